@@ -4,7 +4,14 @@ CREATE TABLE streams(
     source  TEXT NOT NULL,
     units   TEXT NOT NULL,
     brick_uri   TEXT,
-    brick_class TEXT
+    brick_class TEXT,
+    -- derived streams are computed at query time from other streams
+    expression  TEXT,
+    expression_query TEXT,
+    -- float, int, bool (stored in data as 0 or 1) or string (stored in text_data)
+    value_type  TEXT NOT NULL DEFAULT 'float',
+    -- the states a string stream takes, if it declares them
+    states      TEXT[]
 );
 CREATE UNIQUE INDEX ON streams(source, name);
 
@@ -13,6 +20,8 @@ CREATE TABLE data(
     time        TIMESTAMPTZ,
     stream_id   INTEGER REFERENCES streams(id),
     value       FLOAT NOT NULL,
+    -- bitmask of the quality checks the reading failed (0 if it passed them all)
+    quality     SMALLINT NOT NULL DEFAULT 0,
     PRIMARY KEY(time, stream_id)
 );
 CREATE INDEX ON data (stream_id, time DESC);
@@ -29,9 +38,24 @@ ALTER TABLE  data
 SELECT add_compression_policy('data', INTERVAL '14 days');
 
 CREATE VIEW unified AS
-    SELECT time, value, stream_id, name, source, units, brick_uri, brick_class
+    SELECT time, value, stream_id, name, source, units, brick_uri, brick_class, quality
     FROM data LEFT JOIN streams ON data.stream_id = streams.id;
 
+-- readings of string streams
+CREATE TABLE text_data(
+    time        TIMESTAMPTZ,
+    stream_id   INTEGER REFERENCES streams(id),
+    value       TEXT NOT NULL,
+    quality     SMALLINT NOT NULL DEFAULT 0,
+    PRIMARY KEY(time, stream_id)
+);
+CREATE INDEX ON text_data (stream_id, time DESC);
+SELECT * FROM create_hypertable('text_data', 'time');
+
+CREATE VIEW unified_text AS
+    SELECT time, value, stream_id, name, source, units, brick_uri, brick_class, quality
+    FROM text_data LEFT JOIN streams ON text_data.stream_id = streams.id;
+
 
 -- https://docs.timescale.com/latest/using-timescaledb/continuous-aggregates
 -- use MATERIALIZED for Timescale 2.x
@@ -66,17 +90,236 @@ CREATE TABLE triples(
 );
 CREATE UNIQUE INDEX ON triples(source, origin, time, s, p, o);
 
+-- records each version of the triples for a (source, origin). A version can be empty (e.g. when
+-- all of the triples for an origin are deleted), so the versions are not derivable from 'triples' alone
+CREATE TABLE triple_versions(
+    source TEXT NOT NULL,
+    origin TEXT NOT NULL,
+    time TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY(source, origin, time)
+);
+
 CREATE VIEW latest_triples AS
     WITH lts AS (
         SELECT source, origin, MAX(time) as time
-        FROM triples
+        FROM (SELECT source, origin, time FROM triples
+              UNION SELECT source, origin, time FROM triple_versions) AS versions
         GROUP BY source, origin
     )
     SELECT triples.source, s, p, o
     FROM triples
-    RIGHT JOIN lts USING(source, origin, time);
+    JOIN lts USING(source, origin, time);
+
+-- the triples of a source as of a point in time: for each origin, the latest version at or before that time
+CREATE OR REPLACE FUNCTION triples_as_of(graph TEXT, as_of TIMESTAMPTZ)
+RETURNS TABLE(origin TEXT, s TEXT, p TEXT, o TEXT) AS $$
+    SELECT triples.origin, triples.s, triples.p, triples.o
+    FROM triples
+    JOIN (SELECT versions.source, versions.origin, MAX(versions.time) AS time
+          FROM (SELECT source, origin, time FROM triples
+                UNION SELECT source, origin, time FROM triple_versions) AS versions
+          WHERE versions.time <= as_of AND versions.source = graph
+          GROUP BY versions.source, versions.origin) AS latest
+    ON triples.source = latest.source AND triples.origin = latest.origin AND triples.time = latest.time;
+$$ LANGUAGE SQL STABLE;
+
+-- named sets of SHACL shapes that the graph of a source is validated against
+CREATE TABLE shapes(
+    source TEXT NOT NULL,
+    name TEXT NOT NULL,
+    s TEXT NOT NULL,
+    p TEXT NOT NULL,
+    o TEXT NOT NULL,
+    PRIMARY KEY(source, name, s, p, o)
+);
 
 
+-- registered applications: named SPARQL queries that a site must satisfy and the data the application reads
+CREATE TABLE applications(
+    name TEXT PRIMARY KEY,
+    definition JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    -- the key that registered the application, which (like the admin key) can replace or remove it
+    apikey TEXT NOT NULL
+);
+
+-- cached qualification of each source for each application, computed against the version of the model at model_time
+CREATE TABLE application_sites(
+    application TEXT NOT NULL REFERENCES applications(name) ON DELETE CASCADE,
+    source TEXT NOT NULL,
+    qualified BOOLEAN NOT NULL,
+    counts INTEGER[] NOT NULL,
+    errors TEXT[] NOT NULL,
+    model_time TIMESTAMPTZ NOT NULL,
+    computed_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY(application, source)
+);
+
+-- saved queries, executed through /query?view=<name>
+CREATE TABLE views(
+    name TEXT PRIMARY KEY,
+    definition JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    -- the key that registered the view, which (like the admin key) can replace or remove it; empty for the
+    -- common views the server registers
+    apikey TEXT NOT NULL
+);
+
+-- common views that were removed, which the server does not register again
+CREATE TABLE removed_views(
+    name TEXT PRIMARY KEY
+);
+
+-- timezone, holidays and occupancy schedule of each source
+CREATE TABLE site_calendars(
+    source TEXT PRIMARY KEY,
+    timezone TEXT NOT NULL DEFAULT 'UTC',
+    holidays DATE[] NOT NULL DEFAULT '{}',
+    -- list of {"Days": ["Mon", ...], "Start": "08:00", "End": "18:00"} in the local time of the source
+    schedule JSONB NOT NULL DEFAULT '[]',
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+-- server-side rules that compute an output stream from input streams as readings are inserted
+CREATE TABLE rules(
+    name TEXT PRIMARY KEY,
+    definition JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+-- progress of each rule: the output is computed up to the watermark
+CREATE TABLE rule_state(
+    rule TEXT PRIMARY KEY REFERENCES rules(name) ON DELETE CASCADE,
+    watermark TIMESTAMPTZ NOT NULL,
+    -- ids of the input streams at the last evaluation
+    inputs INTEGER[],
+    last_run TIMESTAMPTZ,
+    last_error TEXT,
+    last_error_at TIMESTAMPTZ,
+    runs BIGINT NOT NULL DEFAULT 0,
+    failures BIGINT NOT NULL DEFAULT 0,
+    readings BIGINT NOT NULL DEFAULT 0
+);
+
+-- alerts on the staleness and thresholds of streams
+CREATE TABLE alerts(
+    name TEXT PRIMARY KEY,
+    definition JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    evaluated_at TIMESTAMPTZ,
+    -- the alert only watches the streams this key can read
+    apikey TEXT NOT NULL
+);
+
+-- current state ('ok', 'pending' or 'firing') of each alert for each of its streams
+CREATE TABLE alert_state(
+    alert TEXT NOT NULL REFERENCES alerts(name) ON DELETE CASCADE,
+    stream_id INTEGER NOT NULL,
+    state TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    value FLOAT,
+    since TIMESTAMPTZ NOT NULL,
+    last_notified TIMESTAMPTZ,
+    PRIMARY KEY(alert, stream_id)
+);
+
+-- changes of state of the alerts
+CREATE TABLE alert_events(
+    alert TEXT NOT NULL REFERENCES alerts(name) ON DELETE CASCADE,
+    stream_id INTEGER NOT NULL,
+    time TIMESTAMPTZ NOT NULL,
+    state TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    value FLOAT
+);
+CREATE INDEX ON alert_events (time DESC, alert);
+
+-- notifications of the alerts that have not been delivered to their webhook yet
+CREATE TABLE alert_outbox(
+    id BIGSERIAL PRIMARY KEY,
+    alert TEXT NOT NULL REFERENCES alerts(name) ON DELETE CASCADE,
+    notification JSONB NOT NULL
+);
+CREATE INDEX ON alert_outbox (alert, id);
+
+-- notifications of an alert (or of every alert if NULL) for a source (or every source if NULL) are not sent
+-- between starts_at and ends_at
+CREATE TABLE alert_silences(
+    id SERIAL PRIMARY KEY,
+    alert TEXT REFERENCES alerts(name) ON DELETE CASCADE,
+    source TEXT,
+    starts_at TIMESTAMPTZ NOT NULL,
+    ends_at TIMESTAMPTZ NOT NULL,
+    comment TEXT NOT NULL DEFAULT ''
+);
+
+-- quality checks of the readings inserted into streams; the most specific policy of a stream applies
+CREATE TABLE quality_policies(
+    name TEXT PRIMARY KEY,
+    source TEXT,
+    stream TEXT,
+    brick_class TEXT,
+    definition JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+-- readings held back by the quality checks until they are released into their streams
+CREATE TABLE quarantine(
+    time        TIMESTAMPTZ,
+    stream_id   INTEGER REFERENCES streams(id),
+    value       FLOAT NOT NULL,
+    quality     SMALLINT NOT NULL,
+    quarantined_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY(time, stream_id)
+);
+
+-- idempotency keys of insertions, with the report of the insertion that used each key first
+CREATE TABLE insert_keys(
+    source TEXT NOT NULL,
+    key TEXT NOT NULL,
+    stream TEXT NOT NULL,
+    report JSONB,
+    created_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY(source, key)
+);
+CREATE INDEX ON insert_keys (created_at);
+
+-- asynchronous insertions of uploaded CSV files, which are spooled to disk until they are processed
+CREATE TABLE ingest_jobs(
+    id TEXT PRIMARY KEY,
+    source TEXT NOT NULL,
+    name TEXT NOT NULL,
+    status TEXT NOT NULL,
+    options JSONB NOT NULL,
+    cancel_requested BOOLEAN NOT NULL DEFAULT FALSE,
+    row_count BIGINT NOT NULL DEFAULT 0,
+    error_rows JSONB,
+    report JSONB,
+    error TEXT,
+    -- the job is processed with the key of the user that submitted it
+    apikey TEXT NOT NULL,
+    path TEXT NOT NULL,
+    -- rows of the upload whose readings are committed: a job that is run again resumes after them
+    resume_offset BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL,
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ
+);
+CREATE INDEX ON ingest_jobs (status, created_at);
+CREATE INDEX ON ingest_jobs (source, created_at);
+
+-- true if a source with this calendar is occupied at time t: during a period of its schedule, except on holidays.
+-- Sources without a calendar or a schedule are always occupied
+CREATE OR REPLACE FUNCTION is_occupied(t TIMESTAMPTZ, tz TEXT, holidays DATE[], schedule JSONB) RETURNS BOOLEAN AS $$
+    SELECT CASE WHEN tz IS NULL OR jsonb_typeof(schedule) <> 'array' OR schedule = '[]'::jsonb THEN TRUE
+           ELSE NOT ((t AT TIME ZONE tz)::date = ANY(holidays))
+                AND EXISTS (SELECT 1 FROM jsonb_array_elements(schedule) AS period
+                            WHERE period->'Days' ? to_char(t AT TIME ZONE tz, 'Dy')
+                              AND (t AT TIME ZONE tz)::time >= (period->>'Start')::time
+                              AND (t AT TIME ZONE tz)::time < (period->>'End')::time)
+           END
+$$ LANGUAGE SQL STABLE;
+
 -- for notification when triples changes
 -- from https://citizen428.net/blog/asynchronous-notifications-in-postgres/access
 CREATE OR REPLACE FUNCTION notify_event() RETURNS TRIGGER AS $$
@@ -104,6 +347,11 @@ CREATE TRIGGER notify_triple_change
 AFTER INSERT OR UPDATE OR DELETE ON triples
   FOR EACH ROW EXECUTE PROCEDURE notify_event();
 
+-- tells the reasoner to reload a source when a new version of one of its origins is written
+CREATE TRIGGER notify_version_change
+AFTER INSERT ON triple_versions
+  FOR EACH ROW EXECUTE PROCEDURE notify_event();
+
 
 -- authorization stuff
 CREATE EXTENSION pgcrypto;
@@ -160,3 +408,16 @@ CREATE OR REPLACE FUNCTION unauthorize_read(to_revoke TEXT) RETURNS VOID AS $$
     DELETE FROM authorizations WHERE apikey = to_revoke AND permission = 'read';
   END;
 $$ LANGUAGE plpgsql;
+
+-- the admin permission covers the settings of every source, such as the quality policies without a source
+CREATE OR REPLACE FUNCTION authorize_admin(key TEXT) RETURNS VOID AS $$
+  BEGIN
+    INSERT INTO authorizations(apikey, source, permission) VALUES (key, '*', 'admin');
+  END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION unauthorize_admin(to_revoke TEXT) RETURNS VOID AS $$
+  BEGIN
+    DELETE FROM authorizations WHERE apikey = to_revoke AND permission = 'admin';
+  END;
+$$ LANGUAGE plpgsql;
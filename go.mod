@@ -6,6 +6,7 @@ require (
 	github.com/apache/arrow/go/arrow v0.0.0-20210920193912-bdb2f74131ef
 	github.com/frankban/quicktest v1.11.3 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
+	github.com/jackc/pgconn v1.10.0
 	github.com/jackc/pgx/v4 v4.13.0
 	github.com/jackc/puddle v1.1.4 // indirect
 	github.com/klauspost/compress v1.13.6 // indirect
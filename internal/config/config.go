@@ -2,14 +2,21 @@ package config
 
 import (
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
 // Config is the top-level configuration struct for mortar
 type Config struct {
 	//GRPC     GRPC
-	HTTP     HTTP
-	Database Database
-	Reasoner Reasoner
+	HTTP       HTTP
+	Database   Database
+	Reasoner   Reasoner
+	Validation Validation
+	Qualify    Qualify
+	Jobs       Jobs
+	Buffer     Buffer
 }
 
 // Database store database configuration information (currently just for postgres)
@@ -26,6 +33,59 @@ type Reasoner struct {
 	Address string
 }
 
+// Validation stores the configuration of SHACL validation
+type Validation struct {
+	// RDF files holding the shapes that every source is validated against
+	ShapeFiles []string
+}
+
+// DefaultQualifyWorkers is the default number of qualify queries evaluated concurrently
+const DefaultQualifyWorkers = 4
+
+// DefaultJobWorkers is the default number of insertion jobs processed concurrently
+const DefaultJobWorkers = 2
+
+// DefaultJobSpoolDir is the default directory uploads are spooled to, relative to the working directory
+const DefaultJobSpoolDir = "spool"
+
+// DefaultJobMaxErrors is the default number of rows of an upload that can fail to be read before its job fails
+const DefaultJobMaxErrors = 100
+
+// JobBatchRows is the number of rows of an upload that its job inserts and commits at a time
+const JobBatchRows = 50000
+
+// DefaultBufferMaxBytes is the default size of the insertions the write buffer holds on disk
+const DefaultBufferMaxBytes = 1 << 30
+
+// BackfillBatchSize is the maximum number of readings a backfill writes in one transaction
+const BackfillBatchSize = 50000
+
+// Qualify stores the configuration of the evaluation of qualify requests
+type Qualify struct {
+	// number of (source, query) pairs evaluated concurrently; DefaultQualifyWorkers if not positive
+	Workers int
+	// maximum time for the evaluation of one query on one source; QualifyTaskTimeout if not positive
+	TaskTimeout time.Duration
+}
+
+// Jobs stores the configuration of the asynchronous insertion of uploads
+type Jobs struct {
+	// directory the uploads are spooled to until they are inserted; DefaultJobSpoolDir if empty. Queued jobs
+	// survive a restart as long as the directory does
+	SpoolDir string
+	// number of jobs processed concurrently; DefaultJobWorkers if not positive
+	Workers int
+}
+
+// Buffer stores the configuration of the write buffer, which holds the insertions received while the database is
+// unavailable
+type Buffer struct {
+	// directory of the buffered insertions; the buffer is disabled if empty
+	Dir string
+	// size of the insertions the buffer holds at most; DefaultBufferMaxBytes if not positive
+	MaxBytes int64
+}
+
 // type GRPC struct {
 // 	ListenAddress string
 // 	Port          string
@@ -58,5 +118,45 @@ func NewFromEnv() *Config {
 		Reasoner: Reasoner{
 			Address: os.Getenv("MORTAR_REASONER_ADDRESS"),
 		},
+		Validation: Validation{
+			ShapeFiles: filepath.SplitList(os.Getenv("MORTAR_SHAPE_FILES")),
+		},
+		Qualify: qualifyFromEnv(),
+		Jobs:    jobsFromEnv(),
+		Buffer:  bufferFromEnv(),
+	}
+}
+
+// qualifyFromEnv reads the qualify configuration; invalid values are ignored in favor of the defaults
+func qualifyFromEnv() Qualify {
+	var cfg Qualify
+	if workers, err := strconv.Atoi(os.Getenv("MORTAR_QUALIFY_WORKERS")); err == nil {
+		cfg.Workers = workers
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("MORTAR_QUALIFY_TIMEOUT")); err == nil {
+		cfg.TaskTimeout = timeout
+	}
+	return cfg
+}
+
+// jobsFromEnv reads the configuration of insertion jobs; invalid values are ignored in favor of the defaults
+func jobsFromEnv() Jobs {
+	cfg := Jobs{
+		SpoolDir: os.Getenv("MORTAR_JOB_SPOOL_DIR"),
+	}
+	if workers, err := strconv.Atoi(os.Getenv("MORTAR_JOB_WORKERS")); err == nil {
+		cfg.Workers = workers
+	}
+	return cfg
+}
+
+// bufferFromEnv reads the configuration of the write buffer; invalid values are ignored in favor of the defaults
+func bufferFromEnv() Buffer {
+	cfg := Buffer{
+		Dir: os.Getenv("MORTAR_BUFFER_DIR"),
+	}
+	if max, err := strconv.ParseInt(os.Getenv("MORTAR_BUFFER_MAX_BYTES"), 10, 64); err == nil {
+		cfg.MaxBytes = max
 	}
+	return cfg
 }
@@ -9,3 +9,48 @@ const DataReadTimeout = time.Duration(15 * time.Minute)
 
 // DataWriteTimeout is the maximum allowed time for a data insertion to take before it is cancelled
 const DataWriteTimeout = time.Duration(30 * time.Minute)
+
+// QualifyTaskTimeout is the default maximum time for the evaluation of one qualify query on one source
+const QualifyTaskTimeout = time.Duration(2 * time.Minute)
+
+// RuleEvaluationTimeout is the maximum time for one evaluation of a rule
+const RuleEvaluationTimeout = time.Duration(5 * time.Minute)
+
+// RuleSweepInterval is how often every rule is evaluated, even if none of its inputs received readings
+const RuleSweepInterval = time.Duration(1 * time.Minute)
+
+// RuleDebounceInterval is how long the rule engine collects insertions before evaluating the affected rules
+const RuleDebounceInterval = time.Duration(2 * time.Second)
+
+// AlertEvaluationInterval is how often the alerts are evaluated
+const AlertEvaluationInterval = time.Duration(1 * time.Minute)
+
+// AlertWebhookTimeout is the maximum time for the delivery of notifications to a webhook
+const AlertWebhookTimeout = time.Duration(10 * time.Second)
+
+// IdempotencyKeyRetention is how long the idempotency key of an insertion is remembered
+const IdempotencyKeyRetention = time.Duration(24 * time.Hour)
+
+// BackfillTimeout is the maximum time for a backfill. The compression of the data is postponed by as much while
+// the backfill runs
+const BackfillTimeout = time.Duration(6 * time.Hour)
+
+// JobPollInterval is how often idle job workers look for queued jobs, and finished jobs are expired
+const JobPollInterval = time.Duration(10 * time.Second)
+
+// JobBatchTimeout is the maximum time for a job to insert and commit one batch of the rows of its upload. Jobs are
+// not bounded by the timeout of an insertion: each batch is
+const JobBatchTimeout = time.Duration(10 * time.Minute)
+
+// JobRetention is how long finished jobs are reported
+const JobRetention = time.Duration(7 * 24 * time.Hour)
+
+// DatabasePingTimeout is the maximum time to check whether the database is reachable
+const DatabasePingTimeout = time.Duration(5 * time.Second)
+
+// BufferRetryInterval is how often the write buffer tries to write its insertions while the database is unavailable
+const BufferRetryInterval = time.Duration(10 * time.Second)
+
+// BufferAuthorizationRetention is how long the write buffer accepts insertions into a source with a key after an
+// insertion with that key was authorized to write to the source
+const BufferAuthorizationRetention = time.Duration(24 * time.Hour)
@@ -0,0 +1,449 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// RunAlerts evaluates the registered alerts every AlertEvaluationInterval until the context is cancelled
+func (db *TimescaleDatabase) RunAlerts(ctx context.Context) error {
+	log := logging.FromContext(ctx)
+	ticker := time.NewTicker(config.AlertEvaluationInterval)
+	defer ticker.Stop()
+	for {
+		alerts, err := db.Alerts(ctx)
+		if err != nil {
+			log.Errorf("Could not list alerts: %s", err)
+		}
+		for idx := range alerts {
+			if err := db.evaluateAlert(ctx, &alerts[idx]); err != nil {
+				log.Warnf("Could not evaluate alert %s: %s", alerts[idx].Name, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// evaluateAlert updates the state of the alert for each of its streams, records the changes of state and the
+// notifications that are due, then delivers the pending notifications to the webhook of the alert. The alert is
+// locked while it is evaluated, and is not evaluated again before the next interval, so that several servers can
+// evaluate the alerts
+func (db *TimescaleDatabase) evaluateAlert(ctx context.Context, alert *Alert) error {
+	ctx, cancel := context.WithTimeout(ctx, config.AlertEvaluationInterval)
+	defer cancel()
+
+	cfg, err := alert.parse()
+	if err != nil {
+		return err
+	}
+	var evaluated bool
+	err = db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		var now time.Time
+		row := txn.QueryRow(ctx, `SELECT now() FROM alerts WHERE name = $1 AND (evaluated_at IS NULL OR evaluated_at < $2)
+								  FOR UPDATE SKIP LOCKED`, alert.Name, time.Now().Add(-config.AlertEvaluationInterval/2))
+		if err := row.Scan(&now); errors.Is(err, pgx.ErrNoRows) {
+			// evaluated by another server, or deleted
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Could not lock alert: %w", err)
+		}
+		evaluated = true
+
+		streams, err := db.alertStreams(ctx, alert)
+		if err != nil {
+			return err
+		}
+		conditions, err := db.alertConditions(ctx, txn, cfg, alert, streams, now)
+		if err != nil {
+			return err
+		}
+		states, err := readAlertStates(ctx, txn, alert.Name)
+		if err != nil {
+			return err
+		}
+		silenced, err := silencedSources(ctx, txn, alert.Name, now)
+		if err != nil {
+			return err
+		}
+
+		for _, stream := range streams {
+			state, ok := states[stream.id]
+			if !ok {
+				state = AlertState{State: AlertOK, Since: now}
+			}
+			condition := conditions[stream.id]
+			next, notification := cfg.transition(state, condition.reason, now)
+			next.Value = condition.value
+			if next.State != state.State {
+				if _, err := txn.Exec(ctx, `INSERT INTO alert_events(alert, stream_id, time, state, reason, value) VALUES($1, $2, $3, $4, $5, $6)`,
+					alert.Name, stream.id, now, next.State, next.Reason, next.Value); err != nil {
+					return fmt.Errorf("Could not record change of state: %w", err)
+				}
+			}
+			if len(notification) > 0 && !silenced[""] && !silenced[stream.SourceName] {
+				// resolutions refer to the episode of the alert that they end
+				episode := next
+				if notification == AlertResolved {
+					episode = state
+				} else {
+					next.LastNotified = &now
+				}
+				if err := recordNotification(ctx, txn, AlertNotification{
+					Key:         fmt.Sprintf("%s/%d/%s", alert.Name, stream.id, episode.Since.UTC().Format(time.RFC3339)),
+					Alert:       alert.Name,
+					Description: alert.Description,
+					State:       notification,
+					Reason:      episode.Reason,
+					StreamId:    stream.id,
+					Source:      stream.SourceName,
+					Name:        stream.Name,
+					BrickURI:    stream.BrickURI,
+					Value:       next.Value,
+					Since:       episode.Since,
+					Time:        now,
+				}); err != nil {
+					return err
+				}
+			}
+			if _, err := txn.Exec(ctx, `INSERT INTO alert_state(alert, stream_id, state, reason, value, since, last_notified)
+										VALUES($1, $2, $3, $4, $5, $6, $7)
+										ON CONFLICT (alert, stream_id) DO UPDATE
+										SET state = EXCLUDED.state, reason = EXCLUDED.reason, value = EXCLUDED.value,
+											since = EXCLUDED.since, last_notified = EXCLUDED.last_notified`,
+				alert.Name, stream.id, next.State, next.Reason, next.Value, next.Since, next.LastNotified); err != nil {
+				return fmt.Errorf("Could not update state of alert: %w", err)
+			}
+		}
+
+		// streams that are no longer selected by the alert
+		ids := []int64{}
+		for _, stream := range streams {
+			ids = append(ids, int64(stream.id))
+		}
+		if _, err := txn.Exec(ctx, `DELETE FROM alert_state WHERE alert = $1 AND NOT (stream_id = ANY($2))`, alert.Name, ids); err != nil {
+			return fmt.Errorf("Could not update state of alert: %w", err)
+		}
+
+		_, err = txn.Exec(ctx, `UPDATE alerts SET evaluated_at = $2 WHERE name = $1`, alert.Name, now)
+		return err
+	})
+	if err != nil || !evaluated {
+		return err
+	}
+	// notifications that could not be delivered stay in the outbox and are sent again at the next evaluation
+	return db.deliverOutbox(ctx, alert)
+}
+
+// recordNotification adds the notification to the outbox of its alert
+func recordNotification(ctx context.Context, txn pgx.Tx, notification AlertNotification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("Could not serialize notification: %w", err)
+	}
+	if _, err := txn.Exec(ctx, `INSERT INTO alert_outbox(alert, notification) VALUES($1, $2)`, notification.Alert, body); err != nil {
+		return fmt.Errorf("Could not record notification: %w", err)
+	}
+	return nil
+}
+
+// deliverOutbox POSTs the pending notifications of the alert to its webhook, and removes them from the outbox
+// once the webhook has accepted them. The outbox is not locked during delivery, so a notification may be
+// delivered more than once; receivers deduplicate them with their Key
+func (db *TimescaleDatabase) deliverOutbox(ctx context.Context, alert *Alert) error {
+	rows, err := db.pool.Query(ctx, `SELECT id, notification FROM alert_outbox WHERE alert = $1 ORDER BY id`, alert.Name)
+	if err != nil {
+		return fmt.Errorf("Could not read notifications: %w", err)
+	}
+	var (
+		ids           []int64
+		notifications []AlertNotification
+	)
+	for rows.Next() {
+		var (
+			id           int64
+			body         []byte
+			notification AlertNotification
+		)
+		if err := rows.Scan(&id, &body); err != nil {
+			rows.Close()
+			return fmt.Errorf("Could not scan row: %w", err)
+		}
+		if err := json.Unmarshal(body, &notification); err != nil {
+			rows.Close()
+			return fmt.Errorf("Could not parse notification: %w", err)
+		}
+		ids = append(ids, id)
+		notifications = append(notifications, notification)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Could not read notifications: %w", err)
+	}
+	if len(notifications) == 0 {
+		return nil
+	}
+
+	if err := deliverNotifications(ctx, alert.Webhook, notifications); err != nil {
+		logging.FromContext(ctx).Warnf("Could not notify %s for alert %s: %s", alert.Webhook, alert.Name, err)
+		return nil
+	}
+	if _, err := db.pool.Exec(ctx, `DELETE FROM alert_outbox WHERE id = ANY($1)`, ids); err != nil {
+		return fmt.Errorf("Could not remove delivered notifications: %w", err)
+	}
+	return nil
+}
+
+// transition returns the next state of an alert for a stream, given the reason the condition of the alert
+// holds (empty if it does not), and the state of the notification that is due ("firing", "resolved" or empty)
+func (cfg *alertConfig) transition(state AlertState, reason string, now time.Time) (AlertState, string) {
+	next := state
+	next.Reason = reason
+	if len(reason) == 0 {
+		next.State, next.LastNotified = AlertOK, nil
+		if state.State != AlertOK {
+			next.Since = now
+		}
+		// resolutions are only notified if the alert was
+		if state.State == AlertFiring && state.LastNotified != nil {
+			return next, AlertResolved
+		}
+		return next, ""
+	}
+	if next.State == AlertOK {
+		next.State, next.Since = AlertPending, now
+	}
+	if next.State == AlertPending && now.Sub(next.Since) >= cfg.wait {
+		next.State, next.Since, next.LastNotified = AlertFiring, now, nil
+	}
+	if next.State == AlertFiring && (next.LastNotified == nil || (cfg.repeat > 0 && now.Sub(*next.LastNotified) >= cfg.repeat)) {
+		return next, AlertFiring
+	}
+	return next, ""
+}
+
+// alertCondition is the evaluation of the condition of an alert for a stream
+type alertCondition struct {
+	// empty if the condition does not hold
+	reason string
+	value  *float64
+}
+
+// alertStreamIds returns the ids of the streams selected by the alert
+func (db *TimescaleDatabase) alertStreamIds(ctx context.Context, alert *Alert) ([]int64, error) {
+	ids := append([]int64{}, alert.Ids...)
+	if len(alert.Uris) > 0 {
+		uriIds, err := db.streamIdsOfUris(ctx, alert.Uris, alert.Sites)
+		if err != nil {
+			return nil, fmt.Errorf("Could not resolve streams of alert: %w", err)
+		}
+		ids = append(ids, uriIds...)
+	}
+	if len(alert.Sparql) > 0 {
+		table, err := db.resolveSparqlStreams(ctx, &Query{Sparql: alert.Sparql, Sources: alert.Sites})
+		if err != nil {
+			return nil, fmt.Errorf("Could not resolve streams of alert: %w", err)
+		}
+		for _, row := range table.metadataRows() {
+			ids = append(ids, int64(row.stream.id))
+		}
+	}
+	return ids, nil
+}
+
+// alertStreams returns the stored streams selected by the alert whose source can be read with the key of the
+// user that registered it
+func (db *TimescaleDatabase) alertStreams(ctx context.Context, alert *Alert) ([]Stream, error) {
+	ids, err := db.alertStreamIds(ctx, alert)
+	if err != nil {
+		return nil, err
+	}
+	streams, err := queryStreams(ctx, db.pool, `SELECT id, source, name, units, brick_uri, brick_class, value_type, states FROM streams
+												WHERE id = ANY($1) AND expression IS NULL
+												AND source IN (SELECT source FROM authorizations WHERE apikey = $2 AND permission = 'read')
+												ORDER BY id`, ids, alert.apikey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not resolve streams of alert: %w", err)
+	}
+	return streams, nil
+}
+
+// alertConditions evaluates the condition of the alert for each stream. Staleness is determined from the latest
+// reading of each stream. Thresholds are evaluated over the readings of the window; windows of whole hours are
+// evaluated over the hourly rollups, from the start of the hour the window starts in
+func (db *TimescaleDatabase) alertConditions(ctx context.Context, txn pgx.Tx, cfg *alertConfig, alert *Alert, streams []Stream, now time.Time) (map[int]alertCondition, error) {
+	var ids []int64
+	for _, stream := range streams {
+		ids = append(ids, int64(stream.id))
+	}
+	conditions := make(map[int]alertCondition)
+
+	if alert.Above != nil || alert.Below != nil {
+		var (
+			sql   string
+			start = now.Add(-cfg.window)
+		)
+		if cfg.window%time.Hour == 0 {
+			start = start.Truncate(time.Hour)
+			sql = `SELECT stream_id, ` + cfg.agg.rollupSQL() + ` FROM hourly_summaries
+				   WHERE bucket >= $1 AND stream_id = ANY($2) GROUP BY stream_id`
+		} else {
+			sql = `SELECT stream_id, ` + cfg.agg.toSQL("value") + ` FROM unified
+				   WHERE time > $1 AND stream_id = ANY($2) GROUP BY stream_id`
+		}
+		rows, err := txn.Query(ctx, sql, start, ids)
+		if err != nil {
+			return nil, fmt.Errorf("Could not evaluate thresholds: %w", err)
+		}
+		for rows.Next() {
+			var (
+				id    int
+				value *float64
+			)
+			if err := rows.Scan(&id, &value); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("Could not scan row: %w", err)
+			}
+			if value == nil {
+				continue
+			}
+			condition := alertCondition{value: value}
+			if alert.Above != nil && *value > *alert.Above {
+				condition.reason = "above"
+			} else if alert.Below != nil && *value < *alert.Below {
+				condition.reason = "below"
+			}
+			conditions[id] = condition
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("Could not evaluate thresholds: %w", err)
+		}
+	}
+
+	// staleness takes precedence over thresholds
+	if cfg.staleAfter > 0 {
+		rows, err := txn.Query(ctx, `SELECT id, GREATEST((SELECT MAX(time) FROM data WHERE stream_id = id),
+											  (SELECT MAX(time) FROM text_data WHERE stream_id = id))
+									 FROM unnest($1::bigint[]) AS id`, ids)
+		if err != nil {
+			return nil, fmt.Errorf("Could not evaluate staleness: %w", err)
+		}
+		for rows.Next() {
+			var (
+				id     int
+				latest *time.Time
+			)
+			if err := rows.Scan(&id, &latest); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("Could not scan row: %w", err)
+			}
+			if latest == nil {
+				conditions[id] = alertCondition{reason: "stale"}
+			} else if age := now.Sub(*latest); age > cfg.staleAfter {
+				seconds := age.Seconds()
+				conditions[id] = alertCondition{reason: "stale", value: &seconds}
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("Could not evaluate staleness: %w", err)
+		}
+	}
+	return conditions, nil
+}
+
+// rollupSQL returns the SQL aggregation of the columns of hourly_summaries
+func (agg AggregationType) rollupSQL() string {
+	switch agg {
+	case AggregationMean:
+		return "sum(mean * count) / NULLIF(sum(count), 0)"
+	case AggregationMax:
+		return "max(max)"
+	case AggregationMin:
+		return "min(min)"
+	case AggregationSum:
+		return "sum(mean * count)"
+	case AggregationCount:
+		return "sum(count)::float"
+	}
+	panic("Invalid Aggregation Function")
+}
+
+// readAlertStates returns the stored state of the alert for each stream
+func readAlertStates(ctx context.Context, txn pgx.Tx, name string) (map[int]AlertState, error) {
+	rows, err := txn.Query(ctx, `SELECT stream_id, state, reason, value, since, last_notified FROM alert_state WHERE alert = $1`, name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read state of alert: %w", err)
+	}
+	defer rows.Close()
+	states := make(map[int]AlertState)
+	for rows.Next() {
+		state := AlertState{Alert: name}
+		if err := rows.Scan(&state.StreamId, &state.State, &state.Reason, &state.Value, &state.Since, &state.LastNotified); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		states[state.StreamId] = state
+	}
+	return states, rows.Err()
+}
+
+// silencedSources returns the sources for which the alert is silenced at the given time; "" if it is silenced
+// for every source
+func silencedSources(ctx context.Context, txn pgx.Tx, name string, now time.Time) (map[string]bool, error) {
+	rows, err := txn.Query(ctx, `SELECT COALESCE(source, '') FROM alert_silences
+								 WHERE (alert IS NULL OR alert = $1) AND starts_at <= $2 AND ends_at > $2`, name, now)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read silences: %w", err)
+	}
+	defer rows.Close()
+	silenced := make(map[string]bool)
+	for rows.Next() {
+		var source string
+		if err := rows.Scan(&source); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		silenced[source] = true
+	}
+	return silenced, rows.Err()
+}
+
+// deliverNotifications POSTs the notifications to the webhook as a JSON list
+func deliverNotifications(ctx context.Context, webhook string, notifications []AlertNotification) error {
+	ctx, cancel := context.WithTimeout(ctx, config.AlertWebhookTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(notifications)
+	if err != nil {
+		return fmt.Errorf("Could not serialize notifications: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Could not notify: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Could not notify: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Webhook returned %s: %s", resp.Status, msg)
+	}
+	return nil
+}
@@ -0,0 +1,486 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ErrAlertNotFound is returned when an alert is not registered
+var ErrAlertNotFound = errors.New("Alert not found")
+
+// ErrInvalidAlert is returned when an alert definition is rejected
+var ErrInvalidAlert = errors.New("Invalid alert")
+
+// ErrSilenceNotFound is returned when a silence does not exist
+var ErrSilenceNotFound = errors.New("Silence not found")
+
+// states of an alert for a stream
+const (
+	AlertOK      = "ok"
+	AlertPending = "pending"
+	AlertFiring  = "firing"
+	// the state of the notification sent when a firing alert returns to ok
+	AlertResolved = "resolved"
+)
+
+// Alert watches a selection of streams, which are chosen as in a query: by id, by name or Brick URI, or with
+// a SPARQL query on the Sites. The alert fires for a stream that is stale (no readings in the last StaleAfter)
+// or whose readings cross a threshold (the AggregationFunc of the readings of the last Window is Above or Below
+// the given values). Notifications are POSTed to the Webhook
+type Alert struct {
+	Name        string
+	Description string
+	Ids         []int64
+	Uris        []string
+	Sparql      string
+	Sites       []string
+	// e.g. "15m"
+	StaleAfter string
+	Above      *float64
+	Below      *float64
+	// mean over 5m by default
+	AggregationFunc string
+	Window          string
+	// how long the condition must hold before the alert fires (immediately by default)
+	For     string
+	Webhook string
+	// how often notifications are repeated while the alert fires (never by default)
+	RepeatInterval string
+	// time of the last registration of the alert
+	Updated time.Time
+
+	// the key of the user that registered the alert, whose read permissions determine the streams it watches
+	apikey string
+}
+
+// alertConfig holds the parsed settings of an alert
+type alertConfig struct {
+	staleAfter time.Duration
+	agg        AggregationType
+	window     time.Duration
+	wait       time.Duration
+	repeat     time.Duration
+}
+
+// AlertState is the state of an alert for one of its streams
+type AlertState struct {
+	Alert    string
+	StreamId int
+	Source   string
+	Name     string
+	BrickURI string
+	State    string
+	// "stale", "above" or "below" while the condition holds
+	Reason string
+	// the age of the last reading in seconds (for stale streams), or the aggregated value of the window
+	Value *float64
+	// time of the last change of state
+	Since        time.Time
+	LastNotified *time.Time
+}
+
+// AlertEvent is a change of state of an alert for a stream
+type AlertEvent struct {
+	Alert    string
+	StreamId int
+	Time     time.Time
+	State    string
+	Reason   string
+	Value    *float64
+}
+
+// AlertNotification is POSTed (as a JSON list) to the webhook of an alert when it fires or resolves for a
+// stream. Repeated notifications of the same episode have the same Key
+type AlertNotification struct {
+	Key         string
+	Alert       string
+	Description string
+	// "firing" or "resolved"
+	State    string
+	Reason   string
+	StreamId int
+	Source   string
+	Name     string
+	BrickURI string
+	Value    *float64
+	Since    time.Time
+	Time     time.Time
+}
+
+// Silence suppresses the notifications of an alert (or of every alert, if Alert is empty) for the streams of a
+// source (or of every source) between Start and End. Alerts still change state while silenced; alerts that fire
+// during a silence are notified once it ends
+type Silence struct {
+	Id      int
+	Alert   string
+	Source  string
+	Start   time.Time
+	End     time.Time
+	Comment string
+}
+
+// AlertHistoryRequest asks for the changes of state of an alert (or of every alert) in a time range
+type AlertHistoryRequest struct {
+	Name  string
+	Start time.Time
+	End   time.Time
+}
+
+func (req *AlertHistoryRequest) FromURLParams(vals url.Values) error {
+	var err error
+	req.Name = vals.Get("name")
+	now := time.Now().UTC()
+	req.End = now
+	if _end := vals.Get("end"); len(_end) > 0 {
+		if req.End, err = ParseTime(_end, now); err != nil {
+			return fmt.Errorf("Invalid end time %s: %w", _end, err)
+		}
+	}
+	req.Start = req.End.Add(-24 * time.Hour)
+	if _start := vals.Get("start"); len(_start) > 0 {
+		if req.Start, err = ParseTime(_start, now); err != nil {
+			return fmt.Errorf("Invalid start time %s: %w", _start, err)
+		}
+	}
+	return nil
+}
+
+// parse validates the definition of the alert and returns its settings
+func (alert *Alert) parse() (*alertConfig, error) {
+	cfg := &alertConfig{agg: AggregationMean, window: 5 * time.Minute}
+	switch {
+	case len(alert.Name) == 0:
+		return nil, errors.New("Alert lacks a Name")
+	case len(alert.Ids) == 0 && len(alert.Uris) == 0 && len(alert.Sparql) == 0:
+		return nil, errors.New("Alert needs Ids, Uris or a Sparql query")
+	case len(alert.StaleAfter) == 0 && alert.Above == nil && alert.Below == nil:
+		return nil, errors.New("Alert needs StaleAfter, Above or Below")
+	}
+	if webhook, err := url.Parse(alert.Webhook); err != nil || (webhook.Scheme != "http" && webhook.Scheme != "https") {
+		return nil, fmt.Errorf("Webhook must be a http or https URL: '%s'", alert.Webhook)
+	}
+
+	durations := []struct {
+		name  string
+		expr  string
+		value *time.Duration
+	}{
+		{"StaleAfter", alert.StaleAfter, &cfg.staleAfter},
+		{"Window", alert.Window, &cfg.window},
+		{"For", alert.For, &cfg.wait},
+		{"RepeatInterval", alert.RepeatInterval, &cfg.repeat},
+	}
+	for _, d := range durations {
+		if len(d.expr) == 0 {
+			continue
+		}
+		value, err := ParseDuration(d.expr)
+		if err != nil || value <= 0 {
+			return nil, fmt.Errorf("Invalid %s %s", d.name, d.expr)
+		}
+		*d.value = value
+	}
+	if len(alert.AggregationFunc) > 0 {
+		agg, err := ParseAggregationType(alert.AggregationFunc)
+		if err != nil {
+			return nil, err
+		} else if agg.isState() {
+			return nil, fmt.Errorf("AggregationFunc %s cannot be a threshold", alert.AggregationFunc)
+		}
+		cfg.agg = agg
+	}
+	return cfg, nil
+}
+
+// PutAlert registers the alert, replacing any alert with the same name (see checkAlertAuth). The user needs the
+// read permission on the source of every stream the alert selects. The state of the alert is kept
+func (db *TimescaleDatabase) PutAlert(ctx context.Context, alert *Alert) error {
+	if _, err := alert.parse(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidAlert, err)
+	}
+	if existing, err := db.GetAlert(ctx, alert.Name); err == nil {
+		if err := db.checkAlertAuth(ctx, existing); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, ErrAlertNotFound) {
+		return err
+	}
+	ids, err := db.alertStreamIds(ctx, alert)
+	if err != nil {
+		return err
+	}
+	sources, err := db.streamSources(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, source := range sources {
+		if authorized, err := db.checkAuth(ctx, "read", source); err != nil {
+			return fmt.Errorf("Cannot determine authorized status: %w", err)
+		} else if !authorized {
+			return fmt.Errorf("Cannot read from source: %s", source)
+		}
+	}
+
+	alert.Updated = time.Now()
+	alert.apikey, _ = ctx.Value(ContextKey("user")).(string)
+	definition, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("Could not serialize alert: %w", err)
+	}
+	_, err = db.pool.Exec(ctx, `INSERT INTO alerts(name, definition, updated_at, apikey) VALUES($1, $2, $3, $4)
+								ON CONFLICT (name) DO UPDATE
+								SET definition = EXCLUDED.definition, updated_at = EXCLUDED.updated_at, apikey = EXCLUDED.apikey`,
+		alert.Name, definition, alert.Updated, alert.apikey)
+	if err != nil {
+		return fmt.Errorf("Could not store alert %s: %w", alert.Name, err)
+	}
+	return nil
+}
+
+// checkAlertAuth checks that the user can replace or remove the alert: the user registered it, has the write
+// permission on the source of every stream it selects, or has the admin permission
+func (db *TimescaleDatabase) checkAlertAuth(ctx context.Context, alert *Alert) error {
+	if apikey, _ := ctx.Value(ContextKey("user")).(string); len(apikey) > 0 && apikey == alert.apikey {
+		return nil
+	}
+	if authorized, err := db.checkAuth(ctx, "admin", adminSource); err != nil {
+		return fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if authorized {
+		return nil
+	}
+	ids, err := db.alertStreamIds(ctx, alert)
+	if err != nil {
+		return err
+	}
+	sources, err := db.streamSources(ctx, ids)
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("Cannot manage alert %s without the admin permission", alert.Name)
+	}
+	for _, source := range sources {
+		if authorized, err := db.checkAuth(ctx, "write", source); err != nil {
+			return fmt.Errorf("Cannot determine authorized status: %w", err)
+		} else if !authorized {
+			return fmt.Errorf("Cannot write to source: %s", source)
+		}
+	}
+	return nil
+}
+
+// checkSilenceAuth checks that the user can add or remove a silence for the source: silences of a source need
+// the write permission on it; silences of every source need the admin permission
+func (db *TimescaleDatabase) checkSilenceAuth(ctx context.Context, source string) error {
+	if len(source) > 0 {
+		if authorized, err := db.checkAuth(ctx, "write", source); err != nil {
+			return fmt.Errorf("Cannot determine authorized status: %w", err)
+		} else if authorized {
+			return nil
+		}
+	}
+	if authorized, err := db.checkAuth(ctx, "admin", adminSource); err != nil {
+		return fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		if len(source) > 0 {
+			return fmt.Errorf("Cannot write to source: %s", source)
+		}
+		return fmt.Errorf("Cannot silence alerts for every source without the admin permission")
+	}
+	return nil
+}
+
+// streamSources returns the distinct sources of the streams
+func (db *TimescaleDatabase) streamSources(ctx context.Context, ids []int64) ([]string, error) {
+	rows, err := db.pool.Query(ctx, `SELECT DISTINCT source FROM streams WHERE id = ANY($1) ORDER BY source`, ids)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read sources of streams: %w", err)
+	}
+	defer rows.Close()
+	var sources []string
+	for rows.Next() {
+		var source string
+		if err := rows.Scan(&source); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		sources = append(sources, source)
+	}
+	return sources, rows.Err()
+}
+
+// Alerts lists the registered alerts, ordered by name
+func (db *TimescaleDatabase) Alerts(ctx context.Context) ([]Alert, error) {
+	rows, err := db.pool.Query(ctx, `SELECT definition, apikey FROM alerts ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list alerts: %w", err)
+	}
+	defer rows.Close()
+	var alerts []Alert
+	for rows.Next() {
+		var (
+			definition []byte
+			alert      Alert
+		)
+		if err := rows.Scan(&definition, &alert.apikey); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		if err := json.Unmarshal(definition, &alert); err != nil {
+			return nil, fmt.Errorf("Could not read alert: %w", err)
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts, rows.Err()
+}
+
+// GetAlert returns the registered alert with the given name
+func (db *TimescaleDatabase) GetAlert(ctx context.Context, name string) (*Alert, error) {
+	var (
+		definition []byte
+		alert      Alert
+	)
+	row := db.pool.QueryRow(ctx, `SELECT definition, apikey FROM alerts WHERE name = $1`, name)
+	if err := row.Scan(&definition, &alert.apikey); errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrAlertNotFound, name)
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not read alert %s: %w", name, err)
+	}
+	if err := json.Unmarshal(definition, &alert); err != nil {
+		return nil, fmt.Errorf("Could not read alert %s: %w", name, err)
+	}
+	return &alert, nil
+}
+
+// DeleteAlert removes the alert along with its state and history (see checkAlertAuth)
+func (db *TimescaleDatabase) DeleteAlert(ctx context.Context, name string) error {
+	alert, err := db.GetAlert(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := db.checkAlertAuth(ctx, alert); err != nil {
+		return err
+	}
+	tag, err := db.pool.Exec(ctx, `DELETE FROM alerts WHERE name = $1`, name)
+	if err != nil {
+		return fmt.Errorf("Could not delete alert %s: %w", name, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s", ErrAlertNotFound, name)
+	}
+	return nil
+}
+
+// AlertStates returns the state of every alert (or of the named alert) for each of its streams. Unless all is
+// true, streams in the ok state are omitted
+func (db *TimescaleDatabase) AlertStates(ctx context.Context, name string, all bool) ([]AlertState, error) {
+	rows, err := db.pool.Query(ctx, `SELECT alert, stream_id, streams.source, streams.name, COALESCE(streams.brick_uri, ''),
+											state, reason, value, since, last_notified
+									 FROM alert_state JOIN streams ON streams.id = alert_state.stream_id
+									 WHERE ($1 = '' OR alert = $1) AND ($2 OR state <> 'ok')
+									 ORDER BY alert, stream_id`, name, all)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read state of alerts: %w", err)
+	}
+	defer rows.Close()
+	var states []AlertState
+	for rows.Next() {
+		var state AlertState
+		if err := rows.Scan(&state.Alert, &state.StreamId, &state.Source, &state.Name, &state.BrickURI,
+			&state.State, &state.Reason, &state.Value, &state.Since, &state.LastNotified); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		states = append(states, state)
+	}
+	return states, rows.Err()
+}
+
+// AlertHistory returns the changes of state of the alerts in the range of the request, most recent first
+func (db *TimescaleDatabase) AlertHistory(ctx context.Context, req *AlertHistoryRequest) ([]AlertEvent, error) {
+	rows, err := db.pool.Query(ctx, `SELECT alert, stream_id, time, state, reason, value FROM alert_events
+									 WHERE ($1 = '' OR alert = $1) AND time >= $2 AND time <= $3
+									 ORDER BY time DESC, alert, stream_id`, req.Name, req.Start, req.End)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read history of alerts: %w", err)
+	}
+	defer rows.Close()
+	var events []AlertEvent
+	for rows.Next() {
+		var event AlertEvent
+		if err := rows.Scan(&event.Alert, &event.StreamId, &event.Time, &event.State, &event.Reason, &event.Value); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// Silences lists the silences that have not ended
+func (db *TimescaleDatabase) Silences(ctx context.Context) ([]Silence, error) {
+	rows, err := db.pool.Query(ctx, `SELECT id, COALESCE(alert, ''), COALESCE(source, ''), starts_at, ends_at, comment
+									 FROM alert_silences WHERE ends_at > now() ORDER BY starts_at, id`)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list silences: %w", err)
+	}
+	defer rows.Close()
+	var silences []Silence
+	for rows.Next() {
+		var silence Silence
+		if err := rows.Scan(&silence.Id, &silence.Alert, &silence.Source, &silence.Start, &silence.End, &silence.Comment); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		silences = append(silences, silence)
+	}
+	return silences, rows.Err()
+}
+
+// AddSilence stores the silence and sets its Id (see checkSilenceAuth). A silence without a Start starts now
+func (db *TimescaleDatabase) AddSilence(ctx context.Context, silence *Silence) error {
+	if err := db.checkSilenceAuth(ctx, silence.Source); err != nil {
+		return err
+	}
+	if silence.Start.IsZero() {
+		silence.Start = time.Now()
+	}
+	if !silence.End.After(silence.Start) {
+		return fmt.Errorf("%w: silence ends before it starts", ErrInvalidAlert)
+	}
+	if len(silence.Alert) > 0 {
+		if _, err := db.GetAlert(ctx, silence.Alert); err != nil {
+			return err
+		}
+	}
+	row := db.pool.QueryRow(ctx, `INSERT INTO alert_silences(alert, source, starts_at, ends_at, comment)
+								  VALUES(NULLIF($1, ''), NULLIF($2, ''), $3, $4, $5) RETURNING id`,
+		silence.Alert, silence.Source, silence.Start, silence.End, silence.Comment)
+	if err := row.Scan(&silence.Id); err != nil {
+		return fmt.Errorf("Could not store silence: %w", err)
+	}
+	return nil
+}
+
+// DeleteSilence removes the silence with the given id (see checkSilenceAuth)
+func (db *TimescaleDatabase) DeleteSilence(ctx context.Context, id int) error {
+	var source string
+	row := db.pool.QueryRow(ctx, `SELECT COALESCE(source, '') FROM alert_silences WHERE id = $1`, id)
+	if err := row.Scan(&source); errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%w: %d", ErrSilenceNotFound, id)
+	} else if err != nil {
+		return fmt.Errorf("Could not read silence %d: %w", id, err)
+	}
+	if err := db.checkSilenceAuth(ctx, source); err != nil {
+		return err
+	}
+	tag, err := db.pool.Exec(ctx, `DELETE FROM alert_silences WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("Could not delete silence %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %d", ErrSilenceNotFound, id)
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// ErrApplicationNotFound is returned when a request names an application that is not registered
+var ErrApplicationNotFound = errors.New("Application not found")
+
+// ErrNotQualified is returned when the data of an application is requested for a site that does not qualify for it
+var ErrNotQualified = errors.New("Site does not qualify for the application")
+
+// ErrInvalidApplication is returned when an application definition is rejected
+var ErrInvalidApplication = errors.New("Invalid application")
+
+// ApplicationQuery is a named SPARQL query of an application
+type ApplicationQuery struct {
+	Name   string
+	Sparql string
+}
+
+// Application is a Mortar application registered with the server. A site qualifies for the application if
+// every one of its queries has a solution on the site. The data of the application are the streams of the
+// solutions of DataQuery, read over the data window of the application
+type Application struct {
+	Name        string
+	Description string
+	Queries     []ApplicationQuery
+	// name of the query whose streams the application reads; defaults to the first query
+	DataQuery string
+	// data window: Start and End, or the Window (e.g. "7d" or "1mo") before End. End defaults to now
+	Start  *time.Time
+	End    *time.Time
+	Window string
+	// optional aggregation of the data, as in /query (e.g. "mean" and "15m")
+	AggregationFunc   string
+	AggregationWindow string
+	// time of the last registration of the application
+	Updated time.Time
+}
+
+// check validates the definition of the application
+func (app *Application) check() error {
+	if len(app.Name) == 0 {
+		return errors.New("Application lacks a Name")
+	}
+	if len(app.Queries) == 0 {
+		return errors.New("Application has no Queries")
+	}
+	names := make(map[string]bool)
+	for idx, query := range app.Queries {
+		if len(query.Sparql) == 0 {
+			return fmt.Errorf("Query %d of the application is empty", idx)
+		}
+		if names[query.Name] {
+			return fmt.Errorf("Query name %s is not unique", query.Name)
+		}
+		names[query.Name] = true
+	}
+	if len(app.DataQuery) > 0 && !names[app.DataQuery] {
+		return fmt.Errorf("DataQuery %s is not a query of the application", app.DataQuery)
+	}
+	if len(app.Window) > 0 {
+		if _, err := ParseWindow(app.Window); err != nil {
+			return fmt.Errorf("Invalid Window %s: %w", app.Window, err)
+		}
+	}
+	if len(app.AggregationFunc) > 0 {
+		if _, err := ParseAggregationType(app.AggregationFunc); err != nil {
+			return err
+		}
+		if len(app.AggregationWindow) == 0 {
+			return errors.New("Application has an AggregationFunc but no AggregationWindow")
+		}
+	}
+	if len(app.AggregationWindow) > 0 {
+		if _, err := ParseWindow(app.AggregationWindow); err != nil {
+			return fmt.Errorf("Invalid AggregationWindow %s: %w", app.AggregationWindow, err)
+		}
+	}
+	return nil
+}
+
+// dataQuery builds the query for the data of the application on a site. The start and end of the request
+// override the data window of the application
+func (app *Application) dataQuery(req *ApplicationDataRequest) (*Query, error) {
+	q := &Query{
+		Sparql:  app.Queries[0].Sparql,
+		Sources: []string{req.Source},
+		End:     time.Now(),
+	}
+	for _, query := range app.Queries {
+		if query.Name == app.DataQuery {
+			q.Sparql = query.Sparql
+		}
+	}
+
+	if req.End != nil {
+		q.End = *req.End
+	} else if app.End != nil {
+		q.End = *app.End
+	}
+	if req.Start != nil {
+		q.Start = *req.Start
+	} else if app.Start != nil {
+		q.Start = *app.Start
+	} else if len(app.Window) > 0 {
+		window, err := ParseWindow(app.Window)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Window %s: %w", app.Window, err)
+		}
+		q.Start = window.AddTo(q.End, -1)
+	}
+
+	if len(app.AggregationFunc) > 0 {
+		aggfunc, err := ParseAggregationType(app.AggregationFunc)
+		if err != nil {
+			return nil, err
+		}
+		window, err := ParseWindow(app.AggregationWindow)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid AggregationWindow %s: %w", app.AggregationWindow, err)
+		}
+		q.AggregationFunc = &aggfunc
+		q.AggregationWindow = &window
+	}
+	return q, nil
+}
+
+// ApplicationSite is the qualification of a site for an application. Counts and Errors follow the order
+// of the queries of the application
+type ApplicationSite struct {
+	Source    string
+	Qualified bool
+	// number of solutions of each query
+	Counts []int
+	// the error of each query ("" if it was evaluated)
+	Errors []string
+	// time of the latest version of the model of the site that was qualified, and time of the qualification
+	ModelTime  time.Time
+	ComputedAt time.Time
+}
+
+// PutApplication registers the application, replacing any application with the same name. Only the key that
+// registered an application (or the admin key) can replace it. The cached qualification of the sites is discarded
+func (db *TimescaleDatabase) PutApplication(ctx context.Context, app *Application) error {
+	if err := app.check(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidApplication, err)
+	}
+	apikey, err := db.validApikey(ctx)
+	if err != nil {
+		return err
+	}
+	app.Updated = time.Now()
+	definition, err := json.Marshal(app)
+	if err != nil {
+		return fmt.Errorf("Could not serialize application: %w", err)
+	}
+	return db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		var owner string
+		row := txn.QueryRow(ctx, `SELECT apikey FROM applications WHERE name = $1 FOR UPDATE`, app.Name)
+		if err := row.Scan(&owner); err == nil {
+			if authorized, err := db.checkOwnerAuth(ctx, owner); err != nil {
+				return fmt.Errorf("Cannot determine authorized status: %w", err)
+			} else if !authorized {
+				return fmt.Errorf("Cannot replace application %s registered with another key", app.Name)
+			}
+		} else if !errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("Could not read application %s: %w", app.Name, err)
+		}
+		if _, err := txn.Exec(ctx, `INSERT INTO applications(name, definition, updated_at, apikey) VALUES($1, $2, $3, $4)
+									ON CONFLICT (name) DO UPDATE SET definition = EXCLUDED.definition, updated_at = EXCLUDED.updated_at`,
+			app.Name, definition, app.Updated, apikey); err != nil {
+			return fmt.Errorf("Could not store application %s: %w", app.Name, err)
+		}
+		if _, err := txn.Exec(ctx, `DELETE FROM application_sites WHERE application = $1`, app.Name); err != nil {
+			return fmt.Errorf("Could not clear qualification of %s: %w", app.Name, err)
+		}
+		return nil
+	})
+}
+
+// Applications lists the registered applications, ordered by name
+func (db *TimescaleDatabase) Applications(ctx context.Context) ([]Application, error) {
+	rows, err := db.pool.Query(ctx, `SELECT definition FROM applications ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list applications: %w", err)
+	}
+	defer rows.Close()
+	var apps []Application
+	for rows.Next() {
+		var (
+			definition []byte
+			app        Application
+		)
+		if err := rows.Scan(&definition); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		if err := json.Unmarshal(definition, &app); err != nil {
+			return nil, fmt.Errorf("Could not read application: %w", err)
+		}
+		apps = append(apps, app)
+	}
+	return apps, rows.Err()
+}
+
+// GetApplication returns the registered application with the given name
+func (db *TimescaleDatabase) GetApplication(ctx context.Context, name string) (*Application, error) {
+	var (
+		definition []byte
+		app        Application
+	)
+	row := db.pool.QueryRow(ctx, `SELECT definition FROM applications WHERE name = $1`, name)
+	if err := row.Scan(&definition); errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrApplicationNotFound, name)
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not read application %s: %w", name, err)
+	}
+	if err := json.Unmarshal(definition, &app); err != nil {
+		return nil, fmt.Errorf("Could not read application %s: %w", name, err)
+	}
+	return &app, nil
+}
+
+// DeleteApplication removes the application and its cached qualification. Only the key that registered the
+// application (or the admin key) can remove it
+func (db *TimescaleDatabase) DeleteApplication(ctx context.Context, name string) error {
+	var owner string
+	row := db.pool.QueryRow(ctx, `SELECT apikey FROM applications WHERE name = $1`, name)
+	if err := row.Scan(&owner); errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%w: %s", ErrApplicationNotFound, name)
+	} else if err != nil {
+		return fmt.Errorf("Could not read application %s: %w", name, err)
+	}
+	if authorized, err := db.checkOwnerAuth(ctx, owner); err != nil {
+		return fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return fmt.Errorf("Cannot delete application %s registered with another key", name)
+	}
+	res, err := db.pool.Exec(ctx, `DELETE FROM applications WHERE name = $1`, name)
+	if err != nil {
+		return fmt.Errorf("Could not delete application %s: %w", name, err)
+	}
+	if res.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s", ErrApplicationNotFound, name)
+	}
+	return nil
+}
+
+// ApplicationSites returns the qualification of every site for the application. Qualifications are cached
+// and only recomputed for sites whose model has changed since (or for every site, if req.Refresh is set)
+func (db *TimescaleDatabase) ApplicationSites(ctx context.Context, req *ApplicationSitesRequest) ([]ApplicationSite, error) {
+	app, err := db.GetApplication(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return db.qualifyApplication(ctx, app, req.Sources, req.Refresh)
+}
+
+// ReadApplicationData writes the data of the application on a site to the writer, in the format of ReadDataChunk.
+// Returns ErrNotQualified if the site does not qualify for the application
+func (db *TimescaleDatabase) ReadApplicationData(ctx context.Context, w io.Writer, req *ApplicationDataRequest) error {
+	app, err := db.GetApplication(ctx, req.Name)
+	if err != nil {
+		return err
+	}
+	sites, err := db.qualifyApplication(ctx, app, []string{req.Source}, false)
+	if err != nil {
+		return err
+	}
+	if len(sites) == 0 || !sites[0].Qualified {
+		return fmt.Errorf("%w: %s on %s", ErrNotQualified, app.Name, req.Source)
+	}
+	q, err := app.dataQuery(req)
+	if err != nil {
+		return err
+	}
+	// aggregation windows are aligned to the calendar of the site
+	cal, err := db.SiteCalendar(ctx, req.Source)
+	if err != nil {
+		return err
+	}
+	if q.Location, err = ParseLocation(cal.Timezone); err != nil {
+		return err
+	}
+	return db.ReadDataChunk(ctx, w, q)
+}
+
+// qualifyApplication returns the qualification of the sources (every source, if none are given) for the
+// application, ordered by source. Stale qualifications are recomputed and cached, unless a query failed
+func (db *TimescaleDatabase) qualifyApplication(ctx context.Context, app *Application, sources []string, refresh bool) ([]ApplicationSite, error) {
+	log := logging.FromContext(ctx)
+
+	modelTimes, err := db.modelTimes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read model versions: %w", err)
+	}
+	if len(sources) == 0 {
+		for source := range modelTimes {
+			sources = append(sources, source)
+		}
+	}
+	sort.Strings(sources)
+
+	cached := make(map[string]ApplicationSite)
+	rows, err := db.pool.Query(ctx, `SELECT source, qualified, counts, errors, model_time, computed_at
+									 FROM application_sites WHERE application = $1`, app.Name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read qualification of %s: %w", app.Name, err)
+	}
+	for rows.Next() {
+		var (
+			site   ApplicationSite
+			counts []int32
+		)
+		if err := rows.Scan(&site.Source, &site.Qualified, &counts, &site.Errors, &site.ModelTime, &site.ComputedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		for _, count := range counts {
+			site.Counts = append(site.Counts, int(count))
+		}
+		cached[site.Source] = site
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read qualification of %s: %w", app.Name, err)
+	}
+
+	var stale []string
+	for _, source := range sources {
+		site, ok := cached[source]
+		modelTime, exists := modelTimes[source]
+		if exists && (refresh || !ok || site.ModelTime.Before(modelTime)) {
+			stale = append(stale, source)
+		}
+	}
+
+	if len(stale) > 0 {
+		qualifyReq := &QualifyRequest{Sources: stale}
+		for _, query := range app.Queries {
+			qualifyReq.Queries = append(qualifyReq.Queries, query.Sparql)
+		}
+		results, err := db.Qualify(ctx, qualifyReq, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Could not qualify %s: %w", app.Name, err)
+		}
+		now := time.Now()
+		for _, source := range stale {
+			site := ApplicationSite{
+				Source:     source,
+				Qualified:  true,
+				Counts:     make([]int, len(app.Queries)),
+				Errors:     make([]string, len(app.Queries)),
+				ModelTime:  modelTimes[source],
+				ComputedAt: now,
+			}
+			failed := false
+			for idx := range app.Queries {
+				var result *QualifyResult
+				if len(results[source]) > idx {
+					result = results[source][idx]
+				}
+				switch {
+				case result == nil:
+					site.Errors[idx] = "Query was not evaluated"
+					failed = true
+				case len(result.Error) > 0:
+					site.Errors[idx] = result.Error
+					failed = true
+				default:
+					site.Counts[idx] = result.Count
+				}
+				site.Qualified = site.Qualified && site.Counts[idx] > 0
+			}
+			cached[source] = site
+			if failed {
+				continue
+			}
+			if _, err := db.pool.Exec(ctx, `INSERT INTO application_sites(application, source, qualified, counts, errors, model_time, computed_at)
+											VALUES($1, $2, $3, $4, $5, $6, $7)
+											ON CONFLICT (application, source) DO UPDATE
+											SET qualified = EXCLUDED.qualified, counts = EXCLUDED.counts, errors = EXCLUDED.errors,
+												model_time = EXCLUDED.model_time, computed_at = EXCLUDED.computed_at`,
+				app.Name, source, site.Qualified, site.Counts, site.Errors, site.ModelTime, site.ComputedAt); err != nil {
+				return nil, fmt.Errorf("Could not cache qualification of %s: %w", app.Name, err)
+			}
+		}
+		log.Infof("Qualified %d sites for application %s", len(stale), app.Name)
+	}
+
+	var sites []ApplicationSite
+	for _, source := range sources {
+		if site, ok := cached[source]; ok {
+			if _, exists := modelTimes[source]; exists {
+				sites = append(sites, site)
+			}
+		}
+	}
+	return sites, nil
+}
+
+// modelTimes returns the time of the latest version of the model of each source
+func (db *TimescaleDatabase) modelTimes(ctx context.Context) (map[string]time.Time, error) {
+	rows, err := db.pool.Query(ctx, `SELECT source, MAX(time) FROM
+									 (SELECT source, time FROM triples UNION ALL SELECT source, time FROM triple_versions) AS versions
+									 GROUP BY source`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	times := make(map[string]time.Time)
+	for rows.Next() {
+		var (
+			source string
+			t      time.Time
+		)
+		if err := rows.Scan(&source, &t); err != nil {
+			return nil, err
+		}
+		times[source] = t
+	}
+	return times, rows.Err()
+}
@@ -0,0 +1,319 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/logging"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// ErrInvalidInsertOptions is returned when the options of an insertion cannot be used together
+var ErrInvalidInsertOptions = errors.New("Invalid insert options")
+
+// backfillLock is the advisory lock that serializes backfills
+const backfillLock = 4150591
+
+// BackfillReport reports the outcome of a backfill, and its progress through the chunks of the stream
+type BackfillReport struct {
+	InsertReport
+	// readings staged for the backfill, after their quality checks
+	Staged int64
+	// readings written (or skipped) so far
+	Moved  int64
+	Chunks []BackfillChunk
+}
+
+// BackfillChunk is a chunk of the hypertable of the stream that readings were backfilled into
+type BackfillChunk struct {
+	// the name of the chunk; empty for the readings outside of the existing chunks, which are written to new chunks
+	Chunk string
+	Start time.Time
+	End   time.Time
+	// the chunk was decompressed for the backfill, and compressed again
+	Compressed bool
+	Inserted   int64
+	Updated    int64
+	Skipped    int64
+}
+
+// NeedsBackfill is true if readings between start and end would be written into compressed chunks, which
+// BackfillData writes efficiently
+func (db *TimescaleDatabase) NeedsBackfill(ctx context.Context, start, end time.Time) (bool, error) {
+	var compressed bool
+	row := db.pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM timescaledb_information.chunks
+									WHERE hypertable_name = 'data' AND is_compressed AND range_start <= $2 AND range_end > $1)`, start, end)
+	if err := row.Scan(&compressed); err != nil {
+		return false, fmt.Errorf("Could not read compressed chunks: %w", err)
+	}
+	return compressed, nil
+}
+
+// BackfillData writes the readings of the dataset to its stream like InsertHistoricalData, without holding the
+// readings (and the chunks they are written to) in a single transaction. The readings are checked and staged first;
+// then the compressed chunks they fall in are decompressed one at a time, the readings of the chunk are written in
+// batches of config.BackfillBatchSize readings, and the chunk is compressed again. The compression policy of the
+// hypertable is postponed while the backfill runs. progress (if not nil) is called after each chunk.
+// A failed backfill may have written some of its readings, which are counted by the report it returns along with the
+// error (nil if it wrote none); it can be retried with the same readings and on_conflict=update or ignore
+func (db *TimescaleDatabase) BackfillData(ctx context.Context, ds Dataset, opts InsertOptions, progress func(*BackfillReport)) (*BackfillReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.BackfillTimeout)
+	defer cancel()
+
+	log := logging.FromContext(ctx)
+
+	if err := checkDataset(ds); err != nil {
+		return nil, fmt.Errorf("Cannot handle invalid dataset: %w", err)
+	}
+	if len(opts.IdempotencyKey) > 0 {
+		return nil, fmt.Errorf("%w: backfills do not take idempotency keys (retry with on_conflict=update or ignore)", ErrInvalidInsertOptions)
+	}
+	if authorized, err := db.checkAuth(ctx, "write", ds.GetSource()); err != nil {
+		return nil, fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return nil, fmt.Errorf("Cannot write to source: %s", ds.GetSource())
+	}
+
+	// the staging table is a temporary table of the connection
+	conn, err := db.pool.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Could not acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	// backfills are serialized, so that they do not decompress and compress the same chunks
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, backfillLock); err != nil {
+		return nil, fmt.Errorf("Could not lock backfill: %w", err)
+	}
+	defer func() {
+		if _, err := conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, backfillLock); err != nil {
+			log.Errorf("Could not unlock backfill: %s", err)
+		}
+	}()
+
+	var (
+		report    BackfillReport
+		stream_id int
+		table     string
+	)
+	defer func() {
+		if _, err := conn.Exec(context.Background(), `DROP TABLE IF EXISTS backfill_staging`); err != nil {
+			log.Errorf("Could not drop backfill staging table: %s", err)
+		}
+	}()
+	err = inTransaction(ctx, conn, func(txn pgx.Tx) error {
+		row := txn.QueryRow(ctx, `SELECT id FROM streams WHERE source=$1 AND name=$2`, ds.GetSource(), ds.GetName())
+		if err := row.Scan(&stream_id); err != nil {
+			return fmt.Errorf("No such stream (SourceName: %s, Name: %s): %w", ds.GetSource(), ds.GetName(), err)
+		}
+		report.Staged, table, err = stageReadings(ctx, txn, stream_id, ds, &report.InsertReport)
+		if err != nil {
+			return err
+		}
+		if opts.OnConflict == ConflictError {
+			return checkConflicts(ctx, txn, "backfill_staging", table, stream_id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Staged %d readings for backfill: %s", report.Staged, ds)
+	fail := func(err error) (*BackfillReport, error) {
+		if report.Moved > 0 {
+			return &report, err
+		}
+		return nil, err
+	}
+
+	chunks, err := stagedChunks(ctx, conn, table)
+	if err != nil {
+		return nil, err
+	}
+	for _, chunk := range chunks {
+		if chunk.Compressed {
+			restore, err := postponeCompression(ctx, conn, table)
+			if err != nil {
+				return nil, err
+			}
+			defer restore()
+			break
+		}
+	}
+
+	conflict := conflictClause(table, opts.OnConflict)
+	for _, chunk := range chunks {
+		if chunk.Compressed {
+			if _, err := conn.Exec(ctx, `SELECT decompress_chunk($1::regclass, if_compressed => true)`, chunk.Chunk); err != nil {
+				return fail(fmt.Errorf("Could not decompress chunk %s: %w", chunk.Chunk, err))
+			}
+		}
+		start, end := chunk.Start, chunk.End
+		err := moveStaged(ctx, conn, table, conflict, &start, &end, &chunk)
+		// the chunk is compressed again even if the backfill fails
+		if chunk.Compressed {
+			if _, cerr := conn.Exec(context.Background(), `SELECT compress_chunk($1::regclass, if_not_compressed => true)`, chunk.Chunk); cerr != nil {
+				log.Errorf("Could not compress chunk %s: %s", chunk.Chunk, cerr)
+			}
+		}
+		report.add(chunk)
+		if err != nil {
+			return fail(err)
+		}
+		log.Infof("Backfilled %d of %d readings (chunk %s): %s", report.Moved, report.Staged, chunk.Chunk, ds)
+		if progress != nil {
+			progress(&report)
+		}
+	}
+
+	// the remaining readings are outside of the existing chunks
+	var remaining BackfillChunk
+	row := conn.QueryRow(ctx, `SELECT min(time), max(time) FROM backfill_staging`)
+	var first, last *time.Time
+	if err := row.Scan(&first, &last); err != nil {
+		return fail(fmt.Errorf("Could not read staged readings: %w", err))
+	}
+	if first != nil {
+		remaining.Start, remaining.End = *first, *last
+		err := moveStaged(ctx, conn, table, conflict, nil, nil, &remaining)
+		report.add(remaining)
+		if err != nil {
+			return fail(err)
+		}
+		if progress != nil {
+			progress(&report)
+		}
+	}
+
+	if _, err := conn.Exec(ctx, "SELECT pg_notify('data_inserted', $1)", strconv.Itoa(stream_id)); err != nil {
+		return fail(fmt.Errorf("Cannot notify insertion for id %d: %w", stream_id, err))
+	}
+	log.Infof("Backfilled %5d readings into %d chunks (%d inserted, %d updated, %d skipped, %d flagged, %d quarantined, %d rejected): %s",
+		report.Moved, len(report.Chunks), report.Inserted, report.Updated, report.Skipped, report.Flagged, report.Quarantined, report.Rejected, ds)
+	return &report, nil
+}
+
+func (report *BackfillReport) add(chunk BackfillChunk) {
+	report.Chunks = append(report.Chunks, chunk)
+	report.Inserted += chunk.Inserted
+	report.Updated += chunk.Updated
+	report.Skipped += chunk.Skipped
+	report.Moved += chunk.Inserted + chunk.Updated + chunk.Skipped
+}
+
+// stageReadings checks the readings of the dataset and copies them into the backfill_staging table, which is
+// created for the type of the stream. It returns the number of staged readings and the table they belong to
+func stageReadings(ctx context.Context, txn pgx.Tx, stream_id int, ds Dataset, report *InsertReport) (int64, string, error) {
+	ds.SetId(stream_id)
+	checked, err := newQualityDataset(ctx, txn, stream_id, ds)
+	if err != nil {
+		return 0, "", err
+	}
+	table, valueType := "data", "FLOAT"
+	if checked.typ.typ == ValueString {
+		table, valueType = "text_data", "TEXT"
+	}
+	// the connection may hold the staging table of a backfill that could not drop it
+	_, err = txn.Exec(ctx, "DROP TABLE IF EXISTS backfill_staging; CREATE TEMP TABLE backfill_staging(time TIMESTAMPTZ, stream_id INTEGER, value "+valueType+", quality SMALLINT)")
+	if err != nil {
+		return 0, "", fmt.Errorf("Cannot stage readings for id %d: %w", stream_id, err)
+	}
+	num, err := txn.CopyFrom(ctx, pgx.Identifier{"backfill_staging"}, []string{"time", "stream_id", "value", "quality"}, checked)
+	if err != nil {
+		return 0, "", fmt.Errorf("Cannot stage readings for id %d: %w", stream_id, err)
+	}
+	if _, err := txn.Exec(ctx, "CREATE INDEX ON backfill_staging(time)"); err != nil {
+		return 0, "", fmt.Errorf("Cannot stage readings for id %d: %w", stream_id, err)
+	}
+	if err := checked.quarantine(ctx, txn, stream_id); err != nil {
+		return 0, "", err
+	}
+	report.Flagged, report.Quarantined, report.Rejected = checked.report.Flagged, checked.report.Quarantined, checked.report.Rejected
+	return num, table, nil
+}
+
+// stagedChunks returns the chunks of the table that staged readings fall in, ordered by time
+func stagedChunks(ctx context.Context, conn *pgxpool.Conn, table string) ([]BackfillChunk, error) {
+	rows, err := conn.Query(ctx, `SELECT format('%I.%I', chunk_schema, chunk_name), range_start, range_end, is_compressed
+								  FROM timescaledb_information.chunks AS c
+								  WHERE hypertable_name = $1
+								    AND EXISTS(SELECT 1 FROM backfill_staging WHERE time >= c.range_start AND time < c.range_end)
+								  ORDER BY range_start`, table)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read chunks of %s: %w", table, err)
+	}
+	defer rows.Close()
+	var chunks []BackfillChunk
+	for rows.Next() {
+		var chunk BackfillChunk
+		if err := rows.Scan(&chunk.Chunk, &chunk.Start, &chunk.End, &chunk.Compressed); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
+// moveStaged moves the staged readings between start (inclusive) and end (exclusive) into the table, in batches
+// that are each committed. Nil bounds are open
+func moveStaged(ctx context.Context, conn *pgxpool.Conn, table, conflict string, start, end *time.Time, chunk *BackfillChunk) error {
+	for {
+		var moved, inserted, updated int64
+		row := conn.QueryRow(ctx, `WITH batch AS (
+									DELETE FROM backfill_staging WHERE ctid IN (
+										SELECT ctid FROM backfill_staging
+										WHERE ($1::timestamptz IS NULL OR time >= $1) AND ($2::timestamptz IS NULL OR time < $2)
+										LIMIT $3)
+									RETURNING time, stream_id, value, quality),
+								 written AS (
+									INSERT INTO `+table+`(time, stream_id, value, quality) SELECT time, stream_id, value, quality FROM batch
+									`+conflict+`
+									RETURNING xmax = 0 AS inserted)
+								   SELECT (SELECT count(*) FROM batch), count(*) FILTER (WHERE inserted), count(*) FILTER (WHERE NOT inserted)
+								   FROM written`, start, end, config.BackfillBatchSize)
+		if err := row.Scan(&moved, &inserted, &updated); err != nil {
+			return fmt.Errorf("Could not backfill readings: %w", err)
+		}
+		if moved == 0 {
+			return nil
+		}
+		chunk.Inserted += inserted
+		chunk.Updated += updated
+		chunk.Skipped += moved - inserted - updated
+	}
+}
+
+// postponeCompression postpones the compression policy of the hypertable by config.BackfillTimeout, so that it
+// does not compress the chunks being backfilled, and returns the function that restores its schedule. If the
+// server stops during the backfill, the policy resumes after the timeout
+func postponeCompression(ctx context.Context, conn *pgxpool.Conn, table string) (func(), error) {
+	var (
+		job  int
+		next *time.Time
+	)
+	row := conn.QueryRow(ctx, `SELECT j.job_id, s.next_start FROM timescaledb_information.jobs AS j
+							   LEFT JOIN timescaledb_information.job_stats AS s ON s.job_id = j.job_id
+							   WHERE j.proc_name = 'policy_compression' AND j.hypertable_name = $1`, table)
+	if err := row.Scan(&job, &next); errors.Is(err, pgx.ErrNoRows) {
+		return func() {}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not read compression policy of %s: %w", table, err)
+	}
+	if _, err := conn.Exec(ctx, `SELECT alter_job($1, next_start => $2)`, job, time.Now().Add(config.BackfillTimeout)); err != nil {
+		return nil, fmt.Errorf("Could not postpone compression of %s: %w", table, err)
+	}
+	return func() {
+		restored := time.Now()
+		if next != nil && next.After(restored) {
+			restored = *next
+		}
+		if _, err := conn.Exec(context.Background(), `SELECT alter_job($1, next_start => $2)`, job, restored); err != nil {
+			logging.FromContext(ctx).Errorf("Could not restore compression of %s: %s", table, err)
+		}
+	}, nil
+}
@@ -0,0 +1,277 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/knakk/rdf"
+
+	"github.com/gtfierro/mortar2/internal/config"
+)
+
+// ErrInvalidCalendar is returned when a site calendar is rejected
+var ErrInvalidCalendar = errors.New("Invalid calendar")
+
+// ErrInvalidParams is returned when the parameters of a query are invalid
+var ErrInvalidParams = errors.New("Invalid query parameters")
+
+var (
+	ntBrickTimezone = nt(brickNamespace + "timezone")
+	ntBrickValue    = nt(brickNamespace + "value")
+)
+
+// days of an OccupancyPeriod, as formatted by Postgres' to_char(..., 'Dy')
+var occupancyDays = map[string]bool{"Mon": true, "Tue": true, "Wed": true, "Thu": true, "Fri": true, "Sat": true, "Sun": true}
+
+// OccupancyPeriod is a period of the week during which a site is occupied, in the local time of the site.
+// Start and End are times of day ("08:00", "18:00"; End may be "24:00")
+type OccupancyPeriod struct {
+	Days  []string
+	Start string
+	End   string
+}
+
+// SiteCalendar holds the timezone, holidays and occupancy schedule of a source
+type SiteCalendar struct {
+	Source string
+	// IANA name of the timezone of the site
+	Timezone string
+	// dates (YYYY-MM-DD) on which the site is unoccupied
+	Holidays []string
+	// the site is occupied during these periods, except on holidays. A site without a schedule is always occupied
+	Schedule []OccupancyPeriod
+	// true if the calendar was not set but derived from the model of the source (only its brick:timezone)
+	Derived bool
+	Updated time.Time
+}
+
+// check validates the calendar
+func (cal *SiteCalendar) check() error {
+	if len(cal.Source) == 0 {
+		return errors.New("Calendar lacks a Source")
+	}
+	if len(cal.Timezone) == 0 {
+		cal.Timezone = "UTC"
+	}
+	if _, err := ParseLocation(cal.Timezone); err != nil {
+		return err
+	}
+	for _, holiday := range cal.Holidays {
+		if _, err := time.Parse("2006-01-02", holiday); err != nil {
+			return fmt.Errorf("Invalid holiday %s: must be YYYY-MM-DD", holiday)
+		}
+	}
+	for _, period := range cal.Schedule {
+		if len(period.Days) == 0 {
+			return errors.New("Occupancy period has no Days")
+		}
+		for _, day := range period.Days {
+			if !occupancyDays[day] {
+				return fmt.Errorf("Invalid day %s: must be one of Mon, Tue, Wed, Thu, Fri, Sat, Sun", day)
+			}
+		}
+		start, err := parseTimeOfDay(period.Start)
+		if err != nil {
+			return err
+		}
+		end, err := parseTimeOfDay(period.End)
+		if err != nil {
+			return err
+		}
+		if end <= start {
+			return fmt.Errorf("Occupancy period ends (%s) before it starts (%s)", period.End, period.Start)
+		}
+	}
+	return nil
+}
+
+// parseTimeOfDay parses a time of day between "00:00" and "24:00"
+func parseTimeOfDay(s string) (time.Duration, error) {
+	var hour, minute int
+	if n, err := fmt.Sscanf(s, "%d:%d", &hour, &minute); err != nil || n != 2 || len(s) != 5 ||
+		hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("Invalid time of day %s: must be HH:MM", s)
+	}
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute, nil
+}
+
+// SiteCalendar returns the calendar of the source. If none was set, the calendar is derived from the model
+// of the source
+func (db *TimescaleDatabase) SiteCalendar(ctx context.Context, source string) (*SiteCalendar, error) {
+	calendars, err := db.siteCalendars(ctx, []string{source})
+	if err != nil {
+		return nil, err
+	}
+	return calendars[source], nil
+}
+
+// PutSiteCalendar sets the calendar of a source
+func (db *TimescaleDatabase) PutSiteCalendar(ctx context.Context, cal *SiteCalendar) error {
+	ctx, cancel := context.WithTimeout(ctx, config.DataWriteTimeout)
+	defer cancel()
+
+	if err := cal.check(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidCalendar, err)
+	}
+	if authorized, err := db.checkAuth(ctx, "write", cal.Source); err != nil {
+		return fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return fmt.Errorf("Cannot write to source: %s", cal.Source)
+	}
+
+	cal.Derived = false
+	cal.Updated = time.Now()
+	if cal.Holidays == nil {
+		cal.Holidays = []string{}
+	}
+	if cal.Schedule == nil {
+		cal.Schedule = []OccupancyPeriod{}
+	}
+	schedule, err := json.Marshal(cal.Schedule)
+	if err != nil {
+		return fmt.Errorf("Could not serialize schedule: %w", err)
+	}
+	if _, err := db.pool.Exec(ctx, `INSERT INTO site_calendars(source, timezone, holidays, schedule, updated_at)
+									VALUES($1, $2, $3::text[]::date[], $4, $5)
+									ON CONFLICT (source) DO UPDATE SET timezone = EXCLUDED.timezone, holidays = EXCLUDED.holidays,
+									schedule = EXCLUDED.schedule, updated_at = EXCLUDED.updated_at`,
+		cal.Source, cal.Timezone, cal.Holidays, schedule, cal.Updated); err != nil {
+		return fmt.Errorf("Could not store calendar of %s: %w", cal.Source, err)
+	}
+	return nil
+}
+
+// DeleteSiteCalendar removes the calendar of a source, which is then derived from its model again
+func (db *TimescaleDatabase) DeleteSiteCalendar(ctx context.Context, source string) error {
+	if authorized, err := db.checkAuth(ctx, "write", source); err != nil {
+		return fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return fmt.Errorf("Cannot write to source: %s", source)
+	}
+	if _, err := db.pool.Exec(ctx, `DELETE FROM site_calendars WHERE source = $1`, source); err != nil {
+		return fmt.Errorf("Could not delete calendar of %s: %w", source, err)
+	}
+	return nil
+}
+
+// siteCalendars returns the calendars of the sources: the calendar that was set for a source, or one with the
+// brick:timezone of its model (a literal, or the brick:value of an entity). Sources with neither are in UTC
+func (db *TimescaleDatabase) siteCalendars(ctx context.Context, sources []string) (map[string]*SiteCalendar, error) {
+	calendars := make(map[string]*SiteCalendar)
+	rows, err := db.pool.Query(ctx, `SELECT source, timezone, holidays::text[], schedule, updated_at FROM site_calendars
+									 WHERE source = ANY($1)`, sources)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read calendars: %w", err)
+	}
+	for rows.Next() {
+		var (
+			cal      SiteCalendar
+			schedule []byte
+		)
+		if err := rows.Scan(&cal.Source, &cal.Timezone, &cal.Holidays, &schedule, &cal.Updated); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		if len(schedule) > 0 {
+			if err := json.Unmarshal(schedule, &cal.Schedule); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("Could not read schedule of %s: %w", cal.Source, err)
+			}
+		}
+		calendars[cal.Source] = &cal
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read calendars: %w", err)
+	}
+
+	var derive []string
+	for _, source := range sources {
+		if _, ok := calendars[source]; !ok {
+			calendars[source] = &SiteCalendar{Source: source, Timezone: "UTC", Derived: true}
+			derive = append(derive, source)
+		}
+	}
+	if len(derive) == 0 {
+		return calendars, nil
+	}
+	rows, err = db.pool.Query(ctx, `SELECT tz.source, tz.o, val.o FROM latest_triples AS tz
+									LEFT JOIN latest_triples AS val ON val.source = tz.source AND val.s = tz.o AND val.p = $3
+									WHERE tz.source = ANY($1) AND tz.p = $2`, derive, ntBrickTimezone, ntBrickValue)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read timezones: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			source, object string
+			value          *string
+		)
+		if err := rows.Scan(&source, &object, &value); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		t, err := parseTerm(object)
+		if err == nil && t.kind != rdf.TermLiteral && value != nil {
+			t, err = parseTerm(*value)
+		}
+		if err != nil || t.kind != rdf.TermLiteral {
+			continue
+		}
+		if _, err := ParseLocation(t.value); err == nil {
+			calendars[source].Timezone = t.value
+		}
+	}
+	return calendars, rows.Err()
+}
+
+// withSiteTimezone sets the 'tz' parameter of a query to the timezone of its sites, if it is not given
+// and every site has the same timezone
+func (db *TimescaleDatabase) withSiteTimezone(ctx context.Context, vals url.Values) (url.Values, error) {
+	sites := vals["sites"]
+	if len(vals.Get("tz")) > 0 || len(sites) == 0 {
+		return vals, nil
+	}
+	calendars, err := db.siteCalendars(ctx, sites)
+	if err != nil {
+		return nil, err
+	}
+	tz := calendars[sites[0]].Timezone
+	for _, site := range sites {
+		if calendars[site].Timezone != tz {
+			return vals, nil
+		}
+	}
+	params := make(url.Values)
+	for key, values := range vals {
+		params[key] = values
+	}
+	params.Set("tz", tz)
+	return params, nil
+}
+
+// ParseQuery builds a query from the URL parameters of /query. The 'view' parameter names a view to run,
+// and the timezone of the query defaults to the timezone of its sites
+func (db *TimescaleDatabase) ParseQuery(ctx context.Context, vals url.Values) (*Query, error) {
+	if name := vals.Get("view"); len(name) > 0 {
+		view, err := db.GetView(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if vals, err = view.params(vals); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidView, err)
+		}
+	}
+	vals, err := db.withSiteTimezone(ctx, vals)
+	if err != nil {
+		return nil, err
+	}
+	var q Query
+	if err := q.FromURLParams(vals); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidParams, err)
+	}
+	return &q, nil
+}
@@ -52,6 +52,28 @@ func checkStream(s *Stream) error {
 		}
 	}
 
+	// validate Type and States
+	switch s.Type {
+	case "", ValueFloat, ValueInt, ValueBool, ValueString:
+	default:
+		return fmt.Errorf("Type '%s' is not one of float, int, bool or string", s.Type)
+	}
+	if len(s.States) > 0 && s.Type != ValueString {
+		return errors.New("Only string streams have States")
+	}
+	seen := make(map[string]bool)
+	for _, state := range s.States {
+		if len(state) == 0 {
+			return errors.New("States cannot be empty")
+		} else if seen[state] {
+			return fmt.Errorf("State '%s' is repeated", state)
+		}
+		seen[state] = true
+	}
+	if len(s.Expression) > 0 && s.Type != "" && s.Type != ValueFloat {
+		return errors.New("Derived streams are float streams")
+	}
+
 	return nil
 }
 
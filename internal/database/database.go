@@ -3,18 +3,23 @@ package database
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
-	"github.com/knakk/rdf"
 	"github.com/knakk/sparql"
 
 	"github.com/pierrec/lz4"
@@ -30,26 +35,91 @@ import (
 	"github.com/gtfierro/mortar2/internal/logging"
 )
 
-// TODO: updating Brick model should update types in the 'stream' table
-
 // Database defines the interface to the underlying data store
 type Database interface {
 	Close()
+	Ping(context.Context) error
 	RunAsTransaction(context.Context, func(txn pgx.Tx) error) error
 	RegisterStream(context.Context, Stream) error
-	InsertHistoricalData(ctx context.Context, ds Dataset) error
+	InsertHistoricalData(ctx context.Context, ds Dataset, opts InsertOptions) (*InsertReport, error)
+	BackfillData(ctx context.Context, ds Dataset, opts InsertOptions, progress func(*BackfillReport)) (*BackfillReport, error)
+	NeedsBackfill(ctx context.Context, start, end time.Time) (bool, error)
 	ReadDataChunk(context.Context, io.Writer, *Query) error
 	QuerySparqlWriter(context.Context, io.Writer, string, string) error
 	QuerySparql(context.Context, string, string) (*sparql.Results, error)
+	QuerySparqlProtocol(context.Context, *SparqlProtocolRequest) (*SparqlResponse, error)
 	GetGraph(context.Context, *ModelRequest, io.Writer) error
-	Qualify(context.Context, []string) (map[string][]int, error)
-	AddTriples(context.Context, TripleDataset) error
+	Qualify(context.Context, *QualifyRequest, func(QualifyProgress)) (map[string][]*QualifyResult, error)
+	AddTriples(context.Context, TripleDataset, ValidationMode) (int64, *ValidationReport, error)
+	EditGraph(context.Context, string, []GraphEdit) error
+	GraphVersions(context.Context, string) ([]GraphVersion, error)
+	DiffGraph(context.Context, *DiffRequest) (*GraphDiff, error)
+	RollbackGraph(context.Context, *RollbackRequest) error
+	ValidateGraph(context.Context, *ValidationRequest) (*ValidationReport, error)
+	ShapeSets(context.Context, string) ([]ShapeSet, error)
+	PutShapes(context.Context, string, string, []Triple) error
+	UpdateSparql(context.Context, *SparqlUpdateRequest) error
+	Reconcile(context.Context, *ReconcileRequest) (*ReconcileReport, error)
+	PutApplication(context.Context, *Application) error
+	Applications(context.Context) ([]Application, error)
+	GetApplication(context.Context, string) (*Application, error)
+	DeleteApplication(context.Context, string) error
+	ApplicationSites(context.Context, *ApplicationSitesRequest) ([]ApplicationSite, error)
+	ReadApplicationData(context.Context, io.Writer, *ApplicationDataRequest) error
+	PutView(context.Context, *View) error
+	Views(context.Context) ([]View, error)
+	GetView(context.Context, string) (*View, error)
+	DeleteView(context.Context, string) error
+	ParseQuery(context.Context, url.Values) (*Query, error)
+	SiteCalendar(context.Context, string) (*SiteCalendar, error)
+	PutSiteCalendar(context.Context, *SiteCalendar) error
+	DeleteSiteCalendar(context.Context, string) error
+	PutRule(context.Context, *Rule) error
+	Rules(context.Context) ([]Rule, error)
+	GetRule(context.Context, string) (*Rule, error)
+	DeleteRule(context.Context, string) error
+	RuleStatuses(context.Context, string) ([]RuleStatus, error)
+	BackfillRule(context.Context, *BackfillRequest) (int64, error)
+	RunRules(context.Context) error
+	PutAlert(context.Context, *Alert) error
+	Alerts(context.Context) ([]Alert, error)
+	GetAlert(context.Context, string) (*Alert, error)
+	DeleteAlert(context.Context, string) error
+	AlertStates(context.Context, string, bool) ([]AlertState, error)
+	AlertHistory(context.Context, *AlertHistoryRequest) ([]AlertEvent, error)
+	Silences(context.Context) ([]Silence, error)
+	AddSilence(context.Context, *Silence) error
+	DeleteSilence(context.Context, int) error
+	RunAlerts(context.Context) error
+	SubmitJob(ctx context.Context, source, name string, opts JobOptions, file io.Reader) (*Job, error)
+	Job(context.Context, string) (*Job, error)
+	Jobs(context.Context, string) ([]Job, error)
+	CancelJob(context.Context, string) (*Job, error)
+	RunJobs(context.Context) error
+	PutQualityPolicy(context.Context, *QualityPolicy) error
+	QualityPolicies(context.Context) ([]QualityPolicy, error)
+	GetQualityPolicy(context.Context, string) (*QualityPolicy, error)
+	DeleteQualityPolicy(context.Context, string) error
+	Quarantine(context.Context, *QuarantineRequest) ([]QuarantinedReading, error)
+	ReleaseQuarantine(context.Context, *QuarantineRequest) (int64, error)
 }
 
 // TimescaleDatabase is an implementation of Database for TimescaleDB
 type TimescaleDatabase struct {
 	pool            *pgxpool.Pool
 	reasonerAddress string
+	// shapes from the configured shape library, used to validate every source
+	shapeLibrary []Triple
+	// number of queries evaluated concurrently by Qualify, and the timeout of each of them
+	qualifyWorkers int
+	qualifyTimeout time.Duration
+	// insertion jobs: the directory their uploads are spooled to, the number processed concurrently, and the
+	// cancellation of the running ones
+	jobSpoolDir string
+	jobWorkers  int
+	jobQueued   chan struct{}
+	jobsLock    sync.Mutex
+	runningJobs map[string]context.CancelFunc
 }
 
 // NewTimescaleInsecureDefaults creates a new TimescaleDatabase with the insecure default settings: (listening localhost:5434 with user/pass = mortarchangeme/mortarpasswordchangeme)
@@ -87,6 +157,11 @@ func NewTimescaleFromConfig(ctx context.Context, cfg *config.Config) (Database,
 	connCfg.MaxConnIdleTime = 15 * time.Minute
 	connCfg.MaxConnLifetime = 15 * time.Minute
 
+	shapeLibrary, err := loadShapeLibrary(cfg.Validation.ShapeFiles)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid shape library: %w", err)
+	}
+
 	log := logging.FromContext(ctx)
 	// loop until database is live
 	var pool *pgxpool.Pool
@@ -100,10 +175,24 @@ func NewTimescaleFromConfig(ctx context.Context, cfg *config.Config) (Database,
 		}
 	}
 	log.Infof("Connected to postgres at %s", cfg.Database.Host)
-	return &TimescaleDatabase{
+	db := &TimescaleDatabase{
 		pool:            pool,
 		reasonerAddress: cfg.Reasoner.Address,
-	}, nil
+		shapeLibrary:    shapeLibrary,
+		qualifyWorkers:  cfg.Qualify.Workers,
+		qualifyTimeout:  cfg.Qualify.TaskTimeout,
+		jobSpoolDir:     cfg.Jobs.SpoolDir,
+		jobWorkers:      cfg.Jobs.Workers,
+		jobQueued:       make(chan struct{}, 1),
+		runningJobs:     make(map[string]context.CancelFunc),
+	}
+	if len(db.jobSpoolDir) == 0 {
+		db.jobSpoolDir = config.DefaultJobSpoolDir
+	}
+	if err := db.preloadViews(ctx); err != nil {
+		log.Warnf("Could not preload views: %s", err)
+	}
+	return db, nil
 }
 
 // Close shuts down the connections to the database
@@ -111,6 +200,24 @@ func (db *TimescaleDatabase) Close() {
 	db.pool.Close()
 }
 
+// Unavailable is true if the error is due to the database being unreachable (the connection could not be made, or
+// was lost) rather than to the operation that failed
+func Unavailable(err error) bool {
+	var pgErr *pgconn.PgError
+	if err == nil || errors.As(err, &pgErr) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return pgconn.SafeToRetry(err) || errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Ping returns an error if the database cannot be reached
+func (db *TimescaleDatabase) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, config.DatabasePingTimeout)
+	defer cancel()
+	return db.pool.Ping(ctx)
+}
+
 // RunAsTransaction executes the provided function in a transaction; commits if the function returns nil, and aborts otherwise
 func (db *TimescaleDatabase) RunAsTransaction(ctx context.Context, f func(txn pgx.Tx) error) error {
 	// start transaction in a new pooled connection
@@ -119,6 +226,12 @@ func (db *TimescaleDatabase) RunAsTransaction(ctx context.Context, f func(txn pg
 		return fmt.Errorf("Could not acquire connection from pool: %w", err)
 	}
 	defer conn.Release()
+	return inTransaction(ctx, conn, f)
+}
+
+// inTransaction executes the provided function in a transaction on the connection; commits if the function returns
+// nil, and aborts otherwise
+func inTransaction(ctx context.Context, conn *pgxpool.Conn, f func(txn pgx.Tx) error) error {
 	txn, err := conn.Begin(ctx)
 	if err != nil {
 		return fmt.Errorf("Could not begin transaction: %w", err)
@@ -165,29 +278,81 @@ func (db *TimescaleDatabase) RegisterStream(ctx context.Context, stream Stream)
 			brickClass = &stream.BrickClass
 		}
 
-		res, err := txn.Exec(ctx, `INSERT INTO streams(id, name, source, units, brick_uri, brick_class)
-								 VALUES(DEFAULT, $1, $2, $3, $4, $5) ON CONFLICT (source, name) DO UPDATE
+		var (
+			expression      *string
+			expressionQuery *string
+		)
+		if len(stream.Expression) > 0 {
+			if err := checkExpression(ctx, txn, &stream); err != nil {
+				return err
+			}
+			expression = &stream.Expression
+			if len(stream.ExpressionQuery) > 0 {
+				expressionQuery = &stream.ExpressionQuery
+			}
+		}
+
+		// the type of a stream is kept if the registration does not give one, and changes only while the
+		// stream has no readings
+		var (
+			valueType *string
+			states    []string
+		)
+		if len(stream.Type) == 0 && expression != nil {
+			stream.Type = ValueFloat
+		}
+		if len(stream.Type) > 0 {
+			valueType = &stream.Type
+			states = stream.States
+			var (
+				current     string
+				hasReadings bool
+			)
+			row := txn.QueryRow(ctx, `SELECT value_type,
+										 EXISTS(SELECT 1 FROM data WHERE stream_id = streams.id)
+										 OR EXISTS(SELECT 1 FROM text_data WHERE stream_id = streams.id)
+									  FROM streams WHERE source = $1 AND name = $2`, stream.SourceName, stream.Name)
+			if err := row.Scan(&current, &hasReadings); err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				return fmt.Errorf("Could not read type of stream: %w", err)
+			} else if err == nil && current != stream.Type && hasReadings {
+				return fmt.Errorf("Cannot change type of stream %s from %s to %s: it has readings", stream.Name, current, stream.Type)
+			}
+		}
+
+		res, err := txn.Exec(ctx, `INSERT INTO streams(id, name, source, units, brick_uri, brick_class, expression, expression_query, value_type, states)
+								 VALUES(DEFAULT, $1, $2, $3, $4, $5, $6, $7, COALESCE($8::text, 'float'), $9) ON CONFLICT (source, name) DO UPDATE
 								 SET brick_uri = EXCLUDED.brick_uri,
 								     brick_class = EXCLUDED.brick_class,
-									 units = EXCLUDED.units`,
-			stream.Name, stream.SourceName, stream.Units, brickURI, brickClass)
+									 units = EXCLUDED.units,
+									 expression = EXCLUDED.expression,
+									 expression_query = EXCLUDED.expression_query,
+									 value_type = COALESCE($8::text, streams.value_type),
+									 states = CASE WHEN $8::text IS NULL THEN streams.states ELSE EXCLUDED.states END`,
+			stream.Name, stream.SourceName, stream.Units, brickURI, brickClass, expression, expressionQuery, valueType, states)
 		if err != nil {
 			return fmt.Errorf("Could not register stream: %w", err)
 		}
 		registered = res.RowsAffected() > 0
 
-		// TODO: register as a Triple
 		if brickURI != nil && len(*brickURI) > 0 {
-			s := fmt.Sprintf("<%s>", *brickURI)
-			p := "<http://www.w3.org/1999/02/22-rdf-syntax-ns#type>"
-			o := "<https://brickschema.org/schema/Brick#Point>"
-			if brickClass != nil && len(*brickClass) > 0 {
-				o = fmt.Sprintf("<%s>", *brickClass)
+			// the type of the point of each registered stream makes up its own origin, so registering a stream
+			// writes a version with only that triple, which replaces the previous type of the point
+			origin := streamRegistrationOrigin(*brickURI)
+			if err := lockOrigin(ctx, txn, stream.SourceName, origin); err != nil {
+				return err
 			}
-			res, err = txn.Exec(ctx, `INSERT INTO triples(source, origin, time, s, p, o)
-								 VALUES($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING`,
-				stream.SourceName, "stream_registration", time.Now(), s, p, o)
+			triples, err := latestOriginTriples(ctx, txn, stream.SourceName, origin)
 			if err != nil {
+				return fmt.Errorf("Could not read registered types: %w", err)
+			}
+			typ := Triple{S: nt(*brickURI), P: ntRDFType, O: ntBrickPoint}
+			if brickClass != nil && len(*brickClass) > 0 {
+				typ.O = nt(*brickClass)
+			}
+			if _, ok := triples[typ]; ok && len(triples) == 1 {
+				return nil
+			}
+			if err := writeOriginVersion(ctx, txn, stream.SourceName, origin, time.Now(), tripleSet{typ: struct{}{}}); err != nil {
 				return fmt.Errorf("Could not register stream: %w", err)
 			}
 		}
@@ -201,24 +366,26 @@ func (db *TimescaleDatabase) RegisterStream(ctx context.Context, stream Stream)
 	return err
 }
 
-func (db *TimescaleDatabase) InsertHistoricalData(ctx context.Context, ds Dataset) error {
+// InsertHistoricalData writes the readings of the dataset to its stream, and reports the outcome of their quality
+// checks and of their conflicts with stored readings
+func (db *TimescaleDatabase) InsertHistoricalData(ctx context.Context, ds Dataset, opts InsertOptions) (*InsertReport, error) {
 	ctx, cancel := context.WithTimeout(ctx, config.DataWriteTimeout)
 	defer cancel()
 
 	log := logging.FromContext(ctx)
 
 	if err := checkDataset(ds); err != nil {
-		return fmt.Errorf("Cannot handle invalid dataset: %w", err)
+		return nil, fmt.Errorf("Cannot handle invalid dataset: %w", err)
 	}
 
 	// if the source does not exist, the checkAuth function will fail
 	if authorized, err := db.checkAuth(ctx, "write", ds.GetSource()); err != nil {
-		return fmt.Errorf("Cannot determine authorized status: %w", err)
+		return nil, fmt.Errorf("Cannot determine authorized status: %w", err)
 	} else if !authorized {
-		return fmt.Errorf("Cannot write to source: %s", ds.GetSource())
+		return nil, fmt.Errorf("Cannot write to source: %s", ds.GetSource())
 	}
 
-	var num int64 = 0
+	var report InsertReport
 
 	//log.Infof("Get stream id")
 	//row := db.pool.QueryRow(ctx, `SELECT id FROM streams WHERE source=$1 AND name=$2`, ds.GetSource(), ds.GetName())
@@ -260,28 +427,23 @@ func (db *TimescaleDatabase) InsertHistoricalData(ctx context.Context, ds Datase
 			return fmt.Errorf("No such stream (SourceName: %s, Name: %s): %w", ds.GetSource(), ds.GetName(), err)
 		}
 
-		ds.SetId(stream_id)
-		// _, err = txn.Exec(ctx, "CREATE TEMPORARY TABLE data_temp AS SELECT * FROM data WITH NO DATA;")
-		_, err = txn.Exec(ctx, "CREATE TEMP TABLE data_temp(time TIMESTAMPTZ, stream_id INTEGER, value FLOAT)")
-		if err != nil {
-			return fmt.Errorf("Cannot insert readings for id %d: %w", stream_id, err)
-		}
-
-		num, err = txn.CopyFrom(ctx, pgx.Identifier{"data_temp"}, []string{"time", "stream_id", "value"}, ds)
-		if err != nil {
-			return fmt.Errorf("Cannot insert readings for id %d: %w", stream_id, err)
+		if len(opts.IdempotencyKey) > 0 {
+			earlier, err := claimIdempotencyKey(ctx, txn, ds.GetSource(), ds.GetName(), opts.IdempotencyKey)
+			if err != nil {
+				return err
+			} else if earlier != nil {
+				report = *earlier
+				return nil
+			}
 		}
 
-		//_, err = txn.Exec(ctx, "CALL decompress_backfill(staging_table=>'data_temp', destination_hypertable=>'data', on_conflict_action=>'UPDATE', on_conflict_update_columns=>array['value']);")
-		_, err = txn.Exec(ctx, "INSERT INTO data SELECT * FROM data_temp ON CONFLICT (time, stream_id) DO UPDATE SET value = EXCLUDED.value")
+		report, err = insertReadings(ctx, txn, stream_id, ds, opts.OnConflict)
 		if err != nil {
-			return fmt.Errorf("Cannot insert readings for id %d: %w", stream_id, err)
+			return err
 		}
-		// TODO: the Call has its own transcation; need to move out
 
-		_, err = txn.Exec(ctx, "DROP TABLE data_temp")
-		if err != nil {
-			return fmt.Errorf("Cannot insert readings for id %d: %w", stream_id, err)
+		if len(opts.IdempotencyKey) > 0 {
+			return rememberInsertion(ctx, txn, ds.GetSource(), opts.IdempotencyKey, &report)
 		}
 
 		//for rdg := range ds.GetReadings() {
@@ -296,81 +458,156 @@ func (db *TimescaleDatabase) InsertHistoricalData(ctx context.Context, ds Datase
 
 	})
 
-	if err == nil {
-		log.Infof("Inserted %5d readings: %s", num, ds)
+	if err != nil {
+		return nil, err
 	}
-	return err
+	if report.Replayed {
+		log.Infof("Replayed insertion %s: %s", opts.IdempotencyKey, ds)
+		return &report, nil
+	}
+	log.Infof("Inserted %5d readings (%d updated, %d skipped, %d flagged, %d quarantined, %d rejected): %s",
+		report.Inserted, report.Updated, report.Skipped, report.Flagged, report.Quarantined, report.Rejected, ds)
+	return &report, nil
 }
 
-func (db *TimescaleDatabase) writeMetadataArrow(ctx context.Context, w io.Writer, q *Query) error {
-	// if a sparql query is provided, then execute it, join on 'streams' to get all of the ids
-	// implied by the query, and use those to determine the ids in the 'data' table
-	var err error
+// insertReadings writes the readings of the dataset to the stream; readings at the times of stored readings are
+// handled according to the conflict policy. The readings must be of the type of the stream; the readings of string
+// streams are written to text_data. Numeric readings are checked against the quality policy of the stream: flagged
+// readings are written with their quality, quarantined readings are moved to the quarantine and rejected readings
+// are dropped. Listeners on the 'data_inserted' channel are notified of the stream id when the transaction commits
+func insertReadings(ctx context.Context, txn pgx.Tx, stream_id int, ds Dataset, onConflict ConflictPolicy) (InsertReport, error) {
+	ds.SetId(stream_id)
+	checked, err := newQualityDataset(ctx, txn, stream_id, ds)
+	if err != nil {
+		return InsertReport{}, err
+	}
+	// readings of string streams are stored in text_data
+	table, valueType := "data", "FLOAT"
+	if checked.typ.typ == ValueString {
+		table, valueType = "text_data", "TEXT"
+	}
+	// _, err = txn.Exec(ctx, "CREATE TEMPORARY TABLE data_temp AS SELECT * FROM data WITH NO DATA;")
+	_, err = txn.Exec(ctx, "CREATE TEMP TABLE data_temp(time TIMESTAMPTZ, stream_id INTEGER, value "+valueType+", quality SMALLINT)")
+	if err != nil {
+		return InsertReport{}, fmt.Errorf("Cannot insert readings for id %d: %w", stream_id, err)
+	}
 
-	log := logging.FromContext(ctx)
-	if len(q.Sparql) > 0 {
-		fmt.Println("SPARQL", q.Sparql, q.Sources)
-		// TODO: get all graphs
-		var uris []string
-		if len(q.Sources) == 0 {
-			q.Sources = []string{"default"}
+	num, err := txn.CopyFrom(ctx, pgx.Identifier{"data_temp"}, []string{"time", "stream_id", "value", "quality"}, checked)
+	if err != nil {
+		return InsertReport{}, fmt.Errorf("Cannot insert readings for id %d: %w", stream_id, err)
+	}
+
+	if onConflict == ConflictError {
+		if err := checkConflicts(ctx, txn, "data_temp", table, stream_id); err != nil {
+			return InsertReport{}, err
 		}
+	}
 
-		for _, site := range q.Sources {
-			res, err := db.QuerySparql(ctx, site, q.Sparql)
-			if err != nil {
-				return err
-			}
+	//_, err = txn.Exec(ctx, "CALL decompress_backfill(staging_table=>'data_temp', destination_hypertable=>'data', on_conflict_action=>'UPDATE', on_conflict_update_columns=>array['value']);")
+	// rows written by an update have a non-zero xmax
+	row := txn.QueryRow(ctx, `WITH written AS (
+								INSERT INTO `+table+`(time, stream_id, value, quality) SELECT time, stream_id, value, quality FROM data_temp
+								`+conflictClause(table, onConflict)+`
+								RETURNING xmax = 0 AS inserted)
+							  SELECT count(*) FILTER (WHERE inserted), count(*) FILTER (WHERE NOT inserted) FROM written`)
+	if err := row.Scan(&checked.report.Inserted, &checked.report.Updated); err != nil {
+		return InsertReport{}, fmt.Errorf("Cannot insert readings for id %d: %w", stream_id, err)
+	}
+	checked.report.Skipped = num - checked.report.Inserted - checked.report.Updated
+	// TODO: the Call has its own transcation; need to move out
 
-			fmt.Println("results", len(res.Results.Bindings))
-			for _, row := range res.Results.Bindings {
-				for _, value := range row {
-					if value.Type == "uri" {
-						uris = append(uris, value.Value)
-					}
-				}
-			}
-		}
-		fmt.Println("metadata uris", len(uris))
-		// get ids from the uris
-		var rows pgx.Rows
-		if len(q.Sources) > 0 && q.Sources[0] != "default" {
-			rows, err = db.pool.Query(ctx, `SELECT id from streams WHERE (name = ANY($1) OR brick_uri = ANY($1)) AND source = ANY($2)`, uris, q.Sources)
-		} else {
-			rows, err = db.pool.Query(ctx, `SELECT id from streams WHERE (name = ANY($1) OR brick_uri = ANY($1))`, uris)
-			//rows, err = db.pool.Query(ctx, `SELECT id from streams LIMIT 10`)
+	_, err = txn.Exec(ctx, "DROP TABLE data_temp")
+	if err != nil {
+		return InsertReport{}, fmt.Errorf("Cannot insert readings for id %d: %w", stream_id, err)
+	}
+
+	if err := checked.quarantine(ctx, txn, stream_id); err != nil {
+		return InsertReport{}, err
+	}
+	if err := notifyInsertion(ctx, txn, stream_id); err != nil {
+		return InsertReport{}, err
+	}
+	return checked.report, nil
+}
+
+// notifyInsertion notifies the listeners on the 'data_inserted' channel that readings were written to the stream
+func notifyInsertion(ctx context.Context, txn pgx.Tx, stream_id int) error {
+	if _, err := txn.Exec(ctx, "SELECT pg_notify('data_inserted', $1)", strconv.Itoa(stream_id)); err != nil {
+		return fmt.Errorf("Cannot notify insertion for id %d: %w", stream_id, err)
+	}
+	return nil
+}
+
+// streamIdsOfUris returns the ids of the streams whose name or brick_uri is one of the uris, in the given sources
+// (or in every source)
+func (db *TimescaleDatabase) streamIdsOfUris(ctx context.Context, uris []string, sources []string) ([]int64, error) {
+	var (
+		idRows pgx.Rows
+		err    error
+	)
+	if len(sources) > 0 {
+		idRows, err = db.pool.Query(ctx, `SELECT id from streams WHERE (name = ANY($1) OR brick_uri = ANY($1)) AND source = ANY($2)`, uris, sources)
+	} else {
+		idRows, err = db.pool.Query(ctx, `SELECT id from streams WHERE (name = ANY($1) OR brick_uri = ANY($1))`, uris)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer idRows.Close()
+	var ids []int64
+	for idRows.Next() {
+		var i int64
+		if err := idRows.Scan(&i); err != nil {
+			return nil, fmt.Errorf("Could not query: %w", err)
 		}
-		if err != nil {
-			log.Errorf("could not query? %w", err)
-			return err
+		ids = append(ids, i)
+	}
+	return ids, idRows.Err()
+}
+
+// writeMetadataArrow determines the streams of the query and writes their metadata as an Arrow record. If a SPARQL
+// query is provided, each row of the record is a stream matched by a solution of the query, and the record has a
+// column for each variable of the query in addition to the columns of the streams; the ids of the matched streams
+// are used to determine the ids in the 'data' table. The solutions of the SPARQL query are returned
+func (db *TimescaleDatabase) writeMetadataArrow(ctx context.Context, w io.Writer, q *Query) (*sparqlTable, error) {
+	var (
+		table = &sparqlTable{}
+		rows  []metadataRow
+		err   error
+	)
+
+	log := logging.FromContext(ctx)
+	if len(q.Sparql) > 0 {
+		log.Infof("Resolving streams of SPARQL query on %v", q.Sources)
+		if table, err = db.resolveSparqlStreams(ctx, q); err != nil {
+			return nil, err
 		}
-		for rows.Next() {
-			var i int64
-			if err := rows.Scan(&i); err != nil {
-				return fmt.Errorf("Could not query: %w", err)
+		rows = table.metadataRows()
+		seen := make(map[int64]bool)
+		for _, row := range rows {
+			if id := int64(row.stream.id); !seen[id] {
+				seen[id] = true
+				q.Ids = append(q.Ids, id)
 			}
-			q.Ids = append(q.Ids, i)
 		}
-	} else if len(q.Uris) > 0 {
-		var rows pgx.Rows
-		if len(q.Sources) > 0 {
-			rows, err = db.pool.Query(ctx, `SELECT id from streams WHERE (name = ANY($1) OR brick_uri = ANY($1)) AND source = ANY($2)`, q.Uris, q.Sources)
-		} else {
-			rows, err = db.pool.Query(ctx, `SELECT id from streams WHERE (name = ANY($1) OR brick_uri = ANY($1))`, q.Uris)
+	} else {
+		if len(q.Uris) > 0 {
+			ids, err := db.streamIdsOfUris(ctx, q.Uris, q.Sources)
+			if err != nil {
+				return nil, err
+			}
+			q.Ids = append(q.Ids, ids...)
 		}
+		streams, err := queryStreams(ctx, db.pool, `SELECT id, source, name, units, brick_uri, brick_class, value_type, states FROM streams
+													WHERE id = ANY($1) ORDER BY id`, q.Ids)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("Could not query: %w", err)
 		}
-		for rows.Next() {
-			var i int64
-			if err := rows.Scan(&i); err != nil {
-				return fmt.Errorf("Could not query: %w", err)
-			}
-			q.Ids = append(q.Ids, i)
+		for _, stream := range streams {
+			rows = append(rows, metadataRow{stream: stream})
 		}
 	}
-
-	fmt.Println("metadata ids", len(q.Ids))
+	log.Infof("Metadata query matched %d streams (%d rows)", len(q.Ids), len(rows))
 
 	metadataFields := []arrow.Field{
 		{Name: "brick_class", Type: arrow.BinaryTypes.String, Nullable: true},
@@ -380,6 +617,17 @@ func (db *TimescaleDatabase) writeMetadataArrow(ctx context.Context, w io.Writer
 		{Name: "stream_id", Type: arrow.PrimitiveTypes.Int64, Nullable: false},
 		{Name: "source", Type: arrow.BinaryTypes.String, Nullable: false},
 	}
+	// the variables of the query get a column each; variables named like a stream column are prefixed with '?'
+	streamColumns := len(metadataFields)
+	for _, v := range table.vars {
+		name := v
+		for _, field := range metadataFields[:streamColumns] {
+			if field.Name == v {
+				name = "?" + v
+			}
+		}
+		metadataFields = append(metadataFields, arrow.Field{Name: name, Type: arrow.BinaryTypes.String, Nullable: true})
+	}
 	mdsch := arrow.NewSchema(metadataFields, nil)
 	mdbldr := array.NewRecordBuilder(memory.DefaultAllocator, mdsch)
 	defer mdbldr.Release()
@@ -392,37 +640,84 @@ func (db *TimescaleDatabase) writeMetadataArrow(ctx context.Context, w io.Writer
 	sources := mdbldr.Field(5).(*array.StringBuilder)
 	mdWriter := ipc.NewWriter(w, ipc.WithSchema(mdbldr.Schema()))
 
-	rows, err := db.pool.Query(ctx, `SELECT DISTINCT id, brick_class, brick_uri, units, name, source FROM streams WHERE id = ANY($1)`, q.Ids)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var id int64
-		var brick_class string
-		var brick_uri string
-		var unit string
-		var name string
-		var source string
-		if err := rows.Scan(&id, &brick_class, &brick_uri, &unit, &name, &source); err != nil {
-			return fmt.Errorf("Could not query: %w", err)
-		}
-		classes.Append(brick_class)
-		uris.Append(brick_uri)
-		units.Append(unit)
-		names.Append(name)
-		ids.Append(id)
-		sources.Append(source)
+	for _, row := range rows {
+		classes.Append(row.stream.BrickClass)
+		uris.Append(row.stream.BrickURI)
+		units.Append(row.stream.Units)
+		names.Append(row.stream.Name)
+		ids.Append(int64(row.stream.id))
+		sources.Append(row.stream.SourceName)
+		for idx, v := range table.vars {
+			appendSparqlTerm(mdbldr.Field(streamColumns+idx).(*array.StringBuilder), row.bindings, v)
+		}
 	}
 
 	mdrec := mdbldr.NewRecord()
 	defer mdrec.Release()
 	if err := mdWriter.Write(mdrec); err != nil {
-		return fmt.Errorf("Could not write record %w", err)
+		return nil, fmt.Errorf("Could not write record %w", err)
 	}
 
 	// finish sending metadata
-	return mdWriter.Close()
+	return table, mdWriter.Close()
+}
+
+// writeBindingsArrow writes the solutions of a SPARQL query as an Arrow record with a row for each solution (see
+// makeArrowSchemaFromSPARQL), so that clients can join the data of each stream to the variables of the query
+func writeBindingsArrow(w io.Writer, table *sparqlTable) error {
+	bldr := array.NewRecordBuilder(memory.DefaultAllocator, makeArrowSchemaFromSPARQL(table.vars))
+	defer bldr.Release()
+
+	sources := bldr.Field(len(table.vars)).(*array.StringBuilder)
+	streamIds := bldr.Field(len(table.vars) + 1).(*array.ListBuilder)
+	ids := streamIds.ValueBuilder().(*array.Int64Builder)
+	writer := ipc.NewWriter(w, ipc.WithSchema(bldr.Schema()))
+
+	for _, solution := range table.solutions {
+		for idx, v := range table.vars {
+			appendSparqlTerm(bldr.Field(idx).(*array.StringBuilder), solution.bindings, v)
+		}
+		sources.Append(solution.source)
+		streamIds.Append(true)
+		for _, stream := range solution.streams {
+			ids.Append(int64(stream.id))
+		}
+	}
+
+	rec := bldr.NewRecord()
+	defer rec.Release()
+	if err := writer.Write(rec); err != nil {
+		return fmt.Errorf("Could not write record %w", err)
+	}
+	return writer.Close()
+}
+
+// appendSparqlTerm appends the value of the variable in the solution, or null if it is unbound
+func appendSparqlTerm(column *array.StringBuilder, solution map[string]SparqlTerm, v string) {
+	if term, ok := solution[v]; !ok {
+		column.AppendNull()
+	} else if term.Type == "bnode" {
+		column.Append("_:" + term.Value)
+	} else {
+		column.Append(term.Value)
+	}
+}
+
+// readingsFrom returns the FROM and WHERE clauses that select the readings of a query from the view (unified, or
+// unified_text for the readings of string streams), given the start ($1), end ($2) and stream ids ($3) of the query
+func readingsFrom(q *Query, view string) string {
+	var quality string
+	switch q.Quality {
+	case "good":
+		quality = " AND quality = 0"
+	case "flagged":
+		quality = " AND quality <> 0"
+	}
+	if q.Occupied {
+		return `FROM ` + view + ` LEFT JOIN site_calendars AS cal ON cal.source = ` + view + `.source
+				WHERE time>=$1 and time <=$2 and stream_id = ANY($3) AND is_occupied(time, cal.timezone, cal.holidays, cal.schedule)` + quality
+	}
+	return `FROM ` + view + ` WHERE time>=$1 and time <=$2 and stream_id = ANY($3)` + quality
 }
 
 func (db *TimescaleDatabase) ReadDataChunk(ctx context.Context, httpw io.Writer, q *Query) error {
@@ -433,59 +728,94 @@ func (db *TimescaleDatabase) ReadDataChunk(ctx context.Context, httpw io.Writer,
 	w := lz4.NewWriter(httpw)
 	defer w.Close()
 
-	if err := db.writeMetadataArrow(ctx, w, q); err != nil {
+	table, err := db.writeMetadataArrow(ctx, w, q)
+	if err != nil {
 		return fmt.Errorf("Error processing metadata: %w", err)
 	}
 
 	fmt.Println("query ids", len(q.Ids))
 
+	types, err := db.streamTypes(ctx, q.Ids)
+	if err != nil {
+		return err
+	}
+	var hasText, typed bool
+	for _, typ := range types {
+		hasText = hasText || typ == ValueString
+		typed = typed || typ != ValueFloat
+	}
+	aggregated := q.AggregationFunc != nil && q.AggregationWindow != nil
+	states := aggregated && q.AggregationFunc.isState()
+	typed = typed || states
+
 	// TODO: need to do a better job of streaming this data out
 
-	sch := arrow.NewSchema([]arrow.Field{
+	dataFields := []arrow.Field{
 		{Name: "time", Type: arrow.FixedWidthTypes.Timestamp_ns, Nullable: false},
 		{Name: "value", Type: arrow.PrimitiveTypes.Float64, Nullable: false},
 		{Name: "id", Type: arrow.BinaryTypes.String, Nullable: false},
-	}, nil)
+		{Name: "stream_id", Type: arrow.PrimitiveTypes.Int64, Nullable: false},
+	}
+	// the quality flags of the readings (of any reading of an aggregation bucket) follow the other columns
+	if q.Flags {
+		dataFields = append(dataFields, arrow.Field{Name: "quality", Type: arrow.PrimitiveTypes.Int32, Nullable: false})
+	}
+	// if any stream is not a float stream, the values of the readings also have a column of their type (the other
+	// typed columns are null). The value of the readings of string streams is NaN
+	if typed {
+		dataFields = append(dataFields,
+			arrow.Field{Name: "value_int", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+			arrow.Field{Name: "value_bool", Type: arrow.FixedWidthTypes.Boolean, Nullable: true},
+			arrow.Field{Name: "value_string", Type: arrow.BinaryTypes.String, Nullable: true})
+	}
+	sch := arrow.NewSchema(dataFields, nil)
 	bldr := array.NewRecordBuilder(memory.DefaultAllocator, sch)
 	defer bldr.Release()
 
 	rTimes := bldr.Field(0).(*array.TimestampBuilder)
 	rValues := bldr.Field(1).(*array.Float64Builder)
 	rNames := bldr.Field(2).(*array.StringBuilder)
+	rIds := bldr.Field(3).(*array.Int64Builder)
+	appendQuality := func(quality int32) {
+		if q.Flags {
+			bldr.Field(4).(*array.Int32Builder).Append(quality)
+		}
+	}
+	// appendTyped appends the value of the reading to the column of the type (the empty type for none)
+	appendTyped := func(typ string, rdg Reading) {
+		if !typed {
+			return
+		}
+		rInts := bldr.Field(len(dataFields) - 3).(*array.Int64Builder)
+		rBools := bldr.Field(len(dataFields) - 2).(*array.BooleanBuilder)
+		rStrings := bldr.Field(len(dataFields) - 1).(*array.StringBuilder)
+		if typ == ValueInt {
+			rInts.Append(int64(rdg.Value))
+		} else {
+			rInts.AppendNull()
+		}
+		if typ == ValueBool {
+			rBools.Append(rdg.Value != 0)
+		} else {
+			rBools.AppendNull()
+		}
+		if typ == ValueString {
+			rStrings.Append(rdg.Text)
+		} else {
+			rStrings.AppendNull()
+		}
+	}
 
 	arrowWriter := ipc.NewWriter(w, ipc.WithSchema(bldr.Schema()))
 
-	var (
-		rows pgx.Rows
-		err  error
-	)
-	// write aggregation query if Query contains it
-	if q.AggregationFunc != nil && q.AggregationWindow != nil {
-		sql := fmt.Sprintf(`SELECT time_bucket('%s', time) as time, %s, COALESCE(brick_uri, name)
-							FROM unified WHERE time>=$1 and time <=$2 and stream_id = ANY($3)
-							GROUP BY time, stream_id, brick_uri, name`, *q.AggregationWindow, q.AggregationFunc.toSQL("value"))
-		rows, err = db.pool.Query(ctx, sql, q.Start.Format(time.RFC3339), q.End.Format(time.RFC3339), q.Ids)
-	} else {
-		rows, err = db.pool.Query(ctx, `SELECT time, value, COALESCE(brick_uri, name)
-										FROM unified WHERE time>=$1 and time <=$2 and stream_id = ANY($3)`, q.Start.Format(time.RFC3339), q.End.Format(time.RFC3339), q.Ids)
-	}
-	defer rows.Close()
-
-	if err != nil {
-		return fmt.Errorf("Could not query %w", err)
-	}
-	for rows.Next() {
-		var (
-			t time.Time
-			v float64
-			s string
-		)
-		if err := rows.Scan(&t, &v, &s); err != nil {
-			return fmt.Errorf("Could not query %w", err)
-		}
+	// appendRow appends a row, with the reading in the column of the type
+	appendRow := func(t time.Time, v float64, name string, id int64, quality int32, typ string, rdg Reading) error {
 		rTimes.Append(arrow.Timestamp(t.UnixNano()))
 		rValues.Append(v)
-		rNames.Append(s)
+		rNames.Append(name)
+		rIds.Append(id)
+		appendQuality(quality)
+		appendTyped(typ, rdg)
 
 		// TODO: measure/estimate size
 		if rValues.Len() > 2000000 { // 2 million readings
@@ -496,6 +826,162 @@ func (db *TimescaleDatabase) ReadDataChunk(ctx context.Context, httpw io.Writer,
 			}
 			rec.Release()
 		}
+		return nil
+	}
+
+	// aggregations of states are computed from the readings and the time each holds, up to the end of the query
+	// (or now)
+	if states {
+		series, err := db.stateReadings(ctx, q)
+		if err != nil {
+			return err
+		}
+		end := q.End
+		if now := time.Now(); now.Before(end) {
+			end = now
+		}
+		derived, err := db.derivedStreams(ctx, q.Ids)
+		if err != nil {
+			return err
+		}
+		if len(derived) > 0 {
+			readings, err := db.derivedReadings(ctx, q, derived)
+			if err != nil {
+				return err
+			}
+			for _, d := range derived {
+				name := d.stream.Name
+				if len(d.stream.BrickURI) > 0 {
+					name = d.stream.BrickURI
+				}
+				s := &stateSeries{name: name, typ: ValueFloat}
+				for _, rdg := range readings[d.stream.id] {
+					s.readings = append(s.readings, stateReading{Reading: rdg})
+				}
+				series[int64(d.stream.id)] = s
+			}
+		}
+		ids := make([]int64, 0, len(series))
+		for id := range series {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		for _, id := range ids {
+			s := series[id]
+			// only numbers have a duty cycle
+			if *q.AggregationFunc == AggregationDutyCycle && s.typ == ValueString {
+				continue
+			}
+			for _, bucket := range stateBuckets(s.readings, s.typ, q.Start, end, *q.AggregationWindow, q.Location) {
+				switch *q.AggregationFunc {
+				case AggregationDutyCycle:
+					if err := appendRow(bucket.start, bucket.dutyCycle(), s.name, id, bucket.quality, "", Reading{}); err != nil {
+						return err
+					}
+				case AggregationMode:
+					rdg := bucket.states[bucket.mode()]
+					if err := appendRow(bucket.start, rdg.Value, s.name, id, bucket.quality, s.typ, rdg); err != nil {
+						return err
+					}
+				case AggregationDurations:
+					for _, state := range bucket.names() {
+						err := appendRow(bucket.start, bucket.durations[state].Seconds(), s.name, id, bucket.quality,
+							ValueString, Reading{Text: state})
+						if err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+	} else {
+		var rows pgx.Rows
+		from := readingsFrom(q, "unified")
+		// write aggregation query if Query contains it
+		if aggregated {
+			// buckets are aligned to the calendar of the timezone of the query (weeks start on Monday).
+			// Grouping by position groups by the bucket rather than by the 'time' column of unified
+			bucket := "time_bucket($4::text::interval, time)"
+			args := []interface{}{q.Start.Format(time.RFC3339), q.End.Format(time.RFC3339), q.Ids, q.AggregationWindow.toSQL()}
+			if q.Location != nil && q.Location != time.UTC {
+				bucket = "time_bucket($4::text::interval, time, $5)"
+				args = append(args, q.Location.String())
+			}
+			sql := fmt.Sprintf(`SELECT %s as time, %s, NULL::text, COALESCE(brick_uri, name), stream_id, bit_or(quality)
+								%s
+								GROUP BY 1, stream_id, brick_uri, name`, bucket, q.AggregationFunc.toSQL("value"), from)
+			// string streams only have a count
+			if hasText && *q.AggregationFunc == AggregationCount {
+				sql += fmt.Sprintf(` UNION ALL
+								SELECT %s as time, count(value), NULL::text, COALESCE(brick_uri, name), stream_id, bit_or(quality)
+								%s
+								GROUP BY 1, stream_id, brick_uri, name`, bucket, readingsFrom(q, "unified_text"))
+			}
+			rows, err = db.pool.Query(ctx, sql, args...)
+		} else {
+			sql := `SELECT time, value, NULL::text, COALESCE(brick_uri, name), stream_id, quality ` + from
+			if hasText {
+				sql += ` UNION ALL
+						SELECT time, 'NaN'::float8, value, COALESCE(brick_uri, name), stream_id, quality ` + readingsFrom(q, "unified_text")
+			}
+			rows, err = db.pool.Query(ctx, sql, q.Start.Format(time.RFC3339), q.End.Format(time.RFC3339), q.Ids)
+		}
+		defer rows.Close()
+
+		if err != nil {
+			return fmt.Errorf("Could not query %w", err)
+		}
+		for rows.Next() {
+			var (
+				rdg     Reading
+				text    *string
+				s       string
+				id      int64
+				quality int32
+			)
+			if err := rows.Scan(&rdg.Time, &rdg.Value, &text, &s, &id, &quality); err != nil {
+				return fmt.Errorf("Could not query %w", err)
+			}
+			// aggregated values are in the value column only
+			typ := types[id]
+			if aggregated {
+				typ = ""
+			} else if text != nil {
+				rdg.Text = *text
+			}
+			if err := appendRow(rdg.Time, rdg.Value, s, id, quality, typ, rdg); err != nil {
+				return err
+			}
+		}
+
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("Could not query %w", err)
+		}
+
+		// derived streams have no readings of their own: they are computed from the readings of their inputs
+		derived, err := db.derivedStreams(ctx, q.Ids)
+		if err != nil {
+			return err
+		}
+		if len(derived) > 0 {
+			readings, err := db.derivedReadings(ctx, q, derived)
+			if err != nil {
+				return err
+			}
+			for _, d := range derived {
+				name := d.stream.Name
+				if len(d.stream.BrickURI) > 0 {
+					name = d.stream.BrickURI
+				}
+				for _, rdg := range readings[d.stream.id] {
+					if err := appendRow(rdg.Time, rdg.Value, name, int64(d.stream.id), 0, "", rdg); err != nil {
+						return err
+					}
+				}
+			}
+		}
 	}
 
 	rec := bldr.NewRecord()
@@ -504,8 +990,15 @@ func (db *TimescaleDatabase) ReadDataChunk(ctx context.Context, httpw io.Writer,
 	if err := arrowWriter.Write(rec); err != nil {
 		return fmt.Errorf("Could not write record %w", err)
 	}
+	if err := arrowWriter.Close(); err != nil {
+		return err
+	}
 
-	return arrowWriter.Close()
+	// the solutions of the SPARQL query follow the data, so that clients that only read the metadata and data are unaffected
+	if len(q.Sparql) > 0 {
+		return writeBindingsArrow(w, table)
+	}
+	return nil
 }
 
 func (db *TimescaleDatabase) QuerySparqlWriter(ctx context.Context, w io.Writer, graph string, sparqlQuery string) error {
@@ -540,24 +1033,94 @@ func (db *TimescaleDatabase) QuerySparql(ctx context.Context, graph string, quer
 	return repo.Query(queryString)
 }
 
-func (db *TimescaleDatabase) AddTriples(ctx context.Context, ds TripleDataset) error {
+// QuerySparqlProtocol evaluates a SPARQL 1.1 Protocol query against the reasoner. The dataset of the query
+// is given by the sources in the request; if no sources are given, the default graph is the union of all sources.
+// If req.AsOf is set, the reasoner evaluates the query against a snapshot of the sources at that time
+func (db *TimescaleDatabase) QuerySparqlProtocol(ctx context.Context, req *SparqlProtocolRequest) (*SparqlResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.DataReadTimeout)
+	defer cancel()
+
+	form := url.Values{}
+	form.Set("query", req.Query)
+	for _, source := range req.DefaultSources {
+		form.Add("default-graph-uri", source)
+	}
+	for _, source := range req.NamedSources {
+		form.Add("named-graph-uri", source)
+	}
+
+	queryURL := fmt.Sprintf("http://%s/query/default", db.reasonerAddress)
+	if req.AsOf != nil {
+		form.Set("as_of", req.AsOf.Format(time.RFC3339Nano))
+		queryURL = fmt.Sprintf("http://%s/snapshot", db.reasonerAddress)
+	}
+	if req.Stored {
+		// the latest stored triples are the snapshot as of 'infinity'
+		if req.AsOf == nil {
+			form.Set("as_of", "infinity")
+		}
+		form.Set("reasoning", "false")
+		queryURL = fmt.Sprintf("http://%s/snapshot", db.reasonerAddress)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, queryURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("Could not query %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read query results %w", err)
+	}
+	if resp.StatusCode == http.StatusBadRequest {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidQuery, body)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Reasoner returned %s: %s", resp.Status, body)
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), MediaTypeNTriples) {
+		return &SparqlResponse{Graph: body}, nil
+	}
+	var results SparqlResults
+	if err := json.Unmarshal(body, &results); err != nil {
+		return nil, fmt.Errorf("Could not parse query results %w", err)
+	}
+	return &SparqlResponse{Results: &results}, nil
+}
+
+// AddTriples stores the triples of the dataset as a new version of its origin and returns the number of
+// triples that were stored (repeated triples are only stored once). Unless validation is ValidateNone, the
+// resulting graph of the source is validated against its shapes; with ValidateBlock, a graph with
+// violations is not stored and ErrValidationFailed is returned along with the report
+func (db *TimescaleDatabase) AddTriples(ctx context.Context, ds TripleDataset, validation ValidationMode) (int64, *ValidationReport, error) {
 	ctx, cancel := context.WithTimeout(ctx, config.DataWriteTimeout)
 	defer cancel()
 
 	log := logging.FromContext(ctx)
 	if err := checkTripleDataset(ds); err != nil {
-		return fmt.Errorf("Cannot handle invalid dataset: %w", err)
+		return 0, nil, fmt.Errorf("Cannot handle invalid dataset: %w", err)
 	}
 
 	if authorized, err := db.checkAuth(ctx, "write", ds.GetSource()); err != nil {
-		return fmt.Errorf("Cannot determine authorized status: %w", err)
+		return 0, nil, fmt.Errorf("Cannot determine authorized status: %w", err)
 	} else if !authorized {
-		return fmt.Errorf("Cannot write to source: %s", ds.GetSource())
+		return 0, nil, fmt.Errorf("Cannot write to source: %s", ds.GetSource())
 	}
 
-	var num int64 = 0
+	var (
+		num, inserted int64
+		report        *ValidationReport
+	)
 
 	err := db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		if err := lockOrigin(ctx, txn, ds.GetSource(), ds.GetOrigin()); err != nil {
+			return err
+		}
 		_, err := txn.Exec(ctx, "CREATE TEMP TABLE triplet(source TEXT, origin TEXT, time TIMESTAMPTZ, s TEXT, p TEXT, o TEXT)")
 		if err != nil {
 			return fmt.Errorf("Cannot insert triples for source %s: %w (temp create)", ds.GetSource(), err)
@@ -568,22 +1131,48 @@ func (db *TimescaleDatabase) AddTriples(ctx context.Context, ds TripleDataset) e
 			return fmt.Errorf("Cannot insert triples for source %s: %w (temp insert)", ds.GetSource(), err)
 		}
 
-		_, err = txn.Exec(ctx, "INSERT INTO triples SELECT * FROM triplet ON CONFLICT (source, origin, time, s, p, o) DO NOTHING")
+		res, err := txn.Exec(ctx, "INSERT INTO triples SELECT * FROM triplet ON CONFLICT (source, origin, time, s, p, o) DO NOTHING")
 		if err != nil {
 			return fmt.Errorf("Cannot insert triples for source %s: %w (copy over)", ds.GetSource(), err)
 		}
+		inserted = res.RowsAffected()
 
 		_, err = txn.Exec(ctx, "DROP TABLE triplet")
 		if err != nil {
 			return fmt.Errorf("Cannot insert triples for source %s: %w (drop temp)", ds.GetSource(), err)
 		}
 
+		_, err = txn.Exec(ctx, "INSERT INTO triple_versions(source, origin, time) VALUES($1, $2, $3) ON CONFLICT DO NOTHING",
+			ds.GetSource(), ds.GetOrigin(), ds.GetTime())
+		if err != nil {
+			return fmt.Errorf("Cannot insert triples for source %s: %w (version)", ds.GetSource(), err)
+		}
+
+		if validation != ValidateNone {
+			if report, err = db.validateSource(ctx, txn, ds.GetSource(), nil); err != nil {
+				return err
+			}
+			if validation == ValidateBlock && report.HasViolations() {
+				return ErrValidationFailed
+			}
+		}
+
+		reconciled, err := reconcileStreams(ctx, txn, ds.GetSource(), true)
+		if err != nil {
+			return fmt.Errorf("Cannot reconcile streams for source %s: %w", ds.GetSource(), err)
+		}
+		log.Infof("Reconciled streams of %s: %d updated, %d points unknown, %d streams missing",
+			ds.GetSource(), len(reconciled.Updated), len(reconciled.UnknownPoints), len(reconciled.MissingStreams))
+
 		return nil
 	})
-	if err == nil {
-		log.Infof("Inserted %5d triples", num)
+	if errors.Is(err, ErrValidationFailed) {
+		return 0, report, err
+	} else if err != nil {
+		return 0, nil, err
 	}
-	return err
+	log.Infof("Inserted %5d triples (%d decoded)", inserted, num)
+	return inserted, report, nil
 }
 
 func (db *TimescaleDatabase) graphs(ctx context.Context) ([]string, error) {
@@ -593,6 +1182,7 @@ func (db *TimescaleDatabase) graphs(ctx context.Context) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		var g string
 		if err := rows.Scan(&g); err != nil {
@@ -600,80 +1190,11 @@ func (db *TimescaleDatabase) graphs(ctx context.Context) ([]string, error) {
 		}
 		graphs = append(graphs, g)
 	}
-	return graphs, nil
+	return graphs, rows.Err()
 }
 
-func (db *TimescaleDatabase) Qualify(ctx context.Context, qualifyQueryList []string) (map[string][]int, error) {
-	log := logging.FromContext(ctx)
-
-	var querySiteCounts = make(map[string][]int)
-
-	graphs, err := db.graphs(ctx)
-	if err != nil {
-		return querySiteCounts, err
-	}
-
-	numJobs := len(qualifyQueryList) * len(graphs)
-	tasks := make(chan queryTask, numJobs)
-	results := make(chan queryResult, numJobs)
-	errors := make(chan error, numJobs)
-	done := make(chan struct{})
-	var wg sync.WaitGroup
-	numWorkers := 4
-	wg.Add(numWorkers)
-	for i := 0; i < numWorkers; i++ {
-		wctx, _ := context.WithTimeout(ctx, config.DataReadTimeout)
-		wid := i
-		go func() {
-			for task := range tasks {
-				queryString := qualifyQueryList[task.queryIdx]
-				log.Infof("Querying graph %s with query %s", task.graph, queryString)
-				res, err := db.QuerySparql(wctx, task.graph, queryString)
-				if err != nil {
-					log.Errorf("Could not evaluate query %s: %w", queryString, err)
-					errors <- err
-					break
-				}
-				results <- queryResult{
-					queryTask:    task,
-					numSolutions: len(res.Solutions()),
-				}
-				log.Infof("Worker %d: Graph %s, Query %d, # results %d", wid, task.graph, task.queryIdx, len(res.Solutions()))
-			}
-			wg.Done()
-		}()
-	}
-
-	for queryIdx := range qualifyQueryList {
-		for _, graph := range graphs {
-			tasks <- queryTask{
-				graph:    graph,
-				queryIdx: queryIdx,
-			}
-		}
-	}
-	close(tasks)
-
-	go func() {
-		wg.Wait()
-		close(results)
-		done <- struct{}{}
-	}()
-
-	for res := range results {
-		if _, ok := querySiteCounts[res.graph]; !ok {
-			querySiteCounts[res.graph] = make([]int, len(qualifyQueryList))
-		}
-		querySiteCounts[res.graph][res.queryIdx] = res.numSolutions
-	}
-	select {
-	case err := <-errors:
-		return querySiteCounts, err
-	case <-done:
-	}
-	log.Infof("Qualify result: %+v", querySiteCounts)
-	return querySiteCounts, nil
-}
+// adminSource is the source of the admin permission, which covers the settings of every source
+const adminSource = "*"
 
 func (db *TimescaleDatabase) checkAuth(ctx context.Context, permission, source string) (bool, error) {
 	var numOk int
@@ -690,25 +1211,50 @@ func (db *TimescaleDatabase) checkAuth(ctx context.Context, permission, source s
 	return numOk > 0, nil
 }
 
-// writes NTriples serialization to  the writer
+// validApikey returns the key of the user, if it is registered
+func (db *TimescaleDatabase) validApikey(ctx context.Context) (string, error) {
+	var valid bool
+	apikey, _ := ctx.Value(ContextKey("user")).(string)
+	row := db.pool.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM apikeys WHERE apikey = $1)", apikey)
+	if err := row.Scan(&valid); err != nil {
+		return "", fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !valid {
+		return "", fmt.Errorf("Invalid apikey")
+	}
+	return apikey, nil
+}
+
+// checkOwnerAuth returns true if the user registered the object whose key is owner, or has the admin permission.
+// Objects without an owner (such as the ones the server registers itself) need the admin permission
+func (db *TimescaleDatabase) checkOwnerAuth(ctx context.Context, owner string) (bool, error) {
+	if apikey, _ := ctx.Value(ContextKey("user")).(string); len(owner) > 0 && apikey == owner {
+		return true, nil
+	}
+	return db.checkAuth(ctx, "admin", adminSource)
+}
+
+// GetGraph streams the triples of the source as of req.Timestamp (the current time, if unset) to the writer,
+// serialized as req.MediaType. If req.Origin is set, only the triples from that origin are written
 func (db *TimescaleDatabase) GetGraph(ctx context.Context, req *ModelRequest, w io.Writer) error {
 	log := logging.FromContext(ctx)
-	rows, err := db.pool.Query(ctx, `WITH latest AS (SELECT source, origin, MAX(time) as time
-													 FROM triples WHERE time <= $1 and source = $2
-													 GROUP BY source, origin)
-									 SELECT s, p, o FROM triples
-									 RIGHT JOIN latest USING(source, origin, time) order by s, p, o;`, req.Timestamp, req.Graph)
+	timestamp := req.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	rows, err := db.pool.Query(ctx, `SELECT DISTINCT s, p, o FROM (`+graphAsOfSQL("$1", "$2")+`) AS graph
+									 WHERE $3 = '' OR origin = $3
+									 ORDER BY s, p, o`, timestamp, req.Graph, req.Origin)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
-	enc := rdf.NewTripleEncoder(w, rdf.Turtle)
 	log.Infof("Get graph %+v", req)
 
-	triplesBuffer := bytes.NewBuffer(nil)
-	dec := rdf.NewTripleDecoder(triplesBuffer, rdf.NTriples)
-
-	a := 0
+	gw, err := newGraphWriter(w, req.MediaType, req.Graph)
+	if err != nil {
+		return err
+	}
+	i := 0
 	for rows.Next() {
 		var s, p, o string
 		if err := rows.Scan(&s, &p, &o); err != nil {
@@ -716,41 +1262,22 @@ func (db *TimescaleDatabase) GetGraph(ctx context.Context, req *ModelRequest, w
 			log.Error(err)
 			return err
 		}
-		fstring := "%s %s %s .\n"
-		if strings.HasPrefix(o, "\"") {
-			o = strconv.Quote(o)
-		}
-		if _, err := fmt.Fprintf(triplesBuffer, fstring, s, p, o); err != nil {
-			err = fmt.Errorf("Could not write row into decoder: %s", err)
-			log.Error(err)
-			return err
-		}
-		a += 1
-	}
-
-	i := 0
-	for triple, err := dec.Decode(); err != io.EOF; triple, err = dec.Decode() {
+		triple, err := parseGraphTriple(s, p, o)
 		if err != nil {
-			err = fmt.Errorf("(graph %s) Could not decode triple for graph from database (%d): %s", req.Graph, i, err)
+			err = fmt.Errorf("(graph %s) Could not decode triple for graph from database (%d): %w", req.Graph, i, err)
 			log.Error(err)
 			return err
-		} else if err := enc.Encode(triple); err != nil {
-			err = fmt.Errorf("(graph %s) Could not encode triple %s from database: %s", req.Graph, triple, err)
+		}
+		if err := gw.write(triple); err != nil {
+			err = fmt.Errorf("(graph %s) Could not encode triple %s %s %s from database: %w", req.Graph, s, p, o, err)
 			log.Error(err)
 			return err
 		}
 		i += 1
 	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("(graph %s) Could not read triples: %w", req.Graph, err)
+	}
 
-	return enc.Close()
-}
-
-type queryTask struct {
-	graph    string
-	queryIdx int
-}
-
-type queryResult struct {
-	queryTask
-	numSolutions int
+	return gw.Close()
 }
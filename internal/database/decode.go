@@ -0,0 +1,187 @@
+package database
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/knakk/rdf"
+)
+
+// FormatJSONLD extends the formats of the rdf package, which cannot decode JSON-LD
+const FormatJSONLD rdf.Format = 1000
+
+// maximum length of a line in an N-Triples or N-Quads document, in bytes
+const maxLineLength = 1024 * 1024
+
+// TripleParseError is a syntax error in an RDF document. Line is 0 if the position of the error is unknown
+type TripleParseError struct {
+	Line    int
+	Message string
+	// the error is confined to its line, and decoding continues after it
+	skippable bool
+}
+
+func (e *TripleParseError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("Line %d: %s", e.Line, e.Message)
+	}
+	return e.Message
+}
+
+// Skippable returns true if the decoding of the document continues after the error: only malformed lines of
+// N-Triples and N-Quads documents can be skipped
+func (e *TripleParseError) Skippable() bool {
+	return e.skippable
+}
+
+// the rdf package prefixes its syntax errors with the line and column
+var rdfErrorPosition = regexp.MustCompile(`^(\d+):(\d+):?\s*`)
+
+func newTripleParseError(err error) *TripleParseError {
+	msg := err.Error()
+	if match := rdfErrorPosition.FindStringSubmatch(msg); match != nil {
+		line, _ := strconv.Atoi(match[1])
+		return &TripleParseError{Line: line, Message: strings.TrimPrefix(msg, match[0])}
+	}
+	return &TripleParseError{Message: msg}
+}
+
+// NewTripleDecoder returns a decoder for the document in the given format whose errors are
+// *TripleParseErrors. The decoders of line-based formats (N-Triples, N-Quads) skip malformed lines:
+// decoding can continue after an error, which is Skippable. The decoders of the other formats stop at
+// the first error. The graph names of N-Quads are ignored
+func NewTripleDecoder(r io.Reader, format rdf.Format) rdf.TripleDecoder {
+	switch format {
+	case rdf.NTriples, rdf.NQuads:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), maxLineLength)
+		return &lineTripleDecoder{lines: scanner, format: format}
+	case FormatJSONLD:
+		triples, err := decodeJSONLD(r)
+		return &sliceTripleDecoder{triples: triples, err: err}
+	}
+	return &documentTripleDecoder{dec: rdf.NewTripleDecoder(r, format)}
+}
+
+// lineTripleDecoder decodes N-Triples or N-Quads one line at a time
+type lineTripleDecoder struct {
+	lines  *bufio.Scanner
+	format rdf.Format
+	line   int
+}
+
+func (d *lineTripleDecoder) Decode() (rdf.Triple, error) {
+	for d.lines.Scan() {
+		d.line++
+		line := strings.TrimSpace(d.lines.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var (
+			triple rdf.Triple
+			err    error
+		)
+		if d.format == rdf.NQuads {
+			var quad rdf.Quad
+			quad, err = rdf.NewQuadDecoder(strings.NewReader(line), rdf.NQuads).Decode()
+			triple = quad.Triple
+		} else {
+			triple, err = rdf.NewTripleDecoder(strings.NewReader(line), rdf.NTriples).Decode()
+		}
+		if err == nil && !isComplete(triple) {
+			err = errors.New("Could not parse triple")
+		}
+		if err != nil {
+			perr := newTripleParseError(err)
+			// errors are reported relative to the line we handed to the decoder
+			perr.Line, perr.skippable = d.line, true
+			return triple, perr
+		}
+		return triple, nil
+	}
+	if err := d.lines.Err(); err != nil {
+		return rdf.Triple{}, &TripleParseError{Line: d.line + 1, Message: err.Error()}
+	}
+	return rdf.Triple{}, io.EOF
+}
+
+func (d *lineTripleDecoder) DecodeAll() ([]rdf.Triple, error) {
+	return decodeAll(d)
+}
+
+// documentTripleDecoder wraps the rdf package decoders, which cannot recover from syntax errors
+type documentTripleDecoder struct {
+	dec  rdf.TripleDecoder
+	done bool
+}
+
+func (d *documentTripleDecoder) Decode() (rdf.Triple, error) {
+	if d.done {
+		return rdf.Triple{}, io.EOF
+	}
+	triple, err := d.dec.Decode()
+	if err == io.EOF {
+		return triple, err
+	}
+	// sometimes the triple is not nil, but all the fields are nil; this happens because of a parse error
+	if err == nil && !isComplete(triple) {
+		err = errors.New("Could not parse triple")
+	}
+	if err != nil {
+		d.done = true
+		return triple, newTripleParseError(err)
+	}
+	return triple, nil
+}
+
+func (d *documentTripleDecoder) DecodeAll() ([]rdf.Triple, error) {
+	return decodeAll(d)
+}
+
+// sliceTripleDecoder returns triples that have already been decoded, followed by the decoding error (if any)
+type sliceTripleDecoder struct {
+	triples []rdf.Triple
+	err     error
+}
+
+func (d *sliceTripleDecoder) Decode() (rdf.Triple, error) {
+	if d.err != nil {
+		err := d.err
+		d.err = nil
+		return rdf.Triple{}, err
+	}
+	if len(d.triples) == 0 {
+		return rdf.Triple{}, io.EOF
+	}
+	triple := d.triples[0]
+	d.triples = d.triples[1:]
+	return triple, nil
+}
+
+func (d *sliceTripleDecoder) DecodeAll() ([]rdf.Triple, error) {
+	return decodeAll(d)
+}
+
+// decodeAll decodes triples until the end of the document or the first error
+func decodeAll(dec rdf.TripleDecoder) ([]rdf.Triple, error) {
+	var triples []rdf.Triple
+	for {
+		triple, err := dec.Decode()
+		if err == io.EOF {
+			return triples, nil
+		} else if err != nil {
+			return triples, err
+		}
+		triples = append(triples, triple)
+	}
+}
+
+func isComplete(triple rdf.Triple) bool {
+	return triple.Subj != nil && triple.Pred != nil && triple.Obj != nil
+}
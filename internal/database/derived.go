@@ -0,0 +1,388 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// derivedStream is a stream whose readings are computed at query time from the readings of other streams
+type derivedStream struct {
+	stream Stream
+	expr   expression
+	// the stream id of each input of the expression
+	inputs map[string]int
+}
+
+// series is the readings of a stream, ordered by time
+type series struct {
+	times  []time.Time
+	values []float64
+}
+
+// at returns the value of the series at t, interpolated linearly between the readings around t.
+// There is no value before the first reading or after the last one
+func (s *series) at(t time.Time) (float64, bool) {
+	i := sort.Search(len(s.times), func(i int) bool { return !s.times[i].Before(t) })
+	switch {
+	case i == len(s.times):
+		return 0, false
+	case s.times[i].Equal(t):
+		return s.values[i], true
+	case i == 0:
+		return 0, false
+	}
+	t0, t1 := s.times[i-1], s.times[i]
+	frac := float64(t.Sub(t0)) / float64(t1.Sub(t0))
+	return s.values[i-1] + frac*(s.values[i]-s.values[i-1]), true
+}
+
+// checkExpression validates the expression of a derived stream being registered: stream ids must name
+// stored (not derived) streams of the same source, and SPARQL variables need a query that binds them
+func checkExpression(ctx context.Context, q querier, stream *Stream) error {
+	expr, err := parseExpression(stream.Expression)
+	if err != nil {
+		return fmt.Errorf("Invalid expression '%s': %w", stream.Expression, err)
+	}
+	var ids []int64
+	for _, input := range uniqueStrings(expr.inputs(nil)) {
+		if strings.HasPrefix(input, "?") {
+			if len(stream.ExpressionQuery) == 0 {
+				return fmt.Errorf("Expression uses %s but has no ExpressionQuery", input)
+			}
+			continue
+		}
+		id, err := strconv.ParseInt(input[1:], 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid stream id %s: %w", input, err)
+		}
+		ids = append(ids, id)
+	}
+	stored, err := storedStreams(ctx, q, stream.SourceName, ids)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if !stored[int(id)] {
+			return fmt.Errorf("Expression input $%d is not a stored numeric stream of %s", id, stream.SourceName)
+		}
+	}
+	return nil
+}
+
+// storedStreams returns which of the ids are numeric streams of the source that are not derived
+func storedStreams(ctx context.Context, q querier, source string, ids []int64) (map[int]bool, error) {
+	stored := make(map[int]bool)
+	rows, err := q.Query(ctx, `SELECT id FROM streams WHERE id = ANY($1) AND source = $2 AND expression IS NULL
+							   AND value_type <> 'string'`, ids, source)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query streams: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		stored[id] = true
+	}
+	return stored, rows.Err()
+}
+
+// derivedStreams returns the derived streams among the ids, with their inputs resolved to stored streams.
+// Streams whose inputs cannot be resolved are skipped
+func (db *TimescaleDatabase) derivedStreams(ctx context.Context, ids []int64) ([]*derivedStream, error) {
+	log := logging.FromContext(ctx)
+	rows, err := db.pool.Query(ctx, `SELECT id, source, name, units, brick_uri, brick_class, expression, expression_query
+									 FROM streams WHERE id = ANY($1) AND expression IS NOT NULL ORDER BY id`, ids)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query derived streams: %w", err)
+	}
+	type definition struct {
+		stream Stream
+		query  string
+	}
+	var definitions []definition
+	for rows.Next() {
+		var (
+			def                  definition
+			brickURI, brickClass *string
+			query                *string
+		)
+		if err := rows.Scan(&def.stream.id, &def.stream.SourceName, &def.stream.Name, &def.stream.Units, &brickURI, &brickClass,
+			&def.stream.Expression, &query); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		if brickURI != nil {
+			def.stream.BrickURI = *brickURI
+		}
+		if brickClass != nil {
+			def.stream.BrickClass = *brickClass
+		}
+		if query != nil {
+			def.stream.ExpressionQuery = *query
+		}
+		definitions = append(definitions, def)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Could not query derived streams: %w", err)
+	}
+
+	var derived []*derivedStream
+	for _, def := range definitions {
+		d, err := db.resolveDerivedStream(ctx, def.stream)
+		if err != nil {
+			log.Warnf("Skipping derived stream %s/%s: %s", def.stream.SourceName, def.stream.Name, err)
+			continue
+		}
+		derived = append(derived, d)
+	}
+	return derived, nil
+}
+
+// resolveDerivedStream resolves the inputs of a derived stream: stream ids directly, and SPARQL variables
+// through the streams that their values in the first solution of the ExpressionQuery (evaluated against the
+// latest model of the source of the stream) refer to
+func (db *TimescaleDatabase) resolveDerivedStream(ctx context.Context, stream Stream) (*derivedStream, error) {
+	expr, err := parseExpression(stream.Expression)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid expression '%s': %w", stream.Expression, err)
+	}
+	d := &derivedStream{stream: stream, expr: expr, inputs: make(map[string]int)}
+
+	var (
+		candidates = make(map[string][]Stream)
+		ids        []int64
+		vars       []string
+	)
+	for _, input := range uniqueStrings(expr.inputs(nil)) {
+		if strings.HasPrefix(input, "?") {
+			vars = append(vars, input)
+			continue
+		}
+		id, err := strconv.Atoi(input[1:])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid stream id %s: %w", input, err)
+		}
+		candidates[input] = []Stream{{id: id}}
+		ids = append(ids, int64(id))
+	}
+
+	if len(vars) > 0 {
+		res, err := db.QuerySparqlProtocol(ctx, &SparqlProtocolRequest{Query: stream.ExpressionQuery, DefaultSources: []string{stream.SourceName}})
+		if err != nil {
+			return nil, err
+		}
+		if res.IsGraph() {
+			return nil, fmt.Errorf("%w: ExpressionQuery must be a SELECT query", ErrInvalidQuery)
+		}
+		solutions := res.Results.solutions()
+		if len(solutions) == 0 {
+			return nil, fmt.Errorf("ExpressionQuery has no solution in %s", stream.SourceName)
+		}
+		var terms []SparqlTerm
+		for _, v := range vars {
+			term, ok := solutions[0][v[1:]]
+			if !ok {
+				return nil, fmt.Errorf("ExpressionQuery does not bind %s", v)
+			}
+			terms = append(terms, term)
+		}
+		resolver, err := db.newStreamResolver(ctx, stream.SourceName, nil, terms)
+		if err != nil {
+			return nil, err
+		}
+		for idx, v := range vars {
+			candidates[v] = resolver.resolve(terms[idx])
+			for _, s := range candidates[v] {
+				ids = append(ids, int64(s.id))
+			}
+		}
+	}
+
+	stored, err := storedStreams(ctx, db.pool, stream.SourceName, ids)
+	if err != nil {
+		return nil, err
+	}
+	for input, streams := range candidates {
+		for _, s := range streams {
+			if stored[s.id] {
+				d.inputs[input] = s.id
+				break
+			}
+		}
+		if _, ok := d.inputs[input]; !ok {
+			return nil, fmt.Errorf("Input %s is not a stored stream of %s", input, stream.SourceName)
+		}
+	}
+	return d, nil
+}
+
+// derivedReadings computes the readings of the derived streams between the start and end of the query. The
+// inputs of each stream are aligned on the union of their reading times, interpolating linearly between readings;
+// times before the first or after the last reading of an input, and undefined results (e.g. a division by zero),
+// have no reading. If the query has an aggregation of values, the readings are aggregated like stored readings
+func (db *TimescaleDatabase) derivedReadings(ctx context.Context, q *Query, derived []*derivedStream) (map[int][]Reading, error) {
+	var ids []int64
+	for _, d := range derived {
+		for _, id := range d.inputs {
+			ids = append(ids, int64(id))
+		}
+	}
+	rows, err := db.pool.Query(ctx, `SELECT stream_id, time, value `+readingsFrom(q, "unified")+` ORDER BY stream_id, time`,
+		q.Start.Format(time.RFC3339), q.End.Format(time.RFC3339), ids)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query inputs of derived streams: %w", err)
+	}
+	inputs := make(map[int]*series)
+	for rows.Next() {
+		var (
+			id int
+			t  time.Time
+			v  float64
+		)
+		if err := rows.Scan(&id, &t, &v); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		s, ok := inputs[id]
+		if !ok {
+			s = &series{}
+			inputs[id] = s
+		}
+		s.times = append(s.times, t)
+		s.values = append(s.values, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Could not query inputs of derived streams: %w", err)
+	}
+
+	readings := make(map[int][]Reading)
+	for _, d := range derived {
+		var times []time.Time
+		for _, id := range d.inputs {
+			if s, ok := inputs[id]; ok {
+				times = append(times, s.times...)
+			}
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+		var result []Reading
+		values := make(map[string]float64, len(d.inputs))
+	times:
+		for idx, t := range times {
+			if idx > 0 && t.Equal(times[idx-1]) {
+				continue
+			}
+			for input, id := range d.inputs {
+				s, ok := inputs[id]
+				if !ok {
+					break times
+				}
+				v, ok := s.at(t)
+				if !ok {
+					continue times
+				}
+				values[input] = v
+			}
+			v := d.expr.eval(values)
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			result = append(result, Reading{Time: t, Value: v})
+		}
+		// aggregations of states are computed with the stored readings
+		if q.AggregationFunc != nil && q.AggregationWindow != nil && !q.AggregationFunc.isState() {
+			result = aggregateReadings(result, *q.AggregationFunc, *q.AggregationWindow, q.Location)
+		}
+		readings[d.stream.id] = result
+	}
+	return readings, nil
+}
+
+// aggregateReadings aggregates readings (ordered by time) into buckets of the window, like time_bucket
+func aggregateReadings(readings []Reading, agg AggregationType, window Window, loc *time.Location) []Reading {
+	var (
+		result []Reading
+		bucket []float64
+		start  time.Time
+	)
+	flush := func() {
+		if len(bucket) == 0 {
+			return
+		}
+		result = append(result, Reading{Time: start, Value: aggregateValues(bucket, agg)})
+		bucket = bucket[:0]
+	}
+	for _, rdg := range readings {
+		if b := bucketStart(rdg.Time, window, loc); !b.Equal(start) || len(bucket) == 0 {
+			flush()
+			start = b
+		}
+		bucket = append(bucket, rdg.Value)
+	}
+	flush()
+	return result
+}
+
+// bucketStart returns the start of the bucket of the window that t falls in, with the origins of time_bucket:
+// buckets of months start on 2000-01-01 and other buckets on Monday 2000-01-03, in the local time of loc
+func bucketStart(t time.Time, window Window, loc *time.Location) time.Time {
+	if loc == nil {
+		loc = time.UTC
+	}
+	local := t.In(loc)
+	if window.Months > 0 {
+		months := (local.Year()-2000)*12 + int(local.Month()) - 1
+		n := months / window.Months
+		if months < 0 && months%window.Months != 0 {
+			n--
+		}
+		return time.Date(2000, time.Month(1+n*window.Months), 1, 0, 0, 0, 0, loc)
+	}
+	// bucket the wall clock time, so that days follow the local calendar
+	wall := time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), local.Nanosecond(), time.UTC)
+	origin := time.Date(2000, time.January, 3, 0, 0, 0, 0, time.UTC)
+	width := time.Duration(window.Days)*24*time.Hour + window.Duration
+	n := wall.Sub(origin) / width
+	if wall.Before(origin.Add(n * width)) {
+		n--
+	}
+	start := origin.Add(n * width)
+	return time.Date(start.Year(), start.Month(), start.Day(), start.Hour(), start.Minute(), start.Second(), start.Nanosecond(), loc)
+}
+
+// aggregateValues aggregates a non-empty list of values
+func aggregateValues(values []float64, agg AggregationType) float64 {
+	v := values[0]
+	switch agg {
+	case AggregationMean, AggregationSum:
+		v = 0
+		for _, x := range values {
+			v += x
+		}
+		if agg == AggregationMean {
+			v /= float64(len(values))
+		}
+	case AggregationMax:
+		for _, x := range values {
+			v = math.Max(v, x)
+		}
+	case AggregationMin:
+		for _, x := range values {
+			v = math.Min(v, x)
+		}
+	case AggregationCount:
+		v = float64(len(values))
+	}
+	return v
+}
@@ -0,0 +1,298 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// expression is the arithmetic expression of a derived stream. Its inputs are stream ids ($12) and the
+// variables of a SPARQL query (?supply); e.g. "?supply - ?return" or "$12 * $13 / 1000"
+type expression interface {
+	// eval computes the expression given the value of each input
+	eval(inputs map[string]float64) float64
+	// inputs appends the inputs of the expression
+	inputs(names []string) []string
+}
+
+type numberExpr float64
+
+type inputExpr string
+
+type negateExpr struct {
+	arg expression
+}
+
+type binaryExpr struct {
+	op          byte
+	left, right expression
+}
+
+type callExpr struct {
+	fn   string
+	args []expression
+}
+
+// number of arguments of each function (-1: any number, at least one). Comparisons return 1 (true) or 0 (false),
+// and if(c, a, b) is a if c is not 0 and b otherwise
+var expressionFunctions = map[string]int{"abs": 1, "sqrt": 1, "pow": 2, "min": -1, "max": -1,
+	"gt": 2, "ge": 2, "lt": 2, "le": 2, "if": 3}
+
+func (e numberExpr) eval(map[string]float64) float64        { return float64(e) }
+func (e numberExpr) inputs(names []string) []string         { return names }
+func (e inputExpr) eval(inputs map[string]float64) float64  { return inputs[string(e)] }
+func (e inputExpr) inputs(names []string) []string          { return append(names, string(e)) }
+func (e negateExpr) eval(inputs map[string]float64) float64 { return -e.arg.eval(inputs) }
+func (e negateExpr) inputs(names []string) []string         { return e.arg.inputs(names) }
+
+func (e binaryExpr) eval(inputs map[string]float64) float64 {
+	left, right := e.left.eval(inputs), e.right.eval(inputs)
+	switch e.op {
+	case '+':
+		return left + right
+	case '-':
+		return left - right
+	case '*':
+		return left * right
+	}
+	return left / right
+}
+
+func (e binaryExpr) inputs(names []string) []string {
+	return e.right.inputs(e.left.inputs(names))
+}
+
+func (e callExpr) eval(inputs map[string]float64) float64 {
+	args := make([]float64, len(e.args))
+	for idx, arg := range e.args {
+		args[idx] = arg.eval(inputs)
+	}
+	switch e.fn {
+	case "abs":
+		return math.Abs(args[0])
+	case "sqrt":
+		return math.Sqrt(args[0])
+	case "pow":
+		return math.Pow(args[0], args[1])
+	case "gt":
+		return boolValue(args[0] > args[1])
+	case "ge":
+		return boolValue(args[0] >= args[1])
+	case "lt":
+		return boolValue(args[0] < args[1])
+	case "le":
+		return boolValue(args[0] <= args[1])
+	case "if":
+		if args[0] != 0 {
+			return args[1]
+		}
+		return args[2]
+	case "min", "max":
+		v := args[0]
+		for _, arg := range args[1:] {
+			if e.fn == "min" {
+				v = math.Min(v, arg)
+			} else {
+				v = math.Max(v, arg)
+			}
+		}
+		return v
+	}
+	return math.NaN()
+}
+
+func (e callExpr) inputs(names []string) []string {
+	for _, arg := range e.args {
+		names = arg.inputs(names)
+	}
+	return names
+}
+
+// expressionParser is a recursive descent parser of expressions:
+//
+//	expr    := term (('+' | '-') term)*
+//	term    := unary (('*' | '/') unary)*
+//	unary   := '-' unary | primary
+//	primary := number | '$' id | '?' variable | function '(' expr (',' expr)* ')' | '(' expr ')'
+type expressionParser struct {
+	src string
+	pos int
+}
+
+// parseExpression parses the expression of a derived stream
+func parseExpression(src string) (expression, error) {
+	p := &expressionParser{src: src}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.skip(); p.pos < len(p.src) {
+		return nil, fmt.Errorf("Unexpected '%c' at %d", p.src[p.pos], p.pos)
+	}
+	return e, nil
+}
+
+func (p *expressionParser) skip() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// peek returns the next character that is not a space, or 0 at the end of the expression
+func (p *expressionParser) peek() byte {
+	if p.skip(); p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+// word consumes the characters that match the predicate
+func (p *expressionParser) word(match func(c byte) bool) string {
+	start := p.pos
+	for p.pos < len(p.src) && match(p.src[p.pos]) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *expressionParser) expr() (expression, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) term() (expression, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) unary() (expression, error) {
+	if p.peek() == '-' {
+		p.pos++
+		arg, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return negateExpr{arg: arg}, nil
+	}
+	return p.primary()
+}
+
+func (p *expressionParser) primary() (expression, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, errors.New("Unexpected end of expression")
+	case c == '(':
+		p.pos++
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("Expected ')' at %d", p.pos)
+		}
+		p.pos++
+		return e, nil
+	case c == '$':
+		p.pos++
+		id := p.word(isDigit)
+		if len(id) == 0 {
+			return nil, fmt.Errorf("Expected a stream id at %d", p.pos)
+		}
+		return inputExpr("$" + id), nil
+	case c == '?':
+		p.pos++
+		name := p.word(isNameChar)
+		if len(name) == 0 {
+			return nil, fmt.Errorf("Expected a variable name at %d", p.pos)
+		}
+		return inputExpr("?" + name), nil
+	case isDigit(c) || c == '.':
+		start := p.pos
+		p.word(func(c byte) bool { return isDigit(c) || c == '.' })
+		// exponent
+		if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+			p.pos++
+			if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+				p.pos++
+			}
+			p.word(isDigit)
+		}
+		v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number %s", p.src[start:p.pos])
+		}
+		return numberExpr(v), nil
+	case isNameChar(c):
+		fn := strings.ToLower(p.word(isNameChar))
+		arity, ok := expressionFunctions[fn]
+		if !ok {
+			return nil, fmt.Errorf("Unknown function %s", fn)
+		}
+		if p.peek() != '(' {
+			return nil, fmt.Errorf("Expected '(' after %s", fn)
+		}
+		p.pos++
+		var args []expression
+		for {
+			arg, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("Expected ')' at %d", p.pos)
+		}
+		p.pos++
+		if arity >= 0 && len(args) != arity {
+			return nil, fmt.Errorf("Function %s takes %d arguments", fn, arity)
+		}
+		return callExpr{fn: fn, args: args}, nil
+	}
+	return nil, fmt.Errorf("Unexpected '%c' at %d", c, p.pos)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
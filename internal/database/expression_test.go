@@ -0,0 +1,114 @@
+package database
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpressionEval(t *testing.T) {
+	inputs := map[string]float64{"$12": 10, "$13": 4, "?supply": 55, "?return": 45}
+	for _, tc := range []struct {
+		src  string
+		want float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"16 / 4 / 2", 2},
+		{"2 * 3 + 4 * 5", 26},
+		{"-2 * 3", -6},
+		{"-(2 + 3)", -5},
+		{"--4", 4},
+		{"2 - -3", 5},
+		{"-?supply + ?return", -10},
+		{"?supply - ?return", 10},
+		{"$12 * $13 / 1000", 0.04},
+		{"1.5e2 + .5", 150.5},
+		{"abs(-3)", 3},
+		{"sqrt(16)", 4},
+		{"pow(2, 10)", 1024},
+		{"min($12, $13, 7)", 4},
+		{"MAX($12, $13)", 10},
+		{"gt($12, $13) + lt($12, $13)", 1},
+		{"ge(4, 4) + le(5, 4)", 1},
+		{"if(gt(?supply, ?return), ?supply, ?return)", 55},
+		{"if(0, 1, 2)", 2},
+		{"?missing + 1", 1},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			e, err := parseExpression(tc.src)
+			if err != nil {
+				t.Fatalf("Could not parse: %s", err)
+			}
+			if got := e.eval(inputs); math.Abs(got-tc.want) > 1e-9 {
+				t.Errorf("Got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExpressionDivisionByZero(t *testing.T) {
+	for _, tc := range []struct {
+		src   string
+		check func(float64) bool
+	}{
+		{"1 / 0", func(v float64) bool { return math.IsInf(v, 1) }},
+		{"-1 / $0", func(v float64) bool { return math.IsInf(v, -1) }},
+		{"0 / 0", math.IsNaN},
+		{"sqrt(-1)", math.IsNaN},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			e, err := parseExpression(tc.src)
+			if err != nil {
+				t.Fatalf("Could not parse: %s", err)
+			}
+			// non-finite values are not written to derived streams
+			if got := e.eval(map[string]float64{"$0": 0}); !tc.check(got) {
+				t.Errorf("Got %v", got)
+			}
+		})
+	}
+}
+
+func TestExpressionInputs(t *testing.T) {
+	e, err := parseExpression("if(gt($12, ?supply), -$13, abs(?return)) * 2")
+	if err != nil {
+		t.Fatalf("Could not parse: %s", err)
+	}
+	want := []string{"$12", "?supply", "$13", "?return"}
+	if got := e.inputs(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got inputs %v, want %v", got, want)
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src string
+		err string
+	}{
+		{"", "Unexpected end of expression"},
+		{"1 +", "Unexpected end of expression"},
+		{"(1 + 2", "Expected ')'"},
+		{"1 + 2)", "Unexpected ')'"},
+		{"$", "Expected a stream id"},
+		{"?", "Expected a variable name"},
+		{"1.2.3", "Invalid number 1.2.3"},
+		{"log(2)", "Unknown function log"},
+		{"abs 2", "Expected '(' after abs"},
+		{"abs(1, 2)", "Function abs takes 1 arguments"},
+		{"pow(2)", "Function pow takes 2 arguments"},
+		{"if(1, 2)", "Function if takes 3 arguments"},
+		{"min()", "Unexpected ')'"},
+		{"abs(1", "Expected ')'"},
+		{"1 % 2", "Unexpected '%'"},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			_, err := parseExpression(tc.src)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("Got error %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
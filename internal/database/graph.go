@@ -0,0 +1,379 @@
+package database
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/knakk/rdf"
+)
+
+// GraphMediaTypes are the serializations GetGraph supports, in order of preference
+var GraphMediaTypes = []string{MediaTypeTurtle, MediaTypeNTriples, MediaTypeNQuads, MediaTypeJSONLD, MediaTypeRDFXML}
+
+const (
+	rdfNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	rdfType      = rdfNamespace + "type"
+	xsdString    = xsdNamespace + "string"
+)
+
+// term is an RDF term parsed from its N-Triples serialization in the triples table
+type term struct {
+	kind rdf.TermType
+	// the IRI, the blank node label or the lexical form of the literal
+	value    string
+	lang     string
+	datatype string
+}
+
+// parseTerm parses a term from the triples table. Values that are not N-Triples terms
+// are treated as plain literals
+func parseTerm(s string) (term, error) {
+	switch {
+	case strings.HasPrefix(s, "<") && strings.HasSuffix(s, ">"):
+		return term{kind: rdf.TermIRI, value: s[1 : len(s)-1]}, nil
+	case strings.HasPrefix(s, "_:"):
+		return term{kind: rdf.TermBlank, value: s[2:]}, nil
+	case !strings.HasPrefix(s, `"`):
+		return term{kind: rdf.TermLiteral, value: s}, nil
+	}
+
+	end, err := stringEnd(s, 0)
+	if err != nil {
+		return term{}, fmt.Errorf("Invalid literal %s: %w", s, err)
+	}
+	value, err := unescapeLiteral(s[1:end])
+	if err != nil {
+		return term{}, fmt.Errorf("Invalid literal %s: %w", s, err)
+	}
+	t := term{kind: rdf.TermLiteral, value: value}
+	switch suffix := s[end+1:]; {
+	case len(suffix) == 0:
+	case strings.HasPrefix(suffix, "@"):
+		t.lang = suffix[1:]
+	case strings.HasPrefix(suffix, "^^<") && strings.HasSuffix(suffix, ">"):
+		if dt := suffix[3 : len(suffix)-1]; dt != xsdString {
+			t.datatype = dt
+		}
+	default:
+		return term{}, fmt.Errorf("Invalid literal %s", s)
+	}
+	return t, nil
+}
+
+// unescapeLiteral resolves the escape sequences in the lexical form of an N-Triples literal
+func unescapeLiteral(s string) (string, error) {
+	var b strings.Builder
+	for len(s) > 0 {
+		// strconv does not accept \' inside a double-quoted string
+		if strings.HasPrefix(s, `\'`) {
+			b.WriteByte('\'')
+			s = s[2:]
+			continue
+		}
+		r, _, tail, err := strconv.UnquoteChar(s, '"')
+		if err != nil {
+			return "", err
+		}
+		b.WriteRune(r)
+		s = tail
+	}
+	return b.String(), nil
+}
+
+func (t term) rdf() (rdf.Term, error) {
+	switch {
+	case t.kind == rdf.TermIRI:
+		iri, err := rdf.NewIRI(t.value)
+		return iri, err
+	case t.kind == rdf.TermBlank:
+		blank, err := rdf.NewBlank(t.value)
+		return blank, err
+	case len(t.lang) > 0:
+		lit, err := rdf.NewLangLiteral(t.value, t.lang)
+		return lit, err
+	case len(t.datatype) > 0:
+		dt, err := rdf.NewIRI(t.datatype)
+		if err != nil {
+			return nil, err
+		}
+		return rdf.NewTypedLiteral(t.value, dt), nil
+	}
+	lit, err := rdf.NewLiteral(t.value)
+	return lit, err
+}
+
+// jsonld returns the JSON-LD node reference or value object for the term
+func (t term) jsonld() map[string]string {
+	switch {
+	case t.kind == rdf.TermIRI:
+		return map[string]string{"@id": t.value}
+	case t.kind == rdf.TermBlank:
+		return map[string]string{"@id": "_:" + t.value}
+	case len(t.lang) > 0:
+		return map[string]string{"@value": t.value, "@language": t.lang}
+	case len(t.datatype) > 0:
+		return map[string]string{"@value": t.value, "@type": t.datatype}
+	}
+	return map[string]string{"@value": t.value}
+}
+
+// graphTriple is a triple from the triples table
+type graphTriple struct {
+	s, p, o term
+}
+
+func parseGraphTriple(s, p, o string) (graphTriple, error) {
+	var (
+		t   graphTriple
+		err error
+	)
+	if t.s, err = parseTerm(s); err != nil {
+		return t, err
+	} else if t.s.kind == rdf.TermLiteral {
+		return t, fmt.Errorf("Subject %s is a literal", s)
+	}
+	if t.p, err = parseTerm(p); err != nil {
+		return t, err
+	} else if t.p.kind != rdf.TermIRI {
+		return t, fmt.Errorf("Predicate %s is not an IRI", p)
+	}
+	if t.o, err = parseTerm(o); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+func (t graphTriple) rdf() (rdf.Triple, error) {
+	s, err := t.s.rdf()
+	if err != nil {
+		return rdf.Triple{}, err
+	}
+	p, err := t.p.rdf()
+	if err != nil {
+		return rdf.Triple{}, err
+	}
+	o, err := t.o.rdf()
+	if err != nil {
+		return rdf.Triple{}, err
+	}
+	return rdf.Triple{Subj: s.(rdf.Subject), Pred: p.(rdf.Predicate), Obj: o.(rdf.Object)}, nil
+}
+
+// graphWriter serializes the triples of a source. Triples must be written grouped by subject
+type graphWriter interface {
+	write(graphTriple) error
+	Close() error
+}
+
+// newGraphWriter returns a graphWriter for one of the GraphMediaTypes. Formats that support
+// named graphs put the triples in the graph of the source
+func newGraphWriter(w io.Writer, mediaType, source string) (graphWriter, error) {
+	switch mediaType {
+	case MediaTypeTurtle, "":
+		return &encoderGraphWriter{triples: rdf.NewTripleEncoder(w, rdf.Turtle)}, nil
+	case MediaTypeNTriples:
+		return &encoderGraphWriter{triples: rdf.NewTripleEncoder(w, rdf.NTriples)}, nil
+	case MediaTypeNQuads:
+		graph, err := rdf.NewIRI("urn:" + source)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid graph name for %s: %w", source, err)
+		}
+		return &encoderGraphWriter{quads: rdf.NewQuadEncoder(w, rdf.NQuads), graph: graph}, nil
+	case MediaTypeJSONLD:
+		return newJSONLDGraphWriter(w, source)
+	case MediaTypeRDFXML:
+		return newRDFXMLGraphWriter(w)
+	}
+	return nil, fmt.Errorf("Cannot serialize graph as %s", mediaType)
+}
+
+// encoderGraphWriter uses the rdf package encoders for Turtle, N-Triples and N-Quads
+type encoderGraphWriter struct {
+	triples *rdf.TripleEncoder
+	quads   *rdf.QuadEncoder
+	graph   rdf.Context
+}
+
+func (gw *encoderGraphWriter) write(t graphTriple) error {
+	triple, err := t.rdf()
+	if err != nil {
+		return err
+	}
+	if gw.quads != nil {
+		return gw.quads.Encode(rdf.Quad{Triple: triple, Ctx: gw.graph})
+	}
+	return gw.triples.Encode(triple)
+}
+
+func (gw *encoderGraphWriter) Close() error {
+	if gw.quads != nil {
+		return gw.quads.Close()
+	}
+	return gw.triples.Close()
+}
+
+// jsonldGraphWriter writes expanded JSON-LD: a named graph holding one node object per subject
+type jsonldGraphWriter struct {
+	w       io.Writer
+	enc     *json.Encoder
+	subject *term
+	node    map[string]interface{}
+	written int
+}
+
+func newJSONLDGraphWriter(w io.Writer, source string) (*jsonldGraphWriter, error) {
+	graph, err := json.Marshal("urn:" + source)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(w, "{\"@id\": %s, \"@graph\": [\n", graph); err != nil {
+		return nil, err
+	}
+	return &jsonldGraphWriter{w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (gw *jsonldGraphWriter) write(t graphTriple) error {
+	if gw.subject == nil || *gw.subject != t.s {
+		if err := gw.flush(); err != nil {
+			return err
+		}
+		gw.subject = &t.s
+		gw.node = map[string]interface{}{"@id": t.s.jsonld()["@id"]}
+	}
+	if t.p.value == rdfType && t.o.kind != rdf.TermLiteral {
+		types, _ := gw.node["@type"].([]string)
+		gw.node["@type"] = append(types, t.o.jsonld()["@id"])
+		return nil
+	}
+	values, _ := gw.node[t.p.value].([]map[string]string)
+	gw.node[t.p.value] = append(values, t.o.jsonld())
+	return nil
+}
+
+// flush writes out the node object of the current subject
+func (gw *jsonldGraphWriter) flush() error {
+	if gw.node == nil {
+		return nil
+	}
+	if gw.written > 0 {
+		if _, err := io.WriteString(gw.w, ","); err != nil {
+			return err
+		}
+	}
+	gw.written++
+	return gw.enc.Encode(gw.node)
+}
+
+func (gw *jsonldGraphWriter) Close() error {
+	if err := gw.flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(gw.w, "]}\n")
+	return err
+}
+
+// rdfxmlGraphWriter writes RDF/XML with one rdf:Description element per subject
+type rdfxmlGraphWriter struct {
+	w       io.Writer
+	subject *term
+}
+
+func newRDFXMLGraphWriter(w io.Writer) (*rdfxmlGraphWriter, error) {
+	if _, err := fmt.Fprintf(w, "%s<rdf:RDF xmlns:rdf=\"%s\">\n", xml.Header, rdfNamespace); err != nil {
+		return nil, err
+	}
+	return &rdfxmlGraphWriter{w: w}, nil
+}
+
+// splitPredicate splits the IRI into a namespace and a local name that is a valid XML name.
+// Only ASCII characters are considered for the local name
+func splitPredicate(iri string) (string, string, error) {
+	isNameStart := func(c byte) bool {
+		return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || c == '_'
+	}
+	start := len(iri)
+	for start > 0 {
+		c := iri[start-1]
+		if !(isNameStart(c) || ('0' <= c && c <= '9') || c == '-' || c == '.') {
+			break
+		}
+		start--
+	}
+	// the local name has to start with a letter or an underscore
+	for start < len(iri) && !isNameStart(iri[start]) {
+		start++
+	}
+	if start == len(iri) || start == 0 {
+		return "", "", fmt.Errorf("Cannot serialize predicate %s as RDF/XML", iri)
+	}
+	return iri[:start], iri[start:], nil
+}
+
+func (gw *rdfxmlGraphWriter) write(t graphTriple) error {
+	namespace, local, err := splitPredicate(t.p.value)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	if gw.subject == nil || *gw.subject != t.s {
+		if gw.subject != nil {
+			b.WriteString("  </rdf:Description>\n")
+		}
+		gw.subject = &t.s
+		if t.s.kind == rdf.TermBlank {
+			b.WriteString(`  <rdf:Description rdf:nodeID="`)
+		} else {
+			b.WriteString(`  <rdf:Description rdf:about="`)
+		}
+		xmlEscape(&b, t.s.value)
+		b.WriteString("\">\n")
+	}
+
+	fmt.Fprintf(&b, `    <p:%s xmlns:p="`, local)
+	xmlEscape(&b, namespace)
+	b.WriteString(`"`)
+	switch {
+	case t.o.kind == rdf.TermIRI:
+		b.WriteString(` rdf:resource="`)
+		xmlEscape(&b, t.o.value)
+		b.WriteString("\"/>\n")
+	case t.o.kind == rdf.TermBlank:
+		b.WriteString(` rdf:nodeID="`)
+		xmlEscape(&b, t.o.value)
+		b.WriteString("\"/>\n")
+	default:
+		if len(t.o.lang) > 0 {
+			b.WriteString(` xml:lang="`)
+			xmlEscape(&b, t.o.lang)
+			b.WriteString(`"`)
+		} else if len(t.o.datatype) > 0 {
+			b.WriteString(` rdf:datatype="`)
+			xmlEscape(&b, t.o.datatype)
+			b.WriteString(`"`)
+		}
+		b.WriteString(">")
+		xmlEscape(&b, t.o.value)
+		fmt.Fprintf(&b, "</p:%s>\n", local)
+	}
+	_, err = io.WriteString(gw.w, b.String())
+	return err
+}
+
+func (gw *rdfxmlGraphWriter) Close() error {
+	var end string
+	if gw.subject != nil {
+		end = "  </rdf:Description>\n"
+	}
+	_, err := io.WriteString(gw.w, end+"</rdf:RDF>\n")
+	return err
+}
+
+func xmlEscape(b *strings.Builder, s string) {
+	// writes to a strings.Builder never fail
+	_ = xml.EscapeText(b, []byte(s))
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/jackc/pgx/v4"
+)
+
+// ErrInsertConflict is returned when an insertion with the 'error' conflict policy has readings at the times of
+// stored readings
+var ErrInsertConflict = errors.New("Readings already exist")
+
+// ErrIdempotencyKeyReused is returned when an idempotency key is reused for an insertion into another stream
+var ErrIdempotencyKeyReused = errors.New("Idempotency key was used for another stream")
+
+// ErrIdempotencyKeyInUse is returned when an idempotency key is used by a job that has not finished inserting
+var ErrIdempotencyKeyInUse = errors.New("Idempotency key is used by a running job")
+
+// ConflictPolicy controls what an insertion does with readings at the times of stored readings
+type ConflictPolicy int
+
+const (
+	// ConflictUpdate replaces the stored readings
+	ConflictUpdate ConflictPolicy = iota
+	// ConflictIgnore keeps the stored readings and skips the inserted ones
+	ConflictIgnore
+	// ConflictError rejects the insertion
+	ConflictError
+)
+
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "update":
+		return ConflictUpdate, nil
+	case "ignore":
+		return ConflictIgnore, nil
+	case "error":
+		return ConflictError, nil
+	}
+	return ConflictUpdate, fmt.Errorf("Conflict policy %s unknown", s)
+}
+
+// conflictClause returns the ON CONFLICT clause of an insertion into the table with the policy. Stored readings are
+// only updated if their value or quality changes. The 'error' policy has no clause: conflicts are checked first
+func conflictClause(table string, policy ConflictPolicy) string {
+	switch policy {
+	case ConflictUpdate:
+		return `ON CONFLICT (time, stream_id) DO UPDATE SET value = EXCLUDED.value, quality = EXCLUDED.quality
+				WHERE ` + table + `.value IS DISTINCT FROM EXCLUDED.value OR ` + table + `.quality IS DISTINCT FROM EXCLUDED.quality`
+	case ConflictIgnore:
+		return `ON CONFLICT (time, stream_id) DO NOTHING`
+	}
+	return ""
+}
+
+// checkConflicts returns ErrInsertConflict if readings of the staging table are at the times of readings of the table
+func checkConflicts(ctx context.Context, txn pgx.Tx, staging, table string, stream_id int) error {
+	var conflicts int64
+	row := txn.QueryRow(ctx, `SELECT count(*) FROM `+staging+` JOIN `+table+` USING (time, stream_id)`)
+	if err := row.Scan(&conflicts); err != nil {
+		return fmt.Errorf("Cannot insert readings for id %d: %w", stream_id, err)
+	}
+	if conflicts > 0 {
+		return fmt.Errorf("%w: %d readings of stream %d are at the times of stored readings", ErrInsertConflict, conflicts, stream_id)
+	}
+	return nil
+}
+
+// InsertOptions configures an insertion of readings
+type InsertOptions struct {
+	OnConflict ConflictPolicy
+	// if set, an insertion with the same key into the same source returns the report of the first insertion
+	// instead of inserting the readings again, for as long as the key is retained
+	IdempotencyKey string
+}
+
+func (opts *InsertOptions) FromURLParams(vals url.Values) error {
+	var err error
+	if opts.OnConflict, err = ParseConflictPolicy(vals.Get("on_conflict")); err != nil {
+		return err
+	}
+	return nil
+}
+
+// claimIdempotencyKey claims the key for an insertion into the stream of the source. If an earlier insertion
+// already used the key, its report is returned. Keys are forgotten by expireIdempotencyKeys.
+// A concurrent insertion with the same key waits for the transaction that claimed it
+func claimIdempotencyKey(ctx context.Context, txn pgx.Tx, source, stream, key string) (*InsertReport, error) {
+	res, err := txn.Exec(ctx, `INSERT INTO insert_keys(source, key, stream, created_at) VALUES($1, $2, $3, now())
+							 ON CONFLICT (source, key) DO NOTHING`, source, key, stream)
+	if err != nil {
+		return nil, fmt.Errorf("Could not claim idempotency key %s: %w", key, err)
+	}
+	if res.RowsAffected() > 0 {
+		return nil, nil
+	}
+
+	var (
+		claimedBy  string
+		definition []byte
+	)
+	row := txn.QueryRow(ctx, `SELECT stream, report FROM insert_keys WHERE source = $1 AND key = $2`, source, key)
+	if err := row.Scan(&claimedBy, &definition); err != nil {
+		return nil, fmt.Errorf("Could not read idempotency key %s: %w", key, err)
+	}
+	if claimedBy != stream {
+		return nil, fmt.Errorf("%w: %s was used for %s", ErrIdempotencyKeyReused, key, claimedBy)
+	}
+	// jobs claim the key with their first batch and store the report with their last
+	if definition == nil {
+		return nil, fmt.Errorf("%w: %s", ErrIdempotencyKeyInUse, key)
+	}
+	var report InsertReport
+	if err := json.Unmarshal(definition, &report); err != nil {
+		return nil, fmt.Errorf("Could not read report of idempotency key %s: %w", key, err)
+	}
+	report.Replayed = true
+	return &report, nil
+}
+
+// expireIdempotencyKeys forgets the keys claimed more than config.IdempotencyKeyRetention ago, except the keys of
+// the queued or running jobs that have not stored their report yet
+func (db *TimescaleDatabase) expireIdempotencyKeys(ctx context.Context) error {
+	_, err := db.pool.Exec(ctx, `DELETE FROM insert_keys WHERE created_at < $1
+								 AND NOT (report IS NULL AND EXISTS (
+									SELECT 1 FROM ingest_jobs WHERE ingest_jobs.source = insert_keys.source
+									AND ingest_jobs.options->>'IdempotencyKey' = insert_keys.key
+									AND ingest_jobs.status IN ('queued', 'running')))`,
+		time.Now().Add(-config.IdempotencyKeyRetention))
+	if err != nil {
+		return fmt.Errorf("Could not expire idempotency keys: %w", err)
+	}
+	return nil
+}
+
+// rememberInsertion stores the report of the insertion that claimed the key
+func rememberInsertion(ctx context.Context, txn pgx.Tx, source, key string, report *InsertReport) error {
+	definition, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("Could not serialize insert report: %w", err)
+	}
+	if _, err := txn.Exec(ctx, `UPDATE insert_keys SET report = $3 WHERE source = $1 AND key = $2`, source, key, definition); err != nil {
+		return fmt.Errorf("Could not store report of idempotency key %s: %w", key, err)
+	}
+	return nil
+}
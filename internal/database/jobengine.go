@@ -0,0 +1,371 @@
+package database
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/logging"
+	"github.com/jackc/pgx/v4"
+)
+
+// RunJobs processes the queued jobs until the context is cancelled, with config.Jobs.Workers jobs at a time. The
+// jobs that were running when the server stopped are queued again, and resume after the rows they committed
+func (db *TimescaleDatabase) RunJobs(ctx context.Context) error {
+	log := logging.FromContext(ctx)
+
+	_, err := db.pool.Exec(ctx, `UPDATE ingest_jobs SET status = CASE WHEN cancel_requested THEN 'cancelled' ELSE 'queued' END,
+									finished_at = CASE WHEN cancel_requested THEN now() END
+								 WHERE status = 'running'`)
+	if err != nil {
+		return fmt.Errorf("Could not requeue interrupted jobs: %w", err)
+	}
+
+	workers := db.jobWorkers
+	if workers <= 0 {
+		workers = config.DefaultJobWorkers
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				job, err := db.claimJob(ctx)
+				if err != nil && ctx.Err() == nil {
+					log.Errorf("Could not claim job: %s", err)
+				}
+				if job == nil {
+					select {
+					case <-ctx.Done():
+					case <-db.jobQueued:
+					case <-time.After(config.JobPollInterval):
+					}
+					continue
+				}
+				// another job may be queued for an idle worker
+				db.wakeJobs()
+				db.runJob(ctx, job)
+			}
+		}()
+	}
+
+	expire := time.NewTicker(config.JobPollInterval)
+	defer expire.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		case <-expire.C:
+			if _, err := db.pool.Exec(ctx, `DELETE FROM ingest_jobs WHERE finished_at < $1`, time.Now().Add(-config.JobRetention)); err != nil {
+				log.Errorf("Could not expire jobs: %s", err)
+			}
+			if err := db.sweepSpool(ctx); err != nil {
+				log.Errorf("Could not remove spooled uploads of finished jobs: %s", err)
+			}
+			if err := db.expireIdempotencyKeys(ctx); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// claimJob marks the oldest queued job as running and returns it, or nil if no job is queued
+func (db *TimescaleDatabase) claimJob(ctx context.Context) (*Job, error) {
+	job, err := scanJob(db.pool.QueryRow(ctx, `UPDATE ingest_jobs SET status = 'running', started_at = COALESCE(started_at, now())
+												WHERE id = (SELECT id FROM ingest_jobs WHERE status = 'queued'
+															ORDER BY created_at LIMIT 1 FOR UPDATE SKIP LOCKED)
+												RETURNING `+jobColumns))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// runJob processes the job and records its outcome. A job interrupted by the shutdown of the server is left running,
+// to be queued again when the server restarts
+func (db *TimescaleDatabase) runJob(ctx context.Context, job *Job) {
+	log := logging.FromContext(ctx)
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	db.jobsLock.Lock()
+	db.runningJobs[job.ID] = cancel
+	db.jobsLock.Unlock()
+	defer func() {
+		db.jobsLock.Lock()
+		delete(db.runningJobs, job.ID)
+		db.jobsLock.Unlock()
+	}()
+
+	if job.resumeOffset > 0 {
+		log.Infof("Resuming job %s (%s/%s) after row %d", job.ID, job.Source, job.Name, job.resumeOffset)
+	} else {
+		log.Infof("Running job %s (%s/%s)", job.ID, job.Source, job.Name)
+	}
+	err := db.processJob(jobCtx, job)
+	switch {
+	case ctx.Err() != nil:
+		return
+	case err == nil:
+		job.Status = JobSucceeded
+	case errors.Is(err, errJobCancelled) || jobCtx.Err() != nil:
+		job.Status = JobCancelled
+	default:
+		job.Status, job.Error = JobFailed, err.Error()
+	}
+	if err := db.finishJob(ctx, job); err != nil {
+		log.Errorf("Could not record outcome of job %s: %s", job.ID, err)
+		return
+	}
+	log.Infof("Job %s %s: read %d rows (%d errors)", job.ID, job.Status, job.Rows, len(job.ErrorRows))
+}
+
+// processJob inserts the readings of the spooled upload of the job into its stream, config.JobBatchRows rows at a
+// time. Each batch is committed with the progress of the job, so the job resumes after the last committed batch.
+// Rows that cannot be read (or whose value is not of the type of the stream) are skipped, up to the MaxErrors of
+// the job
+func (db *TimescaleDatabase) processJob(ctx context.Context, job *Job) error {
+	ctx = context.WithValue(ctx, ContextKey("user"), job.apikey)
+
+	if authorized, err := db.checkAuth(ctx, "write", job.Source); err != nil {
+		return fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return fmt.Errorf("Cannot write to source: %s", job.Source)
+	}
+
+	f, err := os.Open(job.path)
+	if err != nil {
+		return fmt.Errorf("Could not open spooled upload: %w", err)
+	}
+	defer f.Close()
+
+	var (
+		stream_id int
+		st        *streamType
+	)
+	err = db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		row := txn.QueryRow(ctx, `SELECT id FROM streams WHERE source=$1 AND name=$2`, job.Source, job.Name)
+		if err := row.Scan(&stream_id); err != nil {
+			return fmt.Errorf("No such stream (SourceName: %s, Name: %s): %w", job.Source, job.Name, err)
+		}
+		st, err = readStreamType(ctx, txn, stream_id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	csvr := csv.NewReader(f)
+	// rows with a wrong number of fields are reported by FromCSVRow
+	csvr.FieldsPerRecord = -1
+	// the rows of the committed batches were already inserted (or reported)
+	for skipped := int64(0); skipped < job.resumeOffset; skipped++ {
+		if _, err := csvr.Read(); err == io.EOF {
+			break
+		} else if _, ok := err.(*csv.ParseError); err != nil && !ok {
+			return fmt.Errorf("Could not read spooled upload: %w", err)
+		}
+	}
+
+	for done := false; !done; {
+		var batch []Reading
+		if batch, done, err = readJobBatch(csvr, job, st); err != nil {
+			return err
+		}
+		replayed, err := db.commitJobBatch(ctx, job, stream_id, batch, done)
+		if err != nil {
+			return err
+		} else if replayed {
+			return nil
+		}
+	}
+	return nil
+}
+
+// readJobBatch reads the readings of the next config.JobBatchRows rows of the upload. done is true at the end of
+// the upload. The rows that cannot be read are added to the ErrorRows of the job
+func readJobBatch(csvr *csv.Reader, job *Job, st *streamType) (batch []Reading, done bool, err error) {
+	var rdg Reading
+	for rows := 0; rows < config.JobBatchRows; rows++ {
+		row, err := csvr.Read()
+		if err == io.EOF {
+			return batch, true, nil
+		} else if _, ok := err.(*csv.ParseError); err != nil && !ok {
+			return nil, false, fmt.Errorf("Could not read spooled upload: %w", err)
+		}
+		job.Rows++
+		if err == nil {
+			err = rdg.FromCSVRow(row)
+		}
+		if err == nil {
+			rdg, err = st.coerce(rdg)
+		}
+		if err != nil {
+			job.ErrorRows = append(job.ErrorRows, JobRowError{Row: job.Rows, Error: err.Error()})
+			if len(job.ErrorRows) > job.Options.MaxErrors {
+				return nil, false, fmt.Errorf("More than %d rows could not be read", job.Options.MaxErrors)
+			}
+			continue
+		}
+		batch = append(batch, rdg)
+	}
+	return batch, false, nil
+}
+
+// commitJobBatch inserts the readings of a batch of the upload and records the progress of the job in the same
+// transaction, bounded by config.JobBatchTimeout. The idempotency key of the job is claimed with its first batch
+// and remembered with its last; replayed is true if the key was already used, and the job then inserts nothing.
+// Returns errJobCancelled if the cancellation of the job was requested: the batch is then not committed
+func (db *TimescaleDatabase) commitJobBatch(ctx context.Context, job *Job, stream_id int, batch []Reading, last bool) (replayed bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, config.JobBatchTimeout)
+	defer cancel()
+
+	var report InsertReport
+	if job.Report != nil {
+		report = *job.Report
+	}
+	key := job.Options.IdempotencyKey
+	err = db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		if len(key) > 0 && job.resumeOffset == 0 {
+			earlier, err := claimIdempotencyKey(ctx, txn, job.Source, job.Name, key)
+			if err != nil {
+				return err
+			} else if earlier != nil {
+				report, replayed = *earlier, true
+				return nil
+			}
+		}
+
+		if len(batch) > 0 {
+			ds := &ArrayDataset{SourceName: job.Source, Name: job.Name, Readings: batch, idx: -1}
+			inserted, err := insertReadings(ctx, txn, stream_id, ds, job.Options.OnConflict)
+			if err != nil {
+				return err
+			}
+			report.Inserted += inserted.Inserted
+			report.Updated += inserted.Updated
+			report.Skipped += inserted.Skipped
+			report.Flagged += inserted.Flagged
+			report.Quarantined += inserted.Quarantined
+			report.Rejected += inserted.Rejected
+		}
+		if last && len(key) > 0 {
+			if err := rememberInsertion(ctx, txn, job.Source, key, &report); err != nil {
+				return err
+			}
+		}
+		return recordJobProgress(ctx, txn, job, &report)
+	})
+	if err != nil {
+		return false, err
+	}
+	job.Report, job.resumeOffset = &report, job.Rows
+	return replayed, nil
+}
+
+// recordJobProgress records the rows of the running job whose readings are committed with the transaction, and
+// returns errJobCancelled if its cancellation was requested
+func recordJobProgress(ctx context.Context, txn pgx.Tx, job *Job, report *InsertReport) error {
+	errorRows, err := json.Marshal(job.ErrorRows)
+	if err != nil {
+		return fmt.Errorf("Could not serialize error rows: %w", err)
+	}
+	definition, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("Could not serialize insert report: %w", err)
+	}
+	var cancelled bool
+	row := txn.QueryRow(ctx, `UPDATE ingest_jobs SET row_count = $2, resume_offset = $2, error_rows = $3, report = $4
+							  WHERE id = $1 RETURNING cancel_requested`, job.ID, job.Rows, errorRows, definition)
+	if err := row.Scan(&cancelled); err != nil {
+		return fmt.Errorf("Could not record progress of job %s: %w", job.ID, err)
+	}
+	if cancelled {
+		return errJobCancelled
+	}
+	return nil
+}
+
+// finishJob records the outcome of the job and removes its spooled upload. The idempotency key of a job that did
+// not succeed is released, so that the upload can be submitted again with it
+func (db *TimescaleDatabase) finishJob(ctx context.Context, job *Job) error {
+	errorRows, err := json.Marshal(job.ErrorRows)
+	if err != nil {
+		return fmt.Errorf("Could not serialize error rows: %w", err)
+	}
+	var report []byte
+	if job.Report != nil {
+		if report, err = json.Marshal(job.Report); err != nil {
+			return fmt.Errorf("Could not serialize insert report: %w", err)
+		}
+	}
+	_, err = db.pool.Exec(ctx, `UPDATE ingest_jobs SET status = $2, row_count = $3, error_rows = $4, report = $5, error = NULLIF($6, ''),
+									finished_at = now()
+								WHERE id = $1`, job.ID, job.Status, job.Rows, errorRows, report, job.Error)
+	if err != nil {
+		return err
+	}
+	if key := job.Options.IdempotencyKey; len(key) > 0 && job.Status != JobSucceeded {
+		_, err := db.pool.Exec(ctx, `DELETE FROM insert_keys WHERE source = $1 AND key = $2 AND report IS NULL`, job.Source, key)
+		if err != nil {
+			return fmt.Errorf("Could not release idempotency key %s: %w", key, err)
+		}
+	}
+	if err := os.Remove(job.path); err != nil && !os.IsNotExist(err) {
+		logging.FromContext(ctx).Warnf("Could not remove spooled upload of job %s: %s", job.ID, err)
+	}
+	return nil
+}
+
+// sweepSpool removes the spooled uploads that belong to no queued or running job. These are left behind when the
+// outcome of a job could not be recorded, or when a job is cancelled as the server restarts. Recent files are
+// kept: their job may not be queued yet
+func (db *TimescaleDatabase) sweepSpool(ctx context.Context) error {
+	files, err := ioutil.ReadDir(db.jobSpoolDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	rows, err := db.pool.Query(ctx, `SELECT path FROM ingest_jobs WHERE status IN ('queued', 'running')`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	pending := make(map[string]bool)
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return err
+		}
+		pending[path] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		path := filepath.Join(db.jobSpoolDir, file.Name())
+		if file.IsDir() || filepath.Ext(path) != ".csv" || pending[path] || time.Since(file.ModTime()) < config.JobPollInterval {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/jackc/pgx/v4"
+)
+
+// ErrJobNotFound is returned when a job does not exist (or was expired)
+var ErrJobNotFound = errors.New("Job not found")
+
+// ErrJobFinished is returned when a finished job is cancelled
+var ErrJobFinished = errors.New("Job already finished")
+
+// errJobCancelled stops a running job whose cancellation was requested
+var errJobCancelled = errors.New("Job was cancelled")
+
+// statuses of jobs
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// JobOptions configures an asynchronous insertion
+type JobOptions struct {
+	InsertOptions
+	// the job fails if more rows than this cannot be read; the other bad rows are skipped
+	MaxErrors int
+}
+
+func (opts *JobOptions) FromURLParams(vals url.Values) error {
+	if err := opts.InsertOptions.FromURLParams(vals); err != nil {
+		return err
+	}
+	opts.MaxErrors = config.DefaultJobMaxErrors
+	if s := vals.Get("max_errors"); len(s) > 0 {
+		max, err := strconv.Atoi(s)
+		if err != nil || max < 0 {
+			return fmt.Errorf("Invalid max_errors %s", s)
+		}
+		opts.MaxErrors = max
+	}
+	return nil
+}
+
+// Job is the asynchronous insertion of an uploaded CSV file into a stream
+type Job struct {
+	ID      string
+	Source  string
+	Name    string
+	Status  string
+	Options JobOptions
+	// rows of the file inserted so far, including the rows that could not be read
+	Rows int64
+	// the rows that could not be read, which were skipped
+	ErrorRows []JobRowError
+	// the report of the readings inserted so far
+	Report *InsertReport
+	// why the job failed
+	Error      string
+	CreatedAt  time.Time
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+
+	// the job is processed with the key of the user that submitted it
+	apikey string
+	// the spooled upload
+	path string
+	// the rows of the upload whose readings are committed; a job that runs again resumes after them
+	resumeOffset int64
+}
+
+// JobRowError is a row of an upload that could not be read
+type JobRowError struct {
+	// the number of the row in the file, from 1
+	Row   int64
+	Error string
+}
+
+const jobColumns = `id, source, name, status, options, row_count, error_rows, report, COALESCE(error, ''), created_at, started_at,
+					finished_at, apikey, path, resume_offset`
+
+func scanJob(row pgx.Row) (*Job, error) {
+	var (
+		job                        Job
+		options, errorRows, report []byte
+	)
+	if err := row.Scan(&job.ID, &job.Source, &job.Name, &job.Status, &options, &job.Rows, &errorRows, &report, &job.Error,
+		&job.CreatedAt, &job.StartedAt, &job.FinishedAt, &job.apikey, &job.path, &job.resumeOffset); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(options, &job.Options); err != nil {
+		return nil, fmt.Errorf("Could not read options of job %s: %w", job.ID, err)
+	}
+	if errorRows != nil {
+		if err := json.Unmarshal(errorRows, &job.ErrorRows); err != nil {
+			return nil, fmt.Errorf("Could not read error rows of job %s: %w", job.ID, err)
+		}
+	}
+	if report != nil {
+		job.Report = new(InsertReport)
+		if err := json.Unmarshal(report, job.Report); err != nil {
+			return nil, fmt.Errorf("Could not read report of job %s: %w", job.ID, err)
+		}
+	}
+	return &job, nil
+}
+
+// newJobID returns a random identifier for a job
+func newJobID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("Could not generate job id: %w", err)
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// SubmitJob spools the CSV file (with the columns of /insert/csv) to disk and queues a job that inserts its readings
+// into the stream. The job is processed by RunJobs with the key of the user submitting it
+func (db *TimescaleDatabase) SubmitJob(ctx context.Context, source, name string, opts JobOptions, file io.Reader) (*Job, error) {
+	if authorized, err := db.checkAuth(ctx, "write", source); err != nil {
+		return nil, fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return nil, fmt.Errorf("Cannot write to source: %s", source)
+	}
+	var exists bool
+	row := db.pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM streams WHERE source=$1 AND name=$2)`, source, name)
+	if err := row.Scan(&exists); err != nil {
+		return nil, fmt.Errorf("Could not read stream: %w", err)
+	} else if !exists {
+		return nil, fmt.Errorf("No such stream (SourceName: %s, Name: %s)", source, name)
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{
+		ID:        id,
+		Source:    source,
+		Name:      name,
+		Status:    JobQueued,
+		Options:   opts,
+		CreatedAt: time.Now(),
+		path:      filepath.Join(db.jobSpoolDir, id+".csv"),
+	}
+	job.apikey, _ = ctx.Value(ContextKey("user")).(string)
+	if err := spool(job.path, file); err != nil {
+		return nil, err
+	}
+
+	options, err := json.Marshal(job.Options)
+	if err != nil {
+		os.Remove(job.path)
+		return nil, fmt.Errorf("Could not serialize job options: %w", err)
+	}
+	_, err = db.pool.Exec(ctx, `INSERT INTO ingest_jobs(id, source, name, status, options, apikey, path, created_at)
+								VALUES($1, $2, $3, $4, $5, $6, $7, $8)`,
+		job.ID, job.Source, job.Name, job.Status, options, job.apikey, job.path, job.CreatedAt)
+	if err != nil {
+		os.Remove(job.path)
+		return nil, fmt.Errorf("Could not queue job: %w", err)
+	}
+	db.wakeJobs()
+	return job, nil
+}
+
+// spool writes the file to the path, and syncs it to disk
+func spool(path string, file io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Could not create spool directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("Could not spool upload: %w", err)
+	}
+	_, err = io.Copy(f, file)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("Could not spool upload: %w", err)
+	}
+	return nil
+}
+
+// Job returns the job, if the user can write to its source
+func (db *TimescaleDatabase) Job(ctx context.Context, id string) (*Job, error) {
+	job, err := scanJob(db.pool.QueryRow(ctx, `SELECT `+jobColumns+` FROM ingest_jobs WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not read job %s: %w", id, err)
+	}
+	if authorized, err := db.checkAuth(ctx, "write", job.Source); err != nil {
+		return nil, fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return nil, fmt.Errorf("Cannot write to source: %s", job.Source)
+	}
+	return job, nil
+}
+
+// Jobs returns the jobs of the source, most recent first
+func (db *TimescaleDatabase) Jobs(ctx context.Context, source string) ([]Job, error) {
+	if authorized, err := db.checkAuth(ctx, "write", source); err != nil {
+		return nil, fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return nil, fmt.Errorf("Cannot write to source: %s", source)
+	}
+	rows, err := db.pool.Query(ctx, `SELECT `+jobColumns+` FROM ingest_jobs WHERE source = $1 ORDER BY created_at DESC`, source)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read jobs: %w", err)
+	}
+	defer rows.Close()
+	var jobs []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		jobs = append(jobs, *job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+// CancelJob cancels the job. A queued job is cancelled at once; a running job stops shortly, and keeps the readings
+// of the batches it already committed
+func (db *TimescaleDatabase) CancelJob(ctx context.Context, id string) (*Job, error) {
+	job, err := db.Job(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var status string
+	row := db.pool.QueryRow(ctx, `UPDATE ingest_jobs SET cancel_requested = true,
+									status = CASE WHEN status = 'queued' THEN 'cancelled' ELSE status END,
+									finished_at = CASE WHEN status = 'queued' THEN now() ELSE finished_at END
+								  WHERE id = $1 AND status IN ('queued', 'running') RETURNING status`, id)
+	if err := row.Scan(&status); errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s is %s", ErrJobFinished, id, job.Status)
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not cancel job %s: %w", id, err)
+	}
+	if status == JobCancelled {
+		os.Remove(job.path)
+	} else {
+		db.jobsLock.Lock()
+		if cancel, ok := db.runningJobs[id]; ok {
+			cancel()
+		}
+		db.jobsLock.Unlock()
+	}
+	return db.Job(ctx, id)
+}
+
+// wakeJobs wakes an idle job worker
+func (db *TimescaleDatabase) wakeJobs() {
+	select {
+	case db.jobQueued <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// columnRow is a row with a value for each of its columns
+type columnRow struct {
+	columns []string
+}
+
+// splitColumns splits a list of SQL expressions on the commas outside of parentheses
+func splitColumns(list string) []string {
+	var (
+		columns []string
+		depth   int
+		start   int
+	)
+	for idx, c := range list {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				columns = append(columns, strings.TrimSpace(list[start:idx]))
+				start = idx + 1
+			}
+		}
+	}
+	return append(columns, strings.TrimSpace(list[start:]))
+}
+
+func (row columnRow) Scan(dest ...interface{}) error {
+	if len(dest) != len(row.columns) {
+		return fmt.Errorf("%d columns scanned into %d destinations", len(row.columns), len(dest))
+	}
+	for idx, d := range dest {
+		switch d := d.(type) {
+		case *string:
+			*d = row.columns[idx]
+		case *int64:
+			*d = int64(idx)
+		case *[]byte:
+			if row.columns[idx] == "options" {
+				*d = []byte(`{"MaxErrors": 3}`)
+			}
+		case *time.Time:
+			*d = time.Unix(int64(idx), 0)
+		case **time.Time:
+			t := time.Unix(int64(idx), 0)
+			*d = &t
+		default:
+			return fmt.Errorf("Unexpected destination %T for column %s", d, row.columns[idx])
+		}
+	}
+	return nil
+}
+
+func TestScanJob(t *testing.T) {
+	columns := splitColumns(jobColumns)
+	job, err := scanJob(columnRow{columns: columns})
+	if err != nil {
+		t.Fatalf("Could not scan job: %s", err)
+	}
+	if job.ID != "id" || job.path != "path" || job.apikey != "apikey" || job.Options.MaxErrors != 3 {
+		t.Errorf("Columns scanned into the wrong fields: %+v", job)
+	}
+	if job.resumeOffset != int64(len(columns)-1) {
+		t.Errorf("Got resume offset %d, want the last column", job.resumeOffset)
+	}
+}
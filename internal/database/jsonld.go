@@ -0,0 +1,413 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/knakk/rdf"
+)
+
+const (
+	xsdNamespace = "http://www.w3.org/2001/XMLSchema#"
+	xsdInteger   = xsdNamespace + "integer"
+	xsdDouble    = xsdNamespace + "double"
+	xsdBoolean   = xsdNamespace + "boolean"
+)
+
+// jsonldTerm is a term definition from a JSON-LD context
+type jsonldTerm struct {
+	id string
+	// coercion of the values of the term: "@id", "@vocab" or a datatype IRI
+	typ      string
+	language string
+}
+
+// jsonldContext is an active JSON-LD context. Only embedded contexts are supported
+type jsonldContext struct {
+	vocab    string
+	base     string
+	language string
+	terms    map[string]jsonldTerm
+}
+
+func (ctx *jsonldContext) clone() *jsonldContext {
+	c := *ctx
+	c.terms = make(map[string]jsonldTerm, len(ctx.terms))
+	for k, v := range ctx.terms {
+		c.terms[k] = v
+	}
+	return &c
+}
+
+// expandIRI expands a term, compact IRI or relative IRI. Vocabulary-relative expansion (for
+// properties and types) uses the term definitions and @vocab; document-relative expansion uses @base
+func (ctx *jsonldContext) expandIRI(value string, vocab bool) string {
+	if strings.HasPrefix(value, "@") {
+		return value
+	}
+	if def, ok := ctx.terms[value]; ok && vocab {
+		return def.id
+	}
+	if idx := strings.Index(value, ":"); idx > 0 {
+		prefix, suffix := value[:idx], value[idx+1:]
+		if prefix == "_" || strings.HasPrefix(suffix, "//") {
+			return value
+		}
+		if def, ok := ctx.terms[prefix]; ok {
+			return def.id + suffix
+		}
+		return value
+	}
+	if vocab && len(ctx.vocab) > 0 {
+		return ctx.vocab + value
+	}
+	return ctx.base + value
+}
+
+// withContext returns the active context updated by a local @context
+func (ctx *jsonldContext) withContext(local interface{}) (*jsonldContext, error) {
+	switch local := local.(type) {
+	case nil:
+		return &jsonldContext{terms: make(map[string]jsonldTerm)}, nil
+	case string:
+		return nil, fmt.Errorf("Remote JSON-LD contexts are not supported (%s)", local)
+	case []interface{}:
+		var err error
+		for _, c := range local {
+			if ctx, err = ctx.withContext(c); err != nil {
+				return nil, err
+			}
+		}
+		return ctx, nil
+	case map[string]interface{}:
+		next := ctx.clone()
+		defined := make(map[string]bool, len(local))
+		// the keywords (@vocab, @base, @language) apply to the terms, so they are defined first
+		for key := range local {
+			if strings.HasPrefix(key, "@") {
+				if err := next.defineLocal(local, key, defined); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for key := range local {
+			if err := next.defineLocal(local, key, defined); err != nil {
+				return nil, err
+			}
+		}
+		return next, nil
+	}
+	return nil, fmt.Errorf("Invalid JSON-LD context %v", local)
+}
+
+// defineLocal adds one entry of a local context to the context, after the terms of the local context that its
+// IRIs use as prefixes
+func (ctx *jsonldContext) defineLocal(local map[string]interface{}, key string, defined map[string]bool) error {
+	if defined[key] {
+		return nil
+	}
+	defined[key] = true
+
+	var iris []string
+	switch value := local[key].(type) {
+	case string:
+		iris = append(iris, value)
+	case map[string]interface{}:
+		iris = append(iris, key)
+		for _, k := range []string{"@id", "@type"} {
+			if iri, ok := value[k].(string); ok {
+				iris = append(iris, iri)
+			}
+		}
+	}
+	for _, iri := range iris {
+		if idx := strings.Index(iri, ":"); idx > 0 && iri[:idx] != key {
+			if _, ok := local[iri[:idx]]; ok {
+				if err := ctx.defineLocal(local, iri[:idx], defined); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return ctx.define(key, local[key])
+}
+
+// define adds one entry of a local context to the context
+func (ctx *jsonldContext) define(key string, value interface{}) error {
+	switch key {
+	case "@vocab":
+		vocab, _ := value.(string)
+		ctx.vocab = ctx.expandIRI(vocab, true)
+		return nil
+	case "@base":
+		ctx.base, _ = value.(string)
+		return nil
+	case "@language":
+		ctx.language, _ = value.(string)
+		return nil
+	case "@version", "@protected":
+		return nil
+	}
+
+	switch value := value.(type) {
+	case nil:
+		delete(ctx.terms, key)
+	case string:
+		ctx.terms[key] = jsonldTerm{id: ctx.expandIRI(value, true)}
+	case map[string]interface{}:
+		def := jsonldTerm{id: ctx.expandIRI(key, true), language: ctx.language}
+		if id, ok := value["@id"].(string); ok {
+			def.id = ctx.expandIRI(id, true)
+		}
+		if typ, ok := value["@type"].(string); ok {
+			def.typ = ctx.expandIRI(typ, true)
+		}
+		if lang, ok := value["@language"].(string); ok {
+			def.language = lang
+		}
+		if _, ok := value["@reverse"]; ok {
+			return fmt.Errorf("Reverse property %s is not supported", key)
+		}
+		if container, ok := value["@container"].(string); ok && container == "@list" {
+			return fmt.Errorf("List container %s is not supported", key)
+		}
+		ctx.terms[key] = def
+	default:
+		return fmt.Errorf("Invalid definition of term %s", key)
+	}
+	return nil
+}
+
+// jsonldDecoder converts JSON-LD node objects to triples
+type jsonldDecoder struct {
+	triples []rdf.Triple
+	blanks  int
+}
+
+// decodeJSONLD converts a JSON-LD document to triples. Named graphs are merged into the default graph
+func decodeJSONLD(r io.Reader) ([]rdf.Triple, error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, &TripleParseError{Message: err.Error()}
+	}
+	var doc interface{}
+	jsonDec := json.NewDecoder(bytes.NewReader(body))
+	jsonDec.UseNumber()
+	if err := jsonDec.Decode(&doc); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line := bytes.Count(body[:syntaxErr.Offset], []byte("\n")) + 1
+			return nil, &TripleParseError{Line: line, Message: syntaxErr.Error()}
+		}
+		return nil, &TripleParseError{Message: err.Error()}
+	}
+
+	dec := &jsonldDecoder{}
+	ctx := &jsonldContext{terms: make(map[string]jsonldTerm)}
+	if err := dec.element(ctx, doc); err != nil {
+		return nil, &TripleParseError{Message: err.Error()}
+	}
+	return dec.triples, nil
+}
+
+// element decodes a top-level element: a node object or an array of them
+func (dec *jsonldDecoder) element(ctx *jsonldContext, elem interface{}) error {
+	switch elem := elem.(type) {
+	case []interface{}:
+		for _, e := range elem {
+			if err := dec.element(ctx, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		_, err := dec.node(ctx, elem)
+		return err
+	}
+	return fmt.Errorf("Expected a JSON-LD node object, got %v", elem)
+}
+
+func (dec *jsonldDecoder) newBlank() rdf.Blank {
+	dec.blanks++
+	blank, _ := rdf.NewBlank(fmt.Sprintf("jsonld%d", dec.blanks))
+	return blank
+}
+
+// resource returns the IRI or blank node named by the expanded identifier
+func (dec *jsonldDecoder) resource(id string) (rdf.Subject, error) {
+	if strings.HasPrefix(id, "_:") {
+		blank, err := rdf.NewBlank(id[2:])
+		return blank, err
+	}
+	if !strings.Contains(id, ":") {
+		return nil, fmt.Errorf("%s is not an absolute IRI", id)
+	}
+	iri, err := rdf.NewIRI(id)
+	return iri, err
+}
+
+// node decodes a node object and returns its subject
+func (dec *jsonldDecoder) node(ctx *jsonldContext, obj map[string]interface{}) (rdf.Subject, error) {
+	var err error
+	if local, ok := obj["@context"]; ok {
+		if ctx, err = ctx.withContext(local); err != nil {
+			return nil, err
+		}
+	}
+
+	var subject rdf.Subject
+	if id, ok := obj["@id"].(string); ok {
+		if subject, err = dec.resource(ctx.expandIRI(id, false)); err != nil {
+			return nil, err
+		}
+	} else {
+		subject = dec.newBlank()
+	}
+
+	for key, value := range obj {
+		switch key {
+		case "@context", "@id", "@index":
+			continue
+		case "@graph":
+			if err := dec.element(ctx, value); err != nil {
+				return nil, err
+			}
+			continue
+		case "@type":
+			types, ok := value.([]interface{})
+			if !ok {
+				types = []interface{}{value}
+			}
+			for _, typ := range types {
+				typ, ok := typ.(string)
+				if !ok {
+					return nil, fmt.Errorf("Invalid @type %v", typ)
+				}
+				class, err := dec.resource(ctx.expandIRI(typ, true))
+				if err != nil {
+					return nil, err
+				}
+				dec.emit(subject, rdfType, class.(rdf.Object))
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "@") {
+			return nil, fmt.Errorf("JSON-LD keyword %s is not supported", key)
+		}
+
+		predicate := ctx.expandIRI(key, true)
+		if !strings.Contains(predicate, ":") {
+			// keys that do not expand to an IRI are dropped, as in JSON-LD expansion
+			continue
+		}
+		def := ctx.terms[key]
+		if len(def.language) == 0 {
+			def.language = ctx.language
+		}
+		objects, err := dec.values(ctx, def, value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value of %s: %w", key, err)
+		}
+		for _, object := range objects {
+			dec.emit(subject, predicate, object)
+		}
+	}
+	return subject, nil
+}
+
+func (dec *jsonldDecoder) emit(subject rdf.Subject, predicate string, object rdf.Object) {
+	pred, _ := rdf.NewIRI(predicate)
+	dec.triples = append(dec.triples, rdf.Triple{Subj: subject, Pred: pred, Obj: object})
+}
+
+// values decodes the value of a property, using the definition of the property's term
+func (dec *jsonldDecoder) values(ctx *jsonldContext, def jsonldTerm, value interface{}) ([]rdf.Object, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		var objects []rdf.Object
+		for _, v := range value {
+			o, err := dec.values(ctx, def, v)
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, o...)
+		}
+		return objects, nil
+	case string:
+		switch def.typ {
+		case "@id", "@vocab":
+			resource, err := dec.resource(ctx.expandIRI(value, def.typ == "@vocab"))
+			if err != nil {
+				return nil, err
+			}
+			return []rdf.Object{resource.(rdf.Object)}, nil
+		case "":
+			if len(def.language) > 0 {
+				lit, err := rdf.NewLangLiteral(value, def.language)
+				return []rdf.Object{lit}, err
+			}
+			lit, err := rdf.NewLiteral(value)
+			return []rdf.Object{lit}, err
+		}
+		return typedLiteral(value, def.typ)
+	case json.Number:
+		datatype := xsdInteger
+		if strings.ContainsAny(value.String(), ".eE") {
+			datatype = xsdDouble
+		}
+		if len(def.typ) > 0 && !strings.HasPrefix(def.typ, "@") {
+			datatype = def.typ
+		}
+		return typedLiteral(value.String(), datatype)
+	case bool:
+		return typedLiteral(fmt.Sprint(value), xsdBoolean)
+	case map[string]interface{}:
+		if v, ok := value["@value"]; ok {
+			return dec.valueObject(ctx, value, v)
+		}
+		if set, ok := value["@set"]; ok {
+			return dec.values(ctx, def, set)
+		}
+		if _, ok := value["@list"]; ok {
+			return nil, errors.New("@list is not supported")
+		}
+		subject, err := dec.node(ctx, value)
+		if err != nil {
+			return nil, err
+		}
+		return []rdf.Object{subject.(rdf.Object)}, nil
+	}
+	return nil, fmt.Errorf("Unexpected value %v", value)
+}
+
+// valueObject decodes a value object: {"@value": ..., "@type" or "@language": ...}
+func (dec *jsonldDecoder) valueObject(ctx *jsonldContext, obj map[string]interface{}, v interface{}) ([]rdf.Object, error) {
+	lexical := fmt.Sprint(v)
+	if s, ok := v.(string); ok {
+		lexical = s
+	}
+	if typ, ok := obj["@type"].(string); ok {
+		return typedLiteral(lexical, ctx.expandIRI(typ, true))
+	}
+	if lang, ok := obj["@language"].(string); ok {
+		lit, err := rdf.NewLangLiteral(lexical, lang)
+		return []rdf.Object{lit}, err
+	}
+	// untyped numbers and booleans get their natural datatypes
+	return dec.values(ctx, jsonldTerm{}, v)
+}
+
+func typedLiteral(value, datatype string) ([]rdf.Object, error) {
+	dt, err := rdf.NewIRI(datatype)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid datatype %s: %w", datatype, err)
+	}
+	return []rdf.Object{rdf.NewTypedLiteral(value, dt)}, nil
+}
@@ -0,0 +1,168 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSONLD(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		doc  string
+		want []string
+	}{
+		{
+			name: "context array",
+			doc: `{"@context": [{"ex": "http://example.org/"}, {"name": "ex:name"}],
+				   "@id": "ex:a", "name": "A"}`,
+			want: []string{`<http://example.org/a> <http://example.org/name> "A"`},
+		},
+		{
+			name: "terms defined before their prefix",
+			doc: `{"@context": {"date": {"@id": "ex:date", "@type": "xsd:date"}, "ex": "http://example.org/",
+							   "xsd": "http://www.w3.org/2001/XMLSchema#"},
+				   "@id": "ex:a", "date": "2024-01-02"}`,
+			want: []string{`<http://example.org/a> <http://example.org/date> "2024-01-02"^^<http://www.w3.org/2001/XMLSchema#date>`},
+		},
+		{
+			name: "vocab",
+			doc: `{"@context": {"@vocab": "http://example.org/"},
+				   "@id": "http://example.org/a", "@type": "Thing", "label": "x"}`,
+			want: []string{
+				`<http://example.org/a> <http://www.w3.org/1999/02/22-rdf-syntax-ns#type> <http://example.org/Thing>`,
+				`<http://example.org/a> <http://example.org/label> "x"`,
+			},
+		},
+		{
+			name: "base",
+			doc: `{"@context": {"@base": "http://example.org/",
+							   "knows": {"@id": "http://xmlns.com/foaf/0.1/knows", "@type": "@id"}},
+				   "@id": "a", "knows": "b"}`,
+			want: []string{`<http://example.org/a> <http://xmlns.com/foaf/0.1/knows> <http://example.org/b>`},
+		},
+		{
+			name: "typed values",
+			doc: `{"@context": {"ex": "http://example.org/", "xsd": "http://www.w3.org/2001/XMLSchema#"},
+				   "@id": "ex:a", "ex:count": 3, "ex:ratio": 0.5, "ex:on": true,
+				   "ex:temp": {"@value": "21.5", "@type": "xsd:decimal"}}`,
+			want: []string{
+				`<http://example.org/a> <http://example.org/count> "3"^^<http://www.w3.org/2001/XMLSchema#integer>`,
+				`<http://example.org/a> <http://example.org/ratio> "0.5"^^<http://www.w3.org/2001/XMLSchema#double>`,
+				`<http://example.org/a> <http://example.org/on> "true"^^<http://www.w3.org/2001/XMLSchema#boolean>`,
+				`<http://example.org/a> <http://example.org/temp> "21.5"^^<http://www.w3.org/2001/XMLSchema#decimal>`,
+			},
+		},
+		{
+			name: "language-tagged values",
+			doc: `{"@context": {"ex": "http://example.org/", "@language": "en",
+							   "fr": {"@id": "ex:fr", "@language": "fr"}},
+				   "@id": "ex:a", "ex:label": "hello", "fr": "bonjour", "ex:es": {"@value": "hola", "@language": "es"}}`,
+			want: []string{
+				`<http://example.org/a> <http://example.org/label> "hello"@en`,
+				`<http://example.org/a> <http://example.org/fr> "bonjour"@fr`,
+				`<http://example.org/a> <http://example.org/es> "hola"@es`,
+			},
+		},
+		{
+			name: "graph",
+			doc: `{"@context": {"ex": "http://example.org/"},
+				   "@graph": [{"@id": "ex:a", "ex:p": {"@id": "ex:b"}}, {"@id": "ex:b", "@type": "ex:C"}]}`,
+			want: []string{
+				`<http://example.org/a> <http://example.org/p> <http://example.org/b>`,
+				`<http://example.org/b> <http://www.w3.org/1999/02/22-rdf-syntax-ns#type> <http://example.org/C>`,
+			},
+		},
+		{
+			name: "nested node",
+			doc:  `{"@id": "http://example.org/a", "http://example.org/p": {"http://example.org/q": "v"}}`,
+			want: []string{
+				`<http://example.org/a> <http://example.org/p> _:jsonld1`,
+				`_:jsonld1 <http://example.org/q> "v"`,
+			},
+		},
+		{
+			name: "keys that are not IRIs are dropped",
+			doc:  `{"@id": "http://example.org/a", "comment": "x"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			triples, err := decodeJSONLD(strings.NewReader(tc.doc))
+			if err != nil {
+				t.Fatalf("Could not decode: %s", err)
+			}
+			var got []string
+			for _, triple := range triples {
+				got = append(got, triple.Subj.Serialize(0)+" "+triple.Pred.Serialize(0)+" "+triple.Obj.Serialize(0))
+			}
+			sort.Strings(got)
+			sort.Strings(tc.want)
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("Got triples\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestDecodeJSONLDErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		doc  string
+		line int
+		msg  string
+	}{
+		{
+			name: "list value",
+			doc:  `{"@id": "http://example.org/a", "http://example.org/p": {"@list": ["x"]}}`,
+			msg:  "@list is not supported",
+		},
+		{
+			name: "list container",
+			doc:  `{"@context": {"p": {"@id": "http://example.org/p", "@container": "@list"}}, "@id": "http://example.org/a", "p": ["x"]}`,
+			msg:  "List container p is not supported",
+		},
+		{
+			name: "reverse term",
+			doc:  `{"@context": {"p": {"@reverse": "http://example.org/p"}}, "@id": "http://example.org/a", "p": "x"}`,
+			msg:  "Reverse property p is not supported",
+		},
+		{
+			name: "reverse keyword",
+			doc:  `{"@id": "http://example.org/a", "@reverse": {"http://example.org/p": {"@id": "http://example.org/b"}}}`,
+			msg:  "JSON-LD keyword @reverse is not supported",
+		},
+		{
+			name: "remote context",
+			doc:  `{"@context": "http://example.org/context.jsonld", "@id": "http://example.org/a"}`,
+			msg:  "Remote JSON-LD contexts are not supported",
+		},
+		{
+			name: "relative subject",
+			doc:  `{"@id": "a", "http://example.org/p": "x"}`,
+			msg:  "a is not an absolute IRI",
+		},
+		{
+			name: "syntax error",
+			doc:  "{\"@id\": \"http://example.org/a\",\n \"http://example.org/p\": }",
+			line: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := decodeJSONLD(strings.NewReader(tc.doc))
+			var perr *TripleParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("Got error %v, want a TripleParseError", err)
+			}
+			if perr.Line != tc.line {
+				t.Errorf("Got error on line %d, want %d", perr.Line, tc.line)
+			}
+			if !strings.Contains(perr.Message, tc.msg) {
+				t.Errorf("Got error %q, want %q", perr.Message, tc.msg)
+			}
+			if perr.Skippable() {
+				t.Errorf("Error %q should not be skippable", perr.Message)
+			}
+		})
+	}
+}
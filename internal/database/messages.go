@@ -12,7 +12,6 @@ import (
 	"time"
 
 	"github.com/knakk/rdf"
-	"github.com/knakk/sparql"
 
 	"github.com/apache/arrow/go/arrow"
 )
@@ -20,6 +19,31 @@ import (
 type ModelRequest struct {
 	Graph     string
 	Timestamp time.Time
+	// if set, only the triples from this origin are returned
+	Origin string
+	// serialization of the graph: one of GraphMediaTypes (defaults to Turtle)
+	MediaType string
+}
+
+func (req *ModelRequest) FromURLParams(vals url.Values) error {
+	if graph := vals.Get("graph"); len(graph) > 0 {
+		req.Graph = graph
+	} else if source := vals.Get("source"); len(source) > 0 {
+		req.Graph = source
+	} else if len(req.Graph) == 0 {
+		return errors.New("Params lacks 'graph'")
+	}
+	if _timestamp := vals.Get("timestamp"); len(_timestamp) > 0 {
+		timestamp, err := time.Parse(time.RFC3339, _timestamp)
+		if err != nil {
+			return fmt.Errorf("Invalid timestamp %s: %w", _timestamp, err)
+		}
+		req.Timestamp = timestamp
+	}
+	if origin := vals.Get("origin"); len(origin) > 0 {
+		req.Origin = origin
+	}
+	return nil
 }
 
 type ContextKey string
@@ -31,7 +55,15 @@ type Stream struct {
 	Name       string
 	BrickURI   string
 	BrickClass string
-	id         int
+	// a derived stream has no readings of its own: they are computed at query time with this expression over
+	// stream ids ($12) and the variables (?supply) of the first solution of the ExpressionQuery on the source
+	Expression      string
+	ExpressionQuery string
+	// the type of the values of the stream: float (the default), int, bool or string. A string stream can declare
+	// the States it takes (e.g. the modes of a fan), and then only accepts them
+	Type   string
+	States []string
+	id     int
 }
 
 func (s *Stream) String() string {
@@ -62,15 +94,36 @@ func (s *Stream) FromURLParams(vals url.Values) error {
 	if class := vals.Get("brick_class"); len(class) > 0 {
 		s.BrickClass = class
 	}
+	if typ := vals.Get("type"); len(typ) > 0 {
+		s.Type = typ
+	}
+	if states, ok := vals["state"]; ok {
+		s.States = states
+	}
 	return nil
 }
 
 type Reading struct {
 	Value float64
 	Time  time.Time
+	// the value of a reading of a string stream. Readings of bool streams have a Value of 1 (true) or 0 (false)
+	Text string
+	// how the value was given, to check it against the type of the stream
+	kind readingKind
 }
 
-// UnmarshalJSON unpacks a Reading from a length-2 JSON array
+type readingKind uint8
+
+const (
+	readingNumber readingKind = iota
+	readingBool
+	readingText
+	// a CSV field, which is a number if Value could be parsed from the Text
+	readingField
+	readingNumericField
+)
+
+// UnmarshalJSON unpacks a Reading from a length-2 JSON array. The value is a number, a boolean or a string
 func (rdg *Reading) UnmarshalJSON(data []byte) error {
 	var (
 		rdgJSON   [2]json.RawMessage
@@ -90,14 +143,32 @@ func (rdg *Reading) UnmarshalJSON(data []byte) error {
 		return errors.New("First item must be a RFC3339 timestamp")
 	}
 
+	var b bool
+	if err := json.Unmarshal(rdgJSON[1], &b); err == nil {
+		rdg.kind, rdg.Value = readingBool, 0
+		if b {
+			rdg.Value = 1
+		}
+		return nil
+	}
+	// strings decode into a json.Number only if they are numbers, so strings are tried first
+	if len(rdgJSON[1]) > 0 && rdgJSON[1][0] == '"' {
+		if err := json.Unmarshal(rdgJSON[1], &rdg.Text); err != nil {
+			return fmt.Errorf("Second item was not a string: %w", err)
+		}
+		rdg.kind = readingText
+		return nil
+	}
+
 	if err := json.Unmarshal(rdgJSON[1], &value); err != nil {
-		return errors.New("Second item must be a number")
+		return errors.New("Second item must be a number, a boolean or a string")
 	}
 
 	rdg.Value, err = value.Float64()
 	if err != nil {
 		return fmt.Errorf("Second item was not a float: %w", err)
 	}
+	rdg.kind = readingNumber
 
 	return err
 }
@@ -109,10 +180,14 @@ func (rdg *Reading) FromCSVRow(row []string) error {
 	if err != nil {
 		return errors.New("First item must be a RFC3339 timestamp")
 	}
+	if len(row) < 2 {
+		return errors.New("Row lacks a value")
+	}
 
-	rdg.Value, err = strconv.ParseFloat(row[1], 64)
-	if err != nil {
-		return errors.New("Second item must be a float")
+	// the type of the stream determines how the field is read
+	rdg.Text, rdg.kind, rdg.Value = row[1], readingField, 0
+	if v, err := strconv.ParseFloat(row[1], 64); err == nil {
+		rdg.kind, rdg.Value = readingNumericField, v
 	}
 
 	return nil
@@ -124,7 +199,8 @@ type Dataset interface {
 	GetReadings() chan Reading
 	SetId(int)
 
-	// for CopyFromSource
+	// for CopyFromSource. The values are the time, the stream id and the Reading, which is converted to the type
+	// of the stream when it is copied
 	Next() bool
 	Values() ([]interface{}, error)
 	Err() error
@@ -191,7 +267,7 @@ func (d *StreamingDataset) Values() ([]interface{}, error) {
 	if d.id == -1 {
 		return nil, errors.New("Need to set ID")
 	}
-	return []interface{}{d.current.Time, d.id, d.current.Value}, nil
+	return []interface{}{d.current.Time, d.id, *d.current}, nil
 }
 
 func (d *StreamingDataset) Err() error {
@@ -249,7 +325,7 @@ func (d *ArrayDataset) Values() ([]interface{}, error) {
 		return nil, errors.New("Need to set ID")
 	}
 	rdg := d.Readings[d.idx]
-	return []interface{}{rdg.Time, d.id, rdg.Value}, nil
+	return []interface{}{rdg.Time, d.id, rdg}, nil
 }
 
 func (d *ArrayDataset) Err() error {
@@ -264,6 +340,12 @@ const (
 	AggregationMin
 	AggregationSum
 	AggregationCount
+	// the fraction of the time the value of a stream is true (not 0); each reading holds until the next reading
+	AggregationDutyCycle
+	// the value a stream held for the longest time
+	AggregationMode
+	// the seconds a stream spent in each of its values, one row per value
+	AggregationDurations
 )
 
 func ParseAggregationType(s string) (AggregationType, error) {
@@ -278,6 +360,12 @@ func ParseAggregationType(s string) (AggregationType, error) {
 		return AggregationSum, nil
 	case "count":
 		return AggregationCount, nil
+	case "duty_cycle":
+		return AggregationDutyCycle, nil
+	case "mode":
+		return AggregationMode, nil
+	case "durations":
+		return AggregationDurations, nil
 	default:
 		return 0, fmt.Errorf("Aggregation type %s unknown", s)
 	}
@@ -299,15 +387,29 @@ func (agg AggregationType) toSQL(field string) string {
 	panic("Invalid Aggregation Function")
 }
 
+// isState is true for the aggregations of the time spent in each value, rather than of the values of the readings
+func (agg AggregationType) isState() bool {
+	return agg == AggregationDutyCycle || agg == AggregationMode || agg == AggregationDurations
+}
+
 type Query struct {
 	Ids               []int64
 	Uris              []string
 	Sources           []string
 	Sparql            string
+	SparqlAsOf        *time.Time
 	Start             time.Time
 	End               time.Time
 	AggregationFunc   *AggregationType
-	AggregationWindow *time.Duration
+	AggregationWindow *Window
+	// timezone of the calendar of relative times, named ranges and aggregation windows; UTC if nil
+	Location *time.Location
+	// only read the data of the occupied hours of each site, according to the calendar of the site
+	Occupied bool
+	// "good" only reads the readings that passed their quality checks, "flagged" only those that failed one
+	Quality string
+	// return the quality flags of the readings
+	Flags bool
 }
 
 func (q *Query) FromURLParams(vals url.Values) error {
@@ -336,8 +438,25 @@ func (q *Query) FromURLParams(vals url.Values) error {
 		}
 	}
 
+	now := time.Now().UTC()
+	if tz := vals.Get("tz"); len(tz) > 0 {
+		if q.Location, err = ParseLocation(tz); err != nil {
+			return err
+		}
+		now = now.In(q.Location)
+	}
+
+	if _end := vals.Get("end"); len(_end) > 0 {
+		q.End, err = ParseTime(_end, now)
+		if err != nil {
+			return fmt.Errorf("Invalid end time %s: %w", _end, err)
+		}
+	} else {
+		q.End = now
+	}
+
 	if _start := vals.Get("start"); len(_start) > 0 {
-		q.Start, err = time.Parse(time.RFC3339, _start)
+		q.Start, err = ParseTime(_start, now)
 		if err != nil {
 			return fmt.Errorf("Invalid start time %s: %w", _start, err)
 		}
@@ -346,13 +465,35 @@ func (q *Query) FromURLParams(vals url.Values) error {
 		q.Start = time.Time{}
 	}
 
-	if _end := vals.Get("end"); len(_end) > 0 {
-		q.End, err = time.Parse(time.RFC3339, _end)
+	// a range gives the start and end that were not given explicitly
+	if _range := vals.Get("range"); len(_range) > 0 {
+		start, end, err := ParseTimeRange(_range, now, q.End)
 		if err != nil {
-			return fmt.Errorf("Invalid end time %s: %w", _end, err)
+			return err
+		}
+		if len(vals.Get("start")) == 0 {
+			q.Start = start
+		}
+		if len(vals.Get("end")) == 0 {
+			q.End = end
+		}
+	}
+
+	if occupied := vals.Get("occupied"); len(occupied) > 0 {
+		if q.Occupied, err = strconv.ParseBool(occupied); err != nil {
+			return fmt.Errorf("Invalid occupied %s: %w", occupied, err)
+		}
+	}
+
+	switch q.Quality = vals.Get("quality"); q.Quality {
+	case "", "all", "good", "flagged":
+	default:
+		return fmt.Errorf("Invalid quality %s (must be all, good or flagged)", q.Quality)
+	}
+	if flags := vals.Get("flags"); len(flags) > 0 {
+		if q.Flags, err = strconv.ParseBool(flags); err != nil {
+			return fmt.Errorf("Invalid flags %s: %w", flags, err)
 		}
-	} else {
-		q.End = time.Now()
 	}
 
 	if _aggfunc := vals.Get("agg"); len(_aggfunc) > 0 {
@@ -364,23 +505,301 @@ func (q *Query) FromURLParams(vals url.Values) error {
 	}
 
 	if _window := vals.Get("window"); len(_window) > 0 {
-		window, err := ParseDuration(_window)
+		window, err := ParseWindow(_window)
 		if err != nil {
 			return fmt.Errorf("Invalid window size %s: %w", _window, err)
 		}
+		if window.IsZero() {
+			return fmt.Errorf("Invalid window size %s", _window)
+		}
 		q.AggregationWindow = &window
 	}
+	if q.AggregationFunc != nil && q.AggregationFunc.isState() && q.Occupied {
+		return errors.New("Aggregations of states cannot be restricted to occupied hours")
+	}
 
 	q.Sources = vals["sites"]
 
+	if q.SparqlAsOf, err = parseAsOf(vals); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SparqlProtocolRequest is a query received through the SPARQL 1.1 Protocol. The RDF dataset
+// of the query is described in terms of Mortar sources: each default-graph-uri and named-graph-uri
+// names a source, either directly or as the 'urn:<source>' graph name used by the reasoner
+type SparqlProtocolRequest struct {
+	Query          string
+	DefaultSources []string
+	NamedSources   []string
+	// if set, the query is evaluated against the sources as they were at this time
+	AsOf *time.Time
+	// if set, the query is evaluated against the stored triples of the sources, without the triples inferred
+	// by the reasoner
+	Stored bool
+}
+
+// FromURLParams reads the query and dataset description from URL parameters or a parsed form body.
+// The non-standard 'site' parameter is accepted as an alias for default-graph-uri
+func (req *SparqlProtocolRequest) FromURLParams(vals url.Values) error {
+	if query := vals.Get("query"); len(query) > 0 {
+		req.Query = query
+	} else if len(req.Query) == 0 {
+		return errors.New("Params lacks 'query'")
+	}
+	for _, uri := range vals["default-graph-uri"] {
+		req.DefaultSources = append(req.DefaultSources, sourceFromGraphURI(uri))
+	}
+	for _, uri := range vals["named-graph-uri"] {
+		req.NamedSources = append(req.NamedSources, sourceFromGraphURI(uri))
+	}
+	if site := vals.Get("site"); len(site) > 0 && len(req.DefaultSources) == 0 {
+		req.DefaultSources = []string{site}
+	}
+	asOf, err := parseAsOf(vals)
+	if err != nil {
+		return err
+	}
+	req.AsOf = asOf
+	return nil
+}
+
+// parseAsOf reads the optional 'as_of' parameter, which selects a historical version of the model
+func parseAsOf(vals url.Values) (*time.Time, error) {
+	_asOf := vals.Get("as_of")
+	if len(_asOf) == 0 {
+		return nil, nil
+	}
+	asOf, err := time.Parse(time.RFC3339, _asOf)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid as_of time %s: %w", _asOf, err)
+	}
+	return &asOf, nil
+}
+
+// QualifyRequest is a list of SPARQL queries to evaluate against every source. By default only the number of
+// solutions of each query is computed; a Detailed request also returns the solutions and the streams they refer to
+type QualifyRequest struct {
+	Queries []string
+	// if set, the queries are evaluated against the sources as they were at this time
+	AsOf     *time.Time
+	Detailed bool
+	// maximum number of solutions returned for each query and source (0 for all of them)
+	Limit int
+	// if either is set, the availability of data for the streams is computed over [Start, End]
+	Start *time.Time
+	End   *time.Time
+	// maximum number of queries evaluated concurrently (0 for the configured number)
+	Concurrency int
+	// if set, the queries are only evaluated against these sources
+	Sources []string
+}
+
+func (req *QualifyRequest) FromURLParams(vals url.Values) error {
+	var err error
+	if req.AsOf, err = parseAsOf(vals); err != nil {
+		return err
+	}
+	if detail := vals.Get("detail"); len(detail) > 0 {
+		if req.Detailed, err = strconv.ParseBool(detail); err != nil {
+			return fmt.Errorf("Invalid detail %s: %w", detail, err)
+		}
+	}
+	if limit := vals.Get("limit"); len(limit) > 0 {
+		if req.Limit, err = strconv.Atoi(limit); err != nil || req.Limit < 0 {
+			return fmt.Errorf("Invalid limit %s", limit)
+		}
+		req.Detailed = true
+	}
+	req.Sources = vals["source"]
+	if concurrency := vals.Get("concurrency"); len(concurrency) > 0 {
+		if req.Concurrency, err = strconv.Atoi(concurrency); err != nil || req.Concurrency < 0 {
+			return fmt.Errorf("Invalid concurrency %s", concurrency)
+		}
+	}
+	if _start := vals.Get("start"); len(_start) > 0 {
+		start, err := ParseTime(_start, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("Invalid start time %s: %w", _start, err)
+		}
+		req.Start = &start
+	}
+	if _end := vals.Get("end"); len(_end) > 0 {
+		end, err := ParseTime(_end, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("Invalid end time %s: %w", _end, err)
+		}
+		req.End = &end
+	}
+	if req.HasWindow() {
+		req.Detailed = true
+		if req.Start == nil {
+			req.Start = &time.Time{}
+		}
+		if req.End == nil {
+			now := time.Now()
+			req.End = &now
+		}
+	}
+	return nil
+}
+
+// HasWindow returns true if the request asks for the availability of data
+func (req *QualifyRequest) HasWindow() bool {
+	return req.Start != nil || req.End != nil
+}
+
+// SparqlUpdateRequest is a SPARQL 1.1 Update request against a source. Triples are deleted from
+// Origin (every origin if empty) and inserted into Origin (DefaultEditOrigin if empty)
+type SparqlUpdateRequest struct {
+	Source string
+	Origin string
+	Update string
+}
+
+// FromURLParams reads the update request from URL parameters or a parsed form body
+func (req *SparqlUpdateRequest) FromURLParams(vals url.Values) error {
+	if source := vals.Get("source"); len(source) > 0 {
+		req.Source = source
+	} else if uri := vals.Get("using-graph-uri"); len(uri) > 0 {
+		req.Source = sourceFromGraphURI(uri)
+	} else {
+		return errors.New("Params lacks 'source'")
+	}
+	if update := vals.Get("update"); len(update) > 0 {
+		req.Update = update
+	} else if len(req.Update) == 0 {
+		return errors.New("Params lacks 'update'")
+	}
+	req.Origin = vals.Get("origin")
+	return nil
+}
+
+// GraphStoreRequest identifies the graph operated on by a SPARQL 1.1 Graph Store HTTP Protocol request.
+// Graphs are Mortar sources; writes replace or add to the triples of Origin (every origin if empty)
+type GraphStoreRequest struct {
+	Source string
+	Origin string
+}
+
+// FromURLParams reads the graph from the 'graph' parameter
+func (req *GraphStoreRequest) FromURLParams(vals url.Values) error {
+	if _, ok := vals["default"]; ok {
+		return errors.New("The default graph is the union of all sources; name a source with 'graph'")
+	}
+	if graph := vals.Get("graph"); len(graph) > 0 {
+		req.Source = sourceFromGraphURI(graph)
+	} else {
+		return errors.New("Params lacks 'graph'")
+	}
+	req.Origin = vals.Get("origin")
 	return nil
 }
 
+// DiffRequest asks for the changes to a source (or one of its origins) between two points in time
+type DiffRequest struct {
+	Source string
+	Origin string
+	From   time.Time
+	To     time.Time
+}
+
+func (req *DiffRequest) FromURLParams(vals url.Values) error {
+	var err error
+	if source := vals.Get("source"); len(source) > 0 {
+		req.Source = source
+	} else {
+		return errors.New("Params lacks 'source'")
+	}
+	if _from := vals.Get("from"); len(_from) > 0 {
+		if req.From, err = time.Parse(time.RFC3339, _from); err != nil {
+			return fmt.Errorf("Invalid from time %s: %w", _from, err)
+		}
+	} else {
+		return errors.New("Params lacks 'from'")
+	}
+	if _to := vals.Get("to"); len(_to) > 0 {
+		if req.To, err = time.Parse(time.RFC3339, _to); err != nil {
+			return fmt.Errorf("Invalid to time %s: %w", _to, err)
+		}
+	} else {
+		req.To = time.Now()
+	}
+	req.Origin = vals.Get("origin")
+	return nil
+}
+
+// RollbackRequest asks for a source (or one of its origins) to be restored to its state at Time
+type RollbackRequest struct {
+	Source string
+	Origin string
+	Time   time.Time
+}
+
+func (req *RollbackRequest) FromURLParams(vals url.Values) error {
+	var err error
+	if source := vals.Get("source"); len(source) > 0 {
+		req.Source = source
+	} else {
+		return errors.New("Params lacks 'source'")
+	}
+	if _time := vals.Get("time"); len(_time) > 0 {
+		if req.Time, err = time.Parse(time.RFC3339, _time); err != nil {
+			return fmt.Errorf("Invalid timestamp %s: %w", _time, err)
+		}
+	} else {
+		return errors.New("Params lacks 'time'")
+	}
+	req.Origin = vals.Get("origin")
+	return nil
+}
+
+// FormatFromMediaType returns the RDF format for the media type
+func FormatFromMediaType(mediaType string) (rdf.Format, error) {
+	switch mediaType {
+	case MediaTypeTurtle, "application/x-turtle":
+		return rdf.Turtle, nil
+	case MediaTypeNTriples, "text/plain":
+		return rdf.NTriples, nil
+	case MediaTypeRDFXML:
+		return rdf.RDFXML, nil
+	case MediaTypeNQuads:
+		return rdf.NQuads, nil
+	case MediaTypeJSONLD:
+		return FormatJSONLD, nil
+	}
+	return rdf.Turtle, fmt.Errorf("Unsupported RDF media type %s", mediaType)
+}
+
+// ReadTriples decodes all of the triples in the document
+func ReadTriples(r io.Reader, format rdf.Format) ([]Triple, error) {
+	var triples []Triple
+	dec := NewTripleDecoder(r, format)
+	for triple, err := dec.Decode(); err != io.EOF; triple, err = dec.Decode() {
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse triple %d: %w", len(triples), err)
+		}
+		triples = append(triples, tripleFromRDF(triple))
+	}
+	return triples, nil
+}
+
+// sourceFromGraphURI maps an RDF graph name to the name of a Mortar source
+func sourceFromGraphURI(uri string) string {
+	return strings.TrimPrefix(uri, "urn:")
+}
+
 type TripleSource struct {
 	Source string
 	Origin string
 	Format rdf.Format
 	Time   time.Time
+	// if true (the default), uploads with syntax errors are rejected; otherwise the valid triples are inserted
+	Strict bool
+	// whether the graph of the source is validated against its shapes after the upload
+	Validate ValidationMode
 }
 
 func (ts *TripleSource) FromURLParams(vals url.Values) error {
@@ -399,17 +818,21 @@ func (ts *TripleSource) FromURLParams(vals url.Values) error {
 
 	// optional
 	ts.Format = rdf.Turtle
-	if _format := vals.Get("format"); len(_format) > 0 {
-		switch strings.ToLower(_format) {
-		case "ntriples", "n3":
-			ts.Format = rdf.NTriples
-		case "turtle", "ttl":
-			ts.Format = rdf.Turtle
-		case "xml", "rdfxml":
-			ts.Format = rdf.RDFXML
+	if format, ok := FormatFromName(vals.Get("format")); ok {
+		ts.Format = format
+	}
+
+	ts.Strict = true
+	if _strict := vals.Get("strict"); len(_strict) > 0 {
+		if ts.Strict, err = strconv.ParseBool(_strict); err != nil {
+			return fmt.Errorf("Invalid strict flag %s: %w", _strict, err)
 		}
 	}
 
+	if ts.Validate, err = ParseValidationMode(vals.Get("validate")); err != nil {
+		return err
+	}
+
 	if _time := vals.Get("time"); len(_time) > 0 {
 		if ts.Time, err = time.Parse(time.RFC3339, _time); err != nil {
 			return fmt.Errorf("Invalid timestamp %s: %w", _time, err)
@@ -419,6 +842,23 @@ func (ts *TripleSource) FromURLParams(vals url.Values) error {
 	return nil
 }
 
+// FormatFromName returns the RDF format with the given name or file extension (e.g. "turtle" or ".ttl")
+func FormatFromName(name string) (rdf.Format, bool) {
+	switch strings.TrimPrefix(strings.ToLower(name), ".") {
+	case "ntriples", "n3", "nt":
+		return rdf.NTriples, true
+	case "turtle", "ttl":
+		return rdf.Turtle, true
+	case "xml", "rdfxml", "rdf", "owl":
+		return rdf.RDFXML, true
+	case "nquads", "nq":
+		return rdf.NQuads, true
+	case "jsonld", "json-ld":
+		return FormatJSONLD, true
+	}
+	return rdf.Turtle, false
+}
+
 type TripleDataset interface {
 	GetSource() string
 	GetOrigin() string
@@ -431,19 +871,28 @@ type TripleDataset interface {
 	Err() error
 }
 
+// StreamingTripleDataset inserts triples as they are decoded. If the dataset is strict, the first
+// syntax error ends the dataset with an error; otherwise malformed lines of N-Triples and N-Quads are
+// skipped, and the other syntax errors (after which the document cannot be decoded) end the dataset
+// with an error
 type StreamingTripleDataset struct {
 	dec     rdf.TripleDecoder
 	source  string
 	origin  string
 	time    time.Time
+	strict  bool
 	current *rdf.Triple
+	parsed  int
+	errors  []*TripleParseError
+	err     error
 }
 
-func NewStreamingTripleDataset(source, origin string, t time.Time, dec rdf.TripleDecoder) *StreamingTripleDataset {
+func NewStreamingTripleDataset(source, origin string, t time.Time, strict bool, dec rdf.TripleDecoder) *StreamingTripleDataset {
 	ds := &StreamingTripleDataset{
 		source:  source,
 		origin:  origin,
 		time:    t,
+		strict:  strict,
 		dec:     dec,
 		current: nil,
 	}
@@ -465,27 +914,45 @@ func (ds *StreamingTripleDataset) GetTime() time.Time {
 func (ds *StreamingTripleDataset) GetTriples() chan rdf.Triple {
 	c := make(chan rdf.Triple)
 	go func() {
-		for {
-			triple, err := ds.dec.Decode()
-			if err == io.EOF {
-				break
-			}
-			c <- triple
+		for ds.Next() {
+			c <- *ds.current
 		}
 		close(c)
 	}()
 	return c
 }
 
+// Parsed returns the number of triples decoded so far
+func (ds *StreamingTripleDataset) Parsed() int {
+	return ds.parsed
+}
+
+// ParseErrors returns the syntax errors encountered so far
+func (ds *StreamingTripleDataset) ParseErrors() []*TripleParseError {
+	return ds.errors
+}
+
 func (ds *StreamingTripleDataset) Next() bool {
-	triple, err := ds.dec.Decode()
-	// sometimes the triple is not nil, but all the fields are nil; this probably happens
-	// because of a parse error
-	if err == io.EOF || triple.Subj == nil || triple.Pred == nil || triple.Obj == nil {
-		return false
+	for {
+		triple, err := ds.dec.Decode()
+		if err == io.EOF {
+			return false
+		} else if err != nil {
+			var perr *TripleParseError
+			if !errors.As(err, &perr) {
+				perr = &TripleParseError{Message: err.Error()}
+			}
+			ds.errors = append(ds.errors, perr)
+			if ds.strict || !perr.Skippable() {
+				ds.err = perr
+				return false
+			}
+			continue
+		}
+		ds.parsed++
+		ds.current = &triple
+		return true
 	}
-	ds.current = &triple
-	return ds.current != nil
 }
 
 func (ds *StreamingTripleDataset) Values() ([]interface{}, error) {
@@ -497,6 +964,112 @@ func (ds *StreamingTripleDataset) Values() ([]interface{}, error) {
 }
 
 func (ds *StreamingTripleDataset) Err() error {
+	return ds.err
+}
+
+// UploadReport summarizes the insertion of an RDF document
+type UploadReport struct {
+	// number of valid triples in the document
+	Parsed int
+	// number of triples stored
+	Inserted int64
+	// number of valid triples that repeat a triple earlier in the document
+	Duplicates int64
+	Errors     []*TripleParseError
+	// the validation of the graph after the upload, if requested
+	Validation *ValidationReport
+}
+
+// ValidationRequest asks for the validation of the current graph of a source. If Shapes is empty,
+// all of the shapes stored for the source are used
+type ValidationRequest struct {
+	Source string
+	Shapes []string
+}
+
+func (req *ValidationRequest) FromURLParams(vals url.Values) error {
+	if source := vals.Get("source"); len(source) > 0 {
+		req.Source = source
+	} else {
+		return errors.New("Params lacks 'source'")
+	}
+	req.Shapes = vals["shapes"]
+	return nil
+}
+
+// ReconcileRequest asks for the reconciliation of the streams of a source with its model. If Apply is
+// false, the report is computed but the streams are not changed
+type ReconcileRequest struct {
+	Source string
+	Apply  bool
+}
+
+func (req *ReconcileRequest) FromURLParams(vals url.Values) error {
+	if source := vals.Get("source"); len(source) > 0 {
+		req.Source = source
+	} else {
+		return errors.New("Params lacks 'source'")
+	}
+	return nil
+}
+
+// ApplicationSitesRequest asks for the qualification of sites (every site, if Sources is empty) for an application
+type ApplicationSitesRequest struct {
+	Name    string
+	Sources []string
+	// recompute the qualification of every site, even if the cached qualification is up to date
+	Refresh bool
+}
+
+func (req *ApplicationSitesRequest) FromURLParams(vals url.Values) error {
+	if name := vals.Get("name"); len(name) > 0 {
+		req.Name = name
+	} else {
+		return errors.New("Params lacks 'name'")
+	}
+	req.Sources = vals["source"]
+	if refresh := vals.Get("refresh"); len(refresh) > 0 {
+		var err error
+		if req.Refresh, err = strconv.ParseBool(refresh); err != nil {
+			return fmt.Errorf("Invalid refresh %s: %w", refresh, err)
+		}
+	}
+	return nil
+}
+
+// ApplicationDataRequest asks for the data of an application on a site. Start and End override the data window of the application
+type ApplicationDataRequest struct {
+	Name   string
+	Source string
+	Start  *time.Time
+	End    *time.Time
+}
+
+func (req *ApplicationDataRequest) FromURLParams(vals url.Values) error {
+	if name := vals.Get("name"); len(name) > 0 {
+		req.Name = name
+	} else {
+		return errors.New("Params lacks 'name'")
+	}
+	if source := vals.Get("source"); len(source) > 0 {
+		req.Source = source
+	} else {
+		return errors.New("Params lacks 'source'")
+	}
+	if _start := vals.Get("start"); len(_start) > 0 {
+		start, err := ParseTime(_start, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("Invalid start time %s: %w", _start, err)
+		}
+		req.Start = &start
+	}
+	if _end := vals.Get("end"); len(_end) > 0 {
+		end, err := ParseTime(_end, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("Invalid end time %s: %w", _end, err)
+		}
+		req.End = &end
+	}
 	return nil
 }
 
@@ -506,7 +1079,7 @@ func ParseDuration(expr string) (time.Duration, error) {
 	var d time.Duration
 	results := dur_re.FindAllStringSubmatch(expr, -1)
 	if len(results) == 0 {
-		return d, errors.New("Invalid. Must be Number followed by h,m,s,us,ms,ns,d")
+		return d, errors.New("Invalid. Must be Number followed by h,m,s,us,ms,ns,d,w")
 	}
 	num := results[0][1]
 	units := results[0][2]
@@ -530,8 +1103,10 @@ func ParseDuration(expr string) (time.Duration, error) {
 		d *= time.Nanosecond
 	case "d", "day", "days":
 		d *= 24 * time.Hour
+	case "w", "wk", "week", "weeks":
+		d *= 7 * 24 * time.Hour
 	default:
-		err = fmt.Errorf("Invalid unit %v. Must be h,m,s,us,ms,ns,d", units)
+		err = fmt.Errorf("Invalid unit %v. Must be h,m,s,us,ms,ns,d,w", units)
 	}
 	return d, err
 }
@@ -544,7 +1119,21 @@ func makeStringArrowSchema(names []string) *arrow.Schema {
 	return arrow.NewSchema(fields, nil)
 }
 
-// build an arrow schema from a sparql query result
-func makeArrowSchemaFromSPARQL(res *sparql.Results) *arrow.Schema {
-	return makeStringArrowSchema(res.Head.Vars)
+// build an arrow schema for the solutions of a sparql query: a column for each variable, followed by the source
+// the query was evaluated against and the ids of the streams that each solution refers to. Variables named
+// 'source' or 'stream_ids' are prefixed with '?'
+func makeArrowSchemaFromSPARQL(vars []string) *arrow.Schema {
+	names := make([]string, len(vars))
+	for idx, v := range vars {
+		names[idx] = v
+		if v == "source" || v == "stream_ids" {
+			names[idx] = "?" + v
+		}
+	}
+	fields := makeStringArrowSchema(names).Fields()
+	fields = append(fields,
+		arrow.Field{Name: "source", Type: arrow.BinaryTypes.String, Nullable: false},
+		arrow.Field{Name: "stream_ids", Type: arrow.ListOf(arrow.PrimitiveTypes.Int64), Nullable: false},
+	)
+	return arrow.NewSchema(fields, nil)
 }
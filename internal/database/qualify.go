@@ -0,0 +1,294 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// QualifySolution is a solution of a qualify query with the ids of the streams it refers to
+type QualifySolution struct {
+	Bindings  map[string]SparqlTerm
+	StreamIds []int64
+}
+
+// DataAvailability describes the readings of a stream in the window of a qualify request
+type DataAvailability struct {
+	Readings int64
+	First    *time.Time
+	Last     *time.Time
+}
+
+// QualifyStream is a stream that the solutions of a qualify query refer to
+type QualifyStream struct {
+	Stream
+	Id int64
+	// only set if the qualify request has a window
+	Availability *DataAvailability
+}
+
+// QualifyResult is the result of a qualify query on one source
+type QualifyResult struct {
+	// the reason the query could not be evaluated on the source; the other fields are empty if set
+	Error string
+	// the number of solutions of the query
+	Count int
+	// the solutions of the query: the first Limit solutions, if the request has a Limit
+	Solutions []QualifySolution
+	// the streams referred to by any solution of the query
+	Streams []QualifyStream
+	// the number of solutions that refer to a stream with readings in the window; only set if the request has a window
+	SolutionsWithData *int
+	err               error
+}
+
+// QualifyProgress reports the result of one query on one source while a qualify request is evaluated
+type QualifyProgress struct {
+	Source string
+	// index of the query in the request
+	Query  int
+	Result *QualifyResult
+	// number of (source, query) pairs evaluated so far, including this one, and in total
+	Completed int
+	Total     int
+}
+
+type queryTask struct {
+	graph    string
+	queryIdx int
+}
+
+type queryResult struct {
+	queryTask
+	result *QualifyResult
+}
+
+// Qualify evaluates each query of the request against every source. The results are indexed by source and query;
+// a query that fails on a source has an Error in its result. If progress is not nil, it is called with each result
+// as soon as it is available (from a single goroutine). If the context is done before every query is evaluated,
+// the results obtained so far are returned along with the error of the context
+func (db *TimescaleDatabase) Qualify(ctx context.Context, req *QualifyRequest, progress func(QualifyProgress)) (map[string][]*QualifyResult, error) {
+	log := logging.FromContext(ctx)
+	results := make(map[string][]*QualifyResult)
+
+	graphs, err := db.graphs(ctx)
+	if err != nil {
+		return results, fmt.Errorf("Could not list sources: %w", err)
+	}
+	if len(req.Sources) > 0 {
+		requested := make(map[string]bool, len(req.Sources))
+		for _, source := range req.Sources {
+			requested[source] = true
+		}
+		var selected []string
+		for _, graph := range graphs {
+			if requested[graph] {
+				selected = append(selected, graph)
+			}
+		}
+		graphs = selected
+	}
+
+	workers := db.qualifyWorkers
+	if workers <= 0 {
+		workers = config.DefaultQualifyWorkers
+	}
+	if req.Concurrency > 0 && req.Concurrency < workers {
+		workers = req.Concurrency
+	}
+
+	tasks := make(chan queryTask)
+	taskResults := make(chan queryResult)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				taskResults <- queryResult{queryTask: task, result: db.qualifyTask(ctx, req, task)}
+			}
+		}()
+	}
+	// tasks stop being handed out once the context is done; the workers finish the tasks they have
+	go func() {
+		defer close(tasks)
+		for queryIdx := range req.Queries {
+			for _, graph := range graphs {
+				select {
+				case tasks <- queryTask{graph: graph, queryIdx: queryIdx}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(taskResults)
+	}()
+
+	total := len(req.Queries) * len(graphs)
+	completed, failed := 0, 0
+	invalid := make([]int, len(req.Queries))
+	for res := range taskResults {
+		if _, ok := results[res.graph]; !ok {
+			results[res.graph] = make([]*QualifyResult, len(req.Queries))
+		}
+		results[res.graph][res.queryIdx] = res.result
+		completed++
+		if res.result.err != nil {
+			failed++
+			if errors.Is(res.result.err, ErrInvalidQuery) {
+				invalid[res.queryIdx]++
+			}
+		}
+		if progress != nil {
+			progress(QualifyProgress{Source: res.graph, Query: res.queryIdx, Result: res.result, Completed: completed, Total: total})
+		}
+	}
+	log.Infof("Qualified %d queries on %d sources: %d of %d evaluated, %d failed", len(req.Queries), len(graphs), completed, total, failed)
+
+	if err := ctx.Err(); err != nil && completed < total {
+		return results, fmt.Errorf("Qualify interrupted after %d of %d queries: %w", completed, total, err)
+	}
+	// a query that is invalid on every source is an error in the request rather than in the sources
+	for queryIdx, n := range invalid {
+		if len(graphs) > 0 && n == len(graphs) {
+			return results, fmt.Errorf("%w: query %d", ErrInvalidQuery, queryIdx)
+		}
+	}
+	return results, nil
+}
+
+// qualifyTask evaluates one query on one source. Errors are recorded in the result
+func (db *TimescaleDatabase) qualifyTask(ctx context.Context, req *QualifyRequest, task queryTask) *QualifyResult {
+	log := logging.FromContext(ctx)
+	timeout := db.qualifyTimeout
+	if timeout <= 0 {
+		timeout = config.QualifyTaskTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	queryString := req.Queries[task.queryIdx]
+	res, err := db.QuerySparqlProtocol(ctx, &SparqlProtocolRequest{
+		Query:          queryString,
+		DefaultSources: []string{task.graph},
+		AsOf:           req.AsOf,
+	})
+	if err == nil && res.IsGraph() {
+		err = fmt.Errorf("%w: qualify queries must be SELECT queries", ErrInvalidQuery)
+	}
+	result := &QualifyResult{}
+	if err == nil && req.Detailed {
+		result, err = db.qualifyResult(ctx, task.graph, req, res.Results)
+	} else if err == nil {
+		result.Count = len(res.Results.solutions())
+	}
+	if err != nil {
+		log.Errorf("Could not evaluate query %d on %s: %s", task.queryIdx, task.graph, err)
+		return &QualifyResult{Error: err.Error(), err: err}
+	}
+	return result
+}
+
+// qualifyResult finds the streams that the solutions of a qualify query refer to and, if the request has
+// a window, whether they have readings in it
+func (db *TimescaleDatabase) qualifyResult(ctx context.Context, graph string, req *QualifyRequest, results *SparqlResults) (*QualifyResult, error) {
+	solutions, err := db.resolveSolutions(ctx, graph, req.AsOf, results)
+	if err != nil {
+		return nil, err
+	}
+	result := &QualifyResult{Count: len(solutions)}
+
+	var (
+		ids   []int64
+		index = make(map[int]int)
+	)
+	for idx, solution := range solutions {
+		var streamIds []int64
+		for _, stream := range solution.streams {
+			streamIds = append(streamIds, int64(stream.id))
+			if _, ok := index[stream.id]; !ok {
+				index[stream.id] = len(result.Streams)
+				result.Streams = append(result.Streams, QualifyStream{Stream: stream, Id: int64(stream.id)})
+				ids = append(ids, int64(stream.id))
+			}
+		}
+		if req.Limit == 0 || idx < req.Limit {
+			result.Solutions = append(result.Solutions, QualifySolution{Bindings: solution.bindings, StreamIds: streamIds})
+		}
+	}
+
+	if !req.HasWindow() {
+		return result, nil
+	}
+	for idx := range result.Streams {
+		result.Streams[idx].Availability = &DataAvailability{}
+	}
+	rows, err := db.pool.Query(ctx, `SELECT stream_id, COUNT(*), MIN(time), MAX(time) FROM (
+										SELECT stream_id, time FROM data WHERE stream_id = ANY($1) AND time >= $2 AND time <= $3
+										UNION ALL
+										SELECT stream_id, time FROM text_data WHERE stream_id = ANY($1) AND time >= $2 AND time <= $3
+									 ) AS readings GROUP BY stream_id`,
+		ids, req.Start, req.End)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query data availability: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id          int
+			first, last time.Time
+			readings    int64
+		)
+		if err := rows.Scan(&id, &readings, &first, &last); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		if idx, ok := index[id]; ok {
+			result.Streams[idx].Availability = &DataAvailability{Readings: readings, First: &first, Last: &last}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Could not query data availability: %w", err)
+	}
+	rows.Close()
+
+	// the readings of derived streams are those computed from their inputs
+	derived, err := db.derivedStreams(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(derived) > 0 {
+		readings, err := db.derivedReadings(ctx, &Query{Start: *req.Start, End: *req.End}, derived)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range derived {
+			if rdgs := readings[d.stream.id]; len(rdgs) > 0 {
+				result.Streams[index[d.stream.id]].Availability = &DataAvailability{
+					Readings: int64(len(rdgs)),
+					First:    &rdgs[0].Time,
+					Last:     &rdgs[len(rdgs)-1].Time,
+				}
+			}
+		}
+	}
+
+	withData := 0
+	for _, solution := range solutions {
+		for _, stream := range solution.streams {
+			if result.Streams[index[stream.id]].Availability.Readings > 0 {
+				withData++
+				break
+			}
+		}
+	}
+	result.SolutionsWithData = &withData
+	return result, nil
+}
@@ -0,0 +1,644 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ErrQualityPolicyNotFound is returned when a quality policy is not registered
+var ErrQualityPolicyNotFound = errors.New("Quality policy not found")
+
+// ErrInvalidQualityPolicy is returned when a quality policy is rejected
+var ErrInvalidQualityPolicy = errors.New("Invalid quality policy")
+
+// Quality is the set of quality checks a reading failed, stored with the reading as a bitmask
+type Quality int16
+
+const (
+	// the value is outside of the Min and Max of the policy
+	QualityRange Quality = 1 << iota
+	// the value changed faster than the MaxRate of the policy since the previous reading
+	QualityRate
+	// the value is the same as the previous Flatline-1 readings
+	QualityFlatline
+	// another reading of the same insertion has the same time
+	QualityDuplicate
+	// the time is further in the future than the MaxFuture of the policy
+	QualityFuture
+	// the value is NaN or infinite
+	QualityNonFinite
+)
+
+var qualityNames = map[Quality]string{
+	QualityRange:     "range",
+	QualityRate:      "rate",
+	QualityFlatline:  "flatline",
+	QualityDuplicate: "duplicate",
+	QualityFuture:    "future",
+	QualityNonFinite: "nonfinite",
+}
+
+// Names returns the names of the failed checks
+func (q Quality) Names() []string {
+	var names []string
+	for flag, name := range qualityNames {
+		if q&flag != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// actions on the readings that fail a quality check, from the weakest to the strongest
+const (
+	// the reading is stored with its quality flags
+	QualityActionFlag = "flag"
+	// the reading is stored in the quarantine instead of the stream, until it is released
+	QualityActionQuarantine = "quarantine"
+	// the reading is dropped
+	QualityActionReject = "reject"
+)
+
+var qualityActionStrength = map[string]int{
+	QualityActionFlag:       1,
+	QualityActionQuarantine: 2,
+	QualityActionReject:     3,
+}
+
+// QualityPolicy configures the quality checks of the readings inserted into streams. A policy applies to one
+// stream (Source and Stream), to the streams of a BrickClass (in every source, or in Source), to the streams of a
+// Source, or to every stream (if all are empty). Only the most specific policy of a stream applies. Streams
+// without a policy only have their non-finite values rejected, and the readings of string streams are not checked
+type QualityPolicy struct {
+	Name       string
+	Source     string
+	Stream     string
+	BrickClass string
+	Min        *float64
+	Max        *float64
+	// maximum change of the value per second
+	MaxRate *float64
+	// number of consecutive identical values from which readings are flagged as flatlined
+	Flatline int
+	// how far in the future readings can be (e.g. "5m")
+	MaxFuture string
+	// action for the readings that fail each check (range, rate, flatline, duplicate, future or nonfinite).
+	// Readings that fail several checks get the strongest action. By default, non-finite values are rejected
+	// and other readings are flagged
+	Actions map[string]string
+	// time of the last registration of the policy
+	Updated time.Time
+}
+
+// InsertReport counts the readings of an insertion by the outcome of their quality checks and of their conflicts
+// with stored readings
+type InsertReport struct {
+	// readings written to the stream at new times
+	Inserted int64
+	// readings that replaced stored readings with a different value
+	Updated int64
+	// readings that were not written because a reading is stored at their time (with the same value, or with the
+	// 'ignore' conflict policy)
+	Skipped int64
+	// readings written with the flags of the quality checks they failed
+	Flagged     int64
+	Quarantined int64
+	Rejected    int64
+	// the insertion was not done again: this is the report of an earlier insertion with the same idempotency key
+	Replayed bool
+}
+
+// QuarantinedReading is a reading held in the quarantine
+type QuarantinedReading struct {
+	StreamId int
+	Source   string
+	Name     string
+	Time     time.Time
+	// nil for non-finite values
+	Value         *float64
+	Flags         []string
+	QuarantinedAt time.Time
+}
+
+// QuarantineRequest selects the quarantined readings of a source (or of one of its streams) in a time range
+type QuarantineRequest struct {
+	Source string
+	Name   string
+	Start  time.Time
+	End    time.Time
+}
+
+func (req *QuarantineRequest) FromURLParams(vals url.Values) error {
+	var err error
+	if source := vals.Get("source"); len(source) > 0 {
+		req.Source = source
+	} else {
+		return errors.New("Params lacks 'source'")
+	}
+	req.Name = vals.Get("name")
+	now := time.Now().UTC()
+	req.End = now
+	if _end := vals.Get("end"); len(_end) > 0 {
+		if req.End, err = ParseTime(_end, now); err != nil {
+			return fmt.Errorf("Invalid end time %s: %w", _end, err)
+		}
+	}
+	if _start := vals.Get("start"); len(_start) > 0 {
+		if req.Start, err = ParseTime(_start, now); err != nil {
+			return fmt.Errorf("Invalid start time %s: %w", _start, err)
+		}
+	}
+	return nil
+}
+
+// check validates the definition of the policy
+func (policy *QualityPolicy) check() error {
+	switch {
+	case len(policy.Name) == 0:
+		return errors.New("Policy lacks a Name")
+	case len(policy.Stream) > 0 && len(policy.Source) == 0:
+		return errors.New("Policy of a Stream needs its Source")
+	case policy.Min != nil && policy.Max != nil && *policy.Min > *policy.Max:
+		return errors.New("Min is greater than Max")
+	case policy.MaxRate != nil && *policy.MaxRate <= 0:
+		return errors.New("MaxRate must be positive")
+	case policy.Flatline < 0 || policy.Flatline == 1:
+		return errors.New("Flatline must be at least 2")
+	}
+	if len(policy.MaxFuture) > 0 {
+		if _, err := ParseDuration(policy.MaxFuture); err != nil {
+			return fmt.Errorf("Invalid MaxFuture %s: %w", policy.MaxFuture, err)
+		}
+	}
+	for check, action := range policy.Actions {
+		known := false
+		for _, name := range qualityNames {
+			known = known || name == check
+		}
+		if !known {
+			return fmt.Errorf("Unknown check %s", check)
+		}
+		if _, ok := qualityActionStrength[action]; !ok {
+			return fmt.Errorf("Unknown action %s for %s (must be flag, quarantine or reject)", action, check)
+		}
+	}
+	return nil
+}
+
+// action returns the action for the readings that fail the check
+func (policy *QualityPolicy) action(flag Quality) string {
+	if policy != nil {
+		if action, ok := policy.Actions[qualityNames[flag]]; ok {
+			return action
+		}
+	}
+	if flag == QualityNonFinite {
+		return QualityActionReject
+	}
+	return QualityActionFlag
+}
+
+// qualityChecker checks the readings inserted into a stream, in the order they are inserted. Rates and
+// flatlines are determined from the previous reading in time, starting with the latest stored reading; a
+// reading older than the previous one restarts the sequence
+type qualityChecker struct {
+	policy    *QualityPolicy
+	maxFuture *time.Duration
+	now       time.Time
+	prev      *Reading
+	// number of consecutive identical values up to prev
+	run  int
+	seen map[int64]bool
+}
+
+func newQualityChecker(policy *QualityPolicy, latest *Reading, now time.Time) (*qualityChecker, error) {
+	checker := &qualityChecker{policy: policy, now: now, prev: latest, run: 1, seen: make(map[int64]bool)}
+	if policy != nil && len(policy.MaxFuture) > 0 {
+		maxFuture, err := ParseDuration(policy.MaxFuture)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid MaxFuture %s: %w", policy.MaxFuture, err)
+		}
+		checker.maxFuture = &maxFuture
+	}
+	return checker, nil
+}
+
+// check returns the checks the reading fails, and the action to take (empty if it passes every check)
+func (c *qualityChecker) check(rdg Reading) (Quality, string) {
+	var flags Quality
+	if math.IsNaN(rdg.Value) || math.IsInf(rdg.Value, 0) {
+		flags |= QualityNonFinite
+	}
+	if p := c.policy; p != nil {
+		if (p.Min != nil && rdg.Value < *p.Min) || (p.Max != nil && rdg.Value > *p.Max) {
+			flags |= QualityRange
+		}
+		if c.maxFuture != nil && rdg.Time.After(c.now.Add(*c.maxFuture)) {
+			flags |= QualityFuture
+		}
+		key := rdg.Time.UnixNano()
+		if c.seen[key] {
+			flags |= QualityDuplicate
+		}
+		c.seen[key] = true
+
+		// spikes and duplicates do not continue the sequence
+		if flags == 0 {
+			run := 1
+			if c.prev != nil && rdg.Time.After(c.prev.Time) {
+				if p.MaxRate != nil && math.Abs(rdg.Value-c.prev.Value)/rdg.Time.Sub(c.prev.Time).Seconds() > *p.MaxRate {
+					flags |= QualityRate
+				}
+				if rdg.Value == c.prev.Value {
+					run = c.run + 1
+				}
+			}
+			if flags == 0 {
+				if p.Flatline > 0 && run >= p.Flatline {
+					flags |= QualityFlatline
+				}
+				c.prev, c.run = &Reading{Time: rdg.Time, Value: rdg.Value}, run
+			}
+		}
+	}
+
+	action := ""
+	for flag := range qualityNames {
+		if flags&flag == 0 {
+			continue
+		}
+		if a := c.policy.action(flag); qualityActionStrength[a] > qualityActionStrength[action] {
+			action = a
+		}
+	}
+	return flags, action
+}
+
+// qualityDataset converts the readings of a dataset to the type of the stream and checks them as they are
+// copied, and adds their quality to the copied rows. Rejected and quarantined readings are not copied
+type qualityDataset struct {
+	ds          Dataset
+	typ         *streamType
+	checker     *qualityChecker
+	report      InsertReport
+	quarantined []Reading
+	flags       []Quality
+	current     []interface{}
+	err         error
+}
+
+func (q *qualityDataset) Next() bool {
+	for q.ds.Next() {
+		values, err := q.ds.Values()
+		if err != nil {
+			q.err = err
+			return false
+		}
+		if len(values) != 3 {
+			q.err = fmt.Errorf("Unexpected row %v", values)
+			return false
+		}
+		rdg, ok := values[2].(Reading)
+		if !ok {
+			q.err = fmt.Errorf("Unexpected row %v", values)
+			return false
+		}
+		if rdg, err = q.typ.coerce(rdg); err != nil {
+			q.err = err
+			return false
+		}
+		// the checks of the values only apply to numbers
+		if rdg.kind == readingText {
+			q.current = []interface{}{rdg.Time, values[1], rdg.Text, int16(0)}
+			return true
+		}
+		flags, action := q.checker.check(rdg)
+		switch action {
+		case QualityActionReject:
+			q.report.Rejected++
+			continue
+		case QualityActionQuarantine:
+			q.report.Quarantined++
+			q.quarantined = append(q.quarantined, rdg)
+			q.flags = append(q.flags, flags)
+			continue
+		case QualityActionFlag:
+			q.report.Flagged++
+		}
+		q.current = []interface{}{rdg.Time, values[1], rdg.Value, int16(flags)}
+		return true
+	}
+	return false
+}
+
+func (q *qualityDataset) Values() ([]interface{}, error) {
+	return q.current, nil
+}
+
+func (q *qualityDataset) Err() error {
+	if q.err != nil {
+		return q.err
+	}
+	return q.ds.Err()
+}
+
+// newQualityDataset prepares the quality checks of the readings inserted into the stream, with its type and policy
+func newQualityDataset(ctx context.Context, txn pgx.Tx, stream_id int, ds Dataset) (*qualityDataset, error) {
+	typ, err := readStreamType(ctx, txn, stream_id)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := streamQualityPolicy(ctx, txn, stream_id)
+	if err != nil {
+		return nil, err
+	}
+	var latest *Reading
+	if policy != nil && (policy.MaxRate != nil || policy.Flatline > 0) {
+		var rdg Reading
+		row := txn.QueryRow(ctx, `SELECT time, value FROM data WHERE stream_id = $1 ORDER BY time DESC LIMIT 1`, stream_id)
+		if err := row.Scan(&rdg.Time, &rdg.Value); err == nil {
+			latest = &rdg
+		} else if !errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("Could not read latest reading of %d: %w", stream_id, err)
+		}
+	}
+	checker, err := newQualityChecker(policy, latest, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &qualityDataset{ds: ds, typ: typ, checker: checker}, nil
+}
+
+// quarantine stores the quarantined readings of the dataset
+func (q *qualityDataset) quarantine(ctx context.Context, txn pgx.Tx, stream_id int) error {
+	if len(q.quarantined) == 0 {
+		return nil
+	}
+	var (
+		times  = make([]time.Time, len(q.quarantined))
+		values = make([]float64, len(q.quarantined))
+		flags  = make([]int16, len(q.quarantined))
+	)
+	for idx, rdg := range q.quarantined {
+		times[idx], values[idx], flags[idx] = rdg.Time, rdg.Value, int16(q.flags[idx])
+	}
+	_, err := txn.Exec(ctx, `INSERT INTO quarantine(time, stream_id, value, quality, quarantined_at)
+							 SELECT t, $2, v, f, now() FROM unnest($1::timestamptz[], $3::float8[], $4::smallint[]) AS r(t, v, f)
+							 ON CONFLICT (time, stream_id) DO UPDATE
+							 SET value = EXCLUDED.value, quality = EXCLUDED.quality, quarantined_at = EXCLUDED.quarantined_at`,
+		times, stream_id, values, flags)
+	if err != nil {
+		return fmt.Errorf("Could not quarantine readings of %d: %w", stream_id, err)
+	}
+	return nil
+}
+
+// streamQualityPolicy returns the most specific policy of the stream, or nil if no policy applies
+func streamQualityPolicy(ctx context.Context, txn pgx.Tx, stream_id int) (*QualityPolicy, error) {
+	var definition []byte
+	row := txn.QueryRow(ctx, `SELECT p.definition FROM quality_policies AS p, streams AS s
+							WHERE s.id = $1 AND (p.source IS NULL OR p.source = s.source)
+							  AND (p.stream IS NULL OR p.stream = s.name)
+							  AND (p.brick_class IS NULL OR p.brick_class = s.brick_class)
+							ORDER BY p.stream IS NOT NULL DESC, p.brick_class IS NOT NULL DESC, p.source IS NOT NULL DESC, p.name
+							LIMIT 1`, stream_id)
+	if err := row.Scan(&definition); errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not read quality policy of %d: %w", stream_id, err)
+	}
+	var policy QualityPolicy
+	if err := json.Unmarshal(definition, &policy); err != nil {
+		return nil, fmt.Errorf("Could not read quality policy of %d: %w", stream_id, err)
+	}
+	return &policy, nil
+}
+
+// PutQualityPolicy registers the policy, replacing any policy with the same name. It applies to the readings
+// inserted after its registration. The user must be able to manage both the policy and the policy it replaces
+// (see checkPolicyAuth)
+func (db *TimescaleDatabase) PutQualityPolicy(ctx context.Context, policy *QualityPolicy) error {
+	if err := policy.check(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidQualityPolicy, err)
+	}
+	if err := db.checkPolicyAuth(ctx, policy.Source); err != nil {
+		return err
+	}
+	policy.Updated = time.Now()
+	definition, err := json.Marshal(policy)
+	if err != nil {
+		return fmt.Errorf("Could not serialize quality policy: %w", err)
+	}
+	return db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		var source string
+		row := txn.QueryRow(ctx, `SELECT COALESCE(source, '') FROM quality_policies WHERE name = $1 FOR UPDATE`, policy.Name)
+		if err := row.Scan(&source); err == nil {
+			if err := db.checkPolicyAuth(ctx, source); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("Could not read quality policy %s: %w", policy.Name, err)
+		}
+		_, err = txn.Exec(ctx, `INSERT INTO quality_policies(name, source, stream, brick_class, definition, updated_at)
+								VALUES($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), $5, $6)
+								ON CONFLICT (name) DO UPDATE
+								SET source = EXCLUDED.source, stream = EXCLUDED.stream, brick_class = EXCLUDED.brick_class,
+									definition = EXCLUDED.definition, updated_at = EXCLUDED.updated_at`,
+			policy.Name, policy.Source, policy.Stream, policy.BrickClass, definition, policy.Updated)
+		if err != nil {
+			return fmt.Errorf("Could not store quality policy %s: %w", policy.Name, err)
+		}
+		return nil
+	})
+}
+
+// checkPolicyAuth checks that the user can manage the quality policies of the source. The policies of a source
+// need the write permission on it; the policies without a source (which apply to the streams of every source)
+// need the admin permission
+func (db *TimescaleDatabase) checkPolicyAuth(ctx context.Context, source string) error {
+	if len(source) > 0 {
+		if authorized, err := db.checkAuth(ctx, "write", source); err != nil {
+			return fmt.Errorf("Cannot determine authorized status: %w", err)
+		} else if !authorized {
+			return fmt.Errorf("Cannot write to source: %s", source)
+		}
+		return nil
+	}
+	if authorized, err := db.checkAuth(ctx, "admin", adminSource); err != nil {
+		return fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return fmt.Errorf("Cannot manage quality policies of every source without the admin permission")
+	}
+	return nil
+}
+
+// QualityPolicies lists the registered quality policies of the sources the user can read, and the policies without
+// a source, ordered by name
+func (db *TimescaleDatabase) QualityPolicies(ctx context.Context) ([]QualityPolicy, error) {
+	apikey := ctx.Value(ContextKey("user"))
+	if apikey == nil {
+		return nil, fmt.Errorf("Cannot determine authorized status: No apikey")
+	}
+	rows, err := db.pool.Query(ctx, `SELECT definition FROM quality_policies
+									 WHERE source IS NULL
+									 OR source IN (SELECT source FROM authorizations WHERE apikey = $1 AND permission = 'read')
+									 ORDER BY name`, apikey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list quality policies: %w", err)
+	}
+	defer rows.Close()
+	var policies []QualityPolicy
+	for rows.Next() {
+		var (
+			definition []byte
+			policy     QualityPolicy
+		)
+		if err := rows.Scan(&definition); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		if err := json.Unmarshal(definition, &policy); err != nil {
+			return nil, fmt.Errorf("Could not read quality policy: %w", err)
+		}
+		policies = append(policies, policy)
+	}
+	return policies, rows.Err()
+}
+
+// GetQualityPolicy returns the registered quality policy with the given name, if the user can read its source (or
+// it has no source)
+func (db *TimescaleDatabase) GetQualityPolicy(ctx context.Context, name string) (*QualityPolicy, error) {
+	var (
+		definition []byte
+		policy     QualityPolicy
+	)
+	row := db.pool.QueryRow(ctx, `SELECT definition FROM quality_policies WHERE name = $1`, name)
+	if err := row.Scan(&definition); errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrQualityPolicyNotFound, name)
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not read quality policy %s: %w", name, err)
+	}
+	if err := json.Unmarshal(definition, &policy); err != nil {
+		return nil, fmt.Errorf("Could not read quality policy %s: %w", name, err)
+	}
+	if len(policy.Source) > 0 {
+		if authorized, err := db.checkAuth(ctx, "read", policy.Source); err != nil {
+			return nil, fmt.Errorf("Cannot determine authorized status: %w", err)
+		} else if !authorized {
+			return nil, fmt.Errorf("Cannot read from source: %s", policy.Source)
+		}
+	}
+	return &policy, nil
+}
+
+// DeleteQualityPolicy removes the quality policy, if the user can manage it (see checkPolicyAuth). The flags of
+// the readings it checked are kept
+func (db *TimescaleDatabase) DeleteQualityPolicy(ctx context.Context, name string) error {
+	return db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		var source string
+		row := txn.QueryRow(ctx, `SELECT COALESCE(source, '') FROM quality_policies WHERE name = $1 FOR UPDATE`, name)
+		if err := row.Scan(&source); errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("%w: %s", ErrQualityPolicyNotFound, name)
+		} else if err != nil {
+			return fmt.Errorf("Could not read quality policy %s: %w", name, err)
+		}
+		if err := db.checkPolicyAuth(ctx, source); err != nil {
+			return err
+		}
+		if _, err := txn.Exec(ctx, `DELETE FROM quality_policies WHERE name = $1`, name); err != nil {
+			return fmt.Errorf("Could not delete quality policy %s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// Quarantine lists the quarantined readings selected by the request, ordered by stream and time
+func (db *TimescaleDatabase) Quarantine(ctx context.Context, req *QuarantineRequest) ([]QuarantinedReading, error) {
+	if authorized, err := db.checkAuth(ctx, "read", req.Source); err != nil {
+		return nil, fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return nil, fmt.Errorf("Cannot read from source: %s", req.Source)
+	}
+	rows, err := db.pool.Query(ctx, `SELECT q.stream_id, s.source, s.name, q.time, q.value, q.quality, q.quarantined_at
+									 FROM quarantine AS q JOIN streams AS s ON s.id = q.stream_id
+									 WHERE s.source = $1 AND ($2 = '' OR s.name = $2) AND q.time >= $3 AND q.time <= $4
+									 ORDER BY q.stream_id, q.time`, req.Source, req.Name, req.Start, req.End)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read quarantine: %w", err)
+	}
+	defer rows.Close()
+	var readings []QuarantinedReading
+	for rows.Next() {
+		var (
+			rdg   QuarantinedReading
+			value float64
+			flags int16
+		)
+		if err := rows.Scan(&rdg.StreamId, &rdg.Source, &rdg.Name, &rdg.Time, &value, &flags, &rdg.QuarantinedAt); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		if !math.IsNaN(value) && !math.IsInf(value, 0) {
+			rdg.Value = &value
+		}
+		rdg.Flags = Quality(flags).Names()
+		readings = append(readings, rdg)
+	}
+	return readings, rows.Err()
+}
+
+// ReleaseQuarantine moves the quarantined readings selected by the request into their streams, with their
+// quality flags, and returns the number of readings that were released
+func (db *TimescaleDatabase) ReleaseQuarantine(ctx context.Context, req *QuarantineRequest) (int64, error) {
+	if authorized, err := db.checkAuth(ctx, "write", req.Source); err != nil {
+		return 0, fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return 0, fmt.Errorf("Cannot write to source: %s", req.Source)
+	}
+	var released int64
+	err := db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		rows, err := txn.Query(ctx, `WITH released AS (
+										DELETE FROM quarantine AS q USING streams AS s
+										WHERE s.id = q.stream_id AND s.source = $1 AND ($2 = '' OR s.name = $2)
+										  AND q.time >= $3 AND q.time <= $4
+										RETURNING q.time, q.stream_id, q.value, q.quality
+									 ), inserted AS (
+										INSERT INTO data(time, stream_id, value, quality) SELECT * FROM released
+										ON CONFLICT (time, stream_id) DO UPDATE SET value = EXCLUDED.value, quality = EXCLUDED.quality
+										RETURNING stream_id
+									 )
+									 SELECT stream_id, COUNT(*) FROM inserted GROUP BY stream_id`,
+			req.Source, req.Name, req.Start, req.End)
+		if err != nil {
+			return fmt.Errorf("Could not release quarantine: %w", err)
+		}
+		var ids []int
+		for rows.Next() {
+			var id, count int
+			if err := rows.Scan(&id, &count); err != nil {
+				rows.Close()
+				return fmt.Errorf("Could not scan row: %w", err)
+			}
+			ids = append(ids, id)
+			released += int64(count)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("Could not release quarantine: %w", err)
+		}
+		for _, id := range ids {
+			if err := notifyInsertion(ctx, txn, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return released, err
+}
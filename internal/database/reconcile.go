@@ -0,0 +1,282 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/knakk/rdf"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+const brickNamespace = "https://brickschema.org/schema/Brick#"
+
+// StreamRegistrationOrigin prefixes the origins that hold the rdf:type triples written when streams are registered:
+// the type of each point is in the origin stream_registration/{BrickURI}
+const StreamRegistrationOrigin = "stream_registration"
+
+// streamRegistrationOrigin returns the origin that holds the rdf:type triple of the point of registered streams
+func streamRegistrationOrigin(brickURI string) string {
+	return StreamRegistrationOrigin + "/" + brickURI
+}
+
+// isStreamRegistrationOrigin returns true if the origin holds types written when streams are registered
+func isStreamRegistrationOrigin(origin string) bool {
+	return origin == StreamRegistrationOrigin || strings.HasPrefix(origin, StreamRegistrationOrigin+"/")
+}
+
+var (
+	ntBrickTimeseries     = nt(brickNamespace + "timeseries")
+	ntBrickHasTimeseries  = nt(brickNamespace + "hasTimeseriesId")
+	ntBrickPoint          = nt(brickNamespace + "Point")
+	reconcileRequiredPred = []string{ntRDFType, ntRDFSSubClass, ntBrickTimeseries, ntBrickHasTimeseries,
+		nt(brickRefNamespace + "hasExternalReference"), nt(brickRefNamespace + "hasTimeseriesId")}
+)
+
+// StreamClassChange is a stream whose brick_class differs from the class of its point in the model
+type StreamClassChange struct {
+	Name       string
+	BrickURI   string
+	Previous   string
+	BrickClass string
+}
+
+// TimeseriesReference is a point in the model that refers to timeseries data through brick:timeseries
+type TimeseriesReference struct {
+	Point        string
+	TimeseriesId string
+}
+
+// ReconcileReport compares the streams of a source with its model
+type ReconcileReport struct {
+	Source string
+	// streams whose brick_class was (or, if the reconciliation was not applied, would be) updated from the model
+	Updated []StreamClassChange
+	// streams whose brick_uri does not appear in the model
+	UnknownPoints []Stream
+	// points with timeseries references (brick:timeseries or ref:hasExternalReference) that do not match any stream
+	MissingStreams []TimeseriesReference
+}
+
+// Reconcile compares the streams of a source with its model and (if req.Apply is set) updates the brick_class of the streams
+func (db *TimescaleDatabase) Reconcile(ctx context.Context, req *ReconcileRequest) (*ReconcileReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.DataWriteTimeout)
+	defer cancel()
+
+	if req.Apply {
+		if authorized, err := db.checkAuth(ctx, "write", req.Source); err != nil {
+			return nil, fmt.Errorf("Cannot determine authorized status: %w", err)
+		} else if !authorized {
+			return nil, fmt.Errorf("Cannot write to source: %s", req.Source)
+		}
+	}
+
+	var report *ReconcileReport
+	err := db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		var err error
+		report, err = reconcileStreams(ctx, txn, req.Source, req.Apply)
+		return err
+	})
+	return report, err
+}
+
+// reconcileStreams compares the streams of a source with the latest version of its model. If apply is set,
+// the brick_class of each stream is set to the most specific class of its point in the model. The rdf:type
+// triples written when streams are registered are ignored: they only reflect the streams table
+func reconcileStreams(ctx context.Context, txn pgx.Tx, source string, apply bool) (*ReconcileReport, error) {
+	log := logging.FromContext(ctx)
+	report := &ReconcileReport{Source: source}
+
+	streams, err := sourceStreams(ctx, txn, source)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read streams of %s: %w", source, err)
+	}
+
+	// only the triples needed for reconciliation are read, along with every node (s, '', '') of the graph.
+	// 'infinity' selects the latest version of each origin
+	rows, err := txn.Query(ctx, `SELECT origin, s, p, o FROM triples_as_of($1, 'infinity') WHERE p = ANY($2)
+								 UNION SELECT origin, s, '', '' FROM triples_as_of($1, 'infinity')
+								 UNION SELECT origin, o, '', '' FROM triples_as_of($1, 'infinity')`,
+		source, reconcileRequiredPred)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read graph of %s: %w", source, err)
+	}
+	var (
+		triples []Triple
+		nodes   = make(map[string]bool)
+	)
+	for rows.Next() {
+		var (
+			origin string
+			t      Triple
+		)
+		if err := rows.Scan(&origin, &t.S, &t.P, &t.O); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		if isStreamRegistrationOrigin(origin) {
+			continue
+		}
+		if len(t.P) == 0 {
+			nodes[t.S] = true
+		} else {
+			triples = append(triples, t)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read graph of %s: %w", source, err)
+	}
+	graph := newRDFGraph(triples)
+
+	var (
+		byURI  = make(map[string]bool)
+		byName = make(map[string]bool)
+	)
+	for _, stream := range streams {
+		byName[stream.Name] = true
+		if len(stream.BrickURI) == 0 {
+			continue
+		}
+		byURI[stream.BrickURI] = true
+		point := nt(stream.BrickURI)
+		if !nodes[point] {
+			report.UnknownPoints = append(report.UnknownPoints, stream)
+			continue
+		}
+		class, ok := pointClass(graph, point, stream.BrickClass)
+		if !ok || class == stream.BrickClass {
+			continue
+		}
+		report.Updated = append(report.Updated, StreamClassChange{
+			Name:       stream.Name,
+			BrickURI:   stream.BrickURI,
+			Previous:   stream.BrickClass,
+			BrickClass: class,
+		})
+	}
+
+	for _, pred := range timeseriesReferencePreds {
+		for _, ref := range graph.byPred[pred] {
+			point, err := parseTerm(ref.S)
+			if err != nil || point.kind != rdf.TermIRI || byURI[point.value] {
+				continue
+			}
+			var id string
+			for _, idPred := range timeseriesIdPreds {
+				if obj, ok := graph.object(ref.O, idPred); ok {
+					if t, err := parseTerm(obj); err == nil {
+						id = t.value
+						break
+					}
+				}
+			}
+			// external references that do not identify a timeseries (e.g. BACnet references) are not reported
+			if pred != ntBrickTimeseries && len(id) == 0 {
+				continue
+			}
+			if len(id) > 0 && byName[id] {
+				continue
+			}
+			report.MissingStreams = append(report.MissingStreams, TimeseriesReference{Point: point.value, TimeseriesId: id})
+		}
+	}
+
+	if !apply {
+		return report, nil
+	}
+	for _, change := range report.Updated {
+		if _, err := txn.Exec(ctx, `UPDATE streams SET brick_class = $3 WHERE source = $1 AND name = $2`,
+			source, change.Name, change.BrickClass); err != nil {
+			return nil, fmt.Errorf("Could not update class of stream %s: %w", change.Name, err)
+		}
+		log.Infof("Reconciled class of stream %s/%s: %s -> %s", source, change.Name, change.Previous, change.BrickClass)
+	}
+	return report, nil
+}
+
+// sourceStreams returns the streams of the source, ordered by name
+func sourceStreams(ctx context.Context, txn querier, source string) ([]Stream, error) {
+	return queryStreams(ctx, txn, `SELECT id, source, name, units, brick_uri, brick_class, value_type, states FROM streams
+								   WHERE source = $1 ORDER BY name`, source)
+}
+
+// pointClass chooses the class of a point from its rdf:type triples: classes that are superclasses of
+// another type of the point (according to the model) are dropped, Brick classes are preferred, and the
+// current class is kept if it is still a candidate. Otherwise the first class in lexical order is chosen
+func pointClass(graph *rdfGraph, point, current string) (string, bool) {
+	var types []string
+	for _, o := range graph.objects(point, ntRDFType) {
+		if t, err := parseTerm(o); err == nil && t.kind == rdf.TermIRI {
+			types = append(types, o)
+		}
+	}
+	types = uniqueStrings(types)
+
+	var candidates []string
+	for _, class := range types {
+		general := false
+		for _, other := range types {
+			if other != class && isSubClass(graph, other, class) {
+				general = true
+				break
+			}
+		}
+		if !general {
+			candidates = append(candidates, class)
+		}
+	}
+	var brick []string
+	for _, class := range candidates {
+		if strings.HasPrefix(class, "<"+brickNamespace) {
+			brick = append(brick, class)
+		}
+	}
+	if len(brick) > 0 {
+		candidates = brick
+	}
+	// brick:Point only describes a point that has not been given a more specific class
+	if len(candidates) > 1 {
+		for i, class := range candidates {
+			if class == ntBrickPoint {
+				candidates = append(candidates[:i:i], candidates[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	for _, class := range candidates {
+		if class == nt(current) {
+			return current, true
+		}
+	}
+	sort.Strings(candidates)
+	return strings.TrimSuffix(strings.TrimPrefix(candidates[0], "<"), ">"), true
+}
+
+// isSubClass returns true if sub is a (transitive) rdfs:subClassOf super in the graph
+func isSubClass(graph *rdfGraph, sub, super string) bool {
+	seen := map[string]bool{sub: true}
+	frontier := []string{sub}
+	for len(frontier) > 0 {
+		class := frontier[0]
+		frontier = frontier[1:]
+		for _, parent := range graph.objects(class, ntRDFSSubClass) {
+			if parent == super {
+				return true
+			}
+			if !seen[parent] {
+				seen[parent] = true
+				frontier = append(frontier, parent)
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// RunRules evaluates the registered rules until the context is cancelled. Rules are evaluated shortly after
+// readings are inserted into one of their inputs, and every rule is evaluated periodically in case a notification
+// was missed (or its inputs changed because the model of the source changed)
+func (db *TimescaleDatabase) RunRules(ctx context.Context) error {
+	log := logging.FromContext(ctx)
+	inserted := make(chan int, 1024)
+	go db.listenInsertions(ctx, inserted)
+
+	var (
+		// the inputs of each rule at its last evaluation
+		inputs = make(map[string]map[int]bool)
+		dirty  = make(map[int]bool)
+		sweep  = time.NewTicker(config.RuleSweepInterval)
+		// fires once insertions have been collected for the debounce interval
+		debounce <-chan time.Time
+	)
+	defer sweep.Stop()
+
+	evaluate := func(all bool) {
+		rules, err := db.Rules(ctx)
+		if err != nil {
+			log.Errorf("Could not list rules: %s", err)
+			return
+		}
+		for idx := range rules {
+			rule := &rules[idx]
+			if !all && !rule.dependsOn(inputs[rule.Name], dirty) {
+				continue
+			}
+			if err := db.evaluateRule(ctx, rule); err != nil {
+				log.Warnf("Could not evaluate rule %s: %s", rule.Name, err)
+			}
+		}
+		// refresh the inputs of the rules
+		statuses, err := db.ruleInputs(ctx)
+		if err != nil {
+			log.Errorf("Could not read inputs of rules: %s", err)
+			return
+		}
+		inputs = statuses
+	}
+
+	evaluate(true)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case id := <-inserted:
+			dirty[id] = true
+			if debounce == nil {
+				debounce = time.After(config.RuleDebounceInterval)
+			}
+		case <-debounce:
+			evaluate(false)
+			dirty = make(map[int]bool)
+			debounce = nil
+		case <-sweep.C:
+			evaluate(true)
+		}
+	}
+}
+
+// dependsOn returns true if one of the inputs of the rule received readings. Rules that were not evaluated yet
+// depend on every stream
+func (rule *Rule) dependsOn(inputs map[int]bool, dirty map[int]bool) bool {
+	if inputs == nil {
+		return true
+	}
+	for id := range dirty {
+		if inputs[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleInputs returns the ids of the input streams of each rule
+func (db *TimescaleDatabase) ruleInputs(ctx context.Context) (map[string]map[int]bool, error) {
+	rows, err := db.pool.Query(ctx, `SELECT rule, inputs FROM rule_state WHERE inputs IS NOT NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query inputs of rules: %w", err)
+	}
+	defer rows.Close()
+	inputs := make(map[string]map[int]bool)
+	for rows.Next() {
+		var (
+			name string
+			ids  []int64
+		)
+		if err := rows.Scan(&name, &ids); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		inputs[name] = make(map[int]bool, len(ids))
+		for _, id := range ids {
+			inputs[name][int(id)] = true
+		}
+	}
+	return inputs, rows.Err()
+}
+
+// listenInsertions sends the ids of the streams that received readings, as notified on the 'data_inserted'
+// channel, until the context is cancelled. Reconnects if the connection is lost
+func (db *TimescaleDatabase) listenInsertions(ctx context.Context, inserted chan<- int) {
+	log := logging.FromContext(ctx)
+	for ctx.Err() == nil {
+		if err := db.waitInsertions(ctx, inserted); err != nil && ctx.Err() == nil {
+			log.Warnf("Lost notifications of insertions (%s); retrying in 5 seconds", err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+func (db *TimescaleDatabase) waitInsertions(ctx context.Context, inserted chan<- int) error {
+	conn, err := db.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("Could not acquire connection: %w", err)
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "LISTEN data_inserted"); err != nil {
+		return fmt.Errorf("Could not listen for insertions: %w", err)
+	}
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		id, err := strconv.Atoi(notification.Payload)
+		if err != nil {
+			continue
+		}
+		select {
+		case inserted <- id:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,470 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// ErrRuleNotFound is returned when a rule is not registered
+var ErrRuleNotFound = errors.New("Rule not found")
+
+// ErrInvalidRule is returned when a rule definition is rejected
+var ErrInvalidRule = errors.New("Invalid rule")
+
+// Rule computes an output stream from input streams as readings are inserted. The output is the Expression over
+// the inputs (as for a derived stream), optionally aggregated with RollingFunc over a trailing RollingWindow
+// (e.g. "mean" over "1h"), and is written to the Output stream of the Source
+type Rule struct {
+	Name        string
+	Description string
+	Source      string
+	// the output stream, which is registered with the rule
+	Output     string
+	Units      string
+	BrickURI   string
+	BrickClass string
+	// expression over stream ids ($12) and the variables (?supply) of the first solution of the ExpressionQuery
+	Expression      string
+	ExpressionQuery string
+	RollingFunc     string
+	RollingWindow   string
+	// time of the last registration of the rule
+	Updated time.Time
+}
+
+// RuleStatus reports the progress of a rule
+type RuleStatus struct {
+	Name string
+	// the output is computed up to the Watermark; the inputs have readings up to LatestInput
+	Watermark   *time.Time
+	LatestInput *time.Time
+	// seconds between the Watermark and LatestInput
+	LagSeconds float64
+	LastRun    *time.Time
+	// the error of the last failed evaluation
+	LastError   string
+	LastErrorAt *time.Time
+	Runs        int64
+	Failures    int64
+	// number of readings written to the output
+	Readings int64
+}
+
+// BackfillRequest asks for the output of a rule to be computed over a historical range
+type BackfillRequest struct {
+	Name  string
+	Start time.Time
+	End   time.Time
+}
+
+func (req *BackfillRequest) FromURLParams(vals url.Values) error {
+	if name := vals.Get("name"); len(name) > 0 {
+		req.Name = name
+	} else {
+		return errors.New("Params lacks 'name'")
+	}
+	now := time.Now().UTC()
+	_start := vals.Get("start")
+	if len(_start) == 0 {
+		return errors.New("Params lacks 'start'")
+	}
+	start, err := ParseTime(_start, now)
+	if err != nil {
+		return fmt.Errorf("Invalid start time %s: %w", _start, err)
+	}
+	req.Start, req.End = start, now
+	if _end := vals.Get("end"); len(_end) > 0 {
+		if req.End, err = ParseTime(_end, now); err != nil {
+			return fmt.Errorf("Invalid end time %s: %w", _end, err)
+		}
+	}
+	if !req.End.After(req.Start) {
+		return errors.New("Backfill ends before it starts")
+	}
+	return nil
+}
+
+// check validates the definition of the rule
+func (rule *Rule) check() error {
+	switch {
+	case len(rule.Name) == 0:
+		return errors.New("Rule lacks a Name")
+	case len(rule.Source) == 0:
+		return errors.New("Rule lacks a Source")
+	case len(rule.Output) == 0:
+		return errors.New("Rule lacks an Output")
+	case len(rule.Expression) == 0:
+		return errors.New("Rule lacks an Expression")
+	}
+	if _, err := parseExpression(rule.Expression); err != nil {
+		return fmt.Errorf("Invalid Expression '%s': %w", rule.Expression, err)
+	}
+	if len(rule.RollingFunc) > 0 || len(rule.RollingWindow) > 0 {
+		if agg, err := ParseAggregationType(rule.RollingFunc); err != nil {
+			return err
+		} else if agg.isState() {
+			return fmt.Errorf("RollingFunc %s is not a rolling aggregation", rule.RollingFunc)
+		}
+		window, err := ParseWindow(rule.RollingWindow)
+		if err != nil {
+			return fmt.Errorf("Invalid RollingWindow %s: %w", rule.RollingWindow, err)
+		}
+		if window.IsZero() {
+			return fmt.Errorf("Invalid RollingWindow %s", rule.RollingWindow)
+		}
+	}
+	return nil
+}
+
+// inputStream is the derived stream that computes the (not yet aggregated) output of the rule
+func (rule *Rule) inputStream(output int) Stream {
+	return Stream{
+		SourceName:      rule.Source,
+		Name:            rule.Output,
+		Expression:      rule.Expression,
+		ExpressionQuery: rule.ExpressionQuery,
+		id:              output,
+	}
+}
+
+// PutRule registers the rule and its output stream, replacing any rule with the same name. The output of a new
+// rule is computed from the time of its registration; earlier readings are computed with BackfillRule. A rule of
+// another source can only be replaced with the admin permission; a rule whose Source or Output changes is computed
+// again from the time of its registration
+func (db *TimescaleDatabase) PutRule(ctx context.Context, rule *Rule) error {
+	if err := rule.check(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRule, err)
+	}
+	output := Stream{
+		SourceName: rule.Source,
+		Name:       rule.Output,
+		Units:      rule.Units,
+		BrickURI:   rule.BrickURI,
+		BrickClass: rule.BrickClass,
+	}
+	if err := db.RegisterStream(ctx, output); err != nil {
+		return fmt.Errorf("Could not register output of rule %s: %w", rule.Name, err)
+	}
+
+	rule.Updated = time.Now()
+	definition, err := json.Marshal(rule)
+	if err != nil {
+		return fmt.Errorf("Could not serialize rule: %w", err)
+	}
+	return db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		var id int
+		if err := txn.QueryRow(ctx, `SELECT id FROM streams WHERE source = $1 AND name = $2`, rule.Source, rule.Output).Scan(&id); err != nil {
+			return fmt.Errorf("Could not find output of rule %s: %w", rule.Name, err)
+		}
+		input := rule.inputStream(id)
+		if err := checkExpression(ctx, txn, &input); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidRule, err)
+		}
+		expr, _ := parseExpression(rule.Expression)
+		for _, name := range expr.inputs(nil) {
+			if name == fmt.Sprintf("$%d", id) {
+				return fmt.Errorf("%w: the output of a rule cannot be one of its inputs", ErrInvalidRule)
+			}
+		}
+
+		var (
+			previous Rule
+			existing []byte
+			reset    bool
+		)
+		row := txn.QueryRow(ctx, `SELECT definition FROM rules WHERE name = $1 FOR UPDATE`, rule.Name)
+		if err := row.Scan(&existing); err == nil {
+			if err := json.Unmarshal(existing, &previous); err != nil {
+				return fmt.Errorf("Could not read rule %s: %w", rule.Name, err)
+			}
+			if previous.Source != rule.Source {
+				if authorized, err := db.checkAuth(ctx, "admin", adminSource); err != nil {
+					return fmt.Errorf("Cannot determine authorized status: %w", err)
+				} else if !authorized {
+					return fmt.Errorf("Cannot replace rule %s of source %s", rule.Name, previous.Source)
+				}
+			}
+			reset = previous.Source != rule.Source || previous.Output != rule.Output
+		} else if !errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("Could not read rule %s: %w", rule.Name, err)
+		}
+
+		if _, err := txn.Exec(ctx, `INSERT INTO rules(name, definition, updated_at) VALUES($1, $2, $3)
+									ON CONFLICT (name) DO UPDATE SET definition = EXCLUDED.definition, updated_at = EXCLUDED.updated_at`,
+			rule.Name, definition, rule.Updated); err != nil {
+			return fmt.Errorf("Could not store rule %s: %w", rule.Name, err)
+		}
+		// the progress of the rule is kept, unless it writes to another stream
+		if _, err := txn.Exec(ctx, `INSERT INTO rule_state(rule, watermark) VALUES($1, $2)
+									ON CONFLICT (rule) DO UPDATE
+									SET watermark = EXCLUDED.watermark, inputs = NULL, last_run = NULL, last_error = NULL,
+										last_error_at = NULL, runs = 0, failures = 0, readings = 0
+									WHERE $3`,
+			rule.Name, rule.Updated, reset); err != nil {
+			return fmt.Errorf("Could not store state of rule %s: %w", rule.Name, err)
+		}
+		return nil
+	})
+}
+
+// Rules lists the registered rules, ordered by name
+func (db *TimescaleDatabase) Rules(ctx context.Context) ([]Rule, error) {
+	rows, err := db.pool.Query(ctx, `SELECT definition FROM rules ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list rules: %w", err)
+	}
+	defer rows.Close()
+	var rules []Rule
+	for rows.Next() {
+		var (
+			definition []byte
+			rule       Rule
+		)
+		if err := rows.Scan(&definition); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		if err := json.Unmarshal(definition, &rule); err != nil {
+			return nil, fmt.Errorf("Could not read rule: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// GetRule returns the registered rule with the given name
+func (db *TimescaleDatabase) GetRule(ctx context.Context, name string) (*Rule, error) {
+	var (
+		definition []byte
+		rule       Rule
+	)
+	row := db.pool.QueryRow(ctx, `SELECT definition FROM rules WHERE name = $1`, name)
+	if err := row.Scan(&definition); errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrRuleNotFound, name)
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not read rule %s: %w", name, err)
+	}
+	if err := json.Unmarshal(definition, &rule); err != nil {
+		return nil, fmt.Errorf("Could not read rule %s: %w", name, err)
+	}
+	return &rule, nil
+}
+
+// DeleteRule removes the rule. Its output stream and the readings written to it are kept
+func (db *TimescaleDatabase) DeleteRule(ctx context.Context, name string) error {
+	rule, err := db.GetRule(ctx, name)
+	if err != nil {
+		return err
+	}
+	if authorized, err := db.checkAuth(ctx, "write", rule.Source); err != nil {
+		return fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return fmt.Errorf("Cannot write to source: %s", rule.Source)
+	}
+	if _, err := db.pool.Exec(ctx, `DELETE FROM rules WHERE name = $1`, name); err != nil {
+		return fmt.Errorf("Could not delete rule %s: %w", name, err)
+	}
+	return nil
+}
+
+// RuleStatuses reports the progress of every rule (or only of the named rule)
+func (db *TimescaleDatabase) RuleStatuses(ctx context.Context, name string) ([]RuleStatus, error) {
+	rows, err := db.pool.Query(ctx, `SELECT rule, watermark, last_run, COALESCE(last_error, ''), last_error_at, runs, failures, readings,
+											(SELECT MAX(time) FROM data WHERE stream_id = ANY(rule_state.inputs))
+									 FROM rule_state WHERE $1 = '' OR rule = $1 ORDER BY rule`, name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read status of rules: %w", err)
+	}
+	defer rows.Close()
+	var statuses []RuleStatus
+	for rows.Next() {
+		var status RuleStatus
+		if err := rows.Scan(&status.Name, &status.Watermark, &status.LastRun, &status.LastError, &status.LastErrorAt,
+			&status.Runs, &status.Failures, &status.Readings, &status.LatestInput); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		if status.Watermark != nil && status.LatestInput != nil && status.LatestInput.After(*status.Watermark) {
+			status.LagSeconds = status.LatestInput.Sub(*status.Watermark).Seconds()
+		}
+		statuses = append(statuses, status)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read status of rules: %w", err)
+	}
+	if len(name) > 0 && len(statuses) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrRuleNotFound, name)
+	}
+	return statuses, nil
+}
+
+// BackfillRule computes the output of the rule between the start and end of the request, replacing the
+// readings of the output in that range. Returns the number of readings written
+func (db *TimescaleDatabase) BackfillRule(ctx context.Context, req *BackfillRequest) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.DataWriteTimeout)
+	defer cancel()
+
+	rule, err := db.GetRule(ctx, req.Name)
+	if err != nil {
+		return 0, err
+	}
+	if authorized, err := db.checkAuth(ctx, "write", rule.Source); err != nil {
+		return 0, fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return 0, fmt.Errorf("Cannot write to source: %s", rule.Source)
+	}
+	var written int64
+	err = db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		// readings at the start of the range are included
+		n, _, err := db.computeRule(ctx, txn, rule, req.Start.Add(-time.Nanosecond), req.End)
+		written = n
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	logging.FromContext(ctx).Infof("Backfilled rule %s from %s to %s: %d readings", rule.Name, req.Start, req.End, written)
+	return written, nil
+}
+
+// evaluateRule computes the output of the rule after its watermark, and advances the watermark to the last
+// reading written. Rules are locked while they are evaluated, so that several servers can run the rule engine
+func (db *TimescaleDatabase) evaluateRule(ctx context.Context, rule *Rule) error {
+	ctx, cancel := context.WithTimeout(ctx, config.RuleEvaluationTimeout)
+	defer cancel()
+
+	var evalErr error
+	err := db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		var watermark time.Time
+		row := txn.QueryRow(ctx, `SELECT watermark FROM rule_state WHERE rule = $1 FOR UPDATE SKIP LOCKED`, rule.Name)
+		if err := row.Scan(&watermark); errors.Is(err, pgx.ErrNoRows) {
+			// evaluated by another server, or deleted
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Could not read state of rule %s: %w", rule.Name, err)
+		}
+
+		// the output is written in a savepoint, so that failures can be recorded in the transaction
+		sp, err := txn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		n, last, err := db.computeRule(ctx, sp, rule, watermark, time.Now())
+		if err == nil {
+			err = sp.Commit(ctx)
+		}
+		if err != nil {
+			evalErr = err
+			if err := sp.Rollback(ctx); err != nil {
+				return err
+			}
+			_, err = txn.Exec(ctx, `UPDATE rule_state SET last_run = now(), last_error = $2, last_error_at = now(),
+									runs = runs + 1, failures = failures + 1 WHERE rule = $1`, rule.Name, err.Error())
+			return err
+		}
+		if last.After(watermark) {
+			watermark = last
+		}
+		_, err = txn.Exec(ctx, `UPDATE rule_state SET watermark = $2, last_run = now(), runs = runs + 1, readings = readings + $3
+								WHERE rule = $1`, rule.Name, watermark, n)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Could not update state of rule %s: %w", rule.Name, err)
+	}
+	return evalErr
+}
+
+// computeRule writes the output of the rule at the times after start, up to end, and returns the number of
+// readings written and the time of the last one. The output is only computed where every input has readings
+// around it, so readings that arrive later for earlier times are not taken into account until a backfill
+func (db *TimescaleDatabase) computeRule(ctx context.Context, txn pgx.Tx, rule *Rule, start, end time.Time) (int64, time.Time, error) {
+	var output int
+	if err := txn.QueryRow(ctx, `SELECT id FROM streams WHERE source = $1 AND name = $2`, rule.Source, rule.Output).Scan(&output); err != nil {
+		return 0, time.Time{}, fmt.Errorf("Could not find output of rule %s: %w", rule.Name, err)
+	}
+	d, err := db.resolveDerivedStream(ctx, rule.inputStream(output))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	var inputs []int64
+	for _, id := range d.inputs {
+		if id == output {
+			return 0, time.Time{}, errors.New("The output of a rule cannot be one of its inputs")
+		}
+		inputs = append(inputs, int64(id))
+	}
+	if _, err := txn.Exec(ctx, `UPDATE rule_state SET inputs = $2 WHERE rule = $1`, rule.Name, inputs); err != nil {
+		return 0, time.Time{}, fmt.Errorf("Could not update state of rule %s: %w", rule.Name, err)
+	}
+
+	// rolling aggregations need the readings of the window before the start
+	q := &Query{Start: start, End: end}
+	var (
+		rolling bool
+		aggfunc AggregationType
+		window  Window
+	)
+	if len(rule.RollingFunc) > 0 {
+		rolling = true
+		if aggfunc, err = ParseAggregationType(rule.RollingFunc); err != nil {
+			return 0, time.Time{}, err
+		}
+		if window, err = ParseWindow(rule.RollingWindow); err != nil {
+			return 0, time.Time{}, err
+		}
+		q.Start = window.AddTo(start, -1)
+	}
+	computed, err := db.derivedReadings(ctx, q, []*derivedStream{d})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	readings := computed[output]
+	if rolling {
+		readings = rollingReadings(readings, aggfunc, window)
+	}
+
+	ds := NewArrayDataset()
+	ds.SourceName, ds.Name = rule.Source, rule.Output
+	for _, rdg := range readings {
+		if rdg.Time.After(start) {
+			ds.Readings = append(ds.Readings, rdg)
+		}
+	}
+	if len(ds.Readings) == 0 {
+		return 0, start, nil
+	}
+	report, err := insertReadings(ctx, txn, output, ds, ConflictUpdate)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return report.Inserted + report.Updated, ds.Readings[len(ds.Readings)-1].Time, nil
+}
+
+// rollingReadings aggregates, at the time of each reading, the readings of the trailing window up to that time
+func rollingReadings(readings []Reading, agg AggregationType, window Window) []Reading {
+	result := make([]Reading, 0, len(readings))
+	first := 0
+	for _, rdg := range readings {
+		from := window.AddTo(rdg.Time, -1)
+		for !readings[first].Time.After(from) {
+			first++
+		}
+		var values []float64
+		for _, r := range readings[first:] {
+			if r.Time.After(rdg.Time) {
+				break
+			}
+			values = append(values, r.Value)
+		}
+		result = append(result, Reading{Time: rdg.Time, Value: aggregateValues(values, agg)})
+	}
+	return result
+}
@@ -0,0 +1,838 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/knakk/rdf"
+)
+
+// maximum nesting of shapes (sh:node, sh:not, ...) before validation gives up, to stop recursive shapes
+const maxShapeDepth = 32
+
+const (
+	shaclNamespace = "http://www.w3.org/ns/shacl#"
+	rdfsNamespace  = "http://www.w3.org/2000/01/rdf-schema#"
+	owlClass       = "http://www.w3.org/2002/07/owl#Class"
+	rdfLangString  = rdfNamespace + "langString"
+)
+
+// nt returns the N-Triples serialization of the IRI, which is how terms are stored in the triples table
+func nt(iri string) string {
+	return "<" + iri + ">"
+}
+
+// sh returns the N-Triples serialization of a term in the SHACL namespace
+func sh(local string) string {
+	return nt(shaclNamespace + local)
+}
+
+var (
+	ntRDFType       = nt(rdfType)
+	ntRDFFirst      = nt(rdfNamespace + "first")
+	ntRDFRest       = nt(rdfNamespace + "rest")
+	ntRDFNil        = nt(rdfNamespace + "nil")
+	ntRDFSSubClass  = nt(rdfsNamespace + "subClassOf")
+	ntRDFSClass     = nt(rdfsNamespace + "Class")
+	ntOWLClass      = nt(owlClass)
+	shapeTargetKeys = []string{sh("targetClass"), sh("targetNode"), sh("targetSubjectsOf"), sh("targetObjectsOf")}
+)
+
+// ValidationResult is a single violation of a SHACL constraint. FocusNode, Value and SourceShape are
+// serialized as N-Triples; Path is a SPARQL property path
+type ValidationResult struct {
+	FocusNode   string
+	Path        string
+	Value       string
+	SourceShape string
+	// IRI of the SHACL constraint component, e.g. http://www.w3.org/ns/shacl#MinCountConstraintComponent
+	Constraint string
+	// IRI of the severity: sh:Violation, sh:Warning or sh:Info
+	Severity string
+	Message  string
+}
+
+// ValidationReport is the result of validating the graph of a source against SHACL shapes
+type ValidationReport struct {
+	Source   string
+	Conforms bool
+	Results  []ValidationResult
+}
+
+// HasViolations returns true if any result has severity sh:Violation
+func (report *ValidationReport) HasViolations() bool {
+	for _, res := range report.Results {
+		if res.Severity == shaclNamespace+"Violation" {
+			return true
+		}
+	}
+	return false
+}
+
+// rdfGraph is an in-memory index of triples
+type rdfGraph struct {
+	triples map[Triple]struct{}
+	out     map[string]map[string][]string
+	in      map[string]map[string][]string
+	byPred  map[string][]Triple
+}
+
+func newRDFGraph(graphs ...[]Triple) *rdfGraph {
+	g := &rdfGraph{
+		triples: make(map[Triple]struct{}),
+		out:     make(map[string]map[string][]string),
+		in:      make(map[string]map[string][]string),
+		byPred:  make(map[string][]Triple),
+	}
+	for _, triples := range graphs {
+		for _, t := range triples {
+			g.add(t)
+		}
+	}
+	return g
+}
+
+func (g *rdfGraph) add(t Triple) {
+	if _, ok := g.triples[t]; ok {
+		return
+	}
+	g.triples[t] = struct{}{}
+	if g.out[t.S] == nil {
+		g.out[t.S] = make(map[string][]string)
+	}
+	g.out[t.S][t.P] = append(g.out[t.S][t.P], t.O)
+	if g.in[t.O] == nil {
+		g.in[t.O] = make(map[string][]string)
+	}
+	g.in[t.O][t.P] = append(g.in[t.O][t.P], t.S)
+	g.byPred[t.P] = append(g.byPred[t.P], t)
+}
+
+func (g *rdfGraph) objects(s, p string) []string {
+	return g.out[s][p]
+}
+
+func (g *rdfGraph) object(s, p string) (string, bool) {
+	if objects := g.out[s][p]; len(objects) > 0 {
+		return objects[0], true
+	}
+	return "", false
+}
+
+func (g *rdfGraph) subjects(p, o string) []string {
+	return g.in[o][p]
+}
+
+// predicates returns the predicates of the triples with the given subject, sorted
+func (g *rdfGraph) predicates(s string) []string {
+	var preds []string
+	for p := range g.out[s] {
+		preds = append(preds, p)
+	}
+	sort.Strings(preds)
+	return preds
+}
+
+// list returns the members of the RDF list starting at head
+func (g *rdfGraph) list(head string) []string {
+	var (
+		members []string
+		seen    = make(map[string]bool)
+	)
+	for head != ntRDFNil && !seen[head] {
+		seen[head] = true
+		first, ok := g.object(head, ntRDFFirst)
+		if !ok {
+			break
+		}
+		members = append(members, first)
+		if head, ok = g.object(head, ntRDFRest); !ok {
+			break
+		}
+	}
+	return members
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := values[:0:0]
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+// shaclValidator validates a data graph against the shapes in a shapes graph. It implements the
+// SHACL Core constraint components (SHACL-SPARQL is not supported). The rdfs:subClassOf
+// hierarchies of both graphs are used to find the instances of classes
+type shaclValidator struct {
+	data    *rdfGraph
+	shapes  *rdfGraph
+	supers  map[string]map[string]bool
+	results []ValidationResult
+	depth   int
+	err     error
+}
+
+// validateGraph validates the triples of a source against the triples of the shapes graph
+func validateGraph(source string, data, shapes []Triple) (*ValidationReport, error) {
+	v := &shaclValidator{
+		data:   newRDFGraph(data),
+		shapes: newRDFGraph(shapes),
+		supers: make(map[string]map[string]bool),
+	}
+	for _, shape := range v.targetedShapes() {
+		for _, focus := range v.focusNodes(shape) {
+			v.validateShape(shape, focus)
+		}
+	}
+	if v.err != nil {
+		return nil, v.err
+	}
+	return &ValidationReport{Source: source, Conforms: len(v.results) == 0, Results: v.results}, nil
+}
+
+// targetedShapes returns the shapes that declare targets, including implicit class targets
+func (v *shaclValidator) targetedShapes() []string {
+	var shapes []string
+	for _, key := range shapeTargetKeys {
+		for _, t := range v.shapes.byPred[key] {
+			shapes = append(shapes, t.S)
+		}
+	}
+	for _, kind := range []string{sh("NodeShape"), sh("PropertyShape")} {
+		for _, shape := range v.shapes.subjects(ntRDFType, kind) {
+			for _, class := range v.shapes.objects(shape, ntRDFType) {
+				if class == ntRDFSClass || class == ntOWLClass {
+					shapes = append(shapes, shape)
+				}
+			}
+		}
+	}
+	shapes = uniqueStrings(shapes)
+	sort.Strings(shapes)
+	return shapes
+}
+
+// focusNodes returns the nodes of the data graph targeted by the shape
+func (v *shaclValidator) focusNodes(shape string) []string {
+	var focus []string
+	classes := append([]string(nil), v.shapes.objects(shape, sh("targetClass"))...)
+	for _, class := range v.shapes.objects(shape, ntRDFType) {
+		if class == ntRDFSClass || class == ntOWLClass {
+			classes = append(classes, shape)
+			break
+		}
+	}
+	for _, class := range classes {
+		for _, sub := range v.subclasses(class) {
+			focus = append(focus, v.data.subjects(ntRDFType, sub)...)
+		}
+	}
+	focus = append(focus, v.shapes.objects(shape, sh("targetNode"))...)
+	for _, p := range v.shapes.objects(shape, sh("targetSubjectsOf")) {
+		for _, t := range v.data.byPred[p] {
+			focus = append(focus, t.S)
+		}
+	}
+	for _, p := range v.shapes.objects(shape, sh("targetObjectsOf")) {
+		for _, t := range v.data.byPred[p] {
+			focus = append(focus, t.O)
+		}
+	}
+	return uniqueStrings(focus)
+}
+
+// subclasses returns the class and all of its (transitive) subclasses
+func (v *shaclValidator) subclasses(class string) []string {
+	classes := []string{class}
+	seen := map[string]bool{class: true}
+	for i := 0; i < len(classes); i++ {
+		for _, g := range []*rdfGraph{v.data, v.shapes} {
+			for _, sub := range g.subjects(ntRDFSSubClass, classes[i]) {
+				if !seen[sub] {
+					seen[sub] = true
+					classes = append(classes, sub)
+				}
+			}
+		}
+	}
+	return classes
+}
+
+// superclasses returns the class and all of its (transitive) superclasses
+func (v *shaclValidator) superclasses(class string) map[string]bool {
+	if supers, ok := v.supers[class]; ok {
+		return supers
+	}
+	supers := map[string]bool{class: true}
+	queue := []string{class}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		for _, g := range []*rdfGraph{v.data, v.shapes} {
+			for _, super := range g.objects(c, ntRDFSSubClass) {
+				if !supers[super] {
+					supers[super] = true
+					queue = append(queue, super)
+				}
+			}
+		}
+	}
+	v.supers[class] = supers
+	return supers
+}
+
+func (v *shaclValidator) instanceOf(node, class string) bool {
+	for _, typ := range v.data.objects(node, ntRDFType) {
+		if v.superclasses(typ)[class] {
+			return true
+		}
+	}
+	return false
+}
+
+// conforms returns true if the node conforms to the shape
+func (v *shaclValidator) conforms(node, shape string) bool {
+	if v.depth >= maxShapeDepth {
+		if v.err == nil {
+			v.err = fmt.Errorf("Shape %s is nested more than %d levels deep", shape, maxShapeDepth)
+		}
+		return true
+	}
+	saved := v.results
+	v.results = nil
+	v.depth++
+	v.validateShape(shape, node)
+	v.depth--
+	ok := len(v.results) == 0
+	v.results = saved
+	return ok
+}
+
+// validateShape validates the focus node against a node shape or a property shape
+func (v *shaclValidator) validateShape(shape, focus string) {
+	if deactivated, ok := v.shapes.object(shape, sh("deactivated")); ok && isTrue(deactivated) {
+		return
+	}
+	if path, ok := v.shapes.object(shape, sh("path")); ok {
+		v.checkConstraints(shape, focus, path, v.evalPath(path, []string{focus}))
+		return
+	}
+	v.checkConstraints(shape, focus, "", []string{focus})
+}
+
+// evalPath returns the nodes reached from the given nodes by the SHACL property path
+func (v *shaclValidator) evalPath(path string, from []string) []string {
+	var reached []string
+	switch {
+	case strings.HasPrefix(path, "<"):
+		for _, node := range from {
+			reached = append(reached, v.data.objects(node, path)...)
+		}
+	case len(v.shapes.objects(path, ntRDFFirst)) > 0:
+		reached = from
+		for _, step := range v.shapes.list(path) {
+			reached = v.evalPath(step, reached)
+		}
+	default:
+		if inverse, ok := v.shapes.object(path, sh("inversePath")); ok {
+			if !strings.HasPrefix(inverse, "<") {
+				v.err = fmt.Errorf("Only predicates can be inverted in SHACL paths (%s)", inverse)
+				return nil
+			}
+			for _, node := range from {
+				reached = append(reached, v.data.subjects(inverse, node)...)
+			}
+		} else if alternatives, ok := v.shapes.object(path, sh("alternativePath")); ok {
+			for _, alt := range v.shapes.list(alternatives) {
+				reached = append(reached, v.evalPath(alt, from)...)
+			}
+		} else if inner, ok := v.shapes.object(path, sh("zeroOrMorePath")); ok {
+			reached = v.closure(inner, from, true)
+		} else if inner, ok := v.shapes.object(path, sh("oneOrMorePath")); ok {
+			reached = v.closure(inner, from, false)
+		} else if inner, ok := v.shapes.object(path, sh("zeroOrOnePath")); ok {
+			reached = append(append(reached, from...), v.evalPath(inner, from)...)
+		} else {
+			v.err = fmt.Errorf("Invalid SHACL path %s", path)
+		}
+	}
+	return uniqueStrings(reached)
+}
+
+// closure returns the nodes reachable by repeating the path one or more times (or zero or more times)
+func (v *shaclValidator) closure(path string, from []string, includeStart bool) []string {
+	seen := make(map[string]bool)
+	var reached []string
+	if includeStart {
+		for _, node := range from {
+			seen[node] = true
+			reached = append(reached, node)
+		}
+	}
+	frontier := from
+	for len(frontier) > 0 {
+		var next []string
+		for _, node := range v.evalPath(path, frontier) {
+			if !seen[node] {
+				seen[node] = true
+				reached = append(reached, node)
+				next = append(next, node)
+			}
+		}
+		frontier = next
+	}
+	return reached
+}
+
+// pathString renders a SHACL property path in SPARQL property path syntax
+func (v *shaclValidator) pathString(path string) string {
+	if len(path) == 0 || strings.HasPrefix(path, "<") {
+		return path
+	}
+	if len(v.shapes.objects(path, ntRDFFirst)) > 0 {
+		var steps []string
+		for _, step := range v.shapes.list(path) {
+			steps = append(steps, v.pathString(step))
+		}
+		return strings.Join(steps, "/")
+	}
+	if inverse, ok := v.shapes.object(path, sh("inversePath")); ok {
+		return "^" + v.pathString(inverse)
+	} else if alternatives, ok := v.shapes.object(path, sh("alternativePath")); ok {
+		var alts []string
+		for _, alt := range v.shapes.list(alternatives) {
+			alts = append(alts, v.pathString(alt))
+		}
+		return "(" + strings.Join(alts, "|") + ")"
+	}
+	for _, modifier := range [][2]string{{"*", "zeroOrMorePath"}, {"+", "oneOrMorePath"}, {"?", "zeroOrOnePath"}} {
+		if inner, ok := v.shapes.object(path, sh(modifier[1])); ok {
+			return "(" + v.pathString(inner) + ")" + modifier[0]
+		}
+	}
+	return path
+}
+
+// report records a result for the shape
+func (v *shaclValidator) report(shape, focus, path, value, component, message string) {
+	severity := shaclNamespace + "Violation"
+	if s, ok := v.shapes.object(shape, sh("severity")); ok {
+		severity = strings.Trim(s, "<>")
+	}
+	if m, ok := v.shapes.object(shape, sh("message")); ok {
+		if t, err := parseTerm(m); err == nil {
+			message = t.value
+		}
+	}
+	v.results = append(v.results, ValidationResult{
+		FocusNode:   focus,
+		Path:        v.pathString(path),
+		Value:       value,
+		SourceShape: shape,
+		Constraint:  shaclNamespace + component,
+		Severity:    severity,
+		Message:     message,
+	})
+}
+
+// intParam returns the integer value of a parameter of the shape
+func (v *shaclValidator) intParam(shape, key string) (int, bool) {
+	value, ok := v.shapes.object(shape, sh(key))
+	if !ok {
+		return 0, false
+	}
+	t, err := parseTerm(value)
+	if err != nil {
+		return 0, false
+	}
+	i, err := strconv.Atoi(t.value)
+	return i, err == nil
+}
+
+// checkConstraints checks the value nodes of the focus node against the constraints of the shape.
+// path is empty for node shapes
+func (v *shaclValidator) checkConstraints(shape, focus, path string, values []string) {
+	report := func(value, component, message string, args ...interface{}) {
+		v.report(shape, focus, path, value, component, fmt.Sprintf(message, args...))
+	}
+	params := func(key string) []string {
+		return v.shapes.objects(shape, sh(key))
+	}
+
+	for _, class := range params("class") {
+		for _, value := range values {
+			if !v.instanceOf(value, class) {
+				report(value, "ClassConstraintComponent", "Value does not have class %s", class)
+			}
+		}
+	}
+	for _, datatype := range params("datatype") {
+		for _, value := range values {
+			t, err := parseTerm(value)
+			if err != nil || t.kind != rdf.TermLiteral || nt(literalDatatype(t)) != datatype {
+				report(value, "DatatypeConstraintComponent", "Value does not have datatype %s", datatype)
+			}
+		}
+	}
+	for _, kind := range params("nodeKind") {
+		for _, value := range values {
+			if !hasNodeKind(value, kind) {
+				report(value, "NodeKindConstraintComponent", "Value is not of node kind %s", kind)
+			}
+		}
+	}
+
+	if len(path) > 0 {
+		if min, ok := v.intParam(shape, "minCount"); ok && len(values) < min {
+			report("", "MinCountConstraintComponent", "Less than %d values", min)
+		}
+		if max, ok := v.intParam(shape, "maxCount"); ok && len(values) > max {
+			report("", "MaxCountConstraintComponent", "More than %d values", max)
+		}
+	}
+
+	for _, bound := range rangeConstraints {
+		key, accept := bound.key, bound.accept
+		for _, bound := range params(key) {
+			for _, value := range values {
+				if c, ok := compareLiterals(value, bound); !ok || !accept(c) {
+					component := strings.ToUpper(key[:1]) + key[1:] + "ConstraintComponent"
+					report(value, component, "Value does not satisfy %s %s", key, bound)
+				}
+			}
+		}
+	}
+
+	if min, ok := v.intParam(shape, "minLength"); ok {
+		for _, value := range values {
+			if t, err := parseTerm(value); err != nil || t.kind == rdf.TermBlank || utf8.RuneCountInString(t.value) < min {
+				report(value, "MinLengthConstraintComponent", "Value is shorter than %d characters", min)
+			}
+		}
+	}
+	if max, ok := v.intParam(shape, "maxLength"); ok {
+		for _, value := range values {
+			if t, err := parseTerm(value); err != nil || t.kind == rdf.TermBlank || utf8.RuneCountInString(t.value) > max {
+				report(value, "MaxLengthConstraintComponent", "Value is longer than %d characters", max)
+			}
+		}
+	}
+	for _, pattern := range params("pattern") {
+		t, err := parseTerm(pattern)
+		if err != nil {
+			v.err = err
+			return
+		}
+		expr := t.value
+		if flags, ok := v.shapes.object(shape, sh("flags")); ok {
+			if f, err := parseTerm(flags); err == nil && len(f.value) > 0 {
+				expr = "(?" + f.value + ")" + expr
+			}
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			v.err = fmt.Errorf("Invalid sh:pattern %s: %w", pattern, err)
+			return
+		}
+		for _, value := range values {
+			if t, err := parseTerm(value); err != nil || t.kind == rdf.TermBlank || !re.MatchString(t.value) {
+				report(value, "PatternConstraintComponent", "Value does not match %s", t.value)
+			}
+		}
+	}
+	for _, list := range params("languageIn") {
+		var langs []string
+		for _, lang := range v.shapes.list(list) {
+			if t, err := parseTerm(lang); err == nil {
+				langs = append(langs, strings.ToLower(t.value))
+			}
+		}
+		for _, value := range values {
+			if t, err := parseTerm(value); err != nil || !languageMatches(t.lang, langs) {
+				report(value, "LanguageInConstraintComponent", "Value does not have one of the languages %v", langs)
+			}
+		}
+	}
+	if unique, ok := v.shapes.object(shape, sh("uniqueLang")); ok && isTrue(unique) && len(path) > 0 {
+		counts := make(map[string]int)
+		for _, value := range values {
+			if t, err := parseTerm(value); err == nil && len(t.lang) > 0 {
+				counts[strings.ToLower(t.lang)]++
+			}
+		}
+		for lang, count := range counts {
+			if count > 1 {
+				report("", "UniqueLangConstraintComponent", "More than one value has language %s", lang)
+			}
+		}
+	}
+
+	if len(path) > 0 {
+		v.checkPropertyPairs(shape, focus, values, report)
+	}
+
+	for _, not := range params("not") {
+		for _, value := range values {
+			if v.conforms(value, not) {
+				report(value, "NotConstraintComponent", "Value conforms to %s", not)
+			}
+		}
+	}
+	for _, list := range params("and") {
+		for _, value := range values {
+			for _, member := range v.shapes.list(list) {
+				if !v.conforms(value, member) {
+					report(value, "AndConstraintComponent", "Value does not conform to all of the shapes")
+					break
+				}
+			}
+		}
+	}
+	for _, list := range params("or") {
+		for _, value := range values {
+			matched := false
+			for _, member := range v.shapes.list(list) {
+				if v.conforms(value, member) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				report(value, "OrConstraintComponent", "Value does not conform to any of the shapes")
+			}
+		}
+	}
+	for _, list := range params("xone") {
+		for _, value := range values {
+			matched := 0
+			for _, member := range v.shapes.list(list) {
+				if v.conforms(value, member) {
+					matched++
+				}
+			}
+			if matched != 1 {
+				report(value, "XoneConstraintComponent", "Value conforms to %d of the shapes instead of exactly one", matched)
+			}
+		}
+	}
+	for _, node := range params("node") {
+		for _, value := range values {
+			if !v.conforms(value, node) {
+				report(value, "NodeConstraintComponent", "Value does not conform to %s", node)
+			}
+		}
+	}
+	for _, property := range params("property") {
+		for _, value := range values {
+			v.validateShape(property, value)
+		}
+	}
+	for _, qualified := range params("qualifiedValueShape") {
+		matched := 0
+		for _, value := range values {
+			if v.conforms(value, qualified) {
+				matched++
+			}
+		}
+		if min, ok := v.intParam(shape, "qualifiedMinCount"); ok && matched < min {
+			report("", "QualifiedMinCountConstraintComponent", "Less than %d values conform to %s", min, qualified)
+		}
+		if max, ok := v.intParam(shape, "qualifiedMaxCount"); ok && matched > max {
+			report("", "QualifiedMaxCountConstraintComponent", "More than %d values conform to %s", max, qualified)
+		}
+	}
+
+	if closed, ok := v.shapes.object(shape, sh("closed")); ok && isTrue(closed) {
+		allowed := make(map[string]bool)
+		for _, property := range params("property") {
+			if p, ok := v.shapes.object(property, sh("path")); ok && strings.HasPrefix(p, "<") {
+				allowed[p] = true
+			}
+		}
+		for _, list := range params("ignoredProperties") {
+			for _, p := range v.shapes.list(list) {
+				allowed[p] = true
+			}
+		}
+		for _, value := range values {
+			for _, p := range v.data.predicates(value) {
+				if allowed[p] {
+					continue
+				}
+				for _, o := range v.data.objects(value, p) {
+					v.report(shape, value, p, o, "ClosedConstraintComponent", fmt.Sprintf("Predicate %s is not allowed", p))
+				}
+			}
+		}
+	}
+
+	for _, hasValue := range params("hasValue") {
+		found := false
+		for _, value := range values {
+			found = found || value == hasValue
+		}
+		if !found {
+			report("", "HasValueConstraintComponent", "Missing value %s", hasValue)
+		}
+	}
+	for _, list := range params("in") {
+		members := make(map[string]bool)
+		for _, member := range v.shapes.list(list) {
+			members[member] = true
+		}
+		for _, value := range values {
+			if !members[value] {
+				report(value, "InConstraintComponent", "Value is not one of the allowed values")
+			}
+		}
+	}
+}
+
+// checkPropertyPairs checks the property pair constraints (sh:equals, sh:disjoint, sh:lessThan,
+// sh:lessThanOrEquals) of a property shape
+func (v *shaclValidator) checkPropertyPairs(shape, focus string, values []string, report func(value, component, message string, args ...interface{})) {
+	inValues := make(map[string]bool, len(values))
+	for _, value := range values {
+		inValues[value] = true
+	}
+	for _, p := range v.shapes.objects(shape, sh("equals")) {
+		others := v.data.objects(focus, p)
+		inOthers := make(map[string]bool, len(others))
+		for _, o := range others {
+			inOthers[o] = true
+			if !inValues[o] {
+				report(o, "EqualsConstraintComponent", "Value of %s is not a value of the path", p)
+			}
+		}
+		for _, value := range values {
+			if !inOthers[value] {
+				report(value, "EqualsConstraintComponent", "Value is not a value of %s", p)
+			}
+		}
+	}
+	for _, p := range v.shapes.objects(shape, sh("disjoint")) {
+		for _, o := range v.data.objects(focus, p) {
+			if inValues[o] {
+				report(o, "DisjointConstraintComponent", "Value is also a value of %s", p)
+			}
+		}
+	}
+	for _, pair := range orderConstraints {
+		key, accept := pair.key, pair.accept
+		for _, p := range v.shapes.objects(shape, sh(key)) {
+			for _, value := range values {
+				for _, o := range v.data.objects(focus, p) {
+					if c, ok := compareLiterals(value, o); !ok || !accept(c) {
+						component := strings.ToUpper(key[:1]) + key[1:] + "ConstraintComponent"
+						report(value, component, "Value is not %s %s", key, o)
+					}
+				}
+			}
+		}
+	}
+}
+
+// comparisonConstraint is a constraint that compares values: accept is given the result of compareLiterals
+type comparisonConstraint struct {
+	key    string
+	accept func(int) bool
+}
+
+var (
+	rangeConstraints = []comparisonConstraint{
+		{"minExclusive", func(c int) bool { return c > 0 }},
+		{"minInclusive", func(c int) bool { return c >= 0 }},
+		{"maxExclusive", func(c int) bool { return c < 0 }},
+		{"maxInclusive", func(c int) bool { return c <= 0 }},
+	}
+	orderConstraints = []comparisonConstraint{
+		{"lessThan", func(c int) bool { return c < 0 }},
+		{"lessThanOrEquals", func(c int) bool { return c <= 0 }},
+	}
+)
+
+// isTrue returns true if the term is the boolean literal true
+func isTrue(value string) bool {
+	t, err := parseTerm(value)
+	return err == nil && t.kind == rdf.TermLiteral && t.value == "true"
+}
+
+// literalDatatype returns the datatype IRI of a literal term
+func literalDatatype(t term) string {
+	if len(t.lang) > 0 {
+		return rdfLangString
+	} else if len(t.datatype) > 0 {
+		return t.datatype
+	}
+	return xsdString
+}
+
+func hasNodeKind(value, kind string) bool {
+	var k string
+	switch {
+	case strings.HasPrefix(value, "<"):
+		k = "IRI"
+	case strings.HasPrefix(value, "_:"):
+		k = "BlankNode"
+	default:
+		k = "Literal"
+	}
+	switch kind {
+	case sh(k):
+		return true
+	case sh("BlankNodeOrIRI"):
+		return k != "Literal"
+	case sh("BlankNodeOrLiteral"):
+		return k != "IRI"
+	case sh("IRIOrLiteral"):
+		return k != "BlankNode"
+	}
+	return false
+}
+
+// languageMatches implements the basic filtering of SPARQL's langMatches
+func languageMatches(lang string, ranges []string) bool {
+	lang = strings.ToLower(lang)
+	for _, r := range ranges {
+		if (r == "*" && len(lang) > 0) || lang == r || strings.HasPrefix(lang, r+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// compareLiterals compares two literals: numerically if both are numbers, otherwise by their lexical
+// forms if they have the same datatype (which orders dates and times correctly). Returns false if the
+// literals are not comparable
+func compareLiterals(a, b string) (int, bool) {
+	ta, errA := parseTerm(a)
+	tb, errB := parseTerm(b)
+	if errA != nil || errB != nil || ta.kind != rdf.TermLiteral || tb.kind != rdf.TermLiteral {
+		return 0, false
+	}
+	fa, errA := strconv.ParseFloat(ta.value, 64)
+	fb, errB := strconv.ParseFloat(tb.value, 64)
+	if errA == nil && errB == nil && !math.IsNaN(fa) && !math.IsNaN(fb) {
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+	if literalDatatype(ta) != literalDatatype(tb) {
+		return 0, false
+	}
+	return strings.Compare(ta.value, tb.value), true
+}
@@ -0,0 +1,315 @@
+package database
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// expandTestTerm expands the 'a' keyword and the ex:, sh:, rdf:, rdfs: and xsd: prefixes of a term
+func expandTestTerm(s string) string {
+	if s == "a" {
+		return ntRDFType
+	}
+	for prefix, ns := range map[string]string{
+		"ex:":   "http://example.org/",
+		"sh:":   shaclNamespace,
+		"rdf:":  rdfNamespace,
+		"rdfs:": rdfsNamespace,
+		"xsd:":  xsdNamespace,
+	} {
+		if strings.HasPrefix(s, prefix) {
+			return nt(ns + strings.TrimPrefix(s, prefix))
+		}
+		if idx := strings.Index(s, "^^"+prefix); idx > 0 {
+			return s[:idx] + "^^" + nt(ns+s[idx+len(prefix)+2:])
+		}
+	}
+	return s
+}
+
+// testTriples reads one triple per line; the object is the rest of the line
+func testTriples(text string) []Triple {
+	var triples []Triple
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		triples = append(triples, Triple{S: expandTestTerm(fields[0]), P: expandTestTerm(fields[1]), O: expandTestTerm(fields[2])})
+	}
+	return triples
+}
+
+func TestValidateGraph(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		shapes string
+		data   string
+		// the local name of the constraint component, the focus node and the value of each result
+		want []string
+	}{
+		{
+			name: "minCount",
+			shapes: `ex:S sh:targetClass ex:Room
+					 ex:S sh:property _:p
+					 _:p sh:path ex:name
+					 _:p sh:minCount "1"^^xsd:integer`,
+			data: `ex:r1 a ex:Room
+				   ex:r2 a ex:Room
+				   ex:r2 ex:name "Kitchen"`,
+			want: []string{"MinCount ex:r1 "},
+		},
+		{
+			name: "maxCount",
+			shapes: `ex:S sh:targetClass ex:Room
+					 ex:S sh:property _:p
+					 _:p sh:path ex:name
+					 _:p sh:maxCount "1"^^xsd:integer`,
+			data: `ex:r1 a ex:Room
+				   ex:r1 ex:name "Kitchen"
+				   ex:r1 ex:name "Lab"
+				   ex:r2 a ex:Room
+				   ex:r2 ex:name "Office"`,
+			want: []string{"MaxCount ex:r1 "},
+		},
+		{
+			name: "targets include instances of subclasses",
+			shapes: `ex:S sh:targetClass ex:Room
+					 ex:S sh:property _:p
+					 _:p sh:path ex:name
+					 _:p sh:minCount "1"^^xsd:integer`,
+			data: `ex:Office rdfs:subClassOf ex:Room
+				   ex:o1 a ex:Office`,
+			want: []string{"MinCount ex:o1 "},
+		},
+		{
+			name: "class",
+			shapes: `ex:S sh:targetClass ex:Room
+					 ex:S sh:property _:p
+					 _:p sh:path ex:hasPoint
+					 _:p sh:class ex:Point`,
+			data: `ex:Temperature_Sensor rdfs:subClassOf ex:Sensor
+				   ex:Sensor rdfs:subClassOf ex:Point
+				   ex:r1 a ex:Room
+				   ex:r1 ex:hasPoint ex:t1
+				   ex:r1 ex:hasPoint ex:x1
+				   ex:r1 ex:hasPoint "not a node"
+				   ex:t1 a ex:Temperature_Sensor
+				   ex:x1 a ex:Equipment`,
+			want: []string{`Class ex:r1 "not a node"`, "Class ex:r1 ex:x1"},
+		},
+		{
+			name: "datatype",
+			shapes: `ex:S sh:targetClass ex:Room
+					 ex:S sh:property _:area
+					 _:area sh:path ex:area
+					 _:area sh:datatype xsd:double
+					 ex:S sh:property _:name
+					 _:name sh:path ex:name
+					 _:name sh:datatype xsd:string`,
+			data: `ex:r1 a ex:Room
+				   ex:r1 ex:area "12.5"^^xsd:double
+				   ex:r1 ex:name "Kitchen"
+				   ex:r2 a ex:Room
+				   ex:r2 ex:area "big"
+				   ex:r2 ex:name "Lab"@en
+				   ex:r3 a ex:Room
+				   ex:r3 ex:area ex:large`,
+			want: []string{`Datatype ex:r2 "big"`, `Datatype ex:r2 "Lab"@en`, "Datatype ex:r3 ex:large"},
+		},
+		{
+			name: "sequence path",
+			shapes: `ex:S sh:targetClass ex:Room
+					 ex:S sh:property _:p
+					 _:p sh:path _:l1
+					 _:l1 rdf:first ex:hasPoint
+					 _:l1 rdf:rest _:l2
+					 _:l2 rdf:first ex:unit
+					 _:l2 rdf:rest rdf:nil
+					 _:p sh:minCount "1"^^xsd:integer`,
+			data: `ex:r1 a ex:Room
+				   ex:r1 ex:hasPoint ex:t1
+				   ex:t1 ex:unit ex:DEG_C
+				   ex:r2 a ex:Room
+				   ex:r2 ex:hasPoint ex:t2`,
+			want: []string{"MinCount ex:r2 "},
+		},
+		{
+			name: "inverse path",
+			shapes: `ex:S sh:targetNode ex:f1
+					 ex:S sh:targetNode ex:f2
+					 ex:S sh:property _:p
+					 _:p sh:path _:inv
+					 _:inv sh:inversePath ex:isPartOf
+					 _:p sh:minCount "1"^^xsd:integer`,
+			data: `ex:r1 ex:isPartOf ex:f1`,
+			want: []string{"MinCount ex:f2 "},
+		},
+		{
+			name: "alternative path",
+			shapes: `ex:S sh:targetClass ex:Room
+					 ex:S sh:property _:p
+					 _:p sh:path _:alt
+					 _:alt sh:alternativePath _:l1
+					 _:l1 rdf:first ex:name
+					 _:l1 rdf:rest _:l2
+					 _:l2 rdf:first ex:label
+					 _:l2 rdf:rest rdf:nil
+					 _:p sh:minCount "1"^^xsd:integer`,
+			data: `ex:r1 a ex:Room
+				   ex:r1 ex:name "Kitchen"
+				   ex:r2 a ex:Room
+				   ex:r2 ex:label "Lab"
+				   ex:r3 a ex:Room`,
+			want: []string{"MinCount ex:r3 "},
+		},
+		{
+			name: "zero or more path",
+			shapes: `ex:S sh:targetClass ex:Room
+					 ex:S sh:property _:p
+					 _:p sh:path _:star
+					 _:star sh:zeroOrMorePath ex:isPartOf
+					 _:p sh:hasValue ex:building`,
+			data: `ex:r1 a ex:Room
+				   ex:r1 ex:isPartOf ex:f1
+				   ex:f1 ex:isPartOf ex:building
+				   ex:r2 a ex:Room
+				   ex:r2 ex:isPartOf ex:f2`,
+			want: []string{"HasValue ex:r2 "},
+		},
+		{
+			name: "one or more path",
+			shapes: `ex:S sh:targetNode ex:building
+					 ex:S sh:property _:p
+					 _:p sh:path _:plus
+					 _:plus sh:oneOrMorePath ex:isPartOf
+					 _:p sh:maxCount "0"^^xsd:integer`,
+			data: `ex:building ex:isPartOf ex:campus
+				   ex:campus ex:isPartOf ex:building`,
+			want: []string{"MaxCount ex:building "},
+		},
+		{
+			name: "zero or one path",
+			shapes: `ex:S sh:targetClass ex:Room
+					 ex:S sh:property _:p
+					 _:p sh:path _:opt
+					 _:opt sh:zeroOrOnePath ex:isPartOf
+					 _:p sh:maxCount "2"^^xsd:integer`,
+			data: `ex:r1 a ex:Room
+				   ex:r1 ex:isPartOf ex:f1
+				   ex:r2 a ex:Room
+				   ex:r2 ex:isPartOf ex:f1
+				   ex:r2 ex:isPartOf ex:f2`,
+			want: []string{"MaxCount ex:r2 "},
+		},
+		{
+			name: "deactivated shapes are ignored",
+			shapes: `ex:S sh:targetClass ex:Room
+					 ex:S sh:deactivated "true"^^xsd:boolean
+					 ex:S sh:property _:p
+					 _:p sh:path ex:name
+					 _:p sh:minCount "1"^^xsd:integer`,
+			data: `ex:r1 a ex:Room`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			report, err := validateGraph("test", testTriples(tc.data), testTriples(tc.shapes))
+			if err != nil {
+				t.Fatalf("Could not validate: %s", err)
+			}
+			var got []string
+			for _, res := range report.Results {
+				component := strings.TrimSuffix(strings.TrimPrefix(res.Constraint, shaclNamespace), "ConstraintComponent")
+				got = append(got, component+" "+res.FocusNode+" "+res.Value)
+			}
+			var want []string
+			for _, w := range tc.want {
+				fields := strings.SplitN(w, " ", 3)
+				want = append(want, fields[0]+" "+expandTestTerm(fields[1])+" "+expandTestTerm(fields[2]))
+			}
+			sort.Strings(got)
+			sort.Strings(want)
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("Got results\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+			if report.Conforms != (len(tc.want) == 0) {
+				t.Errorf("Got Conforms %v with %d results", report.Conforms, len(report.Results))
+			}
+		})
+	}
+}
+
+func TestSHACLPathString(t *testing.T) {
+	shapes := testTriples(`_:seq rdf:first ex:a
+						   _:seq rdf:rest _:seq2
+						   _:seq2 rdf:first _:inv
+						   _:seq2 rdf:rest rdf:nil
+						   _:inv sh:inversePath ex:b
+						   _:alt sh:alternativePath _:alts
+						   _:alts rdf:first ex:a
+						   _:alts rdf:rest _:alts2
+						   _:alts2 rdf:first ex:b
+						   _:alts2 rdf:rest rdf:nil
+						   _:star sh:zeroOrMorePath ex:a
+						   _:plus sh:oneOrMorePath ex:a
+						   _:opt sh:zeroOrOnePath _:inv`)
+	v := &shaclValidator{data: newRDFGraph(), shapes: newRDFGraph(shapes), supers: make(map[string]map[string]bool)}
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"ex:a", "<http://example.org/a>"},
+		{"_:seq", "<http://example.org/a>/^<http://example.org/b>"},
+		{"_:inv", "^<http://example.org/b>"},
+		{"_:alt", "(<http://example.org/a>|<http://example.org/b>)"},
+		{"_:star", "(<http://example.org/a>)*"},
+		{"_:plus", "(<http://example.org/a>)+"},
+		{"_:opt", "(^<http://example.org/b>)?"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			if got := v.pathString(expandTestTerm(tc.path)); got != tc.want {
+				t.Errorf("Got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateGraphErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		shapes string
+		err    string
+	}{
+		{
+			name: "recursive shapes",
+			shapes: `ex:S sh:targetClass ex:Room
+					 ex:S sh:node ex:S`,
+			err: "nested more than",
+		},
+		{
+			name: "inverse of a path",
+			shapes: `ex:S sh:targetClass ex:Room
+					 ex:S sh:property _:p
+					 _:p sh:path _:inv
+					 _:inv sh:inversePath _:seq
+					 _:seq rdf:first ex:a
+					 _:seq rdf:rest rdf:nil`,
+			err: "Only predicates can be inverted",
+		},
+		{
+			name: "invalid path",
+			shapes: `ex:S sh:targetClass ex:Room
+					 ex:S sh:property _:p
+					 _:p sh:path _:bad`,
+			err: "Invalid SHACL path",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := validateGraph("test", testTriples("ex:r1 a ex:Room"), testTriples(tc.shapes))
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("Got error %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package database
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/knakk/rdf"
+)
+
+// media types for SPARQL query results and RDF graphs
+const (
+	MediaTypeSparqlJSON = "application/sparql-results+json"
+	MediaTypeSparqlXML  = "application/sparql-results+xml"
+	MediaTypeCSV        = "text/csv"
+	MediaTypeTSV        = "text/tab-separated-values"
+	MediaTypeTurtle     = "text/turtle"
+	MediaTypeNTriples   = "application/n-triples"
+	MediaTypeNQuads     = "application/n-quads"
+	MediaTypeJSONLD     = "application/ld+json"
+	MediaTypeRDFXML     = "application/rdf+xml"
+)
+
+// ErrInvalidQuery is returned when the reasoner rejects a SPARQL query
+var ErrInvalidQuery = errors.New("Invalid SPARQL query")
+
+// SparqlTerm is a single RDF term in a SPARQL JSON results binding
+type SparqlTerm struct {
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	Lang     string `json:"xml:lang,omitempty"`
+	Datatype string `json:"datatype,omitempty"`
+}
+
+// SparqlHead is the header of a SPARQL JSON results document
+type SparqlHead struct {
+	Vars []string `json:"vars,omitempty"`
+	Link []string `json:"link,omitempty"`
+}
+
+// SparqlBindings holds the solutions of a SELECT query
+type SparqlBindings struct {
+	Bindings []map[string]SparqlTerm `json:"bindings"`
+}
+
+// SparqlResults is the result of a SELECT or ASK query, following the SPARQL 1.1 JSON results format
+type SparqlResults struct {
+	Head    SparqlHead      `json:"head"`
+	Boolean *bool           `json:"boolean,omitempty"`
+	Results *SparqlBindings `json:"results,omitempty"`
+}
+
+// SparqlResponse is the result of a SPARQL query: SELECT and ASK queries produce Results,
+// CONSTRUCT and DESCRIBE queries produce a Graph serialized as N-Triples
+type SparqlResponse struct {
+	Results *SparqlResults
+	Graph   []byte
+}
+
+// IsGraph returns true if the response is an RDF graph
+func (resp *SparqlResponse) IsGraph() bool {
+	return resp.Results == nil
+}
+
+// MediaTypes returns the media types the response can be serialized to, in order of preference
+func (resp *SparqlResponse) MediaTypes() []string {
+	if resp.IsGraph() {
+		return []string{MediaTypeTurtle, MediaTypeNTriples}
+	}
+	return []string{MediaTypeSparqlJSON, MediaTypeSparqlXML, MediaTypeCSV, MediaTypeTSV}
+}
+
+// Write serializes the response to the writer using the given media type
+func (resp *SparqlResponse) Write(w io.Writer, mediaType string) error {
+	if resp.IsGraph() {
+		switch mediaType {
+		case MediaTypeNTriples:
+			_, err := w.Write(resp.Graph)
+			return err
+		case MediaTypeTurtle:
+			return convertNTriples(w, resp.Graph, rdf.Turtle)
+		}
+		return fmt.Errorf("Cannot serialize graph as %s", mediaType)
+	}
+
+	switch mediaType {
+	case MediaTypeSparqlJSON:
+		return json.NewEncoder(w).Encode(resp.Results)
+	case MediaTypeSparqlXML:
+		return resp.Results.writeXML(w)
+	case MediaTypeCSV:
+		return resp.Results.writeCSV(w)
+	case MediaTypeTSV:
+		return resp.Results.writeTSV(w)
+	}
+	return fmt.Errorf("Cannot serialize results as %s", mediaType)
+}
+
+// convertNTriples re-encodes an N-Triples document in the given format
+func convertNTriples(w io.Writer, ntriples []byte, format rdf.Format) error {
+	dec := rdf.NewTripleDecoder(bytes.NewReader(ntriples), rdf.NTriples)
+	enc := rdf.NewTripleEncoder(w, format)
+	for triple, err := dec.Decode(); err != io.EOF; triple, err = dec.Decode() {
+		if err != nil {
+			return fmt.Errorf("Could not decode triple: %w", err)
+		}
+		if err := enc.Encode(triple); err != nil {
+			return fmt.Errorf("Could not encode triple %s: %w", triple, err)
+		}
+	}
+	return enc.Close()
+}
+
+func (res *SparqlResults) solutions() []map[string]SparqlTerm {
+	if res.Results == nil {
+		return nil
+	}
+	return res.Results.Bindings
+}
+
+func (res *SparqlResults) writeXML(w io.Writer) error {
+	type xmlVariable struct {
+		Name string `xml:"name,attr"`
+	}
+	type xmlLiteral struct {
+		Lang     string `xml:"xml:lang,attr,omitempty"`
+		Datatype string `xml:"datatype,attr,omitempty"`
+		Value    string `xml:",chardata"`
+	}
+	type xmlBinding struct {
+		Name    string      `xml:"name,attr"`
+		URI     *string     `xml:"uri,omitempty"`
+		BNode   *string     `xml:"bnode,omitempty"`
+		Literal *xmlLiteral `xml:"literal,omitempty"`
+	}
+	type xmlResult struct {
+		Bindings []xmlBinding `xml:"binding"`
+	}
+	type xmlHead struct {
+		Variables []xmlVariable `xml:"variable"`
+	}
+	type xmlResults struct {
+		Results []xmlResult `xml:"result"`
+	}
+	type xmlDocument struct {
+		XMLName xml.Name    `xml:"http://www.w3.org/2005/sparql-results# sparql"`
+		Head    xmlHead     `xml:"head"`
+		Boolean *bool       `xml:"boolean,omitempty"`
+		Results *xmlResults `xml:"results,omitempty"`
+	}
+
+	doc := xmlDocument{Boolean: res.Boolean}
+	for _, v := range res.Head.Vars {
+		doc.Head.Variables = append(doc.Head.Variables, xmlVariable{Name: v})
+	}
+	if res.Boolean == nil {
+		results := &xmlResults{}
+		for _, row := range res.solutions() {
+			var result xmlResult
+			for _, v := range res.Head.Vars {
+				term, ok := row[v]
+				if !ok {
+					continue
+				}
+				binding := xmlBinding{Name: v}
+				value := term.Value
+				switch term.Type {
+				case "uri":
+					binding.URI = &value
+				case "bnode":
+					binding.BNode = &value
+				default:
+					binding.Literal = &xmlLiteral{Lang: term.Lang, Datatype: term.Datatype, Value: value}
+				}
+				result.Bindings = append(result.Bindings, binding)
+			}
+			results.Results = append(results.Results, result)
+		}
+		doc.Results = results
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(doc)
+}
+
+func (res *SparqlResults) writeCSV(w io.Writer) error {
+	enc := csv.NewWriter(w)
+	enc.UseCRLF = true
+	if res.Boolean != nil {
+		if err := enc.Write([]string{fmt.Sprintf("%t", *res.Boolean)}); err != nil {
+			return err
+		}
+		enc.Flush()
+		return enc.Error()
+	}
+	if err := enc.Write(res.Head.Vars); err != nil {
+		return err
+	}
+	row := make([]string, len(res.Head.Vars))
+	for _, solution := range res.solutions() {
+		for idx, v := range res.Head.Vars {
+			row[idx] = ""
+			if term, ok := solution[v]; ok && term.Type == "bnode" {
+				row[idx] = "_:" + term.Value
+			} else if ok {
+				row[idx] = term.Value
+			}
+		}
+		if err := enc.Write(row); err != nil {
+			return err
+		}
+	}
+	enc.Flush()
+	return enc.Error()
+}
+
+func (res *SparqlResults) writeTSV(w io.Writer) error {
+	if res.Boolean != nil {
+		_, err := fmt.Fprintf(w, "%t\n", *res.Boolean)
+		return err
+	}
+	header := make([]string, len(res.Head.Vars))
+	for idx, v := range res.Head.Vars {
+		header[idx] = "?" + v
+	}
+	if _, err := fmt.Fprintln(w, strings.Join(header, "\t")); err != nil {
+		return err
+	}
+	row := make([]string, len(res.Head.Vars))
+	for _, solution := range res.solutions() {
+		for idx, v := range res.Head.Vars {
+			row[idx] = ""
+			if term, ok := solution[v]; ok {
+				row[idx] = term.ntriples()
+			}
+		}
+		if _, err := fmt.Fprintln(w, strings.Join(row, "\t")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var ntriplesEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// ntriples returns the N-Triples serialization of the term
+func (term SparqlTerm) ntriples() string {
+	switch term.Type {
+	case "uri":
+		return "<" + term.Value + ">"
+	case "bnode":
+		return "_:" + term.Value
+	}
+	lit := `"` + ntriplesEscaper.Replace(term.Value) + `"`
+	if len(term.Lang) > 0 {
+		return lit + "@" + term.Lang
+	} else if len(term.Datatype) > 0 {
+		return lit + "^^<" + term.Datatype + ">"
+	}
+	return lit
+}
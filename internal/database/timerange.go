@@ -0,0 +1,180 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Window is a length of time that may be calendar-aware: Months and Days follow the calendar of the location
+// they are applied in (so that a month or a day across a DST change has the right length) and Duration is exact
+type Window struct {
+	Months   int
+	Days     int
+	Duration time.Duration
+}
+
+var (
+	window_re   = regexp.MustCompile(`^(\d+)\s*([a-zA-Z]+)$`)
+	relative_re = regexp.MustCompile(`^([a-z_]+)((?:\s*[+-]\s*\d+\s*[a-zA-Z]+)*)$`)
+	offset_re   = regexp.MustCompile(`([+-])\s*(\d+\s*[a-zA-Z]+)`)
+)
+
+// ParseWindow parses a window such as "15m", "1d", "1w" or "1mo". Days (d), weeks (w), months (mo) and
+// years (y) are calendar units; the other units are those of ParseDuration
+func ParseWindow(expr string) (Window, error) {
+	var w Window
+	results := window_re.FindStringSubmatch(strings.TrimSpace(expr))
+	if len(results) == 0 {
+		return w, errors.New("Invalid. Must be Number followed by h,m,s,us,ms,ns,d,w,mo,y")
+	}
+	n, err := strconv.Atoi(results[1])
+	if err != nil {
+		return w, err
+	}
+	switch results[2] {
+	case "d", "day", "days":
+		w.Days = n
+	case "w", "wk", "week", "weeks":
+		w.Days = 7 * n
+	case "mo", "month", "months":
+		w.Months = n
+	case "y", "yr", "year", "years":
+		w.Months = 12 * n
+	default:
+		w.Duration, err = ParseDuration(results[1] + results[2])
+	}
+	return w, err
+}
+
+// IsZero returns true if the window has no length
+func (w Window) IsZero() bool {
+	return w.Months == 0 && w.Days == 0 && w.Duration == 0
+}
+
+// AddTo returns t shifted by n windows, in the location of t
+func (w Window) AddTo(t time.Time, n int) time.Time {
+	return t.AddDate(0, n*w.Months, n*w.Days).Add(time.Duration(n) * w.Duration)
+}
+
+// toSQL returns the window as a Postgres interval
+func (w Window) toSQL() string {
+	var parts []string
+	if w.Months != 0 {
+		parts = append(parts, fmt.Sprintf("%d months", w.Months))
+	}
+	if w.Days != 0 {
+		parts = append(parts, fmt.Sprintf("%d days", w.Days))
+	}
+	if w.Duration != 0 || len(parts) == 0 {
+		parts = append(parts, fmt.Sprintf("%d microseconds", w.Duration.Microseconds()))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (w Window) String() string {
+	return w.toSQL()
+}
+
+// ParseLocation loads a timezone by its IANA name (e.g. "America/Los_Angeles"). The empty string is UTC
+func ParseLocation(name string) (*time.Location, error) {
+	if name == "Local" {
+		return nil, errors.New("Timezone must be an IANA name")
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid timezone %s: %w", name, err)
+	}
+	return loc, nil
+}
+
+// ParseTime parses an RFC3339 timestamp or a relative time: an anchor followed by any number of offsets,
+// e.g. "now-7d", "today", "start_of_month-1mo" or "start_of_week+8h". The anchors are now, today (or
+// start_of_day), yesterday, tomorrow, start_of_week (Monday), start_of_month and start_of_year; their day,
+// week, month and year boundaries are those of the location of now
+func ParseTime(expr string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, expr); err == nil {
+		return t, nil
+	}
+	results := relative_re.FindStringSubmatch(strings.TrimSpace(expr))
+	if len(results) == 0 {
+		return time.Time{}, errors.New("Must be RFC3339 or relative (e.g. now-7d)")
+	}
+	t, ok := timeAnchor(results[1], now)
+	if !ok {
+		return time.Time{}, fmt.Errorf("Unknown anchor %s", results[1])
+	}
+	for _, offset := range offset_re.FindAllStringSubmatch(results[2], -1) {
+		w, err := ParseWindow(offset[2])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid offset %s: %w", offset[0], err)
+		}
+		if offset[1] == "-" {
+			t = w.AddTo(t, -1)
+		} else {
+			t = w.AddTo(t, 1)
+		}
+	}
+	return t, nil
+}
+
+func timeAnchor(name string, now time.Time) (time.Time, bool) {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch name {
+	case "now":
+		return now, true
+	case "today", "start_of_day":
+		return day, true
+	case "yesterday":
+		return day.AddDate(0, 0, -1), true
+	case "tomorrow":
+		return day.AddDate(0, 0, 1), true
+	case "start_of_week":
+		// weeks start on Monday, like the buckets of time_bucket
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7)), true
+	case "start_of_month":
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()), true
+	case "start_of_year":
+		return time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, now.Location()), true
+	}
+	return time.Time{}, false
+}
+
+// ParseTimeRange returns the start and end of a range. Named ranges (today, yesterday, this_week, last_week,
+// this_month, last_month, this_year, last_year) are periods of the calendar in the location of now and end
+// at the start of the next period. A relative range such as "-7d" is the window before end
+func ParseTimeRange(expr string, now, end time.Time) (time.Time, time.Time, error) {
+	if strings.HasPrefix(expr, "-") {
+		w, err := ParseWindow(expr[1:])
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Invalid range %s: %w", expr, err)
+		}
+		return w.AddTo(end.In(now.Location()), -1), end, nil
+	}
+
+	var (
+		anchor string
+		period Window
+		prev   bool
+	)
+	switch expr {
+	case "today", "yesterday":
+		anchor, period, prev = "today", Window{Days: 1}, expr == "yesterday"
+	case "this_week", "last_week":
+		anchor, period, prev = "start_of_week", Window{Days: 7}, expr == "last_week"
+	case "this_month", "last_month":
+		anchor, period, prev = "start_of_month", Window{Months: 1}, expr == "last_month"
+	case "this_year", "last_year":
+		anchor, period, prev = "start_of_year", Window{Months: 12}, expr == "last_year"
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("Invalid range %s: must be a named range (e.g. last_month) or relative (e.g. -7d)", expr)
+	}
+	start, _ := timeAnchor(anchor, now)
+	if prev {
+		start = period.AddTo(start, -1)
+	}
+	return start, period.AddTo(start, 1), nil
+}
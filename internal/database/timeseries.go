@@ -0,0 +1,274 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/knakk/rdf"
+)
+
+const brickRefNamespace = "https://brickschema.org/schema/Brick/ref#"
+
+// TimeseriesVariable is the SPARQL variable that names the timeseries of each solution of a metadata query.
+// If a query projects it, only its values are resolved to streams; otherwise every IRI in a solution is
+const TimeseriesVariable = "timeseries"
+
+var (
+	// predicates from a point to its timeseries references: Brick 1.3 external references and Brick 1.2 timeseries
+	timeseriesReferencePreds = []string{nt(brickRefNamespace + "hasExternalReference"), ntBrickTimeseries}
+	// predicates from a timeseries reference to the identifier of its timeseries, which is the name of a stream
+	timeseriesIdPreds = []string{nt(brickRefNamespace + "hasTimeseriesId"), ntBrickHasTimeseries}
+)
+
+// metadataRow is a stream matched by a solution of a metadata query, with the bindings of the solution
+type metadataRow struct {
+	stream   Stream
+	bindings map[string]SparqlTerm
+}
+
+// sparqlSolution is a solution of a metadata query, with the streams it refers to
+type sparqlSolution struct {
+	// the source the query was evaluated against ("default" for the union of all sources)
+	source   string
+	bindings map[string]SparqlTerm
+	streams  []Stream
+}
+
+// sparqlTable holds the solutions of a metadata query over all of its sources
+type sparqlTable struct {
+	vars      []string
+	solutions []sparqlSolution
+}
+
+// metadataRows returns a row for each stream of each solution
+func (table *sparqlTable) metadataRows() []metadataRow {
+	var rows []metadataRow
+	for _, solution := range table.solutions {
+		for _, stream := range solution.streams {
+			rows = append(rows, metadataRow{stream: stream, bindings: solution.bindings})
+		}
+	}
+	return rows
+}
+
+// streamResolver finds the streams of a source that SPARQL terms refer to. IRIs match the brick_uri of a stream
+// or, through timeseries references in the model, its name; literals (timeseries identifiers) match the name of a stream
+type streamResolver struct {
+	byURI  map[string][]Stream
+	byName map[string][]Stream
+	// identifiers of the timeseries referenced by each point
+	references map[string][]string
+}
+
+// resolveSparqlStreams runs the SPARQL query of q against each of its sources and finds the streams that each solution refers to
+func (db *TimescaleDatabase) resolveSparqlStreams(ctx context.Context, q *Query) (*sparqlTable, error) {
+	sources := q.Sources
+	if len(sources) == 0 {
+		sources = []string{"default"}
+	}
+
+	var (
+		table = &sparqlTable{}
+		seen  = make(map[string]bool)
+	)
+	for _, site := range sources {
+		req := &SparqlProtocolRequest{Query: q.Sparql, AsOf: q.SparqlAsOf}
+		if site != "default" {
+			req.DefaultSources = []string{site}
+		}
+		res, err := db.QuerySparqlProtocol(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if res.IsGraph() {
+			return nil, fmt.Errorf("%w: metadata queries must be SELECT queries", ErrInvalidQuery)
+		}
+		for _, v := range res.Results.Head.Vars {
+			if !seen[v] {
+				seen[v] = true
+				table.vars = append(table.vars, v)
+			}
+		}
+		solutions, err := db.resolveSolutions(ctx, site, q.SparqlAsOf, res.Results)
+		if err != nil {
+			return nil, err
+		}
+		table.solutions = append(table.solutions, solutions...)
+	}
+	return table, nil
+}
+
+// resolveSolutions finds the streams of the site (every source, for the "default" site) that each solution of
+// a SELECT query against the site refers to, in the model as of asOf (or the latest model)
+func (db *TimescaleDatabase) resolveSolutions(ctx context.Context, site string, asOf *time.Time, results *SparqlResults) ([]sparqlSolution, error) {
+	source := site
+	if site == "default" {
+		source = ""
+	}
+
+	// only the timeseries variable is resolved if the query has one
+	explicit := false
+	for _, v := range results.Head.Vars {
+		explicit = explicit || v == TimeseriesVariable
+	}
+	resolvable := func(solution map[string]SparqlTerm) []SparqlTerm {
+		if explicit {
+			if term, ok := solution[TimeseriesVariable]; ok {
+				return []SparqlTerm{term}
+			}
+			return nil
+		}
+		var terms []SparqlTerm
+		for _, v := range results.Head.Vars {
+			if term, ok := solution[v]; ok && term.Type == "uri" {
+				terms = append(terms, term)
+			}
+		}
+		return terms
+	}
+
+	var terms []SparqlTerm
+	for _, solution := range results.solutions() {
+		terms = append(terms, resolvable(solution)...)
+	}
+	resolver, err := db.newStreamResolver(ctx, source, asOf, terms)
+	if err != nil {
+		return nil, fmt.Errorf("Could not resolve streams of %s: %w", site, err)
+	}
+
+	var solutions []sparqlSolution
+	for _, bindings := range results.solutions() {
+		solution := sparqlSolution{source: site, bindings: bindings}
+		matched := make(map[int]bool)
+		for _, term := range resolvable(bindings) {
+			for _, stream := range resolver.resolve(term) {
+				if !matched[stream.id] {
+					matched[stream.id] = true
+					solution.streams = append(solution.streams, stream)
+				}
+			}
+		}
+		solutions = append(solutions, solution)
+	}
+	return solutions, nil
+}
+
+// newStreamResolver loads the streams of the source (or of every source, if source is empty) that the terms may refer
+// to, and the timeseries references of the IRIs among the terms in the model as of asOf (or the latest model)
+func (db *TimescaleDatabase) newStreamResolver(ctx context.Context, source string, asOf *time.Time, terms []SparqlTerm) (*streamResolver, error) {
+	resolver := &streamResolver{
+		byURI:      make(map[string][]Stream),
+		byName:     make(map[string][]Stream),
+		references: make(map[string][]string),
+	}
+	var (
+		points []string
+		names  []string
+	)
+	for _, term := range terms {
+		switch term.Type {
+		case "uri":
+			points = append(points, term.Value)
+		case "literal", "typed-literal":
+			names = append(names, term.Value)
+		}
+	}
+	points, names = uniqueStrings(points), uniqueStrings(names)
+
+	at := "infinity"
+	if asOf != nil {
+		at = asOf.Format(time.RFC3339Nano)
+	}
+	ntPoints := make([]string, len(points))
+	for idx, point := range points {
+		ntPoints[idx] = nt(point)
+	}
+	rows, err := db.pool.Query(ctx, `WITH graph AS (
+									   SELECT s, p, o FROM (SELECT source FROM triples UNION SELECT source FROM triple_versions) AS sources,
+									   LATERAL triples_as_of(sources.source, $2::timestamptz)
+									   WHERE $1 = '' OR sources.source = $1)
+									 SELECT ref.s, id.o FROM graph AS ref JOIN graph AS id ON ref.o = id.s
+									 WHERE ref.s = ANY($3) AND ref.p = ANY($4) AND id.p = ANY($5)`,
+		source, at, ntPoints, timeseriesReferencePreds, timeseriesIdPreds)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query timeseries references: %w", err)
+	}
+	for rows.Next() {
+		var point, id string
+		if err := rows.Scan(&point, &id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		t, err := parseTerm(point)
+		if err != nil || t.kind != rdf.TermIRI {
+			continue
+		}
+		if idTerm, err := parseTerm(id); err == nil {
+			resolver.references[t.value] = append(resolver.references[t.value], idTerm.value)
+			names = append(names, idTerm.value)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Could not query timeseries references: %w", err)
+	}
+
+	streams, err := queryStreams(ctx, db.pool, `SELECT id, source, name, units, brick_uri, brick_class, value_type, states FROM streams
+												WHERE (brick_uri = ANY($1) OR name = ANY($2)) AND ($3 = '' OR source = $3)
+												ORDER BY id`, points, uniqueStrings(names), source)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query streams: %w", err)
+	}
+	for _, stream := range streams {
+		if len(stream.BrickURI) > 0 {
+			resolver.byURI[stream.BrickURI] = append(resolver.byURI[stream.BrickURI], stream)
+		}
+		resolver.byName[stream.Name] = append(resolver.byName[stream.Name], stream)
+	}
+	return resolver, nil
+}
+
+// resolve returns the streams the term refers to
+func (r *streamResolver) resolve(term SparqlTerm) []Stream {
+	switch term.Type {
+	case "uri":
+		streams := r.byURI[term.Value]
+		for _, id := range r.references[term.Value] {
+			streams = append(streams[:len(streams):len(streams)], r.byName[id]...)
+		}
+		return streams
+	case "literal", "typed-literal":
+		return r.byName[term.Value]
+	}
+	return nil
+}
+
+// queryStreams runs a query that selects (id, source, name, units, brick_uri, brick_class, value_type, states)
+// from the streams table
+func queryStreams(ctx context.Context, q querier, sql string, args ...interface{}) ([]Stream, error) {
+	rows, err := q.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var streams []Stream
+	for rows.Next() {
+		var (
+			stream     Stream
+			brickURI   *string
+			brickClass *string
+		)
+		if err := rows.Scan(&stream.id, &stream.SourceName, &stream.Name, &stream.Units, &brickURI, &brickClass, &stream.Type, &stream.States); err != nil {
+			return nil, err
+		}
+		if brickURI != nil {
+			stream.BrickURI = *brickURI
+		}
+		if brickClass != nil {
+			stream.BrickClass = *brickClass
+		}
+		streams = append(streams, stream)
+	}
+	return streams, rows.Err()
+}
@@ -0,0 +1,296 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ErrInvalidReading is returned when a reading is not of the type of its stream
+var ErrInvalidReading = errors.New("Invalid reading")
+
+// types of the values of streams
+const (
+	ValueFloat = "float"
+	ValueInt   = "int"
+	// stored as 1 (true) or 0 (false)
+	ValueBool = "bool"
+	// stored in text_data; a string stream that declares its States is an enumeration
+	ValueString = "string"
+)
+
+// integers are stored as floats, which represent them exactly up to 2^53
+const maxExactInt = 1 << 53
+
+// streamType is the type of the values of a stream, against which inserted readings are checked
+type streamType struct {
+	typ    string
+	states map[string]bool
+}
+
+func readStreamType(ctx context.Context, txn pgx.Tx, stream_id int) (*streamType, error) {
+	var (
+		typ    string
+		states []string
+	)
+	row := txn.QueryRow(ctx, `SELECT value_type, states FROM streams WHERE id = $1`, stream_id)
+	if err := row.Scan(&typ, &states); err != nil {
+		return nil, fmt.Errorf("Could not read type of stream %d: %w", stream_id, err)
+	}
+	st := &streamType{typ: typ}
+	if len(states) > 0 {
+		st.states = make(map[string]bool)
+		for _, state := range states {
+			st.states[state] = true
+		}
+	}
+	return st, nil
+}
+
+// coerce converts the reading to the type of the stream, or returns an error if its value is not of that type.
+// Readings from CSV files are parsed according to the type
+func (st *streamType) coerce(rdg Reading) (Reading, error) {
+	switch st.typ {
+	case ValueString:
+		switch rdg.kind {
+		case readingText, readingField, readingNumericField:
+		default:
+			return rdg, fmt.Errorf("%w: reading at %s is not a string", ErrInvalidReading, rdg.Time)
+		}
+		if st.states != nil && !st.states[rdg.Text] {
+			return rdg, fmt.Errorf("%w: reading at %s has undeclared state '%s'", ErrInvalidReading, rdg.Time, rdg.Text)
+		}
+		rdg.Value = 0
+	case ValueBool:
+		switch rdg.kind {
+		case readingBool:
+		case readingField, readingNumericField:
+			b, err := strconv.ParseBool(rdg.Text)
+			if err != nil {
+				return rdg, fmt.Errorf("%w: reading at %s is not a boolean: %s", ErrInvalidReading, rdg.Time, err)
+			}
+			rdg.Value = 0
+			if b {
+				rdg.Value = 1
+			}
+		case readingNumber:
+			if rdg.Value != 0 && rdg.Value != 1 {
+				return rdg, fmt.Errorf("%w: reading at %s is not a boolean: %v", ErrInvalidReading, rdg.Time, rdg.Value)
+			}
+		default:
+			return rdg, fmt.Errorf("%w: reading at %s is not a boolean", ErrInvalidReading, rdg.Time)
+		}
+	case ValueInt:
+		if rdg.kind != readingNumber && rdg.kind != readingNumericField {
+			return rdg, fmt.Errorf("%w: reading at %s is not an integer", ErrInvalidReading, rdg.Time)
+		}
+		if rdg.Value != math.Trunc(rdg.Value) || math.Abs(rdg.Value) > maxExactInt {
+			return rdg, fmt.Errorf("%w: reading at %s is not an integer: %v", ErrInvalidReading, rdg.Time, rdg.Value)
+		}
+	default:
+		if rdg.kind != readingNumber && rdg.kind != readingNumericField {
+			return rdg, fmt.Errorf("%w: reading at %s is not a number", ErrInvalidReading, rdg.Time)
+		}
+	}
+	rdg.kind = readingNumber
+	if st.typ == ValueString {
+		rdg.kind = readingText
+	}
+	return rdg, nil
+}
+
+// streamTypes returns the type of each of the streams
+func (db *TimescaleDatabase) streamTypes(ctx context.Context, ids []int64) (map[int64]string, error) {
+	rows, err := db.pool.Query(ctx, `SELECT id, value_type FROM streams WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query types of streams: %w", err)
+	}
+	defer rows.Close()
+	types := make(map[int64]string)
+	for rows.Next() {
+		var (
+			id  int64
+			typ string
+		)
+		if err := rows.Scan(&id, &typ); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		types[id] = typ
+	}
+	return types, rows.Err()
+}
+
+// stateReading is a reading of a stream whose states are aggregated, with its quality flags
+type stateReading struct {
+	Reading
+	quality int32
+}
+
+// stateSeries is the readings of a stream (ordered by time) whose states are aggregated
+type stateSeries struct {
+	name     string
+	typ      string
+	readings []stateReading
+}
+
+// stateReadings reads the readings of the streams of the query, with the last reading of each stream before the
+// start of the query, which holds at the start
+func (db *TimescaleDatabase) stateReadings(ctx context.Context, q *Query) (map[int64]*stateSeries, error) {
+	var quality string
+	switch q.Quality {
+	case "good":
+		quality = " AND quality = 0"
+	case "flagged":
+		quality = " AND quality <> 0"
+	}
+	sql := `SELECT r.stream_id, COALESCE(s.brick_uri, s.name), s.value_type, r.time, r.value, r.text, r.quality FROM (
+				SELECT stream_id, time, value, NULL::text AS text, quality FROM data
+				WHERE time >= $1 AND time <= $2 AND stream_id = ANY($3)` + quality + `
+				UNION ALL
+				SELECT ids.id, l.time, l.value, NULL::text, l.quality FROM unnest($3::bigint[]) AS ids(id),
+				LATERAL (SELECT time, value, quality FROM data WHERE stream_id = ids.id AND time < $1` + quality + `
+						 ORDER BY time DESC LIMIT 1) AS l
+				UNION ALL
+				SELECT stream_id, time, 'NaN'::float8, value, quality FROM text_data
+				WHERE time >= $1 AND time <= $2 AND stream_id = ANY($3)` + quality + `
+				UNION ALL
+				SELECT ids.id, l.time, 'NaN'::float8, l.value, l.quality FROM unnest($3::bigint[]) AS ids(id),
+				LATERAL (SELECT time, value, quality FROM text_data WHERE stream_id = ids.id AND time < $1` + quality + `
+						 ORDER BY time DESC LIMIT 1) AS l
+			) AS r JOIN streams AS s ON s.id = r.stream_id
+			ORDER BY r.stream_id, r.time`
+	rows, err := db.pool.Query(ctx, sql, q.Start, q.End, q.Ids)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query states: %w", err)
+	}
+	defer rows.Close()
+	series := make(map[int64]*stateSeries)
+	for rows.Next() {
+		var (
+			id        int64
+			name, typ string
+			rdg       stateReading
+			text      *string
+		)
+		if err := rows.Scan(&id, &name, &typ, &rdg.Time, &rdg.Value, &text, &rdg.quality); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		if text != nil {
+			rdg.Text, rdg.kind = *text, readingText
+		}
+		s, ok := series[id]
+		if !ok {
+			s = &stateSeries{name: name, typ: typ}
+			series[id] = s
+		}
+		s.readings = append(s.readings, rdg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Could not query states: %w", err)
+	}
+	return series, nil
+}
+
+// stateName names the state of a reading of a stream of the type
+func stateName(rdg Reading, typ string) string {
+	switch typ {
+	case ValueString:
+		return rdg.Text
+	case ValueBool:
+		return strconv.FormatBool(rdg.Value != 0)
+	}
+	return strconv.FormatFloat(rdg.Value, 'g', -1, 64)
+}
+
+// stateBucket is the time a stream spent in each of its states during a bucket of an aggregation window
+type stateBucket struct {
+	start     time.Time
+	durations map[string]time.Duration
+	// a reading of each state
+	states  map[string]Reading
+	quality int32
+}
+
+// total returns the time covered by the readings in the bucket
+func (b *stateBucket) total() time.Duration {
+	var total time.Duration
+	for _, d := range b.durations {
+		total += d
+	}
+	return total
+}
+
+// names returns the states of the bucket in lexical order
+func (b *stateBucket) names() []string {
+	names := make([]string, 0, len(b.durations))
+	for name := range b.durations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mode returns the state held for the longest time in the bucket (the first in lexical order on ties)
+func (b *stateBucket) mode() string {
+	var mode string
+	for _, name := range b.names() {
+		if len(mode) == 0 || b.durations[name] > b.durations[mode] {
+			mode = name
+		}
+	}
+	return mode
+}
+
+// dutyCycle returns the fraction of the time covered by the readings in the bucket during which the value was
+// not 0
+func (b *stateBucket) dutyCycle() float64 {
+	var on time.Duration
+	for name, d := range b.durations {
+		if b.states[name].Value != 0 {
+			on += d
+		}
+	}
+	return on.Seconds() / b.total().Seconds()
+}
+
+// stateBuckets sums the time spent in each state between start and end in buckets of the window, like
+// time_bucket. Each reading holds its state until the next reading, or until end; readings are ordered by time,
+// and the first one may precede start. Buckets without any reading holding have no state
+func stateBuckets(readings []stateReading, typ string, start, end time.Time, window Window, loc *time.Location) []*stateBucket {
+	var (
+		buckets []*stateBucket
+		current *stateBucket
+	)
+	for idx, rdg := range readings {
+		from, to := rdg.Time, end
+		if idx+1 < len(readings) && readings[idx+1].Time.Before(end) {
+			to = readings[idx+1].Time
+		}
+		if from.Before(start) {
+			from = start
+		}
+		name := stateName(rdg.Reading, typ)
+		for from.Before(to) {
+			bucket := bucketStart(from, window, loc)
+			if current == nil || !current.start.Equal(bucket) {
+				current = &stateBucket{start: bucket, durations: make(map[string]time.Duration), states: make(map[string]Reading)}
+				buckets = append(buckets, current)
+			}
+			until := window.AddTo(bucket, 1)
+			if to.Before(until) {
+				until = to
+			}
+			current.durations[name] += until.Sub(from)
+			current.states[name] = rdg.Reading
+			current.quality |= rdg.quality
+			from = until
+		}
+	}
+	return buckets
+}
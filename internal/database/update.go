@@ -0,0 +1,453 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/knakk/rdf"
+)
+
+// defaultPrefixes are the prefixes the reasoner declares for every query; they are also
+// available to the triples in SPARQL Update requests
+var defaultPrefixes = [][2]string{
+	{"brick", "https://brickschema.org/schema/Brick#"},
+	{"tag", "https://brickschema.org/schema/BrickTag#"},
+	{"rdf", "http://www.w3.org/1999/02/22-rdf-syntax-ns#"},
+	{"rdfs", "http://www.w3.org/2000/01/rdf-schema#"},
+	{"owl", "http://www.w3.org/2002/07/owl#"},
+	{"qudt", "http://qudt.org/schema/qudt/"},
+}
+
+// unboundIRI replaces variables in a template that are not bound by a solution; triples
+// containing it are dropped, as required by SPARQL 1.1 Update
+const unboundIRI = "urn:mortar:unbound"
+
+type updateKind int
+
+const (
+	updateInsertData updateKind = iota + 1
+	updateDeleteData
+	updateModify
+)
+
+// updateOperation is a single operation of a SPARQL Update request. INSERT DATA and DELETE DATA
+// use the data block; DELETE/INSERT ... WHERE (and DELETE WHERE) use the templates and the where block
+type updateOperation struct {
+	kind           updateKind
+	data           string
+	deleteTemplate string
+	insertTemplate string
+	where          string
+}
+
+type prefixDecl struct {
+	name string
+	iri  string
+}
+
+// sparqlUpdate is a parsed SPARQL 1.1 Update request. Only the operations that change triples are supported
+type sparqlUpdate struct {
+	base       string
+	prefixes   []prefixDecl
+	operations []updateOperation
+}
+
+type updateToken struct {
+	kind byte // 'w' for words, 'i' for IRIs, '{' for blocks, ';' for separators
+	text string
+}
+
+// UpdateSparql applies a SPARQL 1.1 Update request to a source. WHERE clauses are evaluated against the source
+// as it was before the request, and the changes made by all operations are stored together as new versions.
+// Triples are deleted from the request's origin (or from every origin if none is given) and inserted into the
+// request's origin (or DefaultEditOrigin)
+func (db *TimescaleDatabase) UpdateSparql(ctx context.Context, req *SparqlUpdateRequest) error {
+	if authorized, err := db.checkAuth(ctx, "write", req.Source); err != nil {
+		return fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return fmt.Errorf("Cannot write to source: %s", req.Source)
+	}
+
+	update, err := parseSparqlUpdate(req.Update)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidQuery, err)
+	}
+
+	insertOrigin := req.Origin
+	if len(insertOrigin) == 0 {
+		insertOrigin = DefaultEditOrigin
+	}
+
+	var edits []GraphEdit
+	for _, op := range update.operations {
+		var del, ins []Triple
+		switch op.kind {
+		case updateInsertData:
+			ins, err = update.parseTriples(op.data)
+		case updateDeleteData:
+			del, err = update.parseTriples(op.data)
+		case updateModify:
+			del, ins, err = db.evaluateModify(ctx, req.Source, update, op)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidQuery, err)
+		}
+		if len(del) > 0 {
+			edits = append(edits, GraphEdit{Origin: req.Origin, Delete: del})
+		}
+		if len(ins) > 0 {
+			edits = append(edits, GraphEdit{Origin: insertOrigin, Insert: ins})
+		}
+	}
+	return db.EditGraph(ctx, req.Source, edits)
+}
+
+// evaluateModify finds the solutions to the WHERE clause of the operation and instantiates
+// the delete and insert templates with each of them. The WHERE clause matches the stored triples of
+// the source: inferred triples cannot be deleted, so they must not select the triples to change
+func (db *TimescaleDatabase) evaluateModify(ctx context.Context, source string, update *sparqlUpdate, op updateOperation) ([]Triple, []Triple, error) {
+	query := update.sparqlPrologue() + "SELECT * WHERE {" + op.where + "}"
+	resp, err := db.QuerySparqlProtocol(ctx, &SparqlProtocolRequest{Query: query, DefaultSources: []string{source}, Stored: true})
+	if err != nil {
+		return nil, nil, err
+	} else if resp.IsGraph() {
+		return nil, nil, errors.New("WHERE clause did not produce solutions")
+	}
+
+	var del, ins []Triple
+	for idx, solution := range resp.Results.solutions() {
+		bind := func(term string) string {
+			if term[0] == '?' || term[0] == '$' {
+				if value, ok := solution[term[1:]]; ok {
+					return value.ntriples()
+				}
+				return "<" + unboundIRI + ">"
+			}
+			// blank nodes in templates are fresh for each solution
+			return fmt.Sprintf("%s_%d", term, idx)
+		}
+
+		triples, err := update.parseTriples(rewriteSparql(op.deleteTemplate, bind))
+		if err != nil {
+			return nil, nil, err
+		}
+		del = append(del, boundTriples(triples)...)
+
+		triples, err = update.parseTriples(rewriteSparql(op.insertTemplate, bind))
+		if err != nil {
+			return nil, nil, err
+		}
+		ins = append(ins, boundTriples(triples)...)
+	}
+	return del, ins, nil
+}
+
+func boundTriples(triples []Triple) []Triple {
+	unbound := "<" + unboundIRI + ">"
+	bound := triples[:0]
+	for _, t := range triples {
+		if t.S != unbound && t.P != unbound && t.O != unbound {
+			bound = append(bound, t)
+		}
+	}
+	return bound
+}
+
+// sparqlPrologue returns the request's BASE and PREFIX declarations in SPARQL syntax
+func (update *sparqlUpdate) sparqlPrologue() string {
+	var prologue strings.Builder
+	if len(update.base) > 0 {
+		fmt.Fprintf(&prologue, "BASE <%s>\n", update.base)
+	}
+	for _, decl := range update.prefixes {
+		fmt.Fprintf(&prologue, "PREFIX %s: <%s>\n", decl.name, decl.iri)
+	}
+	return prologue.String()
+}
+
+// parseTriples parses a block of triples (without variables) using the Turtle decoder
+func (update *sparqlUpdate) parseTriples(block string) ([]Triple, error) {
+	body := strings.TrimSpace(rewriteSparql(block, func(term string) string { return term }))
+	if len(body) == 0 {
+		return nil, nil
+	}
+
+	var doc strings.Builder
+	if len(update.base) > 0 {
+		fmt.Fprintf(&doc, "@base <%s> .\n", update.base)
+	}
+	declared := make(map[string]bool)
+	for _, decl := range update.prefixes {
+		declared[decl.name] = true
+		fmt.Fprintf(&doc, "@prefix %s: <%s> .\n", decl.name, decl.iri)
+	}
+	for _, decl := range defaultPrefixes {
+		if !declared[decl[0]] {
+			fmt.Fprintf(&doc, "@prefix %s: <%s> .\n", decl[0], decl[1])
+		}
+	}
+	doc.WriteString(body)
+	// the final '.' of a block of triples is optional in SPARQL
+	if !strings.HasSuffix(body, ".") {
+		doc.WriteString(" .")
+	}
+
+	var triples []Triple
+	dec := rdf.NewTripleDecoder(strings.NewReader(doc.String()), rdf.Turtle)
+	for triple, err := dec.Decode(); err != io.EOF; triple, err = dec.Decode() {
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse triples: %w", err)
+		} else if triple.Subj == nil || triple.Pred == nil || triple.Obj == nil {
+			return nil, errors.New("Could not parse triples")
+		}
+		triples = append(triples, tripleFromRDF(triple))
+	}
+	return triples, nil
+}
+
+// parseSparqlUpdate parses the operations of a SPARQL 1.1 Update request. Supports INSERT DATA,
+// DELETE DATA, DELETE WHERE and DELETE/INSERT ... WHERE
+func parseSparqlUpdate(text string) (*sparqlUpdate, error) {
+	tokens, err := lexSparqlUpdate(text)
+	if err != nil {
+		return nil, err
+	}
+
+	update := &sparqlUpdate{}
+	keyword := func(idx int) string {
+		if idx < len(tokens) && tokens[idx].kind == 'w' {
+			return strings.ToUpper(tokens[idx].text)
+		}
+		return ""
+	}
+	block := func(idx int) (string, error) {
+		if idx < len(tokens) && tokens[idx].kind == '{' {
+			return tokens[idx].text, nil
+		}
+		return "", fmt.Errorf("Expected a block after %s", tokens[idx-1].text)
+	}
+
+	for i := 0; i < len(tokens); {
+		switch kw := keyword(i); {
+		case tokens[i].kind == ';':
+			i++
+		case kw == "PREFIX":
+			if i+2 >= len(tokens) || tokens[i+1].kind != 'w' || !strings.HasSuffix(tokens[i+1].text, ":") || tokens[i+2].kind != 'i' {
+				return nil, errors.New("Invalid PREFIX declaration")
+			}
+			update.prefixes = append(update.prefixes, prefixDecl{name: strings.TrimSuffix(tokens[i+1].text, ":"), iri: tokens[i+2].text})
+			i += 3
+		case kw == "BASE":
+			if i+1 >= len(tokens) || tokens[i+1].kind != 'i' {
+				return nil, errors.New("Invalid BASE declaration")
+			}
+			update.base = tokens[i+1].text
+			i += 2
+		case (kw == "INSERT" || kw == "DELETE") && keyword(i+1) == "DATA":
+			data, err := block(i + 2)
+			if err != nil {
+				return nil, err
+			}
+			op := updateOperation{kind: updateInsertData, data: data}
+			if kw == "DELETE" {
+				op.kind = updateDeleteData
+			}
+			update.operations = append(update.operations, op)
+			i += 3
+		case kw == "DELETE" && keyword(i+1) == "WHERE":
+			pattern, err := block(i + 2)
+			if err != nil {
+				return nil, err
+			}
+			update.operations = append(update.operations, updateOperation{kind: updateModify, deleteTemplate: pattern, where: pattern})
+			i += 3
+		case kw == "DELETE" || kw == "INSERT":
+			op := updateOperation{kind: updateModify}
+			if kw == "DELETE" {
+				if op.deleteTemplate, err = block(i + 1); err != nil {
+					return nil, err
+				}
+				i += 2
+			}
+			if keyword(i) == "INSERT" {
+				if op.insertTemplate, err = block(i + 1); err != nil {
+					return nil, err
+				}
+				i += 2
+			}
+			if keyword(i) == "USING" {
+				return nil, errors.New("USING is not supported; the graph to update is given by the 'source' parameter")
+			} else if keyword(i) != "WHERE" {
+				return nil, errors.New("Expected WHERE")
+			}
+			if op.where, err = block(i + 1); err != nil {
+				return nil, err
+			}
+			update.operations = append(update.operations, op)
+			i += 2
+		case kw == "WITH":
+			return nil, errors.New("WITH is not supported; the graph to update is given by the 'source' parameter")
+		default:
+			return nil, fmt.Errorf("Unsupported SPARQL Update operation %s", tokens[i].text)
+		}
+	}
+	return update, nil
+}
+
+// lexSparqlUpdate splits an update request into words, IRIs, ';' separators and the contents of top-level {} blocks
+func lexSparqlUpdate(text string) ([]updateToken, error) {
+	var tokens []updateToken
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '#':
+			i = commentEnd(text, i)
+		case c == ';':
+			tokens = append(tokens, updateToken{kind: ';', text: ";"})
+			i++
+		case c == '<':
+			end := iriEnd(text, i)
+			if end < 0 {
+				return nil, errors.New("Unterminated IRI")
+			}
+			tokens = append(tokens, updateToken{kind: 'i', text: text[i+1 : end]})
+			i = end + 1
+		case c == '{':
+			end, err := matchingBrace(text, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, updateToken{kind: '{', text: text[i+1 : end]})
+			i = end + 1
+		case c == '}':
+			return nil, errors.New("Unbalanced '}'")
+		default:
+			j := i
+			for j < len(text) && !unicode.IsSpace(rune(text[j])) && !strings.ContainsRune("{};<#", rune(text[j])) {
+				j++
+			}
+			tokens = append(tokens, updateToken{kind: 'w', text: text[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// matchingBrace returns the index of the '}' closing the '{' at text[open]
+func matchingBrace(text string, open int) (int, error) {
+	depth := 0
+	for i := open; i < len(text); i++ {
+		switch text[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				return i, nil
+			}
+		case '"', '\'':
+			end, err := stringEnd(text, i)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+		case '#':
+			i = commentEnd(text, i) - 1
+		case '<':
+			if end := iriEnd(text, i); end > 0 {
+				i = end
+			}
+		}
+	}
+	return 0, errors.New("Unbalanced '{'")
+}
+
+// rewriteSparql removes comments from the text and replaces each variable (?x, $x)
+// and blank node label (_:x) outside of strings and IRIs with the result of rewrite
+func rewriteSparql(text string, rewrite func(term string) string) string {
+	isName := func(c byte) bool {
+		return c == '_' || c == '-' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	}
+	nameEnd := func(i int) int {
+		for i < len(text) && isName(text[i]) {
+			i++
+		}
+		return i
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '"' || c == '\'':
+			end, err := stringEnd(text, i)
+			if err != nil {
+				end = len(text) - 1
+			}
+			out.WriteString(text[i : end+1])
+			i = end + 1
+		case c == '<' && iriEnd(text, i) > 0:
+			end := iriEnd(text, i)
+			out.WriteString(text[i : end+1])
+			i = end + 1
+		case c == '#':
+			out.WriteByte('\n')
+			i = commentEnd(text, i)
+		case (c == '?' || c == '$') && i+1 < len(text) && isName(text[i+1]):
+			end := nameEnd(i + 1)
+			out.WriteString(rewrite(text[i:end]))
+			i = end
+		case c == '_' && i+2 < len(text) && text[i+1] == ':' && (i == 0 || !isName(text[i-1])):
+			end := nameEnd(i + 2)
+			out.WriteString(rewrite(text[i:end]))
+			i = end
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.String()
+}
+
+// stringEnd returns the index of the closing quote of the string literal starting at text[start]
+func stringEnd(text string, start int) (int, error) {
+	quote := text[start : start+1]
+	if strings.HasPrefix(text[start:], strings.Repeat(quote, 3)) {
+		quote = strings.Repeat(quote, 3)
+	}
+	for i := start + len(quote); i < len(text); i++ {
+		if text[i] == '\\' {
+			i++
+		} else if strings.HasPrefix(text[i:], quote) {
+			return i + len(quote) - 1, nil
+		}
+	}
+	return 0, errors.New("Unterminated string")
+}
+
+// iriEnd returns the index of the '>' closing the IRI starting at text[start], or -1 if the '<'
+// does not start an IRI (e.g. it is a comparison in a FILTER)
+func iriEnd(text string, start int) int {
+	for i := start + 1; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '>':
+			return i
+		case unicode.IsSpace(rune(c)) || strings.ContainsRune("<{}\"", rune(c)):
+			return -1
+		}
+	}
+	return -1
+}
+
+// commentEnd returns the index of the end of the line containing the comment at text[start]
+func commentEnd(text string, start int) int {
+	if end := strings.IndexByte(text[start:], '\n'); end >= 0 {
+		return start + end
+	}
+	return len(text)
+}
@@ -0,0 +1,203 @@
+package database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSparqlUpdate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		update string
+		want   *sparqlUpdate
+	}{
+		{
+			name:   "insert data",
+			update: "PREFIX ex: <http://example.org/>\nINSERT DATA { ex:a ex:p \"x\" }",
+			want: &sparqlUpdate{
+				prefixes:   []prefixDecl{{name: "ex", iri: "http://example.org/"}},
+				operations: []updateOperation{{kind: updateInsertData, data: ` ex:a ex:p "x" `}},
+			},
+		},
+		{
+			name:   "delete data",
+			update: "BASE <http://example.org/> delete data {<a> <p> <b>}",
+			want: &sparqlUpdate{
+				base:       "http://example.org/",
+				operations: []updateOperation{{kind: updateDeleteData, data: `<a> <p> <b>`}},
+			},
+		},
+		{
+			name:   "delete where",
+			update: "DELETE WHERE { ?s ?p ?o }",
+			want: &sparqlUpdate{
+				operations: []updateOperation{{kind: updateModify, deleteTemplate: ` ?s ?p ?o `, where: ` ?s ?p ?o `}},
+			},
+		},
+		{
+			name:   "delete insert where",
+			update: "DELETE { ?s a brick:Sensor } INSERT { ?s a brick:Temperature_Sensor } WHERE { ?s a brick:Sensor FILTER(?v < 3) }",
+			want: &sparqlUpdate{
+				operations: []updateOperation{{
+					kind:           updateModify,
+					deleteTemplate: ` ?s a brick:Sensor `,
+					insertTemplate: ` ?s a brick:Temperature_Sensor `,
+					where:          ` ?s a brick:Sensor FILTER(?v < 3) `,
+				}},
+			},
+		},
+		{
+			name:   "insert where",
+			update: "INSERT { ?s <http://example.org/q> 1 } WHERE { ?s <http://example.org/p> ?o }",
+			want: &sparqlUpdate{
+				operations: []updateOperation{{
+					kind:           updateModify,
+					insertTemplate: ` ?s <http://example.org/q> 1 `,
+					where:          ` ?s <http://example.org/p> ?o `,
+				}},
+			},
+		},
+		{
+			name:   "several operations",
+			update: "PREFIX ex: <http://example.org/> INSERT DATA { ex:a ex:p ex:b } ; # the second operation\n DELETE DATA { ex:a ex:p ex:c } ;",
+			want: &sparqlUpdate{
+				prefixes: []prefixDecl{{name: "ex", iri: "http://example.org/"}},
+				operations: []updateOperation{
+					{kind: updateInsertData, data: ` ex:a ex:p ex:b `},
+					{kind: updateDeleteData, data: ` ex:a ex:p ex:c `},
+				},
+			},
+		},
+		{
+			name:   "string escapes",
+			update: `INSERT DATA { <a> <p> "a \" } { b" . <a> <q> '''multi } ' line''' . <a> <r> 'it\'s }' }`,
+			want: &sparqlUpdate{
+				operations: []updateOperation{{
+					kind: updateInsertData,
+					data: ` <a> <p> "a \" } { b" . <a> <q> '''multi } ' line''' . <a> <r> 'it\'s }' `,
+				}},
+			},
+		},
+		{
+			name:   "nested braces",
+			update: "DELETE { ?s ?p ?o } WHERE { ?s ?p ?o OPTIONAL { ?s <q> ?q FILTER NOT EXISTS { ?q a <C> } } }",
+			want: &sparqlUpdate{
+				operations: []updateOperation{{
+					kind:           updateModify,
+					deleteTemplate: ` ?s ?p ?o `,
+					where:          ` ?s ?p ?o OPTIONAL { ?s <q> ?q FILTER NOT EXISTS { ?q a <C> } } `,
+				}},
+			},
+		},
+		{
+			name:   "braces in comments",
+			update: "INSERT DATA { <a> <p> <b> # } is not the end\n }",
+			want: &sparqlUpdate{
+				operations: []updateOperation{{kind: updateInsertData, data: " <a> <p> <b> # } is not the end\n "}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseSparqlUpdate(tc.update)
+			if err != nil {
+				t.Fatalf("Could not parse update: %s", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseSparqlUpdateErrors(t *testing.T) {
+	for _, tc := range []struct {
+		update string
+		err    string
+	}{
+		{"INSERT DATA { <a> <p> <b>", "Unbalanced '{'"},
+		{"INSERT DATA { <a> <p> <b> } }", "Unbalanced '}'"},
+		{`INSERT DATA { <a> <p> "b }`, "Unterminated string"},
+		{"INSERT DATA", "Expected a block after DATA"},
+		{"PREFIX ex <http://example.org/>", "Invalid PREFIX declaration"},
+		{"BASE example", "Invalid BASE declaration"},
+		{"DELETE { ?s ?p ?o }", "Expected WHERE"},
+		{"DELETE { ?s ?p ?o } USING <g> WHERE { ?s ?p ?o }", "USING is not supported"},
+		{"WITH <g> DELETE { ?s ?p ?o } WHERE { ?s ?p ?o }", "WITH is not supported"},
+		{"LOAD <http://example.org/data.ttl>", "Unsupported SPARQL Update operation LOAD"},
+	} {
+		t.Run(tc.update, func(t *testing.T) {
+			_, err := parseSparqlUpdate(tc.update)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("Got error %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestMatchingBrace(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want int
+	}{
+		{"{}", 1},
+		{"{ { } }", 6},
+		{"{ ?s ?p ?o FILTER NOT EXISTS { ?o a <C> } } }", 42},
+		{`{ "}" }`, 6},
+		{`{ "\"}" }`, 8},
+		{`{ """ } "" } """ }`, 17},
+		{"{ # }\n}", 6},
+		{"{ <http://example.org/#a> }", 26},
+		{"{ FILTER(?a < ?b) }", 18},
+	} {
+		t.Run(tc.text, func(t *testing.T) {
+			got, err := matchingBrace(tc.text, 0)
+			if err != nil {
+				t.Fatalf("Could not match brace: %s", err)
+			}
+			if got != tc.want {
+				t.Errorf("Got %d, want %d", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := matchingBrace("{ { }", 0); err == nil {
+		t.Errorf("Unbalanced braces should not match")
+	}
+}
+
+func TestRewriteSparql(t *testing.T) {
+	rewrite := func(term string) string {
+		return "[" + term + "]"
+	}
+	for _, tc := range []struct {
+		text string
+		want string
+	}{
+		{"?s ?p $o", "[?s] [?p] [$o]"},
+		{`?s <http://example.org/?x> "?y" '$z'`, `[?s] <http://example.org/?x> "?y" '$z'`},
+		{"_:b1 <p> _:b2", "[_:b1] <p> [_:b2]"},
+		{"ex:a_:b ?s", "ex:a_:b [?s]"},
+		{"?s ?p ?o # ?c\n.", "[?s] [?p] [?o] \n\n."},
+		{"FILTER(?a < ?b)", "FILTER([?a] < [?b])"},
+	} {
+		t.Run(tc.text, func(t *testing.T) {
+			if got := rewriteSparql(tc.text, rewrite); got != tc.want {
+				t.Errorf("Got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBoundTriples(t *testing.T) {
+	unbound := "<" + unboundIRI + ">"
+	triples := []Triple{
+		{S: "<a>", P: "<p>", O: "<b>"},
+		{S: unbound, P: "<p>", O: "<b>"},
+		{S: "<a>", P: "<p>", O: unbound},
+	}
+	want := []Triple{{S: "<a>", P: "<p>", O: "<b>"}}
+	if got := boundTriples(triples); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
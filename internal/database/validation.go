@@ -0,0 +1,146 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/knakk/rdf"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// ValidationMode controls the SHACL validation of metadata uploads
+type ValidationMode int
+
+const (
+	// ValidateNone skips validation
+	ValidateNone ValidationMode = iota
+	// ValidateReport validates the graph of the source after the upload and reports the results
+	ValidateReport
+	// ValidateBlock rejects the upload if the resulting graph has violations
+	ValidateBlock
+)
+
+func ParseValidationMode(s string) (ValidationMode, error) {
+	switch strings.ToLower(s) {
+	case "", "none", "false":
+		return ValidateNone, nil
+	case "report", "true":
+		return ValidateReport, nil
+	case "block":
+		return ValidateBlock, nil
+	}
+	return ValidateNone, fmt.Errorf("Validation mode %s unknown", s)
+}
+
+// ErrValidationFailed is returned when a write is rejected because the graph would not conform to its shapes
+var ErrValidationFailed = errors.New("Graph does not conform to its shapes")
+
+// ShapeSet is a named set of SHACL shapes stored for a source
+type ShapeSet struct {
+	Name    string
+	Triples int
+}
+
+// loadShapeLibrary reads the shape files given in the configuration. The format of each file is
+// determined by its extension (Turtle by default)
+func loadShapeLibrary(files []string) ([]Triple, error) {
+	var library []Triple
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("Could not open shape file %s: %w", file, err)
+		}
+		format, ok := FormatFromName(filepath.Ext(file))
+		if !ok {
+			format = rdf.Turtle
+		}
+		triples, err := ReadTriples(f, format)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Could not read shape file %s: %w", file, err)
+		}
+		library = append(library, triples...)
+	}
+	return library, nil
+}
+
+// ValidateGraph validates the current graph of a source against the shape library and the shapes stored
+// for the source (or only the named sets in req.Shapes)
+func (db *TimescaleDatabase) ValidateGraph(ctx context.Context, req *ValidationRequest) (*ValidationReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.DataReadTimeout)
+	defer cancel()
+	return db.validateSource(ctx, db.pool, req.Source, req.Shapes)
+}
+
+func (db *TimescaleDatabase) validateSource(ctx context.Context, q querier, source string, names []string) (*ValidationReport, error) {
+	log := logging.FromContext(ctx)
+	graph, err := queryTriples(ctx, q, `SELECT s, p, o FROM latest_triples WHERE source = $1`, source)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read graph of %s: %w", source, err)
+	}
+	shapes, err := queryTriples(ctx, q, `SELECT s, p, o FROM shapes
+										 WHERE source = $1 AND (COALESCE(cardinality($2::text[]), 0) = 0 OR name = ANY($2))`, source, names)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read shapes of %s: %w", source, err)
+	}
+	shapes = append(shapes, db.shapeLibrary...)
+
+	report, err := validateGraph(source, graph, shapes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not validate %s: %w", source, err)
+	}
+	log.Infof("Validated %s (%d triples, %d shape triples): %d results", source, len(graph), len(shapes), len(report.Results))
+	return report, nil
+}
+
+// ShapeSets lists the sets of shapes stored for the source
+func (db *TimescaleDatabase) ShapeSets(ctx context.Context, source string) ([]ShapeSet, error) {
+	rows, err := db.pool.Query(ctx, `SELECT name, COUNT(*) FROM shapes WHERE source = $1 GROUP BY name ORDER BY name`, source)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list shapes of %s: %w", source, err)
+	}
+	defer rows.Close()
+
+	var sets []ShapeSet
+	for rows.Next() {
+		var set ShapeSet
+		if err := rows.Scan(&set.Name, &set.Triples); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		sets = append(sets, set)
+	}
+	return sets, rows.Err()
+}
+
+// PutShapes replaces the named set of shapes for the source. If there are no triples, the set is removed
+func (db *TimescaleDatabase) PutShapes(ctx context.Context, source, name string, triples []Triple) error {
+	ctx, cancel := context.WithTimeout(ctx, config.DataWriteTimeout)
+	defer cancel()
+
+	if authorized, err := db.checkAuth(ctx, "write", source); err != nil {
+		return fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return fmt.Errorf("Cannot write to source: %s", source)
+	}
+
+	return db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		if _, err := txn.Exec(ctx, `DELETE FROM shapes WHERE source = $1 AND name = $2`, source, name); err != nil {
+			return fmt.Errorf("Could not remove shapes %s/%s: %w", source, name, err)
+		}
+		rows := make([][]interface{}, 0, len(triples))
+		for triple := range newRDFGraph(triples).triples {
+			rows = append(rows, []interface{}{source, name, triple.S, triple.P, triple.O})
+		}
+		if _, err := txn.CopyFrom(ctx, pgx.Identifier{"shapes"}, []string{"source", "name", "s", "p", "o"}, pgx.CopyFromRows(rows)); err != nil {
+			return fmt.Errorf("Could not store shapes %s/%s: %w", source, name, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,349 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/knakk/rdf"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// DefaultEditOrigin is the origin that holds triples added through SPARQL Update or the
+// Graph Store Protocol when the request does not name an origin
+const DefaultEditOrigin = "edits"
+
+// Triple is a triple as it is stored in the database: each term is serialized as N-Triples
+type Triple struct {
+	S string
+	P string
+	O string
+}
+
+func tripleFromRDF(t rdf.Triple) Triple {
+	return Triple{
+		S: t.Subj.Serialize(rdf.NTriples),
+		P: t.Pred.Serialize(rdf.NTriples),
+		O: t.Obj.Serialize(rdf.NTriples),
+	}
+}
+
+type tripleSet map[Triple]struct{}
+
+// querier is implemented by both connection pools and transactions
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+// graphAsOfSQL returns a query for the triples (origin, s, p, o) of the source given by the sourceParam placeholder
+// as of the time given by the atParam placeholder: for each origin, this is the latest version at or before that time
+func graphAsOfSQL(atParam, sourceParam string) string {
+	return fmt.Sprintf(`SELECT origin, s, p, o FROM triples_as_of(%s, %s)`, sourceParam, atParam)
+}
+
+// GraphVersion is a version of the triples from one origin of a source
+type GraphVersion struct {
+	Origin  string
+	Time    time.Time
+	Triples int
+}
+
+// GraphDiff holds the triples added to and removed from a source between two points in time
+type GraphDiff struct {
+	Source  string
+	Origin  string
+	From    time.Time
+	To      time.Time
+	Added   []Triple
+	Removed []Triple
+}
+
+// GraphEdit is a change to the triples of one origin of a source. If Clear is set, the existing
+// triples of the origin are removed; then the Delete triples are removed and the Insert triples are added.
+// An edit with an empty Origin applies to every origin of the source and cannot Insert
+type GraphEdit struct {
+	Origin string
+	Clear  bool
+	Delete []Triple
+	Insert []Triple
+}
+
+// EditGraph applies the edits, in order, to the latest versions of the origins of a source. Each changed origin
+// is written to the triples table as a new version; all new versions share the same timestamp
+func (db *TimescaleDatabase) EditGraph(ctx context.Context, source string, edits []GraphEdit) error {
+	ctx, cancel := context.WithTimeout(ctx, config.DataWriteTimeout)
+	defer cancel()
+
+	log := logging.FromContext(ctx)
+	if len(source) == 0 {
+		return fmt.Errorf("Cannot edit invalid graph: SourceName is null")
+	}
+	if authorized, err := db.checkAuth(ctx, "write", source); err != nil {
+		return fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return fmt.Errorf("Cannot write to source: %s", source)
+	}
+
+	return db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		var (
+			current = make(map[string]tripleSet)
+			changed = make(map[string]bool)
+		)
+		load := func(origin string) (tripleSet, error) {
+			if triples, ok := current[origin]; ok {
+				return triples, nil
+			}
+			if err := lockOrigin(ctx, txn, source, origin); err != nil {
+				return nil, err
+			}
+			triples, err := latestOriginTriples(ctx, txn, source, origin)
+			if err != nil {
+				return nil, fmt.Errorf("Could not read triples for origin %s: %w", origin, err)
+			}
+			current[origin] = triples
+			return triples, nil
+		}
+
+		for _, edit := range edits {
+			origins := []string{edit.Origin}
+			if len(edit.Origin) == 0 {
+				if len(edit.Insert) > 0 {
+					return fmt.Errorf("Edits to all origins of %s cannot insert triples", source)
+				}
+				var err error
+				if origins, err = sourceOrigins(ctx, txn, source); err != nil {
+					return fmt.Errorf("Could not read origins of %s: %w", source, err)
+				}
+			}
+
+			for _, origin := range origins {
+				triples, err := load(origin)
+				if err != nil {
+					return err
+				}
+				if edit.Clear && len(triples) > 0 {
+					triples = make(tripleSet)
+					current[origin] = triples
+					changed[origin] = true
+				}
+				for _, t := range edit.Delete {
+					if _, ok := triples[t]; ok {
+						delete(triples, t)
+						changed[origin] = true
+					}
+				}
+				for _, t := range edit.Insert {
+					if _, ok := triples[t]; !ok {
+						triples[t] = struct{}{}
+						changed[origin] = true
+					}
+				}
+			}
+		}
+
+		now := time.Now()
+		for origin := range changed {
+			if err := writeOriginVersion(ctx, txn, source, origin, now, current[origin]); err != nil {
+				return fmt.Errorf("Could not write new version of %s/%s: %w", source, origin, err)
+			}
+			log.Infof("Wrote version %s of %s/%s with %d triples", now.Format(time.RFC3339Nano), source, origin, len(current[origin]))
+		}
+		if len(changed) > 0 {
+			if _, err := reconcileStreams(ctx, txn, source, true); err != nil {
+				return fmt.Errorf("Could not reconcile streams of %s: %w", source, err)
+			}
+		}
+		return nil
+	})
+}
+
+// GraphVersions lists the versions of every origin of the source, oldest first
+func (db *TimescaleDatabase) GraphVersions(ctx context.Context, source string) ([]GraphVersion, error) {
+	if authorized, err := db.checkAuth(ctx, "read", source); err != nil {
+		return nil, fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return nil, fmt.Errorf("Cannot read from source: %s", source)
+	}
+	rows, err := db.pool.Query(ctx, `SELECT origin, time, COUNT(s) FROM
+									 (SELECT source, origin, time FROM triples WHERE source = $1
+									  UNION SELECT source, origin, time FROM triple_versions WHERE source = $1) AS versions
+									 LEFT JOIN triples USING(source, origin, time)
+									 GROUP BY origin, time ORDER BY time, origin`, source)
+	if err != nil {
+		return nil, fmt.Errorf("Could not query versions of %s: %w", source, err)
+	}
+	defer rows.Close()
+
+	var versions []GraphVersion
+	for rows.Next() {
+		var v GraphVersion
+		if err := rows.Scan(&v.Origin, &v.Time, &v.Triples); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// DiffGraph computes the triples added and removed between the state of a source (or one of its origins)
+// at req.From and its state at req.To
+func (db *TimescaleDatabase) DiffGraph(ctx context.Context, req *DiffRequest) (*GraphDiff, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.DataReadTimeout)
+	defer cancel()
+
+	if authorized, err := db.checkAuth(ctx, "read", req.Source); err != nil {
+		return nil, fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return nil, fmt.Errorf("Cannot read from source: %s", req.Source)
+	}
+
+	diff := &GraphDiff{
+		Source: req.Source,
+		Origin: req.Origin,
+		From:   req.From,
+		To:     req.To,
+	}
+	// $1 is the 'newer' graph and $2 is the 'older' graph
+	sql := fmt.Sprintf(`SELECT s, p, o FROM (%s) AS newer WHERE $4 = '' OR origin = $4
+						EXCEPT
+						SELECT s, p, o FROM (%s) AS older WHERE $4 = '' OR origin = $4`,
+		graphAsOfSQL("$1", "$3"), graphAsOfSQL("$2", "$3"))
+
+	var err error
+	if diff.Added, err = queryTriples(ctx, db.pool, sql, req.To, req.From, req.Source, req.Origin); err != nil {
+		return nil, fmt.Errorf("Could not compute added triples: %w", err)
+	}
+	if diff.Removed, err = queryTriples(ctx, db.pool, sql, req.From, req.To, req.Source, req.Origin); err != nil {
+		return nil, fmt.Errorf("Could not compute removed triples: %w", err)
+	}
+	return diff, nil
+}
+
+// RollbackGraph restores a source (or one of its origins) to its state at req.Time by writing the triples
+// it had then as new versions. Origins that did not exist at req.Time become empty. Later versions are kept
+func (db *TimescaleDatabase) RollbackGraph(ctx context.Context, req *RollbackRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, config.DataWriteTimeout)
+	defer cancel()
+
+	if authorized, err := db.checkAuth(ctx, "write", req.Source); err != nil {
+		return fmt.Errorf("Cannot determine authorized status: %w", err)
+	} else if !authorized {
+		return fmt.Errorf("Cannot write to source: %s", req.Source)
+	}
+
+	rows, err := db.pool.Query(ctx, graphAsOfSQL("$1", "$2"), req.Time, req.Source)
+	if err != nil {
+		return fmt.Errorf("Could not read %s at %s: %w", req.Source, req.Time, err)
+	}
+	defer rows.Close()
+	previous := make(map[string][]Triple)
+	for rows.Next() {
+		var (
+			origin string
+			t      Triple
+		)
+		if err := rows.Scan(&origin, &t.S, &t.P, &t.O); err != nil {
+			return fmt.Errorf("Could not scan row: %w", err)
+		}
+		previous[origin] = append(previous[origin], t)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Could not read %s at %s: %w", req.Source, req.Time, err)
+	}
+
+	origins := []string{req.Origin}
+	if len(req.Origin) == 0 {
+		if origins, err = sourceOrigins(ctx, db.pool, req.Source); err != nil {
+			return fmt.Errorf("Could not read origins of %s: %w", req.Source, err)
+		}
+	}
+	var edits []GraphEdit
+	for _, origin := range origins {
+		edits = append(edits, GraphEdit{Origin: origin, Clear: true, Insert: previous[origin]})
+	}
+	return db.EditGraph(ctx, req.Source, edits)
+}
+
+// queryTriples runs a query that selects (s, p, o)
+func queryTriples(ctx context.Context, q querier, sql string, args ...interface{}) ([]Triple, error) {
+	rows, err := q.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var triples []Triple
+	for rows.Next() {
+		var t Triple
+		if err := rows.Scan(&t.S, &t.P, &t.O); err != nil {
+			return nil, err
+		}
+		triples = append(triples, t)
+	}
+	return triples, rows.Err()
+}
+
+// lockOrigin locks the origin of a source until the end of the transaction, so that concurrent writers of the
+// origin do not derive their versions from the same latest version and drop each other's changes
+func lockOrigin(ctx context.Context, txn pgx.Tx, source, origin string) error {
+	if _, err := txn.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1 || '/' || $2))`, source, origin); err != nil {
+		return fmt.Errorf("Could not lock origin %s of %s: %w", origin, source, err)
+	}
+	return nil
+}
+
+// latestOriginTriples returns the triples in the latest version of the given origin of a source
+func latestOriginTriples(ctx context.Context, txn querier, source, origin string) (tripleSet, error) {
+	rows, err := txn.Query(ctx, `SELECT s, p, o FROM triples
+								 WHERE source = $1 AND origin = $2 AND time = (
+								   SELECT MAX(time) FROM (SELECT time FROM triples WHERE source = $1 AND origin = $2
+								                          UNION SELECT time FROM triple_versions WHERE source = $1 AND origin = $2) AS versions)`,
+		source, origin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	triples := make(tripleSet)
+	for rows.Next() {
+		var t Triple
+		if err := rows.Scan(&t.S, &t.P, &t.O); err != nil {
+			return nil, err
+		}
+		triples[t] = struct{}{}
+	}
+	return triples, rows.Err()
+}
+
+// sourceOrigins returns the names of all origins that have contributed triples to the source
+func sourceOrigins(ctx context.Context, txn querier, source string) ([]string, error) {
+	rows, err := txn.Query(ctx, `SELECT DISTINCT origin FROM triples WHERE source = $1
+								 UNION SELECT origin FROM triple_versions WHERE source = $1`, source)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var origins []string
+	for rows.Next() {
+		var origin string
+		if err := rows.Scan(&origin); err != nil {
+			return nil, err
+		}
+		origins = append(origins, origin)
+	}
+	return origins, rows.Err()
+}
+
+// writeOriginVersion stores the triples as the version of the origin at time t
+func writeOriginVersion(ctx context.Context, txn pgx.Tx, source, origin string, t time.Time, triples tripleSet) error {
+	rows := make([][]interface{}, 0, len(triples))
+	for triple := range triples {
+		rows = append(rows, []interface{}{source, origin, t, triple.S, triple.P, triple.O})
+	}
+	if _, err := txn.CopyFrom(ctx, pgx.Identifier{"triples"}, []string{"source", "origin", "time", "s", "p", "o"}, pgx.CopyFromRows(rows)); err != nil {
+		return err
+	}
+	_, err := txn.Exec(ctx, `INSERT INTO triple_versions(source, origin, time) VALUES($1, $2, $3) ON CONFLICT DO NOTHING`, source, origin, t)
+	return err
+}
@@ -0,0 +1,312 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ErrViewNotFound is returned when a view is not registered
+var ErrViewNotFound = errors.New("View not found")
+
+// ErrInvalidView is returned when a view definition is rejected
+var ErrInvalidView = errors.New("Invalid view")
+
+// placeholders of the parameters of a view in its SPARQL query, e.g. {{class}}
+var viewParameter = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// URL parameters of /query, which cannot name the parameters of a view
+var reservedViewParameters = map[string]bool{
+	"view": true, "sparql": true, "id": true, "uri": true, "start": true, "end": true,
+	"agg": true, "window": true, "range": true, "tz": true, "occupied": true, "sites": true, "site": true, "as_of": true,
+	"quality": true, "flags": true,
+}
+
+// View is a saved query. Its SPARQL query may contain {{parameter}} placeholders, which are filled from
+// the URL parameters of the same name when the view is executed (or from the defaults in Parameters).
+// The URL parameters of /query override the sites, time range and aggregation of the view
+type View struct {
+	Name        string
+	Description string
+	Sparql      string
+	// default values of the parameters of the query
+	Parameters map[string]string
+	// sites the query runs against; defaults to every site
+	Sites []string
+	// time range of the query, if it is not given a start: relative to its end (e.g. "-7d") or named (e.g. "last_month")
+	Range string
+	// optional aggregation of the data (e.g. "mean" and "15m")
+	AggregationFunc   string
+	AggregationWindow string
+	// time of the last registration of the view
+	Updated time.Time
+}
+
+// commonViews are registered when the server starts, unless a view with the same name already exists
+var commonViews = []View{
+	{
+		Name:        "points",
+		Description: "Points of a Brick class (brick:Point by default) over the last day",
+		Sparql: `PREFIX brick: <https://brickschema.org/schema/Brick#>
+PREFIX rdfs: <http://www.w3.org/2000/01/rdf-schema#>
+SELECT ?timeseries WHERE { ?timeseries a/rdfs:subClassOf* {{class}} }`,
+		Parameters: map[string]string{"class": "brick:Point"},
+		Range:      "-1d",
+	},
+	{
+		Name:        "zone_air_temperature",
+		Description: "Zone air temperature sensors and their equipment, 15 minute means over the last week",
+		Sparql: `PREFIX brick: <https://brickschema.org/schema/Brick#>
+PREFIX rdfs: <http://www.w3.org/2000/01/rdf-schema#>
+SELECT ?timeseries ?equip WHERE {
+    ?timeseries a/rdfs:subClassOf* brick:Zone_Air_Temperature_Sensor .
+    OPTIONAL { ?timeseries brick:isPointOf ?equip }
+}`,
+		Range:             "-7d",
+		AggregationFunc:   "mean",
+		AggregationWindow: "15m",
+	},
+	{
+		Name:        "building_power",
+		Description: "Electrical power of the building meters, hourly means over the last 30 days",
+		Sparql: `PREFIX brick: <https://brickschema.org/schema/Brick#>
+PREFIX rdfs: <http://www.w3.org/2000/01/rdf-schema#>
+SELECT ?timeseries ?meter WHERE {
+    ?meter a/rdfs:subClassOf* brick:Building_Electrical_Meter .
+    ?timeseries brick:isPointOf ?meter .
+    ?timeseries a/rdfs:subClassOf* brick:Electrical_Power_Sensor .
+}`,
+		Range:             "-30d",
+		AggregationFunc:   "mean",
+		AggregationWindow: "1h",
+	},
+}
+
+// check validates the definition of the view
+func (view *View) check() error {
+	if len(view.Name) == 0 {
+		return errors.New("View lacks a Name")
+	}
+	if len(view.Sparql) == 0 {
+		return errors.New("View lacks a Sparql query")
+	}
+	for _, match := range viewParameter.FindAllStringSubmatch(view.Sparql, -1) {
+		if reservedViewParameters[match[1]] {
+			return fmt.Errorf("Parameter name %s is reserved", match[1])
+		}
+	}
+	for name := range view.Parameters {
+		if reservedViewParameters[name] {
+			return fmt.Errorf("Parameter name %s is reserved", name)
+		}
+	}
+	if len(view.Range) > 0 {
+		now := time.Now()
+		if _, _, err := ParseTimeRange(view.Range, now, now); err != nil {
+			return err
+		}
+	}
+	if len(view.AggregationFunc) > 0 {
+		if _, err := ParseAggregationType(view.AggregationFunc); err != nil {
+			return err
+		}
+		if len(view.AggregationWindow) == 0 {
+			return errors.New("View has an AggregationFunc but no AggregationWindow")
+		}
+	}
+	if len(view.AggregationWindow) > 0 {
+		if _, err := ParseWindow(view.AggregationWindow); err != nil {
+			return fmt.Errorf("Invalid AggregationWindow %s: %w", view.AggregationWindow, err)
+		}
+	}
+	return nil
+}
+
+// render fills the placeholders of the SPARQL query of the view. Values cannot contain braces or line
+// breaks, so that they cannot add graph patterns to the query
+func (view *View) render(vals url.Values) (string, error) {
+	var err error
+	sparql := viewParameter.ReplaceAllStringFunc(view.Sparql, func(placeholder string) string {
+		name := viewParameter.FindStringSubmatch(placeholder)[1]
+		value, ok := view.Parameters[name]
+		if v := vals.Get(name); len(v) > 0 {
+			value, ok = v, true
+		}
+		switch {
+		case err != nil:
+		case !ok:
+			err = fmt.Errorf("View %s needs parameter %s", view.Name, name)
+		case strings.ContainsAny(value, "{}\r\n"):
+			err = fmt.Errorf("Invalid value for parameter %s: %s", name, value)
+		}
+		return value
+	})
+	return sparql, err
+}
+
+// params returns the URL parameters of /query that run the view: 'site' or 'sites' replace the sites of
+// the view, and 'start', 'end', 'range', 'agg' and 'window' override its time range and aggregation
+func (view *View) params(vals url.Values) (url.Values, error) {
+	sparql, err := view.render(vals)
+	if err != nil {
+		return nil, err
+	}
+	params := make(url.Values)
+	for key, values := range vals {
+		params[key] = values
+	}
+	params.Set("sparql", url.PathEscape(sparql))
+	if _, ok := params["sites"]; !ok {
+		if sites, ok := params["site"]; ok {
+			params["sites"] = sites
+		} else {
+			params["sites"] = view.Sites
+		}
+	}
+	if len(params.Get("agg")) == 0 && len(view.AggregationFunc) > 0 {
+		params.Set("agg", view.AggregationFunc)
+	}
+	if len(params.Get("window")) == 0 && len(view.AggregationWindow) > 0 {
+		params.Set("window", view.AggregationWindow)
+	}
+	if len(params.Get("start")) == 0 && len(params.Get("range")) == 0 && len(view.Range) > 0 {
+		params.Set("range", view.Range)
+	}
+	return params, nil
+}
+
+// PutView registers the view, replacing any view with the same name. Only the key that registered a view (or the
+// admin key) can replace it; the common views can only be replaced with the admin key
+func (db *TimescaleDatabase) PutView(ctx context.Context, view *View) error {
+	if err := view.check(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidView, err)
+	}
+	apikey, err := db.validApikey(ctx)
+	if err != nil {
+		return err
+	}
+	view.Updated = time.Now()
+	definition, err := json.Marshal(view)
+	if err != nil {
+		return fmt.Errorf("Could not serialize view: %w", err)
+	}
+	return db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		var owner string
+		row := txn.QueryRow(ctx, `SELECT apikey FROM views WHERE name = $1 FOR UPDATE`, view.Name)
+		if err := row.Scan(&owner); err == nil {
+			if authorized, err := db.checkOwnerAuth(ctx, owner); err != nil {
+				return fmt.Errorf("Cannot determine authorized status: %w", err)
+			} else if !authorized {
+				return fmt.Errorf("Cannot replace view %s registered with another key", view.Name)
+			}
+		} else if !errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("Could not read view %s: %w", view.Name, err)
+		}
+		if _, err := txn.Exec(ctx, `INSERT INTO views(name, definition, updated_at, apikey) VALUES($1, $2, $3, $4)
+									ON CONFLICT (name) DO UPDATE SET definition = EXCLUDED.definition, updated_at = EXCLUDED.updated_at`,
+			view.Name, definition, view.Updated, apikey); err != nil {
+			return fmt.Errorf("Could not store view %s: %w", view.Name, err)
+		}
+		if _, err := txn.Exec(ctx, `DELETE FROM removed_views WHERE name = $1`, view.Name); err != nil {
+			return fmt.Errorf("Could not store view %s: %w", view.Name, err)
+		}
+		return nil
+	})
+}
+
+// preloadViews registers the common views that are not registered yet, and were not removed
+func (db *TimescaleDatabase) preloadViews(ctx context.Context) error {
+	for _, view := range commonViews {
+		view.Updated = time.Now()
+		definition, err := json.Marshal(view)
+		if err != nil {
+			return fmt.Errorf("Could not serialize view: %w", err)
+		}
+		if _, err := db.pool.Exec(ctx, `INSERT INTO views(name, definition, updated_at, apikey)
+										SELECT $1, $2, $3, '' WHERE NOT EXISTS (SELECT 1 FROM removed_views WHERE name = $1)
+										ON CONFLICT (name) DO NOTHING`, view.Name, definition, view.Updated); err != nil {
+			return fmt.Errorf("Could not store view %s: %w", view.Name, err)
+		}
+	}
+	return nil
+}
+
+// Views lists the registered views, ordered by name
+func (db *TimescaleDatabase) Views(ctx context.Context) ([]View, error) {
+	rows, err := db.pool.Query(ctx, `SELECT definition FROM views ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("Could not list views: %w", err)
+	}
+	defer rows.Close()
+	var views []View
+	for rows.Next() {
+		var (
+			definition []byte
+			view       View
+		)
+		if err := rows.Scan(&definition); err != nil {
+			return nil, fmt.Errorf("Could not scan row: %w", err)
+		}
+		if err := json.Unmarshal(definition, &view); err != nil {
+			return nil, fmt.Errorf("Could not read view: %w", err)
+		}
+		views = append(views, view)
+	}
+	return views, rows.Err()
+}
+
+// GetView returns the registered view with the given name
+func (db *TimescaleDatabase) GetView(ctx context.Context, name string) (*View, error) {
+	var (
+		definition []byte
+		view       View
+	)
+	row := db.pool.QueryRow(ctx, `SELECT definition FROM views WHERE name = $1`, name)
+	if err := row.Scan(&definition); errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrViewNotFound, name)
+	} else if err != nil {
+		return nil, fmt.Errorf("Could not read view %s: %w", name, err)
+	}
+	if err := json.Unmarshal(definition, &view); err != nil {
+		return nil, fmt.Errorf("Could not read view %s: %w", name, err)
+	}
+	return &view, nil
+}
+
+// DeleteView removes the view. Only the key that registered a view (or the admin key) can remove it; removed
+// common views are not registered again when the server starts
+func (db *TimescaleDatabase) DeleteView(ctx context.Context, name string) error {
+	return db.RunAsTransaction(ctx, func(txn pgx.Tx) error {
+		var owner string
+		row := txn.QueryRow(ctx, `SELECT apikey FROM views WHERE name = $1 FOR UPDATE`, name)
+		if err := row.Scan(&owner); errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("%w: %s", ErrViewNotFound, name)
+		} else if err != nil {
+			return fmt.Errorf("Could not read view %s: %w", name, err)
+		}
+		if authorized, err := db.checkOwnerAuth(ctx, owner); err != nil {
+			return fmt.Errorf("Cannot determine authorized status: %w", err)
+		} else if !authorized {
+			return fmt.Errorf("Cannot delete view %s registered with another key", name)
+		}
+		if _, err := txn.Exec(ctx, `DELETE FROM views WHERE name = $1`, name); err != nil {
+			return fmt.Errorf("Could not delete view %s: %w", name, err)
+		}
+		for _, view := range commonViews {
+			if view.Name != name {
+				continue
+			}
+			if _, err := txn.Exec(ctx, `INSERT INTO removed_views(name) VALUES($1) ON CONFLICT DO NOTHING`, name); err != nil {
+				return fmt.Errorf("Could not delete view %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
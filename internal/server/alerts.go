@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/database"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// serveAlerts lists (GET), registers (PUT or POST) and removes (DELETE) alerts
+func (srv *Server) serveAlerts(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	defer r.Body.Close()
+
+	name := r.URL.Query().Get("name")
+	switch r.Method {
+	case http.MethodGet:
+		var (
+			response interface{}
+			err      error
+		)
+		if len(name) > 0 {
+			response, err = srv.db.GetAlert(ctx, name)
+		} else {
+			response, err = srv.db.Alerts(ctx)
+		}
+		if err != nil {
+			rerr := fmt.Errorf("Could not read alerts: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), alertErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Errorf("Could not serialize alerts: %s", err)
+		}
+	case http.MethodPut, http.MethodPost:
+		var alert database.Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			rerr := fmt.Errorf("Could not parse alert: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := srv.db.PutAlert(ctx, &alert); err != nil {
+			rerr := fmt.Errorf("Could not register alert: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), alertErrorStatus(err))
+			return
+		}
+		log.Infof("Registered alert %s", alert.Name)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if len(name) == 0 {
+			http.Error(w, "Params lacks 'name'", http.StatusBadRequest)
+			return
+		}
+		if err := srv.db.DeleteAlert(ctx, name); err != nil {
+			rerr := fmt.Errorf("Could not delete alert: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), alertErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Alert requests must use GET, PUT, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// alertStatus returns the streams for which alerts are pending or firing (name= restricts the states to one
+// alert; all=true includes the streams that are ok)
+func (srv *Server) alertStatus(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	defer r.Body.Close()
+
+	all := false
+	if _all := r.URL.Query().Get("all"); len(_all) > 0 {
+		var err error
+		if all, err = strconv.ParseBool(_all); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid all %s: %s", _all, err), http.StatusBadRequest)
+			return
+		}
+	}
+	states, err := srv.db.AlertStates(ctx, r.URL.Query().Get("name"), all)
+	if err != nil {
+		rerr := fmt.Errorf("Could not read state of alerts: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), alertErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(states); err != nil {
+		log.Errorf("Could not serialize state of alerts: %s", err)
+	}
+}
+
+// alertHistory returns the changes of state of the alerts between start= and end= (the last day by default)
+func (srv *Server) alertHistory(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	defer r.Body.Close()
+
+	var req database.AlertHistoryRequest
+	if err := req.FromURLParams(r.URL.Query()); err != nil {
+		rerr := fmt.Errorf("Could not parse history request: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusBadRequest)
+		return
+	}
+	events, err := srv.db.AlertHistory(ctx, &req)
+	if err != nil {
+		rerr := fmt.Errorf("Could not read history of alerts: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), alertErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		log.Errorf("Could not serialize history of alerts: %s", err)
+	}
+}
+
+// serveSilences lists (GET), adds (POST) and removes (DELETE with id=) silences
+func (srv *Server) serveSilences(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	defer r.Body.Close()
+
+	switch r.Method {
+	case http.MethodGet:
+		silences, err := srv.db.Silences(ctx)
+		if err != nil {
+			rerr := fmt.Errorf("Could not read silences: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), alertErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(silences); err != nil {
+			log.Errorf("Could not serialize silences: %s", err)
+		}
+	case http.MethodPost:
+		var silence database.Silence
+		if err := json.NewDecoder(r.Body).Decode(&silence); err != nil {
+			rerr := fmt.Errorf("Could not parse silence: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := srv.db.AddSilence(ctx, &silence); err != nil {
+			rerr := fmt.Errorf("Could not add silence: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), alertErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(silence); err != nil {
+			log.Errorf("Could not serialize silence: %s", err)
+		}
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "Params lacks a valid 'id'", http.StatusBadRequest)
+			return
+		}
+		if err := srv.db.DeleteSilence(ctx, id); err != nil {
+			rerr := fmt.Errorf("Could not delete silence: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), alertErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Silence requests must use GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+func alertErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrAlertNotFound), errors.Is(err, database.ErrSilenceNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrInvalidAlert):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/database"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// serveApplications lists (GET), registers (PUT or POST) and removes (DELETE) applications
+func (srv *Server) serveApplications(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	defer r.Body.Close()
+
+	name := r.URL.Query().Get("name")
+	switch r.Method {
+	case http.MethodGet:
+		var (
+			response interface{}
+			err      error
+		)
+		if len(name) > 0 {
+			response, err = srv.db.GetApplication(ctx, name)
+		} else {
+			response, err = srv.db.Applications(ctx)
+		}
+		if err != nil {
+			rerr := fmt.Errorf("Could not read applications: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), applicationErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Errorf("Could not serialize applications: %s", err)
+		}
+	case http.MethodPut, http.MethodPost:
+		var app database.Application
+		if err := json.NewDecoder(r.Body).Decode(&app); err != nil {
+			rerr := fmt.Errorf("Could not parse application: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := srv.db.PutApplication(ctx, &app); err != nil {
+			rerr := fmt.Errorf("Could not register application: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), applicationErrorStatus(err))
+			return
+		}
+		log.Infof("Registered application %s", app.Name)
+		// qualify the sites in the background, so the qualification is cached by the time it is requested
+		go func() {
+			ctx, cancel := context.WithTimeout(srv.ctx, config.DataReadTimeout)
+			defer cancel()
+			if _, err := srv.db.ApplicationSites(ctx, &database.ApplicationSitesRequest{Name: app.Name}); err != nil {
+				log.Errorf("Could not qualify sites for application %s: %s", app.Name, err)
+			}
+		}()
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if len(name) == 0 {
+			http.Error(w, "Params lacks 'name'", http.StatusBadRequest)
+			return
+		}
+		if err := srv.db.DeleteApplication(ctx, name); err != nil {
+			rerr := fmt.Errorf("Could not delete application: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), applicationErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Application requests must use GET, PUT, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// applicationSites returns the qualification of the sites for an application
+func (srv *Server) applicationSites(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), config.DataReadTimeout)
+	defer cancel()
+	defer r.Body.Close()
+
+	var req database.ApplicationSitesRequest
+	if err := req.FromURLParams(r.URL.Query()); err != nil {
+		rerr := fmt.Errorf("Could not read application sites from params: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusBadRequest)
+		return
+	}
+	sites, err := srv.db.ApplicationSites(ctx, &req)
+	if err != nil {
+		rerr := fmt.Errorf("Could not qualify sites: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), applicationErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sites); err != nil {
+		log.Errorf("Could not serialize application sites: %s", err)
+	}
+}
+
+// readApplicationData returns the data of an application on a site, in the same format as /query
+func (srv *Server) readApplicationData(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), config.DataReadTimeout)
+	defer cancel()
+	defer r.Body.Close()
+
+	var req database.ApplicationDataRequest
+	if err := req.FromURLParams(r.URL.Query()); err != nil {
+		rerr := fmt.Errorf("Could not read application data from params: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := srv.db.ReadApplicationData(ctx, w, &req); err != nil {
+		rerr := fmt.Errorf("Could not read application data: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), applicationErrorStatus(err))
+	}
+}
+
+func applicationErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrApplicationNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrNotQualified):
+		return http.StatusConflict
+	case errors.Is(err, database.ErrInvalidApplication), errors.Is(err, database.ErrInvalidQuery):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/database"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// insertBackfill backfills the readings of a JSON dataset (like /insert/data) or, if the body is text/csv, of a CSV
+// file (like /insert/csv) into compressed chunks
+func (srv *Server) insertBackfill(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Backfills must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	opts, err := insertOptions(r)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the body is kept, to be buffered if the database is unavailable
+	body, spool := srv.keepBody(r)
+	defer spool.close()
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "text/csv" {
+		var ds = database.NewArrayDataset()
+		if err := json.NewDecoder(body).Decode(ds); err != nil {
+			log.Errorf("Could not parse dataset %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		buffered := bufferedInsertion{Kind: bufferedData, Source: ds.GetSource(), Options: *opts, Backfill: true}
+		srv.backfill(r.Context(), w, r, ds, *opts, nil, func(err error) bool {
+			return srv.bufferInsertion(w, r, buffered, spool.body(r.Body), err)
+		})
+		return
+	}
+
+	var stream database.Stream
+	if err := stream.FromURLParams(r.URL.Query()); err != nil {
+		rerr := fmt.Errorf("Could not read source from params: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), config.BackfillTimeout)
+	defer cancel()
+	buffered := bufferedInsertion{Kind: bufferedCSV, Source: stream.SourceName, Stream: stream, Options: *opts, Backfill: true}
+	if err := srv.db.RegisterStream(ctx, stream); err != nil {
+		if srv.bufferInsertion(w, r, buffered, spool.body(r.Body), err) {
+			return
+		}
+		log.Errorf("Could not register stream %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// registering the stream needs the write permission on the source
+	srv.authorizedInsertion(r, stream.SourceName)
+
+	readings := make(chan database.Reading)
+	ds := database.NewStreamingDataset(stream.SourceName, stream.Name, readings)
+	errc := srv.readCSVReadings(ctx, cancel, body, readings)
+
+	srv.backfill(ctx, w, r, ds, *opts, errc, func(err error) bool {
+		// the file is read again from the start once the reader stopped
+		cancel()
+		<-errc
+		return srv.bufferInsertion(w, r, buffered, spool.body(r.Body), err)
+	})
+}
+
+// backfill backfills the readings of the dataset and writes the report. With Accept: application/x-ndjson, the
+// report is streamed after each chunk, one line per chunk, and the last line is the final report (or an object with
+// the Error). errc (if not nil) reports the outcome of reading the readings of the dataset. buffer (if not nil)
+// buffers the backfill if it fails before it wrote any reading, and returns true if it did: a buffered backfill is
+// replayed from the start, which fails on the readings already written with on_conflict=error. Backfills are bounded
+// by config.BackfillTimeout rather than the timeout of an insertion
+func (srv *Server) backfill(ctx context.Context, w http.ResponseWriter, r *http.Request, ds database.Dataset, opts database.InsertOptions,
+	errc <-chan error, buffer func(error) bool) {
+	log := logging.FromContext(srv.ctx)
+
+	var (
+		enc      = json.NewEncoder(w)
+		progress func(*database.BackfillReport)
+		sent     bool
+	)
+	if negotiateContentType(r.Header.Get("Accept"), []string{"application/json", mediaTypeNDJSON}) == mediaTypeNDJSON {
+		w.Header().Set("Content-Type", mediaTypeNDJSON)
+		flusher, _ := w.(http.Flusher)
+		progress = func(report *database.BackfillReport) {
+			sent = true
+			if err := enc.Encode(report); err != nil {
+				log.Errorf("Could not serialize backfill progress: %s", err)
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+
+	report, err := srv.db.BackfillData(ctx, ds, opts, progress)
+	if err != nil && report == nil && !sent && buffer != nil && buffer(err) {
+		return
+	} else if err == nil && errc != nil {
+		err = <-errc
+	} else if err != nil && report != nil {
+		err = fmt.Errorf("Backfill failed after writing %d readings: %w", report.Moved, err)
+	}
+	if err != nil {
+		log.Errorf("Could not backfill data %s", err)
+		if !sent {
+			http.Error(w, err.Error(), insertErrorStatus(err))
+			return
+		}
+		// the status has already been sent, so the error is reported as the last line
+		if err := enc.Encode(map[string]string{"Error": err.Error()}); err != nil {
+			log.Errorf("Could not serialize backfill error: %s", err)
+		}
+		return
+	}
+	srv.authorizedInsertion(r, ds.GetSource())
+	if progress == nil {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if err := enc.Encode(report); err != nil {
+		log.Errorf("Could not serialize backfill report: %s", err)
+	}
+}
+
+// readingsSpan returns the times of the first and last readings; ok is false if there are none
+func readingsSpan(readings []database.Reading) (start, end time.Time, ok bool) {
+	for idx, rdg := range readings {
+		if idx == 0 || rdg.Time.Before(start) {
+			start = rdg.Time
+		}
+		if idx == 0 || rdg.Time.After(end) {
+			end = rdg.Time
+		}
+	}
+	return start, end, len(readings) > 0
+}
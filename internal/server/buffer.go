@@ -0,0 +1,527 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/database"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// errBufferFull is returned when an insertion does not fit in the write buffer
+var errBufferFull = errors.New("Write buffer is full")
+
+// kinds of buffered insertions
+const (
+	// the JSON dataset of /insert/data
+	bufferedData = "data"
+	// the CSV file of /insert/csv
+	bufferedCSV = "csv"
+)
+
+// buffered insertions are files named after the time they were buffered, so that they are written in order.
+// Insertions that cannot be written are moved to the 'failed' directory of the buffer
+const (
+	bufferedSuffix = ".insert"
+	failedDir      = "failed"
+)
+
+// bufferedInsertion is the header of a buffered insertion, which is followed by the body of its request
+type bufferedInsertion struct {
+	Kind string
+	// the source the insertion writes to
+	Source string
+	// the stream of a CSV file, which is registered before the readings are inserted
+	Stream  database.Stream
+	Options database.InsertOptions
+	// the readings are backfilled, as with /insert/backfill
+	Backfill bool
+	// the insertion is written with the key of the user that sent it
+	Apikey     string
+	BufferedAt time.Time
+}
+
+// bufferStatus reports the backlog of the write buffer
+type bufferStatus struct {
+	Enabled bool
+	// insertions waiting for the database, and their size on disk
+	Insertions int64
+	Bytes      int64
+	MaxBytes   int64
+	// when the oldest waiting insertion was buffered
+	Oldest *time.Time
+	// insertions written since the server started
+	Written int64
+	// insertions that could not be written once the database was reachable
+	Failed int64
+	// the error of the last attempt to write the insertions
+	LastError   string
+	LastErrorAt *time.Time
+}
+
+// writeBuffer holds the insertions received while the database is unavailable on disk, until they are written
+type writeBuffer struct {
+	dir      string
+	maxBytes int64
+	wake     chan struct{}
+
+	lock   sync.Mutex
+	seq    int64
+	status bufferStatus
+	// when each key was last authorized to write to each source, by key and source
+	authorized map[[2]string]time.Time
+}
+
+// newWriteBuffer opens the write buffer in the directory of the config, with the insertions it already holds
+func newWriteBuffer(cfg config.Buffer) (*writeBuffer, error) {
+	buf := &writeBuffer{
+		dir:      cfg.Dir,
+		maxBytes: cfg.MaxBytes,
+		wake:     make(chan struct{}, 1),
+
+		authorized: make(map[[2]string]time.Time),
+	}
+	if buf.maxBytes <= 0 {
+		buf.maxBytes = config.DefaultBufferMaxBytes
+	}
+	if err := os.MkdirAll(filepath.Join(buf.dir, failedDir), 0700); err != nil {
+		return nil, fmt.Errorf("Could not create write buffer: %w", err)
+	}
+	files, err := ioutil.ReadDir(buf.dir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read write buffer: %w", err)
+	}
+	for _, file := range files {
+		switch {
+		case strings.HasSuffix(file.Name(), ".tmp"):
+			// an insertion that was not acknowledged
+			os.Remove(filepath.Join(buf.dir, file.Name()))
+		case strings.HasSuffix(file.Name(), bufferedSuffix):
+			buf.status.Insertions++
+			buf.status.Bytes += file.Size()
+		}
+	}
+	failed, err := ioutil.ReadDir(filepath.Join(buf.dir, failedDir))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read write buffer: %w", err)
+	}
+	buf.status.Failed = int64(len(failed))
+	if names, err := buf.names(); err == nil && len(names) > 0 {
+		buf.status.Oldest = bufferedAt(names[0])
+	}
+	return buf, nil
+}
+
+// names returns the names of the buffered insertions, oldest first
+func (buf *writeBuffer) names() ([]string, error) {
+	files, err := ioutil.ReadDir(buf.dir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read write buffer: %w", err)
+	}
+	var names []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), bufferedSuffix) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// bufferedAt returns the time the insertion with the name was buffered
+func bufferedAt(name string) *time.Time {
+	nanos, err := strconv.ParseInt(strings.SplitN(name, "-", 2)[0], 10, 64)
+	if err != nil {
+		return nil
+	}
+	t := time.Unix(0, nanos)
+	return &t
+}
+
+// add writes the insertion to the buffer. The insertion is on disk once add returns
+func (buf *writeBuffer) add(header bufferedInsertion, body io.Reader) error {
+	buf.lock.Lock()
+	buf.seq++
+	name := fmt.Sprintf("%019d-%06d%s", header.BufferedAt.UnixNano(), buf.seq%1000000, bufferedSuffix)
+	available := buf.maxBytes - buf.status.Bytes
+	buf.lock.Unlock()
+
+	path := filepath.Join(buf.dir, name)
+	size, err := spoolInsertion(path+".tmp", header, body, available)
+	if err != nil {
+		return err
+	}
+
+	buf.lock.Lock()
+	defer buf.lock.Unlock()
+	// concurrent insertions may have filled the buffer
+	if buf.status.Bytes+size > buf.maxBytes {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("%w: %d of %d bytes used", errBufferFull, buf.status.Bytes, buf.maxBytes)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("Could not buffer insertion: %w", err)
+	}
+	if err := syncDir(buf.dir); err != nil {
+		return fmt.Errorf("Could not buffer insertion: %w", err)
+	}
+	buf.status.Insertions++
+	buf.status.Bytes += size
+	if buf.status.Oldest == nil {
+		buf.status.Oldest = &header.BufferedAt
+	}
+	select {
+	case buf.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// spoolInsertion writes the header and the body of the insertion to the path, and syncs it to disk. Fails with
+// errBufferFull if it takes more than the available bytes
+func spoolInsertion(path string, header bufferedInsertion, body io.Reader, available int64) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("Could not buffer insertion: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	err = json.NewEncoder(w).Encode(header)
+	if err == nil {
+		_, err = io.Copy(w, io.LimitReader(body, available))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	var size int64
+	if err == nil {
+		size, err = f.Seek(0, io.SeekCurrent)
+	}
+	if err == nil && size >= available {
+		err = fmt.Errorf("%w: the insertion takes more than the %d available bytes", errBufferFull, available)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		if !errors.Is(err, errBufferFull) {
+			err = fmt.Errorf("Could not buffer insertion: %w", err)
+		}
+		return 0, err
+	}
+	return size, nil
+}
+
+// syncDir syncs the directory, so that the files renamed into it are on disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// remove removes the written (or failed) insertion from the buffer
+func (buf *writeBuffer) remove(name string, failed bool) error {
+	path := filepath.Join(buf.dir, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if failed {
+		err = os.Rename(path, filepath.Join(buf.dir, failedDir, name))
+	} else {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	buf.lock.Lock()
+	defer buf.lock.Unlock()
+	buf.status.Insertions--
+	buf.status.Bytes -= info.Size()
+	if failed {
+		buf.status.Failed++
+	} else {
+		buf.status.Written++
+	}
+	buf.status.Oldest = nil
+	if names, err := buf.names(); err == nil && len(names) > 0 {
+		buf.status.Oldest = bufferedAt(names[0])
+	}
+	return nil
+}
+
+// authorize remembers that the key was authorized to write to the source, so that insertions into the source with
+// the key are buffered for config.BufferAuthorizationRetention
+func (buf *writeBuffer) authorize(apikey, source string) {
+	buf.lock.Lock()
+	defer buf.lock.Unlock()
+	now := time.Now()
+	if _, ok := buf.authorized[[2]string{apikey, source}]; !ok {
+		for pair, at := range buf.authorized {
+			if now.Sub(at) > config.BufferAuthorizationRetention {
+				delete(buf.authorized, pair)
+			}
+		}
+	}
+	buf.authorized[[2]string{apikey, source}] = now
+}
+
+// isAuthorized returns true if the key was recently authorized to write to the source
+func (buf *writeBuffer) isAuthorized(apikey, source string) bool {
+	buf.lock.Lock()
+	defer buf.lock.Unlock()
+	at, ok := buf.authorized[[2]string{apikey, source}]
+	return ok && time.Since(at) <= config.BufferAuthorizationRetention
+}
+
+// authorizedInsertion remembers that the key of the request was authorized to write to the source (see
+// writeBuffer.authorize)
+func (srv *Server) authorizedInsertion(r *http.Request, source string) {
+	if srv.buffer == nil {
+		return
+	}
+	apikey, _ := r.Context().Value(database.ContextKey("user")).(string)
+	srv.buffer.authorize(apikey, source)
+}
+
+func (buf *writeBuffer) failed(err error) {
+	buf.lock.Lock()
+	defer buf.lock.Unlock()
+	now := time.Now()
+	buf.status.LastError, buf.status.LastErrorAt = err.Error(), &now
+}
+
+// bodySpool keeps the part of the body of a request that was read, so that the request can be buffered if its
+// insertion fails after it started reading the body. It stops keeping the body (and the request cannot be buffered)
+// once the body does not fit in the buffer
+type bodySpool struct {
+	f        *os.File
+	size     int64
+	max      int64
+	overflow bool
+}
+
+// spoolBody starts keeping the body of a request, in a temporary file of the buffer
+func (buf *writeBuffer) spoolBody() (*bodySpool, error) {
+	f, err := ioutil.TempFile(buf.dir, "body-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("Could not spool body: %w", err)
+	}
+	return &bodySpool{f: f, max: buf.maxBytes}, nil
+}
+
+// Write keeps the bytes that were read; it never fails, so that the insertion is not affected by the spool
+func (spool *bodySpool) Write(p []byte) (int, error) {
+	if spool.overflow {
+		return len(p), nil
+	}
+	if spool.size+int64(len(p)) > spool.max {
+		spool.overflow = true
+		return len(p), nil
+	}
+	n, err := spool.f.Write(p)
+	spool.size += int64(n)
+	if err != nil {
+		spool.overflow = true
+	}
+	return len(p), nil
+}
+
+// keepBody tees the body of the request into a spool of the write buffer (if it is enabled), so that the request
+// can be buffered if its insertion fails after the body was read. Returns the body to read, and the spool
+func (srv *Server) keepBody(r *http.Request) (io.Reader, *bodySpool) {
+	if srv.buffer == nil {
+		return r.Body, nil
+	}
+	spool, err := srv.buffer.spoolBody()
+	if err != nil {
+		logging.FromContext(srv.ctx).Warnf("Insertion cannot be buffered: %s", err)
+		return r.Body, nil
+	}
+	return io.TeeReader(r.Body, spool), spool
+}
+
+// body returns the whole body: the part that was read, followed by the rest of the request. Returns nil if the
+// body was not kept
+func (spool *bodySpool) body(rest io.Reader) io.Reader {
+	if spool == nil || spool.overflow {
+		return nil
+	}
+	if _, err := spool.f.Seek(0, io.SeekStart); err != nil {
+		return nil
+	}
+	return io.MultiReader(spool.f, rest)
+}
+
+func (spool *bodySpool) close() {
+	if spool == nil {
+		return
+	}
+	spool.f.Close()
+	os.Remove(spool.f.Name())
+}
+
+// bufferInsertion buffers the insertion of the request, which failed with the error, if the database is unavailable,
+// and acknowledges it. Returns false if the insertion was not handled: the buffer is disabled, the body was not
+// kept, the key of the request was not recently authorized to write to the source of the insertion (which cannot be
+// checked without the database), or the insertion failed for another reason than the database being unreachable
+func (srv *Server) bufferInsertion(w http.ResponseWriter, r *http.Request, header bufferedInsertion, body io.Reader, err error) bool {
+	log := logging.FromContext(srv.ctx)
+	if srv.buffer == nil || body == nil {
+		return false
+	}
+	if !database.Unavailable(err) && srv.db.Ping(r.Context()) == nil {
+		return false
+	}
+	header.Apikey, _ = r.Context().Value(database.ContextKey("user")).(string)
+	if !srv.buffer.isAuthorized(header.Apikey, header.Source) {
+		log.Warnf("Database unavailable (%s); not buffering %s insertion into %s with a key that was not recently authorized", err, header.Kind, header.Source)
+		return false
+	}
+
+	header.BufferedAt = time.Now()
+	if err := srv.buffer.add(header, body); err != nil {
+		rerr := fmt.Errorf("Database unavailable, and could not buffer insertion: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	log.Warnf("Database unavailable (%s); buffered %s insertion", err, header.Kind)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(map[string]bool{"Buffered": true}); err != nil {
+		log.Errorf("Could not serialize buffered insertion: %s", err)
+	}
+	return true
+}
+
+// drainBuffer writes the buffered insertions, oldest first, until the context is cancelled. The insertions are
+// written once they are buffered and every config.BufferRetryInterval, until the database is unavailable again.
+// An insertion that cannot be written while the database is reachable is moved to the 'failed' directory
+func (srv *Server) drainBuffer(ctx context.Context) {
+	log := logging.FromContext(ctx)
+	retry := time.NewTicker(config.BufferRetryInterval)
+	defer retry.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-srv.buffer.wake:
+		case <-retry.C:
+		}
+		names, err := srv.buffer.names()
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		for _, name := range names {
+			err := srv.writeBuffered(ctx, name)
+			if err != nil && (database.Unavailable(err) || srv.db.Ping(ctx) != nil) {
+				srv.buffer.failed(err)
+				break
+			}
+			if err != nil {
+				log.Errorf("Could not write buffered insertion %s: %s", name, err)
+				srv.buffer.failed(err)
+			}
+			if err := srv.buffer.remove(name, err != nil); err != nil {
+				log.Errorf("Could not remove buffered insertion %s: %s", name, err)
+				break
+			}
+		}
+	}
+}
+
+// writeBuffered writes the buffered insertion like the request that was buffered
+func (srv *Server) writeBuffered(ctx context.Context, name string) error {
+	f, err := os.Open(filepath.Join(srv.buffer.dir, name))
+	if err != nil {
+		return fmt.Errorf("Could not read buffered insertion: %w", err)
+	}
+	defer f.Close()
+	body := bufio.NewReader(f)
+	line, err := body.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("Could not read buffered insertion: %w", err)
+	}
+	var header bufferedInsertion
+	if err := json.Unmarshal(line, &header); err != nil {
+		return fmt.Errorf("Could not read buffered insertion: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, database.ContextKey("user"), header.Apikey))
+	defer cancel()
+	switch header.Kind {
+	case bufferedData:
+		var ds = database.NewArrayDataset()
+		if err := json.NewDecoder(body).Decode(ds); err != nil {
+			return fmt.Errorf("Could not parse dataset: %w", err)
+		}
+		if header.Backfill {
+			_, err = srv.db.BackfillData(ctx, ds, header.Options, nil)
+		} else {
+			_, err = srv.db.InsertHistoricalData(ctx, ds, header.Options)
+		}
+		return err
+	case bufferedCSV:
+		if err := srv.db.RegisterStream(ctx, header.Stream); err != nil {
+			return fmt.Errorf("Could not register stream: %w", err)
+		}
+		readings := make(chan database.Reading)
+		ds := database.NewStreamingDataset(header.Stream.SourceName, header.Stream.Name, readings)
+		errc := srv.readCSVReadings(ctx, cancel, body, readings)
+		if header.Backfill {
+			if _, err := srv.db.BackfillData(ctx, ds, header.Options, nil); err != nil {
+				return err
+			}
+			return <-errc
+		}
+		report, err := srv.db.InsertHistoricalData(ctx, ds, header.Options)
+		if err != nil {
+			return err
+		} else if report.Replayed {
+			return nil
+		}
+		return <-errc
+	}
+	return fmt.Errorf("Unknown kind of buffered insertion %s", header.Kind)
+}
+
+// bufferStatus reports the backlog of the write buffer
+func (srv *Server) bufferStatus(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+
+	var status bufferStatus
+	if srv.buffer != nil {
+		srv.buffer.lock.Lock()
+		status = srv.buffer.status
+		srv.buffer.lock.Unlock()
+		status.Enabled, status.MaxBytes = true, srv.buffer.maxBytes
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Errorf("Could not serialize status of write buffer: %s", err)
+	}
+}
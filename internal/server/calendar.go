@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/database"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// serveCalendar returns (GET), sets (PUT or POST) and removes (DELETE) the calendar of a source
+func (srv *Server) serveCalendar(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	defer r.Body.Close()
+
+	source := r.URL.Query().Get("source")
+	if len(source) == 0 {
+		http.Error(w, "Params lacks 'source'", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		cal, err := srv.db.SiteCalendar(ctx, source)
+		if err != nil {
+			rerr := fmt.Errorf("Could not read calendar: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(cal); err != nil {
+			log.Errorf("Could not serialize calendar: %s", err)
+		}
+	case http.MethodPut, http.MethodPost:
+		var cal database.SiteCalendar
+		if err := json.NewDecoder(r.Body).Decode(&cal); err != nil {
+			rerr := fmt.Errorf("Could not parse calendar: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), http.StatusBadRequest)
+			return
+		}
+		cal.Source = source
+		if err := srv.db.PutSiteCalendar(ctx, &cal); err != nil {
+			rerr := fmt.Errorf("Could not set calendar: %w", err)
+			log.Error(rerr)
+			status := http.StatusInternalServerError
+			if errors.Is(err, database.ErrInvalidCalendar) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, rerr.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := srv.db.DeleteSiteCalendar(ctx, source); err != nil {
+			rerr := fmt.Errorf("Could not delete calendar: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Calendar requests must use GET, PUT, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/database"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// updateSPARQL implements the update operation of the SPARQL 1.1 Protocol
+func (srv *Server) updateSPARQL(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), config.DataWriteTimeout)
+	defer cancel()
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "SPARQL updates must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		req    database.SparqlUpdateRequest
+		params = r.URL.Query()
+	)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		if err := r.ParseForm(); err != nil {
+			rerr := fmt.Errorf("Bad SPARQL update: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), http.StatusBadRequest)
+			return
+		}
+		params = r.Form
+	} else {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			rerr := fmt.Errorf("Bad SPARQL update: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Update = string(body)
+	}
+	if err := req.FromURLParams(params); err != nil {
+		rerr := fmt.Errorf("Bad SPARQL update: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Infof("Update SPARQL: %s/%s %s", req.Source, req.Origin, req.Update)
+	if err := srv.db.UpdateSparql(ctx, &req); err != nil {
+		rerr := fmt.Errorf("Could not apply SPARQL update: %w", err)
+		log.Error(rerr)
+		if errors.Is(err, database.ErrInvalidQuery) {
+			http.Error(w, rerr.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, rerr.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveGraphStore implements the SPARQL 1.1 Graph Store HTTP Protocol with indirect graph identification
+// (?graph=<source>). Without an 'origin' parameter, PUT and DELETE replace or remove the triples of
+// every origin of the source and POST adds triples to DefaultEditOrigin
+func (srv *Server) serveGraphStore(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), config.DataWriteTimeout)
+	defer cancel()
+	defer r.Body.Close()
+
+	var req database.GraphStoreRequest
+	if err := req.FromURLParams(r.URL.Query()); err != nil {
+		rerr := fmt.Errorf("Could not read graph from params: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		edits   []database.GraphEdit
+		triples []database.Triple
+	)
+	if r.Method == http.MethodPut || r.Method == http.MethodPost {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		format, err := database.FormatFromMediaType(mediaType)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		if triples, err = database.ReadTriples(r.Body, format); err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	insertOrigin := req.Origin
+	if len(insertOrigin) == 0 {
+		insertOrigin = database.DefaultEditOrigin
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		mediaType := negotiateContentType(r.Header.Get("Accept"), database.GraphMediaTypes)
+		if len(mediaType) == 0 {
+			http.Error(w, fmt.Sprintf("Graphs can be returned as %v", database.GraphMediaTypes), http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set("Content-Type", mediaType)
+		if r.Method == http.MethodHead {
+			return
+		}
+		modelReq := &database.ModelRequest{Graph: req.Source, Origin: req.Origin, MediaType: mediaType}
+		if err := srv.db.GetGraph(ctx, modelReq, w); err != nil {
+			rerr := fmt.Errorf("Could not write graph: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), http.StatusInternalServerError)
+		}
+		return
+	case http.MethodPut:
+		edits = []database.GraphEdit{{Origin: req.Origin, Clear: true}, {Origin: insertOrigin, Insert: triples}}
+	case http.MethodPost:
+		edits = []database.GraphEdit{{Origin: insertOrigin, Insert: triples}}
+	case http.MethodDelete:
+		edits = []database.GraphEdit{{Origin: req.Origin, Clear: true}}
+	default:
+		http.Error(w, "Graph Store requests must use GET, HEAD, PUT, POST or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Infof("Graph Store %s %s/%s (%d triples)", r.Method, req.Source, req.Origin, len(triples))
+	if err := srv.db.EditGraph(ctx, req.Source, edits); err != nil {
+		rerr := fmt.Errorf("Could not edit graph: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
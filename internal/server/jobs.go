@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/database"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// submitJob spools the CSV file of the request and queues a job that inserts it into the stream. The response is
+// the queued job, whose status is at /jobs/{id}
+func (srv *Server) submitJob(ctx context.Context, w http.ResponseWriter, r *http.Request, stream database.Stream) {
+	log := logging.FromContext(srv.ctx)
+
+	var opts database.JobOptions
+	if err := opts.FromURLParams(r.URL.Query()); err != nil {
+		rerr := fmt.Errorf("Could not read job options from params: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.IdempotencyKey = r.Header.Get("Idempotency-Key")
+
+	job, err := srv.db.SubmitJob(ctx, stream.SourceName, stream.Name, opts, r.Body)
+	if err != nil {
+		rerr := fmt.Errorf("Could not submit job: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		log.Errorf("Could not serialize job: %s", err)
+	}
+}
+
+// listJobs lists the jobs of the source
+func (srv *Server) listJobs(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Jobs are listed with GET", http.StatusMethodNotAllowed)
+		return
+	}
+	source := r.URL.Query().Get("source")
+	if len(source) == 0 {
+		http.Error(w, "Jobs are listed for a source", http.StatusBadRequest)
+		return
+	}
+	jobs, err := srv.db.Jobs(ctx, source)
+	if err != nil {
+		rerr := fmt.Errorf("Could not read jobs: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), jobErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(jobs); err != nil {
+		log.Errorf("Could not serialize jobs: %s", err)
+	}
+}
+
+// serveJob reports (GET) or cancels (DELETE) the job /jobs/{id}
+func (srv *Server) serveJob(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	var (
+		job *database.Job
+		err error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		job, err = srv.db.Job(ctx, id)
+	case http.MethodDelete:
+		job, err = srv.db.CancelJob(ctx, id)
+	default:
+		http.Error(w, "Jobs are read with GET and cancelled with DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		rerr := fmt.Errorf("Could not handle job: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), jobErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		log.Errorf("Could not serialize job: %s", err)
+	}
+}
+
+func jobErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrJobNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrJobFinished):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
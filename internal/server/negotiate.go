@@ -0,0 +1,70 @@
+package server
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// mediaTypeNDJSON is newline-delimited JSON, used to stream results
+const mediaTypeNDJSON = "application/x-ndjson"
+
+// negotiateContentType picks the offered media type that best matches the Accept header.
+// Offers are given in order of the server's preference, which breaks ties between equally
+// acceptable types. Returns the empty string if none of the offers are acceptable
+func negotiateContentType(accept string, offers []string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	if len(strings.TrimSpace(accept)) == 0 {
+		return offers[0]
+	}
+
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if _q, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(_q, 64); err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType: mediaType, q: q})
+	}
+
+	var (
+		best  string
+		bestQ float64
+	)
+	for _, offer := range offers {
+		// the most specific matching media range determines the quality of the offer
+		q, specificity := 0.0, -1
+		for _, r := range ranges {
+			var s int
+			switch {
+			case r.mediaType == offer:
+				s = 2
+			case strings.HasSuffix(r.mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(r.mediaType, "*")):
+				s = 1
+			case r.mediaType == "*/*":
+				s = 0
+			default:
+				continue
+			}
+			if s > specificity {
+				q, specificity = r.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/database"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// serveQualityPolicies lists (GET), registers (PUT or POST) and removes (DELETE) quality policies
+func (srv *Server) serveQualityPolicies(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	defer r.Body.Close()
+
+	name := r.URL.Query().Get("name")
+	switch r.Method {
+	case http.MethodGet:
+		var (
+			response interface{}
+			err      error
+		)
+		if len(name) > 0 {
+			response, err = srv.db.GetQualityPolicy(ctx, name)
+		} else {
+			response, err = srv.db.QualityPolicies(ctx)
+		}
+		if err != nil {
+			rerr := fmt.Errorf("Could not read quality policies: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), qualityErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Errorf("Could not serialize quality policies: %s", err)
+		}
+	case http.MethodPut, http.MethodPost:
+		var policy database.QualityPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			rerr := fmt.Errorf("Could not parse quality policy: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := srv.db.PutQualityPolicy(ctx, &policy); err != nil {
+			rerr := fmt.Errorf("Could not register quality policy: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), qualityErrorStatus(err))
+			return
+		}
+		log.Infof("Registered quality policy %s", policy.Name)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if len(name) == 0 {
+			http.Error(w, "Params lacks 'name'", http.StatusBadRequest)
+			return
+		}
+		if err := srv.db.DeleteQualityPolicy(ctx, name); err != nil {
+			rerr := fmt.Errorf("Could not delete quality policy: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), qualityErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Quality policy requests must use GET, PUT, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveQuarantine lists (GET) the quarantined readings of a source, or releases them (POST) into their streams
+func (srv *Server) serveQuarantine(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+	defer r.Body.Close()
+
+	var req database.QuarantineRequest
+	if err := req.FromURLParams(r.URL.Query()); err != nil {
+		rerr := fmt.Errorf("Could not parse quarantine request: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var response interface{}
+	switch r.Method {
+	case http.MethodGet:
+		readings, err := srv.db.Quarantine(ctx, &req)
+		if err != nil {
+			rerr := fmt.Errorf("Could not read quarantine: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), qualityErrorStatus(err))
+			return
+		}
+		response = readings
+	case http.MethodPost:
+		released, err := srv.db.ReleaseQuarantine(ctx, &req)
+		if err != nil {
+			rerr := fmt.Errorf("Could not release quarantine: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), qualityErrorStatus(err))
+			return
+		}
+		log.Infof("Released %d readings of %s from quarantine", released, req.Source)
+		response = map[string]int64{"Released": released}
+	default:
+		http.Error(w, "Quarantine requests must use GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Could not serialize quarantine: %s", err)
+	}
+}
+
+func qualityErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrQualityPolicyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrInvalidQualityPolicy):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
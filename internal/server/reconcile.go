@@ -0,0 +1,44 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gtfierro/mortar2/internal/database"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// reconcileStreams reports (GET) or applies (POST) the reconciliation of the streams of a source with its model
+func (srv *Server) reconcileStreams(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	defer r.Body.Close()
+
+	var req database.ReconcileRequest
+	if err := req.FromURLParams(r.URL.Query()); err != nil {
+		rerr := fmt.Errorf("Could not read reconciliation from params: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		req.Apply = true
+	default:
+		http.Error(w, "Reconciliation requests must use GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := srv.db.Reconcile(r.Context(), &req)
+	if err != nil {
+		rerr := fmt.Errorf("Could not reconcile streams: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Errorf("Could not serialize reconciliation report: %s", err)
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/database"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// serveRules lists (GET), registers (PUT or POST) and removes (DELETE) rules
+func (srv *Server) serveRules(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	defer r.Body.Close()
+
+	name := r.URL.Query().Get("name")
+	switch r.Method {
+	case http.MethodGet:
+		var (
+			response interface{}
+			err      error
+		)
+		if len(name) > 0 {
+			response, err = srv.db.GetRule(ctx, name)
+		} else {
+			response, err = srv.db.Rules(ctx)
+		}
+		if err != nil {
+			rerr := fmt.Errorf("Could not read rules: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), ruleErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Errorf("Could not serialize rules: %s", err)
+		}
+	case http.MethodPut, http.MethodPost:
+		var rule database.Rule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			rerr := fmt.Errorf("Could not parse rule: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := srv.db.PutRule(ctx, &rule); err != nil {
+			rerr := fmt.Errorf("Could not register rule: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), ruleErrorStatus(err))
+			return
+		}
+		log.Infof("Registered rule %s", rule.Name)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if len(name) == 0 {
+			http.Error(w, "Params lacks 'name'", http.StatusBadRequest)
+			return
+		}
+		if err := srv.db.DeleteRule(ctx, name); err != nil {
+			rerr := fmt.Errorf("Could not delete rule: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), ruleErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Rule requests must use GET, PUT, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// ruleStatus reports the progress, lag and last failure of every rule, or of the rule given by name=
+func (srv *Server) ruleStatus(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), config.DataReadTimeout)
+	defer cancel()
+	defer r.Body.Close()
+
+	statuses, err := srv.db.RuleStatuses(ctx, r.URL.Query().Get("name"))
+	if err != nil {
+		rerr := fmt.Errorf("Could not read status of rules: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), ruleErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		log.Errorf("Could not serialize status of rules: %s", err)
+	}
+}
+
+// backfillRule computes the output of a rule over a historical range (name=, start= and optionally end=)
+func (srv *Server) backfillRule(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Backfills must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var req database.BackfillRequest
+	if err := req.FromURLParams(r.URL.Query()); err != nil {
+		rerr := fmt.Errorf("Could not parse backfill request: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusBadRequest)
+		return
+	}
+	written, err := srv.db.BackfillRule(r.Context(), &req)
+	if err != nil {
+		rerr := fmt.Errorf("Could not backfill rule: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), ruleErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int64{"Readings": written}); err != nil {
+		log.Errorf("Could not serialize backfill: %s", err)
+	}
+}
+
+func ruleErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrRuleNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrInvalidRule):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
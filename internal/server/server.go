@@ -4,16 +4,18 @@ import (
 	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gtfierro/mortar2/internal/config"
 	"github.com/gtfierro/mortar2/internal/database"
 	"github.com/gtfierro/mortar2/internal/logging"
-	"github.com/knakk/rdf"
 )
 
 // Server implements the frontend HTTP interface
@@ -21,6 +23,8 @@ type Server struct {
 	ctx         context.Context
 	db          database.Database
 	httpAddress string
+	// holds the insertions received while the database is unavailable; nil if disabled
+	buffer *writeBuffer
 }
 
 // NewWithInsecureDefaults creates a new Server with the (insecure) default settings; helpful for debugging, but NEVER run in production!
@@ -57,6 +61,28 @@ func NewFromConfig(ctx context.Context, cfg *config.Config) (*Server, error) {
 		httpAddress: httpAddress,
 		db:          db,
 	}
+	if len(cfg.Buffer.Dir) > 0 {
+		if srv.buffer, err = newWriteBuffer(cfg.Buffer); err != nil {
+			return nil, fmt.Errorf("Could not open write buffer: %w", err)
+		}
+		go srv.drainBuffer(ctx)
+	}
+
+	go func() {
+		if err := db.RunRules(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			logging.FromContext(ctx).Errorf("Rule engine stopped: %s", err)
+		}
+	}()
+	go func() {
+		if err := db.RunAlerts(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			logging.FromContext(ctx).Errorf("Alert engine stopped: %s", err)
+		}
+	}()
+	go func() {
+		if err := db.RunJobs(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			logging.FromContext(ctx).Errorf("Job workers stopped: %s", err)
+		}
+	}()
 
 	return srv, nil
 }
@@ -77,11 +103,37 @@ func (srv *Server) ServeHTTP() error {
 	mux.HandleFunc("/register_stream", requireAuth(addLogger(srv.registerStream)))
 	mux.HandleFunc("/insert/data", requireAuth(addLogger(srv.insertJSONData)))
 	mux.HandleFunc("/insert/csv", requireAuth(addLogger(srv.insertCSVFile)))
+	mux.HandleFunc("/insert/backfill", requireAuth(addLogger(srv.insertBackfill)))
+	mux.HandleFunc("/jobs", requireAuth(addLogger(srv.listJobs)))
+	mux.HandleFunc("/jobs/", requireAuth(addLogger(srv.serveJob)))
+	mux.HandleFunc("/buffer/status", addLogger(srv.bufferStatus))
 	mux.HandleFunc("/insert/metadata", requireAuth(addLogger(srv.insertTriplesFromFile)))
 	mux.HandleFunc("/query", addLogger(srv.readDataChunk))
 	mux.HandleFunc("/query/model", requireAuth(addLogger(srv.readModel)))
-	mux.HandleFunc("/sparql", addLogger(srv.serveSPARQLQuery))
+	mux.HandleFunc("/sparql", allowCORS(addLogger(srv.serveSPARQLQuery)))
+	mux.HandleFunc("/sparql/update", requireAuth(addLogger(srv.updateSPARQL)))
+	mux.HandleFunc("/sparql/graph", requireAuth(addLogger(srv.serveGraphStore)))
+	mux.HandleFunc("/versions", requireAuth(addLogger(srv.listGraphVersions)))
+	mux.HandleFunc("/versions/diff", requireAuth(addLogger(srv.diffGraphVersions)))
+	mux.HandleFunc("/versions/rollback", requireAuth(addLogger(srv.rollbackGraph)))
+	mux.HandleFunc("/validate", requireAuth(addLogger(srv.validateGraph)))
+	mux.HandleFunc("/validate/shapes", requireAuth(addLogger(srv.serveShapes)))
+	mux.HandleFunc("/reconcile", requireAuth(addLogger(srv.reconcileStreams)))
 	mux.HandleFunc("/qualify", addLogger(srv.handleQualify))
+	mux.HandleFunc("/applications", requireAuth(addLogger(srv.serveApplications)))
+	mux.HandleFunc("/applications/sites", addLogger(srv.applicationSites))
+	mux.HandleFunc("/applications/data", addLogger(srv.readApplicationData))
+	mux.HandleFunc("/views", requireAuth(addLogger(srv.serveViews)))
+	mux.HandleFunc("/calendar", requireAuth(addLogger(srv.serveCalendar)))
+	mux.HandleFunc("/rules", requireAuth(addLogger(srv.serveRules)))
+	mux.HandleFunc("/rules/status", addLogger(srv.ruleStatus))
+	mux.HandleFunc("/rules/backfill", requireAuth(addLogger(srv.backfillRule)))
+	mux.HandleFunc("/alerts", requireAuth(addLogger(srv.serveAlerts)))
+	mux.HandleFunc("/alerts/status", addLogger(srv.alertStatus))
+	mux.HandleFunc("/alerts/history", addLogger(srv.alertHistory))
+	mux.HandleFunc("/alerts/silences", requireAuth(addLogger(srv.serveSilences)))
+	mux.HandleFunc("/quality/policies", requireAuth(addLogger(srv.serveQualityPolicies)))
+	mux.HandleFunc("/quality/quarantine", requireAuth(addLogger(srv.serveQuarantine)))
 	// TODO: data stream statistics (per source, per type, etc)
 
 	server := &http.Server{
@@ -129,12 +181,23 @@ func (srv *Server) insertJSONData(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 	defer r.Body.Close()
 
+	opts, err := insertOptions(r)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the body is kept, to be buffered if the database is unavailable
+	body, spool := srv.keepBody(r)
+	defer spool.close()
 	var ds = database.NewArrayDataset()
-	if err := json.NewDecoder(r.Body).Decode(ds); err != nil {
+	if err := json.NewDecoder(body).Decode(ds); err != nil {
 		log.Errorf("Could not parse dataset %s", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	buffered := bufferedInsertion{Kind: bufferedData, Source: ds.GetSource(), Options: *opts}
 
 	//// TODO: register stream if necessary
 	//stream := database.GetStream(&ds)
@@ -150,12 +213,38 @@ func (srv *Server) insertJSONData(w http.ResponseWriter, r *http.Request) {
 	//	return
 	//}
 
+	// readings that fall in compressed chunks are backfilled, unless the insertion must be idempotent
+	if start, end, ok := readingsSpan(ds.Readings); ok && len(opts.IdempotencyKey) == 0 {
+		backfill, err := srv.db.NeedsBackfill(ctx, start, end)
+		if err != nil && srv.bufferInsertion(w, r, buffered, spool.body(r.Body), err) {
+			return
+		} else if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if backfill {
+			buffered.Backfill = true
+			srv.backfill(r.Context(), w, r, ds, *opts, nil, func(err error) bool {
+				return srv.bufferInsertion(w, r, buffered, spool.body(r.Body), err)
+			})
+			return
+		}
+	}
+
 	// insert data
-	if err := srv.db.InsertHistoricalData(ctx, ds); err != nil {
+	report, err := srv.db.InsertHistoricalData(ctx, ds, *opts)
+	if err != nil && srv.bufferInsertion(w, r, buffered, spool.body(r.Body), err) {
+		return
+	} else if err != nil {
 		log.Errorf("Could not insert data %s", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), insertErrorStatus(err))
 		return
 	}
+	srv.authorizedInsertion(r, ds.GetSource())
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Errorf("Could not serialize insert report: %s", err)
+	}
 }
 
 func (srv *Server) insertCSVFile(w http.ResponseWriter, r *http.Request) {
@@ -164,12 +253,7 @@ func (srv *Server) insertCSVFile(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 	defer r.Body.Close()
 
-	var (
-		rdg    database.Reading
-		stream database.Stream
-		rowNum = 0
-	)
-
+	var stream database.Stream
 	if err := stream.FromURLParams(r.URL.Query()); err != nil {
 		rerr := fmt.Errorf("Could not read source from params: %w", err)
 		log.Error(rerr)
@@ -177,20 +261,82 @@ func (srv *Server) insertCSVFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	//log.Infof("%+v\n", stream)
+	opts, err := insertOptions(r)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	buffered := bufferedInsertion{Kind: bufferedCSV, Source: stream.SourceName, Stream: stream, Options: *opts}
 	if err := srv.db.RegisterStream(ctx, stream); err != nil {
+		// the file was not read yet
+		if srv.bufferInsertion(w, r, buffered, r.Body, err) {
+			return
+		}
 		log.Errorf("Could not register stream %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// registering the stream needs the write permission on the source
+	srv.authorizedInsertion(r, stream.SourceName)
 
-	// try out csv decoder
-	csvr := csv.NewReader(r.Body)
+	// an asynchronous upload is spooled, and inserted by a job
+	if async, _ := strconv.ParseBool(r.URL.Query().Get("async")); async {
+		srv.submitJob(ctx, w, r, stream)
+		return
+	}
+
+	// the part of the file that was read is kept, to be buffered if the database becomes unavailable
+	body, spool := srv.keepBody(r)
+	defer spool.close()
 	readings := make(chan database.Reading)
-	errc := make(chan error)
 	ds := database.NewStreamingDataset(stream.SourceName, stream.Name, readings)
+	errc := srv.readCSVReadings(ctx, cancel, body, readings)
+
+	report, err := srv.db.InsertHistoricalData(ctx, ds, *opts)
+	if err != nil && spool != nil {
+		// the file is read again from the start once the reader stopped
+		cancel()
+		<-errc
+		if srv.bufferInsertion(w, r, buffered, spool.body(r.Body), err) {
+			return
+		}
+	}
+	if err != nil {
+		log.Errorf("Could not insert data %s", err)
+		http.Error(w, err.Error(), insertErrorStatus(err))
+		return
+	}
+
+	// a replayed insertion does not read the file
+	if !report.Replayed {
+		err = <-errc
+	}
+	if err != nil {
+		log.Errorf("Problem inserting CSV file: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Errorf("Could not serialize insert report: %s", err)
+	}
+}
+
+// readCSVReadings sends the readings of the rows of the CSV file to the channel, which is closed at the end of the
+// file. The outcome of reading the file is sent on the returned channel; a bad row cancels the insertion
+func (srv *Server) readCSVReadings(ctx context.Context, cancel context.CancelFunc, body io.Reader, readings chan database.Reading) <-chan error {
+	log := logging.FromContext(srv.ctx)
 
+	// try out csv decoder
+	csvr := csv.NewReader(body)
+	errc := make(chan error, 1)
 	go func() {
+		var (
+			rdg    database.Reading
+			rowNum = 0
+		)
 		for {
 			row, err := csvr.Read()
 			if err == io.EOF {
@@ -210,26 +356,45 @@ func (srv *Server) insertCSVFile(w http.ResponseWriter, r *http.Request) {
 				errc <- fmt.Errorf("Bad row %d in CSV file: %w", rowNum, err)
 				return
 			}
-			ds.GetReadings() <- rdg
+			// the insertion stops early if a reading is rejected
+			select {
+			case readings <- rdg:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
 			rowNum++
 		}
 		errc <- nil
 	}()
+	return errc
+}
 
-	if err := srv.db.InsertHistoricalData(ctx, ds); err != nil {
-		log.Errorf("Could not insert data %s", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// insertOptions reads the conflict policy of an insertion from its params, and its idempotency key from the
+// Idempotency-Key header
+func insertOptions(r *http.Request) (*database.InsertOptions, error) {
+	var opts database.InsertOptions
+	if err := opts.FromURLParams(r.URL.Query()); err != nil {
+		return nil, fmt.Errorf("Could not read insert options from params: %w", err)
 	}
+	opts.IdempotencyKey = r.Header.Get("Idempotency-Key")
+	return &opts, nil
+}
 
-	err := <-errc
-	if err != nil {
-		log.Errorf("Problem inserting CSV file: %s", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// insertErrorStatus is the status of a failed insertion: readings of the wrong type (or options that cannot be used
+// together) are bad requests, and
+// readings that conflict with stored readings or reused idempotency keys are conflicts
+func insertErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrInvalidReading), errors.Is(err, database.ErrInvalidInsertOptions):
+		return http.StatusBadRequest
+	case errors.Is(err, database.ErrInsertConflict), errors.Is(err, database.ErrIdempotencyKeyReused),
+		errors.Is(err, database.ErrIdempotencyKeyInUse):
+		return http.StatusConflict
 	}
+	return http.StatusInternalServerError
 }
 
-// TODO: get metadat as well: units, SPARQL query results, etc
 func (srv *Server) readDataChunk(w http.ResponseWriter, r *http.Request) {
 	log := logging.FromContext(srv.ctx)
 	ctx, cancel := context.WithTimeout(r.Context(), config.DataReadTimeout)
@@ -238,18 +403,18 @@ func (srv *Server) readDataChunk(w http.ResponseWriter, r *http.Request) {
 
 	start := time.Now()
 
-	var query database.Query
-	if err := query.FromURLParams(r.URL.Query()); err != nil {
-		rerr := fmt.Errorf("Could not read source from params: %w", err)
+	query, err := srv.db.ParseQuery(ctx, r.URL.Query())
+	if err != nil {
+		rerr := fmt.Errorf("Could not read query from params: %w", err)
 		log.Error(rerr)
-		http.Error(w, rerr.Error(), http.StatusBadRequest)
+		http.Error(w, rerr.Error(), queryErrorStatus(err))
 		return
 	}
 
 	// TODO: is there a (standard) way to communicate errors over the Arrow IPC
 	// mechanism rather than falling back to an HTTP status code?
 	log.Infof("Read data chunk %+v", query)
-	err := srv.db.ReadDataChunk(ctx, w, &query)
+	err = srv.db.ReadDataChunk(ctx, w, query)
 	if err != nil {
 		log.Errorf("Problem querying data: %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -271,16 +436,48 @@ func (srv *Server) insertTriplesFromFile(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	dec := rdf.NewTripleDecoder(r.Body, tripSrc.Format)
-	ds := database.NewStreamingTripleDataset(tripSrc.Source, tripSrc.Origin, time.Now(), dec)
+	// without a 'format' parameter, the format is taken from the Content-Type
+	if len(r.URL.Query().Get("format")) == 0 {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if format, err := database.FormatFromMediaType(mediaType); err == nil {
+			tripSrc.Format = format
+		}
+	}
 
-	err := srv.db.AddTriples(ctx, ds)
-	if err != nil {
+	dec := database.NewTripleDecoder(r.Body, tripSrc.Format)
+	ds := database.NewStreamingTripleDataset(tripSrc.Source, tripSrc.Origin, time.Now(), tripSrc.Strict, dec)
+
+	inserted, validation, err := srv.db.AddTriples(ctx, ds, tripSrc.Validate)
+	report := database.UploadReport{
+		Parsed:     ds.Parsed(),
+		Inserted:   inserted,
+		Duplicates: int64(ds.Parsed()) - inserted,
+		Errors:     ds.ParseErrors(),
+		Validation: validation,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil && ds.Err() != nil {
+		// the upload was rejected because of the syntax errors in the report
+		log.Errorf("Rejected triples for %s/%s: %s", tripSrc.Source, tripSrc.Origin, report.Errors[0])
+		report.Inserted, report.Duplicates = 0, 0
+		w.WriteHeader(http.StatusBadRequest)
+	} else if errors.Is(err, database.ErrValidationFailed) {
+		log.Errorf("Rejected triples for %s/%s: %s", tripSrc.Source, tripSrc.Origin, err)
+		report.Inserted, report.Duplicates = 0, 0
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	} else if err != nil {
 		log.Errorf("Problem inserting triples: %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if len(report.Errors) > 0 {
+		log.Warnf("Skipped %d malformed triples for %s/%s", len(report.Errors), tripSrc.Source, tripSrc.Origin)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Errorf("Could not serialize upload report: %s", err)
 	}
 }
 
+// serveSPARQLQuery implements the query operation of the SPARQL 1.1 Protocol
 func (srv *Server) serveSPARQLQuery(w http.ResponseWriter, r *http.Request) {
 	log := logging.FromContext(srv.ctx)
 	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
@@ -288,63 +485,153 @@ func (srv *Server) serveSPARQLQuery(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	var (
-		sparqlQuery []byte
-		err         error
+		req    database.SparqlProtocolRequest
+		params = r.URL.Query()
 	)
-	w.Header().Add("Content-Type", "application/sparql-results+json")
-
-	// check query parameters
-	// get first 'site'
-	q := r.URL.Query()
-	log.Infof("Query: %+v", q)
-	site := q.Get("site")
-	if queryString := q.Get("query"); len(queryString) > 0 {
-		sparqlQuery = []byte(queryString)
-	} else if sparqlQuery, err = ioutil.ReadAll(r.Body); err != nil {
-		rerr := fmt.Errorf("Bad SPARQL query: %w", err)
-		log.Error(rerr)
-		http.Error(w, rerr.Error(), http.StatusBadRequest)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType == "application/x-www-form-urlencoded" {
+			if err := r.ParseForm(); err != nil {
+				rerr := fmt.Errorf("Bad SPARQL query: %w", err)
+				log.Error(rerr)
+				http.Error(w, rerr.Error(), http.StatusBadRequest)
+				return
+			}
+			params = r.Form
+			break
+		}
+		// application/sparql-query; bodies without a content type are also accepted for older clients
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			rerr := fmt.Errorf("Bad SPARQL query: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Query = string(body)
+	default:
+		http.Error(w, "SPARQL queries must use GET or POST", http.StatusMethodNotAllowed)
 		return
-	} else if len(sparqlQuery) == 0 {
+	}
+
+	if err := req.FromURLParams(params); err != nil {
 		rerr := fmt.Errorf("Bad SPARQL query: %w", err)
 		log.Error(rerr)
 		http.Error(w, rerr.Error(), http.StatusBadRequest)
 		return
 	}
 
-	log.Infof("Query SPARQL: %s %s", site, string(sparqlQuery))
-	if err := srv.db.QuerySparqlWriter(ctx, w, site, string(sparqlQuery)); err != nil {
+	log.Infof("Query SPARQL: %v %s", req.DefaultSources, req.Query)
+	resp, err := srv.db.QuerySparqlProtocol(ctx, &req)
+	if err != nil {
 		rerr := fmt.Errorf("Bad SPARQL query: %w", err)
 		log.Error(rerr)
-		http.Error(w, rerr.Error(), http.StatusInternalServerError)
+		if errors.Is(err, database.ErrInvalidQuery) {
+			http.Error(w, rerr.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, rerr.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
+
+	mediaType := negotiateContentType(r.Header.Get("Accept"), resp.MediaTypes())
+	if len(mediaType) == 0 {
+		http.Error(w, fmt.Sprintf("Results can be returned as %v", resp.MediaTypes()), http.StatusNotAcceptable)
+		return
+	}
+	w.Header().Set("Content-Type", mediaType)
+	if err := resp.Write(w, mediaType); err != nil {
+		log.Errorf("Could not serialize SPARQL results: %s", err)
+	}
 }
 
+// handleQualify evaluates a JSON-encoded list of SPARQL queries against every source. If the client accepts
+// application/x-ndjson, the result of each query on each source is streamed as soon as it is available
 func (srv *Server) handleQualify(w http.ResponseWriter, r *http.Request) {
-	// TODO: JSON-encoded list of sparql queries
 	log := logging.FromContext(srv.ctx)
 
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), config.DataReadTimeout)
 	defer cancel()
 	defer r.Body.Close()
 
-	var qualifyQueryList []string
-	if err := json.NewDecoder(r.Body).Decode(&qualifyQueryList); err != nil {
+	var req database.QualifyRequest
+	if err := req.FromURLParams(r.URL.Query()); err != nil {
+		rerr := fmt.Errorf("Could not read qualify from params: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req.Queries); err != nil {
 		log.Errorf("Could not parse list of queries %s", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	results, err := srv.db.Qualify(ctx, qualifyQueryList)
+	mediaType := negotiateContentType(r.Header.Get("Accept"), []string{"application/json", mediaTypeNDJSON})
+	if len(mediaType) == 0 {
+		http.Error(w, "Qualify results are available as application/json or "+mediaTypeNDJSON, http.StatusNotAcceptable)
+		return
+	}
+
+	if mediaType == mediaTypeNDJSON {
+		w.Header().Set("Content-Type", mediaTypeNDJSON)
+		enc := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+		progress := func(p database.QualifyProgress) {
+			if !req.Detailed {
+				p.Result = &database.QualifyResult{Error: p.Result.Error, Count: p.Result.Count}
+			}
+			if err := enc.Encode(p); err != nil {
+				log.Errorf("Could not serialize qualify progress: %s", err)
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if _, err := srv.db.Qualify(ctx, &req, progress); err != nil {
+			// the status has already been sent, so the error is reported as the last line
+			log.Errorf("Could not qualify: %s", err)
+			if err := enc.Encode(map[string]string{"Error": err.Error()}); err != nil {
+				log.Errorf("Could not serialize qualify error: %s", err)
+			}
+		}
+		return
+	}
+
+	results, err := srv.db.Qualify(ctx, &req, nil)
 	if err != nil {
 		rerr := fmt.Errorf("Could not qualify: %w", err)
 		log.Error(rerr)
-		http.Error(w, rerr.Error(), http.StatusInternalServerError)
+		if errors.Is(err, database.ErrInvalidQuery) {
+			http.Error(w, rerr.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			http.Error(w, rerr.Error(), http.StatusGatewayTimeout)
+		} else {
+			http.Error(w, rerr.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
+	// without details, the number of solutions of each query is returned for each source (-1 if the query failed)
+	var response interface{} = results
+	if !req.Detailed {
+		counts := make(map[string][]int, len(results))
+		for graph, graphResults := range results {
+			counts[graph] = make([]int, len(graphResults))
+			for idx, result := range graphResults {
+				if result == nil || len(result.Error) > 0 {
+					counts[graph][idx] = -1
+				} else {
+					counts[graph][idx] = result.Count
+				}
+			}
+		}
+		response = counts
+	}
+	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
-	if err := enc.Encode(results); err != nil {
+	if err := enc.Encode(response); err != nil {
 		rerr := fmt.Errorf("Could not serialize qualify results: %w", err)
 		log.Error(rerr)
 		http.Error(w, rerr.Error(), http.StatusInternalServerError)
@@ -359,14 +646,25 @@ func (srv *Server) readModel(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 	defer r.Body.Close()
 
+	// the request can be given as a JSON body, as URL parameters or both (parameters take precedence)
 	var request database.ModelRequest
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		log.Errorf("Could not read model request %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := request.FromURLParams(r.URL.Query()); err != nil {
 		log.Errorf("Could not read model request %s", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// w.Header().Add("Content-Type", "text/turtle")
+	request.MediaType = negotiateContentType(r.Header.Get("Accept"), database.GraphMediaTypes)
+	if len(request.MediaType) == 0 {
+		http.Error(w, fmt.Sprintf("Models can be returned as %v", database.GraphMediaTypes), http.StatusNotAcceptable)
+		return
+	}
+	w.Header().Set("Content-Type", request.MediaType)
 	if err := srv.db.GetGraph(ctx, &request, w); err != nil {
 		rerr := fmt.Errorf("Could not write graph: %w", err)
 		log.Error(rerr)
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/database"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// validateGraph validates the current graph of a source against its SHACL shapes
+func (srv *Server) validateGraph(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), config.DataReadTimeout)
+	defer cancel()
+	defer r.Body.Close()
+
+	var req database.ValidationRequest
+	if err := req.FromURLParams(r.URL.Query()); err != nil {
+		rerr := fmt.Errorf("Could not read validation from params: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := srv.db.ValidateGraph(ctx, &req)
+	if err != nil {
+		rerr := fmt.Errorf("Could not validate graph: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Errorf("Could not serialize validation report: %s", err)
+	}
+}
+
+// serveShapes lists (GET), replaces (PUT) and removes (DELETE) the named sets of shapes of a source
+func (srv *Server) serveShapes(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	defer r.Body.Close()
+
+	params := r.URL.Query()
+	source, name := params.Get("source"), params.Get("name")
+	if len(source) == 0 {
+		http.Error(w, "Params lacks 'source'", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		sets, err := srv.db.ShapeSets(ctx, source)
+		if err != nil {
+			rerr := fmt.Errorf("Could not list shapes: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(sets); err != nil {
+			log.Errorf("Could not serialize shapes: %s", err)
+		}
+		return
+	}
+
+	if len(name) == 0 {
+		http.Error(w, "Params lacks 'name'", http.StatusBadRequest)
+		return
+	}
+	var triples []database.Triple
+	switch r.Method {
+	case http.MethodPut:
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if len(mediaType) == 0 {
+			mediaType = database.MediaTypeTurtle
+		}
+		format, err := database.FormatFromMediaType(mediaType)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		if triples, err = database.ReadTriples(r.Body, format); err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+	default:
+		http.Error(w, "Shapes requests must use GET, PUT or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Infof("Shapes %s %s/%s (%d triples)", r.Method, source, name, len(triples))
+	if err := srv.db.PutShapes(ctx, source, name, triples); err != nil {
+		rerr := fmt.Errorf("Could not store shapes: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/config"
+	"github.com/gtfierro/mortar2/internal/database"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+func (srv *Server) listGraphVersions(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	defer r.Body.Close()
+
+	source := r.URL.Query().Get("source")
+	if len(source) == 0 {
+		http.Error(w, "Params lacks 'source'", http.StatusBadRequest)
+		return
+	}
+
+	versions, err := srv.db.GraphVersions(ctx, source)
+	if err != nil {
+		rerr := fmt.Errorf("Could not list versions: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(versions); err != nil {
+		log.Errorf("Could not serialize versions: %s", err)
+	}
+}
+
+func (srv *Server) diffGraphVersions(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), config.DataReadTimeout)
+	defer cancel()
+	defer r.Body.Close()
+
+	var req database.DiffRequest
+	if err := req.FromURLParams(r.URL.Query()); err != nil {
+		rerr := fmt.Errorf("Could not read diff from params: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	diff, err := srv.db.DiffGraph(ctx, &req)
+	if err != nil {
+		rerr := fmt.Errorf("Could not compute diff: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(diff); err != nil {
+		log.Errorf("Could not serialize diff: %s", err)
+	}
+}
+
+func (srv *Server) rollbackGraph(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), config.DataWriteTimeout)
+	defer cancel()
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Rollbacks must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req database.RollbackRequest
+	if err := req.FromURLParams(r.URL.Query()); err != nil {
+		rerr := fmt.Errorf("Could not read rollback from params: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Infof("Rollback %s/%s to %s", req.Source, req.Origin, req.Time)
+	if err := srv.db.RollbackGraph(ctx, &req); err != nil {
+		rerr := fmt.Errorf("Could not roll back graph: %w", err)
+		log.Error(rerr)
+		http.Error(w, rerr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gtfierro/mortar2/internal/database"
+	"github.com/gtfierro/mortar2/internal/logging"
+)
+
+// serveViews lists (GET), registers (PUT or POST) and removes (DELETE) saved views
+func (srv *Server) serveViews(w http.ResponseWriter, r *http.Request) {
+	log := logging.FromContext(srv.ctx)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	defer r.Body.Close()
+
+	name := r.URL.Query().Get("name")
+	switch r.Method {
+	case http.MethodGet:
+		var (
+			response interface{}
+			err      error
+		)
+		if len(name) > 0 {
+			response, err = srv.db.GetView(ctx, name)
+		} else {
+			response, err = srv.db.Views(ctx)
+		}
+		if err != nil {
+			rerr := fmt.Errorf("Could not read views: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), queryErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Errorf("Could not serialize views: %s", err)
+		}
+	case http.MethodPut, http.MethodPost:
+		var view database.View
+		if err := json.NewDecoder(r.Body).Decode(&view); err != nil {
+			rerr := fmt.Errorf("Could not parse view: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := srv.db.PutView(ctx, &view); err != nil {
+			rerr := fmt.Errorf("Could not register view: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), queryErrorStatus(err))
+			return
+		}
+		log.Infof("Registered view %s", view.Name)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if len(name) == 0 {
+			http.Error(w, "Params lacks 'name'", http.StatusBadRequest)
+			return
+		}
+		if err := srv.db.DeleteView(ctx, name); err != nil {
+			rerr := fmt.Errorf("Could not delete view: %w", err)
+			log.Error(rerr)
+			http.Error(w, rerr.Error(), queryErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "View requests must use GET, PUT, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+func queryErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrViewNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrInvalidView), errors.Is(err, database.ErrInvalidParams):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
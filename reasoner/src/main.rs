@@ -3,7 +3,7 @@ use std::env;
 use std::str;
 use log::debug;
 use serde::{Serialize, Deserialize};
-use std::collections::HashMap;
+use std::collections::{HashMap, HashSet};
 use tokio::time;
 use futures::channel::mpsc;
 use futures::future::join_all;
@@ -13,6 +13,7 @@ use futures::{
 use oxigraph::model::{Term, NamedNode, BlankNode, Literal, Triple};
 use tokio_postgres::{NoTls, Error, AsyncMessage};
 use oxigraph::sparql::{QueryResults, QueryResultsFormat, Query};
+use oxigraph::io::GraphFormat;
 use oxigraph::model::*;
 use oxigraph::SledStore;
 use reasonable::graphmanager::GraphManager;
@@ -30,6 +31,9 @@ const qfmt: &str = "PREFIX brick: <https://brickschema.org/schema/Brick#>
     PREFIX qudt: <http://qudt.org/schema/qudt/>
     ";
 
+// maximum size of a SPARQL query body, in bytes
+const QUERY_SIZE_LIMIT: u64 = 1024 * 1024;
+
 fn with_db(store: SledStore) -> impl Filter<Extract = (SledStore,), Error = std::convert::Infallible> + Clone {
     warp::any().map(move || store.clone())
 }
@@ -71,6 +75,123 @@ fn graphname_node(t: &str) -> GraphName {
     GraphName::NamedNode(NamedNode::new(format!("urn:{}", t)).unwrap())
 }
 
+fn named_graph_node(t: &str) -> NamedOrBlankNode {
+    NamedOrBlankNode::NamedNode(NamedNode::new(format!("urn:{}", t)).unwrap())
+}
+
+// evaluates the query over the named graph (or the union of all graphs for "default" and "all").
+// SELECT and ASK results are returned as SPARQL JSON results; CONSTRUCT and DESCRIBE results as N-Triples
+fn evaluate_query(store: &SledStore, graphname: &str, query: &str, default_graphs: &[String], named_graphs: &[String]) -> Result<warp::http::Response<Vec<u8>>, warp::http::Error> {
+    let sparql = format!("{}{}", qfmt, query);
+    let mut parsed_query = match Query::parse(&sparql, None) {
+        Ok(q) => q,
+        Err(e) => {
+            return warp::http::Response::builder()
+                .status(warp::http::StatusCode::BAD_REQUEST)
+                .body(format!("Bad query: {}", e).into_bytes())
+        }
+    };
+    if !default_graphs.is_empty() {
+        parsed_query.dataset_mut().set_default_graph(default_graphs.iter().map(|g| graphname_node(g)).collect());
+    } else {
+        match graphname {
+            "default" => parsed_query.dataset_mut().set_default_graph_as_union(),
+            "all" => parsed_query.dataset_mut().set_default_graph_as_union(),
+            gname => parsed_query.dataset_mut().set_default_graph(vec![graphname_node(gname)]) ,
+        };
+    }
+    if !named_graphs.is_empty() {
+        parsed_query.dataset_mut().set_available_named_graphs(named_graphs.iter().map(|g| named_graph_node(g)).collect());
+    }
+    println!("Querying graph {}", graphname_node(graphname));
+
+    let res = match store.query(parsed_query) {
+        Ok(res) => res,
+        Err(e) => {
+            return warp::http::Response::builder()
+                .status(warp::http::StatusCode::INTERNAL_SERVER_ERROR)
+                .body(format!("Could not evaluate query: {}", e).into_bytes())
+        }
+    };
+    let mut resp: Vec<u8> = Vec::new();
+    let (written, content_type) = if let QueryResults::Graph(_) = res {
+        (res.write_graph(&mut resp, GraphFormat::NTriples), "application/n-triples")
+    } else {
+        (res.write(&mut resp, QueryResultsFormat::Json), "application/sparql-results+json")
+    };
+    match written {
+        Ok(_) => warp::http::Response::builder()
+            .header("content-type", content_type)
+            .body(resp),
+        Err(e) => warp::http::Response::builder()
+            .status(warp::http::StatusCode::INTERNAL_SERVER_ERROR)
+            .body(format!("Could not serialize results: {}", e).into_bytes()),
+    }
+}
+
+fn row_to_triple(row: &tokio_postgres::Row) -> Triple {
+    let (s, p, o): (&str, &str, &str) = (row.get(0), row.get(1), row.get(2));
+    debug!("{} {} {}", s, p, o);
+    make_triple(parse_triple_term(s).unwrap(),
+                 parse_triple_term(p).unwrap(),
+                 parse_triple_term(o).unwrap()).unwrap()
+}
+
+// reads the latest triples for the source from the database
+async fn load_source(pool: &Pool<PostgresConnectionManager<NoTls>>, source: &str) -> Vec<Triple> {
+    let conn = pool.get().await.unwrap();
+    let rows = conn.query("SELECT s, p, o FROM latest_triples WHERE source = $1", &[&source]).await.unwrap();
+    rows.iter().map(row_to_triple).collect()
+}
+
+// reads the triples of the given sources (or of all sources) as they were at the as_of time
+async fn load_snapshot(pool: &Pool<PostgresConnectionManager<NoTls>>, sources: &[String], as_of: &str) -> Result<Vec<(String, Vec<Triple>)>, String> {
+    let conn = pool.get().await.map_err(|e| format!("Could not connect to database: {}", e))?;
+    let sources: Vec<String> = if sources.is_empty() {
+        let rows = conn.query("SELECT DISTINCT source FROM triples WHERE time <= $1::text::timestamptz", &[&as_of]).await
+                       .map_err(|e| format!("Could not list sources: {}", e))?;
+        rows.iter().map(|row| row.get::<_, &str>(0).to_owned()).collect()
+    } else {
+        sources.to_vec()
+    };
+    let mut snapshot = Vec::new();
+    for source in sources {
+        let rows = conn.query("SELECT s, p, o FROM triples_as_of($1, $2::text::timestamptz)", &[&source, &as_of]).await
+                       .map_err(|e| format!("Could not read {} as of {}: {}", source, as_of, e))?;
+        snapshot.push((source, rows.iter().map(row_to_triple).collect()));
+    }
+    Ok(snapshot)
+}
+
+// evaluates the query against a temporary store holding a snapshot of the sources. Unless reasoning is false,
+// the store also holds the triples inferred from the snapshot
+fn evaluate_snapshot_query(snapshot: Vec<(String, Vec<Triple>)>, reasoning: bool, query: &str, default_graphs: &[String], named_graphs: &[String]) -> Result<warp::http::Response<Vec<u8>>, warp::http::Error> {
+    if !reasoning {
+        let store = match SledStore::new() {
+            Ok(store) => store,
+            Err(e) => return warp::http::Response::builder()
+                .status(warp::http::StatusCode::INTERNAL_SERVER_ERROR)
+                .body(format!("Could not create store: {}", e).into_bytes()),
+        };
+        for (source, triples) in snapshot {
+            let graph = graphname_node(&source);
+            for triple in triples {
+                if let Err(e) = store.insert(&triple.in_graph(graph.clone())) {
+                    return warp::http::Response::builder()
+                        .status(warp::http::StatusCode::INTERNAL_SERVER_ERROR)
+                        .body(format!("Could not load {}: {}", source, e).into_bytes());
+                }
+            }
+        }
+        return evaluate_query(&store, "default", query, default_graphs, named_graphs);
+    }
+    let mut mgr = GraphManager::new();
+    for (source, triples) in snapshot {
+        mgr.add_triples(Some(source), triples);
+    }
+    evaluate_query(&mgr.store(), "default", query, default_graphs, named_graphs)
+}
+
 #[tokio::main]
 async fn main() -> Result<(), Error> {
     env_logger::init();
@@ -123,17 +244,8 @@ async fn main() -> Result<(), Error> {
     let ingest_futures = sources.map(|src| {
         let newp = pool.clone();
         async move {
-            let sourcename = src.clone();
-            let conn = newp.get().await.unwrap();
-            let rows = conn.query("SELECT s, p, o FROM latest_triples WHERE source = $1", &[&src]).await.unwrap();
-            let triples: Vec<Triple> = rows.iter().map(|row| {
-                let (s, p, o): (&str, &str, &str) = (row.get(0), row.get(1), row.get(2));
-                debug!("{} {} {}", s, p, o);
-                make_triple(parse_triple_term(s).unwrap(),
-                             parse_triple_term(p).unwrap(),
-                             parse_triple_term(o).unwrap()).unwrap()
-            }).collect();
-            (sourcename, triples)
+            let triples = load_source(&newp, &src).await;
+            (src, triples)
         }
     });
     let _: Vec<_> = join_all(ingest_futures).await.into_iter().map(|(sourcename, triples)| {
@@ -164,7 +276,7 @@ async fn main() -> Result<(), Error> {
 
     // TODO: graph name in the query
     let query = warp::path!("query" / String)
-            .and(warp::body::content_length_limit(1024))
+            .and(warp::body::content_length_limit(QUERY_SIZE_LIMIT))
             .and(
                 warp::body::bytes().and_then(|body: bytes::Bytes| async move {
                     std::str::from_utf8(&body)
@@ -174,92 +286,127 @@ async fn main() -> Result<(), Error> {
             )
             .and(with_db(store.clone()))
             .map(|graphname: String, query: String, store: SledStore| {
-                let sparql = format!("{}{}", qfmt, query);
-                //println!("query: {} {}", sparql, graphname);
-                let mut parsed_query = Query::parse(&sparql, None).unwrap();
-                match graphname.as_str() {
-                    "default" => parsed_query.dataset_mut().set_default_graph_as_union(),
-                    "all" => parsed_query.dataset_mut().set_default_graph_as_union(),
-                    gname => parsed_query.dataset_mut().set_default_graph(vec![graphname_node(gname)]) ,
-                };
-                println!("Querying graph {}", graphname_node(&graphname));
-                let res = store.clone().query(parsed_query).unwrap();
-                let mut resp: Vec<u8> = Vec::new();
-                if let QueryResults::Solutions(_) = res {
-                    res.write(&mut resp, QueryResultsFormat::Json).unwrap();
-                    warp::http::Response::builder()
-                        .header("content-type", "application/json")
-                        .body(resp)
-                } else {
-                    warp::http::Response::builder()
-                        .status(warp::http::StatusCode::INTERNAL_SERVER_ERROR)
-                        .body("No results".as_bytes().to_vec())
-                }
+                evaluate_query(&store, &graphname, &query, &[], &[])
             });
 
+    // SPARQL 1.1 Protocol form submission; default-graph-uri and named-graph-uri are Mortar sources
     let query2 = warp::path!("query" / String)
-            .and(warp::body::content_length_limit(1024))
+            .and(warp::body::content_length_limit(QUERY_SIZE_LIMIT))
             .and(warp::header::exact("content-type", "application/x-www-form-urlencoded"))
             .and(warp::body::form())
             .and(with_db(store.clone()))
-            .map(|graphname: String, m: HashMap<String, String>, store: SledStore| {
-                if let Some(query) = m.get("query") {
-                    let sparql = format!("{}{}", qfmt, query);
-                    //println!("query: {} {}", sparql, graphname);
-                    let mut parsed_query = Query::parse(&sparql, None).unwrap();
-                    match graphname.as_str() {
-                        "default" => parsed_query.dataset_mut().set_default_graph_as_union(),
-                        "all" => parsed_query.dataset_mut().set_default_graph_as_union(),
-                        gname => parsed_query.dataset_mut().set_default_graph(vec![graphname_node(gname)]) ,
-                    };
-                    println!("Querying graph {}", graphname_node(&graphname));
-                    let res = store.clone().query(parsed_query).unwrap();
-                    let mut resp: Vec<u8> = Vec::new();
-                    if let QueryResults::Solutions(_) = res {
-                        res.write(&mut resp, QueryResultsFormat::Json).unwrap();
-                        warp::http::Response::builder()
-                            .header("content-type", "application/json")
-                            .body(resp)
-                    } else {
-                        warp::http::Response::builder()
-                            .status(warp::http::StatusCode::INTERNAL_SERVER_ERROR)
-                            .body("No results".as_bytes().to_vec())
-
+            .map(|graphname: String, params: Vec<(String, String)>, store: SledStore| {
+                let mut query = None;
+                let mut default_graphs = Vec::new();
+                let mut named_graphs = Vec::new();
+                for (key, value) in params {
+                    match key.as_str() {
+                        "query" => query = Some(value),
+                        "default-graph-uri" => default_graphs.push(value),
+                        "named-graph-uri" => named_graphs.push(value),
+                        _ => (),
                     }
+                }
+                if let Some(query) = query {
+                    evaluate_query(&store, &graphname, &query, &default_graphs, &named_graphs)
                 } else {
                     warp::http::Response::builder()
-                        .status(warp::http::StatusCode::INTERNAL_SERVER_ERROR)
+                        .status(warp::http::StatusCode::BAD_REQUEST)
                         .body("Bad query".as_bytes().to_vec())
+                }
+            });
 
+    // time-travel queries: the same form parameters as query2, plus the RFC3339 'as_of' time (or 'infinity' for the
+    // latest triples). With reasoning=false, the query only matches the stored triples
+    let snapshot_pool = pool.clone();
+    let snapshot = warp::path!("snapshot")
+            .and(warp::body::content_length_limit(QUERY_SIZE_LIMIT))
+            .and(warp::body::form())
+            .and_then(move |params: Vec<(String, String)>| {
+                let pool = snapshot_pool.clone();
+                async move {
+                    let mut query = None;
+                    let mut as_of = None;
+                    let mut reasoning = true;
+                    let mut default_graphs = Vec::new();
+                    let mut named_graphs = Vec::new();
+                    for (key, value) in params {
+                        match key.as_str() {
+                            "query" => query = Some(value),
+                            "as_of" => as_of = Some(value),
+                            "reasoning" => reasoning = value != "false",
+                            "default-graph-uri" => default_graphs.push(value),
+                            "named-graph-uri" => named_graphs.push(value),
+                            _ => (),
+                        }
+                    }
+                    let (query, as_of) = match (query, as_of) {
+                        (Some(query), Some(as_of)) => (query, as_of),
+                        _ => {
+                            return Ok::<_, warp::Rejection>(warp::http::Response::builder()
+                                .status(warp::http::StatusCode::BAD_REQUEST)
+                                .body("Snapshot queries need 'query' and 'as_of'".as_bytes().to_vec()))
+                        }
+                    };
+                    let mut sources = default_graphs.clone();
+                    sources.extend(named_graphs.iter().cloned());
+                    let resp = match load_snapshot(&pool, &sources, &as_of).await {
+                        Ok(snapshot) => evaluate_snapshot_query(snapshot, reasoning, &query, &default_graphs, &named_graphs),
+                        Err(e) => warp::http::Response::builder()
+                            .status(warp::http::StatusCode::INTERNAL_SERVER_ERROR)
+                            .body(e.into_bytes()),
+                    };
+                    Ok::<_, warp::Rejection>(resp)
                 }
             });
 
     // TODO: accept postgres stuff as env variables
     println!("Serving on 0.0.0.0:3031");
     tokio::spawn(
-        warp::serve(query2.or(query))
+        warp::serve(query2.or(query).or(snapshot))
             .run(([0, 0, 0, 0], 3031))
     );
 
     //let mut trips: Vec<(Node, Node, Node)> = Vec::new();
     let mut trips: HashMap<String, Vec<Triple>> = HashMap::new();
+    let mut reloads: HashSet<String> = HashSet::new();
     let mut interval = time::interval(time::Duration::from_secs(10));
     loop {
         tokio::select! {
             msg = rx.next() => {
                 if let Some(x) = msg {
                     if let AsyncMessage::Notification(n) = x {
-                        let msg: TripleEvent = serde_json::from_str(n.payload()).unwrap();
-                        let source = msg.data.source.to_owned();
-                        let triple = make_triple(parse_triple_term(&msg.data.s).unwrap(),
-                                                 parse_triple_term(&msg.data.p).unwrap(),
-                                                 parse_triple_term(&msg.data.o).unwrap()).unwrap();
-                        trips.entry(source).or_insert(Vec::new())
-                             .push(triple);
+                        let event: serde_json::Value = serde_json::from_str(n.payload()).unwrap();
+                        if event["table"] == "triple_versions" {
+                            // a new version of an origin can remove triples, so the whole source is reloaded
+                            if let Some(source) = event["data"]["source"].as_str() {
+                                reloads.insert(source.to_owned());
+                            }
+                        } else {
+                            let msg: TripleEvent = serde_json::from_value(event).unwrap();
+                            let source = msg.data.source.to_owned();
+                            let triple = make_triple(parse_triple_term(&msg.data.s).unwrap(),
+                                                     parse_triple_term(&msg.data.p).unwrap(),
+                                                     parse_triple_term(&msg.data.o).unwrap()).unwrap();
+                            trips.entry(source).or_insert(Vec::new())
+                                 .push(triple);
+                        }
                     }
                 }
             },
             _ = interval.tick() => {
+                let sources: Vec<String> = reloads.drain().collect();
+                for source in sources {
+                    // the reload includes any triples that arrived since the last tick
+                    trips.remove(&source);
+                    let triples = load_source(&pool, &source).await;
+                    if let Err(e) = store.clear_graph(&graphname_node(&source)) {
+                        println!("Could not clear graph {}: {}", source, e);
+                        continue;
+                    }
+                    println!("Reloaded {} {}", source, triples.len());
+                    mgr.add_triples(Some(source), triples);
+                }
                 if trips.len() > 0 {
                     for (graphname, values) in trips.iter() {
                         mgr.add_triples(Some(graphname.clone()), values.clone());